@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/OdyseeTeam/player-server/pkg/catalog"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	catalogBlobsDir string
+	catalogOut      string
+
+	catalogCmd = &cobra.Command{
+		Use:   "catalog",
+		Short: "manage local stream catalogs for offline mode",
+	}
+	catalogBuildCmd = &cobra.Command{
+		Use:   "build",
+		Short: "build a stream catalog from a directory of blobs",
+		Run:   buildCatalog,
+	}
+)
+
+func init() {
+	catalogBuildCmd.Flags().StringVar(&catalogBlobsDir, "blobs-dir", "", "directory containing sd and content blobs")
+	catalogBuildCmd.Flags().StringVar(&catalogOut, "out", "catalog.json", "catalog file to write, existing entries in it are preserved")
+	catalogBuildCmd.MarkFlagRequired("blobs-dir")
+
+	catalogCmd.AddCommand(catalogBuildCmd)
+	rootCmd.AddCommand(catalogCmd)
+}
+
+func buildCatalog(cmd *cobra.Command, args []string) {
+	initLogger()
+
+	built, err := catalog.Build(catalogBlobsDir)
+	if err != nil {
+		Logger.Fatal(err)
+	}
+
+	var existing []catalog.Entry
+	if _, err := os.Stat(catalogOut); err == nil {
+		existing, err = catalog.ReadEntries(catalogOut)
+		if err != nil {
+			Logger.Fatal(err)
+		}
+	}
+
+	entries := catalog.Merge(existing, built)
+	if err := catalog.Write(catalogOut, entries); err != nil {
+		Logger.Fatal(err)
+	}
+	Logger.Infof("found %v streams, %v new, catalog written to %v", len(built), len(entries)-len(existing), catalogOut)
+}
@@ -2,17 +2,29 @@ package cmd
 
 import (
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"time"
 
+	"github.com/OdyseeTeam/player-server/firewall"
 	"github.com/OdyseeTeam/player-server/internal/config"
+	"github.com/OdyseeTeam/player-server/internal/iapi"
 	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/internal/reload"
 	"github.com/OdyseeTeam/player-server/internal/version"
+	"github.com/OdyseeTeam/player-server/pkg/admission"
 	"github.com/OdyseeTeam/player-server/pkg/app"
+	"github.com/OdyseeTeam/player-server/pkg/audit"
+	"github.com/OdyseeTeam/player-server/pkg/catalog"
+	"github.com/OdyseeTeam/player-server/pkg/clientip"
+	"github.com/OdyseeTeam/player-server/pkg/edgetoken"
+	"github.com/OdyseeTeam/player-server/pkg/geo"
+	"github.com/OdyseeTeam/player-server/pkg/health"
+	"github.com/OdyseeTeam/player-server/pkg/hlssession"
 	"github.com/OdyseeTeam/player-server/pkg/logger"
 	"github.com/OdyseeTeam/player-server/pkg/paid"
+	"github.com/OdyseeTeam/player-server/pkg/quota"
+	"github.com/OdyseeTeam/player-server/pkg/signedurl"
+	"github.com/OdyseeTeam/player-server/pkg/transcode"
 	"github.com/OdyseeTeam/player-server/player"
 	"github.com/lbryio/reflector.go/server/http3"
 
@@ -22,6 +34,7 @@ import (
 	"github.com/lbryio/reflector.go/store"
 
 	"github.com/c2h5oh/datasize"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -37,6 +50,12 @@ var (
 	lbrynetAddress string
 	paidPubKey     string
 
+	paidPubKeyCache   string
+	paidPubKeyRefresh time.Duration
+
+	nativeEntitlements bool
+	rentalStatePath    string
+
 	upstreamReflector  string
 	upstreamProtocol   string
 	cloudFrontEndpoint string
@@ -48,8 +67,54 @@ var (
 	transcoderVideoSize    string
 	transcoderAddr         string
 	transcoderRemoteServer string
-
-	edgeToken string
+	transcoderRestoreGate  bool
+	hlsSignatureTTL        time.Duration
+	hlsPrefetchSegments    int
+	hlsAccessTTL           time.Duration
+
+	readinessTimeout      time.Duration
+	readinessCacheTTL     time.Duration
+	readinessMinFreeSpace string
+	shutdownDrain         time.Duration
+
+	edgeToken      string
+	edgeTokensPath string
+
+	catalogPath string
+
+	blocklistURL        string
+	blocklistSnapshot   string
+	blocklistInterval   time.Duration
+	blocklistMaxAge     time.Duration
+	blocklistFailClosed bool
+
+	admissionPolicyPath string
+	geoCountryDBPath    string
+	geoPolicyPath       string
+	urlSigningKeysPath  string
+	rateLimitsPath      string
+	patternsPath        string
+	blacklistPath       string
+	escalationPath      string
+	asnDBPath           string
+	asnUpdateInterval   time.Duration
+	maxmindLicenseKey   string
+	clientIPConfigPath  string
+	directClients       bool
+	downloadQuotas      bool
+	downloadQuotaPolicy string
+	downloadQuotaState  string
+
+	transcodeOnDemand        bool
+	transcodeThreshold       int
+	transcodeThresholdWindow time.Duration
+
+	auditLogPath       string
+	auditLogMaxSize    string
+	auditLogBackups    int
+	auditWebhookURL    string
+	auditWebhookToken  string
+	auditFlushInterval time.Duration
 
 	rootCmd = &cobra.Command{
 		Use:     "odysee_player",
@@ -63,6 +128,13 @@ func init() {
 	rootCmd.Flags().StringVar(&bindAddress, "bind", "0.0.0.0:8080", "address to bind HTTP server to")
 	rootCmd.Flags().StringVar(&lbrynetAddress, "lbrynet", "https://api.na-backend.odysee.com/api/v1/proxy", "lbrynet server URL")
 	rootCmd.Flags().StringVar(&paidPubKey, "paid_pubkey", "https://api.na-backend.odysee.com/api/v1/paid/pubkey", "pubkey for playing paid content")
+	rootCmd.Flags().StringVar(&paidPubKeyCache, "paid-pubkey-cache", "", "file to keep the last good paid content pubkey set in, used when the pubkey URL is unavailable at startup")
+	rootCmd.Flags().DurationVar(&paid.TokenExpiry.PerUnit, "paid-token-expiry-per-unit", paid.TokenExpiry.PerUnit, "lifetime of paid tokens created with the default expiry policy for every started paid-token-expiry-unit of the stream size")
+	rootCmd.Flags().Uint64Var(&paid.TokenExpiry.Unit, "paid-token-expiry-unit", paid.TokenExpiry.Unit, "stream size in bytes paid tokens are given paid-token-expiry-per-unit of validity for")
+	rootCmd.Flags().DurationVar(&paid.ActiveStreamWindow, "paid-stream-window", paid.ActiveStreamWindow, "how long a client counts towards the concurrent stream limit of a paid token after its last request")
+	rootCmd.Flags().BoolVar(&nativeEntitlements, "native-entitlements", false, "verify rental and purchase entitlement tokens for paid content requested without an edge token")
+	rootCmd.Flags().StringVar(&rentalStatePath, "rental-state", "", "file to persist rental first play times in, can be shared between nodes (kept in memory if not set)")
+	rootCmd.Flags().DurationVar(&paidPubKeyRefresh, "paid-pubkey-refresh", 15*time.Minute, "how often to refresh paid content pubkeys (0 to disable)")
 
 	rootCmd.Flags().UintVar(&player.StreamWriteTimeout, "http-stream-write-timeout", player.StreamWriteTimeout, "write timeout for stream http requests (seconds)")
 	rootCmd.Flags().UintVar(&app.WriteTimeout, "http-write-timeout", app.WriteTimeout, "write timeout for http requests (seconds)")
@@ -84,6 +156,10 @@ func init() {
 	rootCmd.Flags().StringVar(&transcoderVideoSize, "transcoder-video-size", "200GB", "max size of transcoder video storage")
 	rootCmd.Flags().StringVar(&transcoderAddr, "transcoder-addr", "", "transcoder API address")
 	rootCmd.Flags().StringVar(&transcoderRemoteServer, "transcoder-remote-server", "", "remote transcoder storage server URL")
+	rootCmd.Flags().BoolVar(&transcoderRestoreGate, "transcoder-restore-gate", false, "report the player as not ready on /readyz until transcoded videos in --transcoder-video-path are indexed")
+	rootCmd.Flags().IntVar(&hlsPrefetchSegments, "hls-prefetch-segments", hlssession.DefaultOpts().Lookahead, "number of segments following a requested one to retrieve from the transcoder ahead of time (0 to disable)")
+	rootCmd.Flags().DurationVar(&hlsAccessTTL, "hls-access-ttl", hlssession.DefaultOpts().DecisionTTL, "how long access checks passed by a viewer of a transcoded stream are carried over to their next fragment requests")
+	rootCmd.Flags().DurationVar(&hlsSignatureTTL, "hls-signature-ttl", player.DefaultHLSSignatureTTL, "how long playlist and segment urls of transcoded streams signed with --url-signing-keys are valid for")
 
 	rootCmd.Flags().UintVar(&player.PrefetchCount, "prefetch-count", player.DefaultPrefetchLen, "how many blobs to retrieve from origin in advance")
 
@@ -92,24 +168,108 @@ func init() {
 	rootCmd.Flags().Float64Var(&player.ThrottleScale, "throttle-scale", 1.5, "Throttle scale to rate limit in MB/s, only the 1.2 in 1.2MB/s")
 	rootCmd.Flags().BoolVar(&player.ThrottleSwitch, "throttle-enabled", true, "Enables throttling")
 
-	rootCmd.Flags().StringVar(&edgeToken, "edge-token", "", "Edge token for delivering purchased/rented streams")
+	rootCmd.Flags().StringVar(&edgeToken, "edge-token", "", "Edge token for delivering purchased/rented streams and fetching blobs from upstream, valid for all scopes (deprecated, use --edge-tokens)")
+	rootCmd.Flags().StringVar(&edgeTokensPath, "edge-tokens", "", "JSON file with named and scoped edge tokens, reloaded via the config endpoint")
+
+	rootCmd.Flags().StringVar(&admissionPolicyPath, "admission-policy", "", "JSON file with referrer/origin/user agent admission rules, reloaded on change (built-in rules are used if not set)")
+	rootCmd.Flags().StringVar(&urlSigningKeysPath, "url-signing-keys", "", "JSON keyring for verifying signed playback urls, reloaded on change")
+	rootCmd.Flags().StringVar(&geoCountryDBPath, "geoip-country-db", "", "MaxMind country database (GeoLite2-Country.mmdb) for geo restrictions, restrictions are disabled if not set")
+	rootCmd.Flags().StringVar(&geoPolicyPath, "geo-policy", "", "JSON file with per-claim and per-channel country rules, reloaded on change")
+	rootCmd.Flags().StringVar(&blocklistURL, "blocklist-url", iapi.DefaultBlocklistURL, "URL of the blocked content list")
+	rootCmd.Flags().StringVar(&blocklistSnapshot, "blocklist-snapshot", "", "file to keep the last synced blocked content list in, used at startup until the list is synced")
+	rootCmd.Flags().DurationVar(&blocklistInterval, "blocklist-interval", 2*time.Minute, "how often to sync the blocked content list")
+	rootCmd.Flags().DurationVar(&blocklistMaxAge, "blocklist-max-age", 0, "consider the blocked content list unavailable when it could not be synced for this long (0 to always use the last synced list)")
+	rootCmd.Flags().BoolVar(&blocklistFailClosed, "blocklist-fail-closed", false, "block all content while the blocked content list is unavailable instead of serving it")
+	rootCmd.Flags().StringVar(&blacklistPath, "blacklist", "blacklist.json", "file IP and ASN bans are loaded from and saved to")
+	rootCmd.Flags().BoolVar(&downloadQuotas, "download-quotas", false, "enforce daily download quotas per client IP and account")
+	rootCmd.Flags().StringVar(&downloadQuotaPolicy, "download-quota-policy", "", "JSON file with download quotas and per-claim and per-channel overrides, reloaded on change")
+	rootCmd.Flags().StringVar(&downloadQuotaState, "download-quota-state", "", "file to persist daily download usage in, so restarts don't reset quotas")
+	rootCmd.Flags().StringVar(&clientIPConfigPath, "client-ip-config", "", "JSON file with CDN providers and trusted proxies allowed to pass the client IP, reloaded on change (see client_ip.example.json)")
+	rootCmd.Flags().BoolVar(&directClients, "direct-clients", false, "take client IPs from connection addresses, for players clients connect to directly (required if --client-ip-config is not set)")
+	rootCmd.Flags().StringVar(&asnDBPath, "geoip-asn-db", "", "MaxMind ASN database (GeoLite2-ASN.mmdb) for ASN bans, reloaded on change (ASN bans are disabled if not set)")
+	rootCmd.Flags().DurationVar(&asnUpdateInterval, "geoip-asn-update-interval", 0, "how often to download a fresh ASN database from MaxMind into --geoip-asn-db (0 disables updates)")
+	rootCmd.Flags().StringVar(&maxmindLicenseKey, "maxmind-license-key", "", "MaxMind license key for ASN database updates (MAXMIND_KEY is used if not set)")
+	rootCmd.Flags().StringVar(&escalationPath, "escalation-policy", "", "JSON file with abuse signal weights and ban durations for automatic temporary bans (built-in defaults are used in dry run mode if not set)")
+	rootCmd.Flags().StringVar(&patternsPath, "patterns", "", "JSON file with url path, claim name, channel name and sd hash block rules, reloaded on change and saved to on changes made through the config API")
+	rootCmd.Flags().StringVar(&rateLimitsPath, "rate-limits", "", "JSON file with per-client rate limits and exemptions, reloaded on change (built-in defaults are used if not set)")
+	rootCmd.Flags().BoolVar(&transcodeOnDemand, "transcode-on-demand", false, "ask the transcoder for renditions of popular streams that have none")
+	rootCmd.Flags().IntVar(&transcodeThreshold, "transcode-threshold", transcode.DefaultPolicy().Threshold, "number of original plays within --transcode-threshold-window that triggers transcoding")
+	rootCmd.Flags().DurationVar(&transcodeThresholdWindow, "transcode-threshold-window", transcode.DefaultPolicy().Window, "window original plays are counted in for on-demand transcoding")
+	rootCmd.Flags().StringVar(&auditLogPath, "audit-log", "", "JSONL file to record denied requests in")
+	rootCmd.Flags().StringVar(&auditLogMaxSize, "audit-log-max-size", "100MB", "size at which the audit log is rotated")
+	rootCmd.Flags().IntVar(&auditLogBackups, "audit-log-backups", 5, "number of rotated audit logs to keep")
+	rootCmd.Flags().StringVar(&auditWebhookURL, "audit-webhook", "", "URL to post batches of denied request events to")
+	rootCmd.Flags().StringVar(&auditWebhookToken, "audit-webhook-token", os.Getenv("AUDIT_WEBHOOK_TOKEN"), "bearer token for the audit webhook")
+	rootCmd.Flags().DurationVar(&auditFlushInterval, "audit-flush-interval", 5*time.Second, "how long denied request events are batched before being written")
+	rootCmd.Flags().StringVar(&catalogPath, "catalog", "", "serve streams from a local catalog file or directory instead of resolving them via lbrynet")
+	rootCmd.Flags().DurationVar(&readinessTimeout, "readiness-timeout", health.DefaultOpts().Timeout, "how long each /readyz dependency check may take before it's considered failing")
+	rootCmd.Flags().DurationVar(&readinessCacheTTL, "readiness-cache-ttl", health.DefaultOpts().CacheTTL, "how long /readyz dependency check results are reused for")
+	rootCmd.Flags().StringVar(&readinessMinFreeSpace, "readiness-min-free-space", "1GB", "free disk space required in cache paths for the player to report itself ready")
+	rootCmd.Flags().DurationVar(&shutdownDrain, "shutdown-drain", 0, "how long the player reports itself not ready on /readyz after a shutdown signal before it stops accepting requests")
 }
 
 func run(cmd *cobra.Command, args []string) {
 	initLogger()
 	defer logger.Flush()
 
-	initPubkey()
+	if catalogPath == "" {
+		initPubkey()
+		defer paid.FirstPlays.Shutdown()
+	}
 
-	blobSource := getBlobSource()
+	readiness := initReadiness()
+	blobSource := getBlobSource(readiness)
+	if catalogPath == "" {
+		initBlocklist()
+	}
+	edgeTokens := initEdgeTokens()
+	initRateLimits()
+	initBans()
+	initASNDatabase()
+	initPatterns()
+	if l := initAuditLog(); l != nil {
+		defer l.Shutdown()
+	}
 
-	p := player.NewPlayer(
-		initHotCache(blobSource),
+	playerOpts := []func(*player.PlayerOptions){
+		player.WithAdmissionGate(initAdmissionGate()),
 		player.WithLbrynetServer(lbrynetAddress),
 		player.WithDownloads(allowDownloads),
 		player.WithPrefetch(enablePrefetch),
-		player.WithEdgeToken(edgeToken),
-	)
+		player.WithEdgeTokens(edgeTokens),
+		player.WithEntitlements(nativeEntitlements),
+	}
+	if catalogPath != "" {
+		playerOpts = append(playerOpts, player.WithCatalog(initCatalog()))
+	}
+	if geoCountryDBPath != "" {
+		r, err := geo.NewRestrictor(geoCountryDBPath, geoPolicyPath)
+		if err != nil {
+			Logger.Fatal(err)
+		}
+		r.Watch(reload.DefaultInterval)
+		playerOpts = append(playerOpts, player.WithGeoRestrictor(r))
+	}
+	if q := initDownloadQuota(); q != nil {
+		defer q.Shutdown()
+		playerOpts = append(playerOpts, player.WithDownloadQuota(q))
+	}
+	if t := initTranscodeTrigger(); t != nil {
+		defer t.Shutdown()
+		playerOpts = append(playerOpts, player.WithTranscodeTrigger(t))
+	}
+	if urlSigningKeysPath != "" {
+		k, err := signedurl.LoadKeyring(urlSigningKeysPath)
+		if err != nil {
+			Logger.Fatal(err)
+		}
+		k.Watch(reload.DefaultInterval)
+		playerOpts = append(playerOpts, player.WithURLSigner(k), player.WithHLSSignatureTTL(hlsSignatureTTL))
+	}
+	p := player.NewPlayer(initHotCache(blobSource, readiness), playerOpts...)
+	if catalogPath == "" {
+		readiness.Add(health.Check{Name: "resolver", Run: p.CheckResolver})
+	}
 
 	var tcsize datasize.ByteSize
 	err := tcsize.UnmarshalText([]byte(transcoderVideoSize))
@@ -134,20 +294,30 @@ func run(cmd *cobra.Command, args []string) {
 			tCfg = tCfg.RemoteServer(transcoderRemoteServer)
 		}
 		c := tclient.New(tCfg)
-		//TODO: this can probably be in a separate go routine so that startup isn't blocked
-		n, err := c.RestoreCache()
-		if err != nil {
-			Logger.Error(err)
-		} else {
-			Logger.Infof("restored %v items into transcoder cache", n)
-		}
-
 		p.AddTranscoderClient(&c, transcoderVideoPath)
+		p.RestoreTranscoderCache(restoredTranscoderItems)
+		// The player falls back to original streams without the transcoder, so it's only required to be ready with the restore gate.
+		readiness.Add(
+			health.Check{Name: "transcoder", Run: health.HTTP(nil, transcoderAddr), Optional: true},
+			health.Check{Name: "transcoder_cache", Run: p.CheckTranscoderCache, Optional: !transcoderRestoreGate},
+			health.Check{Name: "transcoder_disk", Run: health.DiskSpace(transcoderVideoPath, minFreeSpace()), Optional: true},
+		)
+		s := initHLSSessions(&c)
+		defer s.Shutdown()
+		p.AddHLSSessions(s)
 	}
 
-	a := app.New(app.Opts{Address: bindAddress, BlobStore: blobSource, EdgeToken: edgeToken})
+	a := app.New(app.Opts{
+		Address:     bindAddress,
+		BlobStore:   blobSource,
+		EdgeTokens:  edgeTokens,
+		ClientIP:    initClientIP(),
+		Health:      readiness,
+		DrainPeriod: shutdownDrain,
+	})
 
 	metrics.InstallRoute(a.Router)
+	health.InstallRoutes(a.Router, readiness)
 	player.InstallPlayerRoutes(a.Router, p)
 	config.InstallConfigRoute(a.Router)
 	if enableProfile {
@@ -158,7 +328,7 @@ func run(cmd *cobra.Command, args []string) {
 	a.ServeUntilShutdown()
 }
 
-func initHotCache(origin store.BlobStore) *player.HotCache {
+func initHotCache(origin store.BlobStore, readiness *health.Checker) *player.HotCache {
 	var hotCacheBytes datasize.ByteSize
 	err := hotCacheBytes.UnmarshalText([]byte(hotCacheSize))
 	if err != nil {
@@ -170,10 +340,14 @@ func initHotCache(origin store.BlobStore) *player.HotCache {
 
 	metrics.PlayerCacheInfo(hotCacheBytes.Bytes())
 	unencryptedCache := player.NewDecryptedCache(origin)
+	readiness.Add(
+		health.Check{Name: "decrypted_cache_index", Run: unencryptedCache.CheckIndex},
+		health.Check{Name: "decrypted_cache_disk", Run: health.DiskSpace(unencryptedCache.Path(), minFreeSpace())},
+	)
 	return player.NewHotCache(*unencryptedCache, int64(hotCacheBytes.Bytes()))
 }
 
-func getBlobSource() store.BlobStore {
+func getBlobSource(readiness *health.Checker) store.BlobStore {
 	var blobSource store.BlobStore
 
 	if upstreamReflector != "" {
@@ -196,9 +370,13 @@ func getBlobSource() store.BlobStore {
 
 	} else if cloudFrontEndpoint != "" {
 		blobSource = store.NewCloudFrontROStore(cloudFrontEndpoint)
+	} else if catalogPath != "" && diskCacheDir != "" {
+		// Offline mode: all blobs are expected to be present in the disk cache already.
+		return store.NewDiskStore(diskCacheDir, 2)
 	} else {
-		Logger.Fatal("one of [--upstream-reflector|--cloudfront-endpoint] is required")
+		Logger.Fatal("one of [--upstream-reflector|--cloudfront-endpoint] is required, or --disk-cache-dir with --catalog")
 	}
+	readiness.Add(health.Check{Name: "blob_origin", Run: health.BlobStore(blobSource)})
 
 	diskCacheMaxSize, diskCachePath := diskCacheParams() //TODO: use reflector code instead of code duplication
 	//we are tracking blobs in memory with a 1 byte long boolean, which means that for each 2MB (a blob) we need 1Byte
@@ -209,6 +387,7 @@ func getBlobSource() store.BlobStore {
 		if err != nil {
 			Logger.Fatal(err)
 		}
+		readiness.Add(health.Check{Name: "blob_cache_disk", Run: health.DiskSpace(diskCachePath, minFreeSpace())})
 		blobSource = store.NewCachingStore(
 			"player",
 			blobSource,
@@ -253,20 +432,239 @@ func initLogger() {
 	logger.ConfigureSentry(version.Version(), logger.EnvProd)
 }
 
-func initPubkey() {
-	l := Logger
+func initCatalog() *catalog.Catalog {
+	c, err := catalog.Load(catalogPath)
+	if err != nil {
+		Logger.Fatal(err)
+	}
+	c.Watch(reload.DefaultInterval)
+	return c
+}
 
-	r, err := http.Get(paidPubKey)
+func initAdmissionGate() *admission.Gate {
+	g, err := admission.NewGate(admissionPolicyPath)
 	if err != nil {
-		l.Fatal(err)
+		Logger.Fatal(err)
 	}
-	rawKey, err := io.ReadAll(r.Body)
+	g.Watch(reload.DefaultInterval)
+	return g
+}
+
+func initBlocklist() {
+	policy := iapi.FailOpen
+	if blocklistFailClosed {
+		policy = iapi.FailClosed
+	}
+	iapi.InitBlocklist(iapi.BlocklistOpts{
+		URL:          blocklistURL,
+		SnapshotPath: blocklistSnapshot,
+		Interval:     blocklistInterval,
+		MaxAge:       blocklistMaxAge,
+		FailPolicy:   policy,
+	})
+}
+
+func initDownloadQuota() *quota.Quota {
+	if !downloadQuotas {
+		return nil
+	}
+	q, err := quota.New(quota.Opts{PolicyPath: downloadQuotaPolicy, StatePath: downloadQuotaState})
 	if err != nil {
-		l.Fatal(err)
+		Logger.Fatal(err)
 	}
-	err = paid.InitPubKey(rawKey)
+	q.Start()
+	return q
+}
+
+func initClientIP() *clientip.Resolver {
+	if clientIPConfigPath == "" {
+		// Client IP headers used to be honored from anyone, silently switching to connection addresses
+		// would make players behind a CDN ban and limit the CDN instead of its clients.
+		if !directClients {
+			Logger.Fatal("--client-ip-config is required unless the player is reached by clients directly, in which case set --direct-clients")
+		}
+		Logger.Info("client IPs are taken from connection addresses")
+		return nil
+	}
+	r, err := clientip.LoadResolver(clientIPConfigPath)
 	if err != nil {
-		l.Fatal(err)
+		Logger.Fatal(err)
+	}
+	r.Watch(reload.DefaultInterval)
+	firewall.Escalations.SetExempt(r.Trusted)
+	return r
+}
+
+func initASNDatabase() {
+	if asnDBPath == "" {
+		if n := firewall.ASNBanCount(); n > 0 {
+			Logger.Errorf("no ASN database configured, %v ASN bans are not enforced", n)
+		} else {
+			Logger.Warn("no ASN database configured, ASN bans are disabled")
+		}
+		return
+	}
+	if asnUpdateInterval > 0 {
+		key := maxmindLicenseKey
+		if key == "" {
+			key = os.Getenv("MAXMIND_KEY")
+		}
+		u := firewall.NewASNUpdater(asnDBPath, key, asnUpdateInterval)
+		if _, err := os.Stat(asnDBPath); os.IsNotExist(err) {
+			if err := u.Update(); err != nil {
+				Logger.Fatal(err)
+			}
+		}
+		u.Start()
+	}
+	if err := firewall.LoadASNDatabase(asnDBPath); err != nil {
+		Logger.Fatal(err)
+	}
+	firewall.WatchASNDatabase(asnDBPath, reload.DefaultInterval)
+}
+
+func initBans() {
+	if blacklistPath != firewall.BlacklistPath {
+		firewall.BlacklistPath = blacklistPath
+		firewall.ReloadBlacklist()
+	}
+	firewall.StartBanExpiry(time.Minute)
+	if escalationPath != "" {
+		p, err := firewall.LoadEscalationPolicy(escalationPath)
+		if err != nil {
+			Logger.Fatal(err)
+		}
+		firewall.Escalations.SetPolicy(p)
+	}
+}
+
+func initPatterns() {
+	if patternsPath == "" {
+		return
+	}
+	if err := firewall.ConfigurePatterns(patternsPath); err != nil {
+		Logger.Fatal(err)
+	}
+	firewall.WatchPatterns(reload.DefaultInterval)
+}
+
+func initTranscodeTrigger() *transcode.Trigger {
+	if !transcodeOnDemand {
+		return nil
+	}
+	if transcoderAddr == "" {
+		Logger.Fatal("--transcode-on-demand needs --transcoder-addr")
+	}
+	p := transcode.DefaultPolicy()
+	p.Threshold = transcodeThreshold
+	p.Window = transcodeThresholdWindow
+	t := transcode.NewTrigger(transcode.NewTowerSubmitter(transcoderAddr), p)
+	t.Start()
+	return t
+}
+
+// restoredTranscoderItems returns the number of items in the transcoder cache, which is filled during the restore.
+func restoredTranscoderItems() int64 {
+	var m dto.Metric
+	if err := tclient.TranscodedCacheItemsCount.Write(&m); err != nil {
+		return 0
+	}
+	return int64(m.GetGauge().GetValue())
+}
+
+// initReadiness sets up the checker behind /readyz, dependency checks are added as they're initialized.
+func initReadiness() *health.Checker {
+	c := health.New(health.Opts{Timeout: readinessTimeout, CacheTTL: readinessCacheTTL})
+	config.Health = c
+	return c
+}
+
+func minFreeSpace() uint64 {
+	var size datasize.ByteSize
+	err := size.UnmarshalText([]byte(readinessMinFreeSpace))
+	if err != nil {
+		Logger.Fatal(err)
+	}
+	return size.Bytes()
+}
+
+func initHLSSessions(tc hlssession.Transcoder) *hlssession.Cache {
+	opts := hlssession.DefaultOpts()
+	opts.Lookahead = hlsPrefetchSegments
+	opts.DecisionTTL = hlsAccessTTL
+	s := hlssession.New(tc, opts)
+	s.Start()
+	return s
+}
+
+func initAuditLog() *audit.Log {
+	var sinks []audit.Sink
+	if auditLogPath != "" {
+		var maxSize datasize.ByteSize
+		if err := maxSize.UnmarshalText([]byte(auditLogMaxSize)); err != nil {
+			Logger.Fatal(err)
+		}
+		s, err := audit.NewFileSink(auditLogPath, int64(maxSize), auditLogBackups)
+		if err != nil {
+			Logger.Fatal(err)
+		}
+		sinks = append(sinks, s)
+	}
+	if auditWebhookURL != "" {
+		sinks = append(sinks, audit.NewWebhookSink(auditWebhookURL, auditWebhookToken))
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+	opts := audit.DefaultOpts()
+	opts.FlushInterval = auditFlushInterval
+	opts.ASNLookup = firewall.GetProviderForIP
+	audit.Default = audit.New(opts, sinks...)
+	return audit.Default
+}
+
+func initRateLimits() {
+	if rateLimitsPath == "" {
+		return
+	}
+	if err := firewall.ConfigureLimits(rateLimitsPath); err != nil {
+		Logger.Fatal(err)
+	}
+	reload.Watch(rateLimitsPath, reload.DefaultInterval, func() {
+		if err := firewall.ReloadLimits(); err != nil {
+			Logger.Errorf("failed to reload rate limits: %v", err)
+		}
+	})
+}
+
+func initEdgeTokens() *edgetoken.Set {
+	var extra []edgetoken.Token
+	if edgeToken != "" {
+		extra = append(extra, edgetoken.Legacy(edgeToken))
+	}
+	tokens, err := edgetoken.Load(edgeTokensPath, extra...)
+	if err != nil {
+		Logger.Fatal(err)
+	}
+	config.EdgeTokens = tokens
+	return tokens
+}
+
+func initPubkey() {
+	r := paid.NewPubKeyRefresher(paidPubKey, paidPubKeyCache)
+	if err := r.Load(); err != nil {
+		Logger.Fatal(err)
+	}
+	if paidPubKeyRefresh > 0 {
+		r.Start(paidPubKeyRefresh)
+	}
+	if rentalStatePath != "" {
+		s, err := paid.LoadFirstPlayStore(rentalStatePath)
+		if err != nil {
+			Logger.Fatal(err)
+		}
+		s.Start(paid.FirstPlayFlushInterval)
+		paid.FirstPlays = s
 	}
 }
 
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/pkg/signedurl"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	signKeysPath string
+	signClaimID  string
+	signSdHash   string
+	signClientIP string
+	signOps      []string
+	signTTL      time.Duration
+
+	reStreamIDs = regexp.MustCompile(`/([0-9a-f]{40})/([0-9a-f]{96})`)
+
+	signURLCmd = &cobra.Command{
+		Use:   "sign-url [url]",
+		Short: "sign a playback url so it can be played without passing admission checks",
+		Args:  cobra.ExactArgs(1),
+		Run:   signURL,
+	}
+)
+
+func init() {
+	signURLCmd.Flags().StringVar(&signKeysPath, "keys", "", "url signing keyring file")
+	signURLCmd.Flags().StringVar(&signClaimID, "claim-id", "", "claim ID, detected from the url if omitted")
+	signURLCmd.Flags().StringVar(&signSdHash, "sd-hash", "", "sd hash, detected from the url if omitted")
+	signURLCmd.Flags().StringVar(&signClientIP, "client-ip", "", "bind the url to a client IP or network prefix (1.2.3.0/24)")
+	signURLCmd.Flags().StringSliceVar(&signOps, "ops", nil, "operations allowed by the url (download, hls)")
+	signURLCmd.Flags().DurationVar(&signTTL, "ttl", time.Hour, "how long the url stays valid")
+	signURLCmd.MarkFlagRequired("keys")
+
+	rootCmd.AddCommand(signURLCmd)
+}
+
+func signURL(cmd *cobra.Command, args []string) {
+	k, err := signedurl.LoadKeyring(signKeysPath)
+	if err != nil {
+		Logger.Fatal(err)
+	}
+
+	u, err := url.Parse(args[0])
+	if err != nil {
+		Logger.Fatal(err)
+	}
+	if m := reStreamIDs.FindStringSubmatch(u.Path); m != nil {
+		if signClaimID == "" {
+			signClaimID = m[1]
+		}
+		if signSdHash == "" {
+			signSdHash = m[2]
+		}
+	}
+	if signClaimID == "" || signSdHash == "" {
+		Logger.Fatal("cannot detect claim ID and sd hash from the url, supply --claim-id and --sd-hash")
+	}
+
+	signed, err := k.SignURL(args[0], signedurl.Params{
+		ClaimID:    signClaimID,
+		SdHash:     strings.TrimSuffix(signSdHash, ".mp4"),
+		Expires:    time.Now().Add(signTTL),
+		ClientIP:   signClientIP,
+		Operations: signOps,
+	})
+	if err != nil {
+		Logger.Fatal(err)
+	}
+	fmt.Println(signed)
+}
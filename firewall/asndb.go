@@ -0,0 +1,195 @@
+package firewall
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/atomicfile"
+	"github.com/OdyseeTeam/player-server/internal/mmdb"
+	"github.com/OdyseeTeam/player-server/internal/reload"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ErrNoASNDatabase is returned by ASN lookups when no database is loaded.
+var ErrNoASNDatabase = errors.Base("ASN database is not loaded")
+
+// DefaultASNDatabaseURL is the MaxMind download endpoint for the GeoLite2 ASN database.
+const DefaultASNDatabaseURL = "https://download.maxmind.com/app/geoip_download?edition_id=GeoLite2-ASN&suffix=tar.gz"
+
+// providerDB is read into memory, so a replaced reader never has to be closed under in-flight lookups.
+var providerDB atomic.Pointer[maxminddb.Reader]
+
+// GetProviderForIP returns the organization and number of the ASN ip belongs to.
+func GetProviderForIP(ipStr string) (string, int, error) {
+	db := providerDB.Load()
+	if db == nil {
+		return "", 0, ErrNoASNDatabase
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return "", 0, errors.Err("invalid ip %q", ipStr)
+	}
+	var ASN struct {
+		AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+		AutonomousSystemNumber       int    `maxminddb:"autonomous_system_number"`
+	}
+
+	err := db.Lookup(ip, &ASN)
+	if err != nil {
+		return "", 0, errors.Err(err)
+	}
+	return ASN.AutonomousSystemOrganization, ASN.AutonomousSystemNumber, nil
+}
+
+// LoadASNDatabase validates the ASN database at path and makes it active.
+// The active database is kept if validation fails.
+func LoadASNDatabase(path string) error {
+	db, err := mmdb.Open(path, "ASN")
+	if err != nil {
+		return err
+	}
+	providerDB.Store(db)
+	Logger.Infof("loaded ASN database %v built at %v", path, time.Unix(int64(db.Metadata.BuildEpoch), 0).UTC())
+	return nil
+}
+
+// UnloadASNDatabase disables ASN lookups.
+func UnloadASNDatabase() {
+	providerDB.Store(nil)
+}
+
+// WatchASNDatabase reloads the database at path whenever the file changes.
+func WatchASNDatabase(path string, interval time.Duration) *stop.Group {
+	return reload.Watch(path, interval, func() {
+		if err := LoadASNDatabase(path); err != nil {
+			Logger.Errorf("failed to reload ASN database: %v", err)
+		}
+	})
+}
+
+// ASNUpdater periodically downloads the ASN database from MaxMind and replaces the file at Path.
+type ASNUpdater struct {
+	Path       string
+	LicenseKey string
+	// URL defaults to DefaultASNDatabaseURL, the license key is added to it.
+	URL      string
+	Interval time.Duration
+	Client   *http.Client
+
+	grp *stop.Group
+}
+
+// NewASNUpdater creates an updater for the database at path.
+func NewASNUpdater(path, licenseKey string, interval time.Duration) *ASNUpdater {
+	return &ASNUpdater{
+		Path:       path,
+		LicenseKey: licenseKey,
+		URL:        DefaultASNDatabaseURL,
+		Interval:   interval,
+		Client:     &http.Client{Timeout: 5 * time.Minute},
+		grp:        stop.New(),
+	}
+}
+
+// Update downloads the database, validates it and atomically replaces the file at Path.
+// The new database is not loaded, that is left to WatchASNDatabase or LoadASNDatabase.
+func (u *ASNUpdater) Update() error {
+	if u.LicenseKey == "" {
+		return errors.Err("MaxMind license key is not set")
+	}
+	src, err := url.Parse(u.URL)
+	if err != nil {
+		return errors.Err(err)
+	}
+	q := src.Query()
+	q.Set("license_key", u.LicenseKey)
+	src.RawQuery = q.Encode()
+
+	res, err := u.Client.Get(src.String())
+	if err != nil {
+		// The URL in the error would include the license key.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return errors.Err("cannot download ASN database: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Err("cannot download ASN database: unexpected status code %d", res.StatusCode)
+	}
+
+	err = atomicfile.Write(u.Path, func(f *os.File) error {
+		if err := extractGeoIPDB(res.Body, ".mmdb", f); err != nil {
+			return err
+		}
+		// Only a database that can be opened replaces the current one.
+		_, err := mmdb.Open(f.Name(), "ASN")
+		return err
+	})
+	if err != nil {
+		return errors.Err(err)
+	}
+	Logger.Infof("updated ASN database %v", u.Path)
+	return nil
+}
+
+// Start runs Update every Interval until Shutdown is called.
+func (u *ASNUpdater) Start() {
+	u.grp.Add(1)
+	go func() {
+		defer u.grp.Done()
+		t := time.NewTicker(u.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-u.grp.Ch():
+				return
+			case <-t.C:
+				if err := u.Update(); err != nil {
+					Logger.Errorf("ASN database update failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops background updates.
+func (u *ASNUpdater) Shutdown() {
+	u.grp.StopAndWait()
+}
+
+// extractGeoIPDB copies the first file with a name ending in suffix from a gzipped tarball to w.
+func extractGeoIPDB(r io.Reader, suffix string, w io.Writer) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer func() { _ = gzr.Close() }()
+
+	tr := tar.NewReader(gzr)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return errors.Err("no %v file in archive", suffix)
+		}
+		if err != nil {
+			return errors.Err(err)
+		}
+		if header.Typeflag == tar.TypeReg && strings.HasSuffix(header.Name, suffix) {
+			_, err = io.Copy(w, tr)
+			return errors.Err(err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package firewall
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OdyseeTeam/player-server/internal/mmdbtest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeASNDatabase(t *testing.T, path string, org string) {
+	t.Helper()
+	err := mmdbtest.Write(path, "GeoLite2-ASN", map[string]map[string]any{
+		"1.1.1.0/24":      {"autonomous_system_number": uint32(13335), "autonomous_system_organization": org},
+		"2606:4700::/32":  {"autonomous_system_number": uint32(13335), "autonomous_system_organization": org},
+		"207.182.16.0/20": {"autonomous_system_number": uint32(64500), "autonomous_system_organization": "ABUSIVE"},
+	})
+	require.NoError(t, err)
+}
+
+func withASNDatabase(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "GeoLite2-ASN.mmdb")
+	writeASNDatabase(t, path, "CLOUDFLARENET")
+	require.NoError(t, LoadASNDatabase(path))
+	t.Cleanup(UnloadASNDatabase)
+	return path
+}
+
+func TestGetProviderForIP(t *testing.T) {
+	_, _, err := GetProviderForIP("1.1.1.1")
+	assert.ErrorIs(t, err, ErrNoASNDatabase)
+
+	withASNDatabase(t)
+	org, asn, err := GetProviderForIP("1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "CLOUDFLARENET", org)
+	assert.Equal(t, 13335, asn)
+
+	_, asn, err = GetProviderForIP("2606:4700::1111")
+	require.NoError(t, err)
+	assert.Equal(t, 13335, asn)
+
+	_, asn, err = GetProviderForIP("8.8.8.8")
+	require.NoError(t, err)
+	assert.Equal(t, 0, asn)
+}
+
+func TestLoadASNDatabaseValidates(t *testing.T) {
+	path := withASNDatabase(t)
+	dir := t.TempDir()
+
+	country := filepath.Join(dir, "country.mmdb")
+	require.NoError(t, mmdbtest.Write(country, "GeoLite2-Country", map[string]map[string]any{
+		"1.1.1.0/24": {"country": map[string]any{"iso_code": "AU"}},
+	}))
+	assert.Error(t, LoadASNDatabase(country))
+
+	garbage := filepath.Join(dir, "garbage.mmdb")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a database"), 0644))
+	assert.Error(t, LoadASNDatabase(garbage))
+	assert.Error(t, LoadASNDatabase(filepath.Join(dir, "missing.mmdb")))
+
+	// The previous database stays active.
+	_, asn, err := GetProviderForIP("1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, 13335, asn)
+
+	writeASNDatabase(t, path, "RENAMED")
+	require.NoError(t, LoadASNDatabase(path))
+	org, _, err := GetProviderForIP("1.1.1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "RENAMED", org)
+}
+
+func TestCheckBansASN(t *testing.T) {
+	withBlacklist(t, `{"blacklisted_asn": [64500]}`)
+	assert.Equal(t, 1, ASNBanCount())
+	// ASN bans are skipped without a database.
+	assert.False(t, CheckBans("207.182.29.47"))
+
+	withASNDatabase(t)
+	assert.True(t, CheckBans("207.182.29.47"))
+	assert.False(t, CheckBans("1.1.1.1"))
+}
+
+func TestASNUpdater(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src.mmdb")
+	writeASNDatabase(t, src, "CLOUDFLARENET")
+	db, err := os.ReadFile(src)
+	require.NoError(t, err)
+
+	var archive bytes.Buffer
+	gzw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gzw)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "GeoLite2-ASN_20240101/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "GeoLite2-ASN_20240101/COPYRIGHT.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 2}))
+	_, err = tw.Write([]byte("c\n"))
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "GeoLite2-ASN_20240101/GeoLite2-ASN.mmdb", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(db))}))
+	_, err = tw.Write(db)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gzw.Close())
+
+	var key string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = r.URL.Query().Get("license_key")
+		if r.URL.Path == "/broken" {
+			w.Write([]byte("not an archive"))
+			return
+		}
+		w.Write(archive.Bytes())
+	}))
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "asn", "GeoLite2-ASN.mmdb")
+	u := NewASNUpdater(path, "secret", 0)
+	u.URL = ts.URL + "/download?edition_id=GeoLite2-ASN"
+	require.NoError(t, u.Update())
+	assert.Equal(t, "secret", key)
+	require.NoError(t, LoadASNDatabase(path))
+	t.Cleanup(UnloadASNDatabase)
+
+	u.URL = ts.URL + "/broken"
+	assert.Error(t, u.Update())
+	// A failed update leaves the existing file in place.
+	require.NoError(t, LoadASNDatabase(path))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	u.LicenseKey = ""
+	assert.Error(t, u.Update())
+}
@@ -0,0 +1,344 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/atomicfile"
+	"github.com/OdyseeTeam/player-server/internal/iprange"
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+
+	"github.com/gaissmai/bart"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// BlacklistPath is the file bans are loaded from and persisted to.
+var BlacklistPath = "blacklist.json"
+
+// Ban blocks an IP, a CIDR range or a whole ASN, either permanently or until ExpiresAt.
+type Ban struct {
+	// IP is an address or a CIDR range, empty for ASN bans.
+	IP        string     `json:"ip,omitempty"`
+	ASN       int        `json:"asn,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired checks if the ban is no longer in effect at t.
+func (b Ban) Expired(t time.Time) bool {
+	return b.ExpiresAt != nil && !t.Before(*b.ExpiresAt)
+}
+
+func (b Ban) key() string {
+	if b.IP != "" {
+		return b.IP
+	}
+	return fmt.Sprintf("AS%d", b.ASN)
+}
+
+// normalize validates the ban target and rewrites IP into canonical prefix form.
+func (b *Ban) normalize() error {
+	if (b.IP == "") == (b.ASN == 0) {
+		return errors.Err("a ban needs either an ip or an asn")
+	}
+	if b.ASN < 0 {
+		return errors.Err("invalid asn %v", b.ASN)
+	}
+	if b.IP != "" {
+		p, err := iprange.ParsePrefix(b.IP)
+		if err != nil {
+			return errors.Err("invalid ip %v: %v", b.IP, err)
+		}
+		b.IP = p.String()
+	}
+	return nil
+}
+
+// blacklist is the on-disk format. BlacklistedAsn and BlacklistedIPs are still read as permanent bans.
+type blacklist struct {
+	BlacklistedAsn []int    `json:"blacklisted_asn,omitempty"`
+	BlacklistedIPs []string `json:"blacklisted_ips,omitempty"`
+	Bans           []Ban    `json:"bans"`
+}
+
+// banSet is an immutable snapshot of bans, swapped atomically so lookups never take a lock.
+type banSet struct {
+	ips  *bart.Table[*Ban]
+	asns map[int]*Ban
+	bans []Ban
+}
+
+func newBanSet(bans []Ban) *banSet {
+	s := &banSet{ips: &bart.Table[*Ban]{}, asns: map[int]*Ban{}, bans: bans}
+	for i := range s.bans {
+		b := &s.bans[i]
+		if b.IP != "" {
+			s.ips.Insert(netip.MustParsePrefix(b.IP), b)
+		} else {
+			s.asns[b.ASN] = b
+		}
+	}
+	metrics.BansActive.WithLabelValues("ip").Set(float64(s.ips.Size()))
+	metrics.BansActive.WithLabelValues("asn").Set(float64(len(s.asns)))
+	return s
+}
+
+var (
+	bans = func() *atomic.Pointer[banSet] {
+		p := &atomic.Pointer[banSet]{}
+		p.Store(newBanSet(nil))
+		return p
+	}()
+	// banMu serializes ban changes, lookups only load the current set.
+	banMu sync.Mutex
+)
+
+// ReloadBlacklist replaces active bans with the ones in BlacklistPath.
+func ReloadBlacklist() {
+	f, err := os.ReadFile(BlacklistPath)
+	if err != nil {
+		Logger.Warn("no blacklist file found, skipping blacklist")
+		return
+	}
+
+	var bl blacklist
+	err = json.Unmarshal(f, &bl)
+	if err != nil {
+		Logger.Errorf("failed to unmarshal blacklist: %v", err)
+		return
+	}
+	var list []Ban
+	for _, v := range bl.BlacklistedAsn {
+		list = append(list, Ban{ASN: v})
+	}
+	for _, v := range bl.BlacklistedIPs {
+		list = append(list, Ban{IP: v})
+	}
+	list = append(list, bl.Bans...)
+
+	banMu.Lock()
+	defer banMu.Unlock()
+	now := time.Now()
+	byKey := map[string]Ban{}
+	for _, b := range list {
+		if err := b.normalize(); err != nil {
+			Logger.Warnf("skipping ban: %v", err)
+			continue
+		}
+		if !b.Expired(now) {
+			byKey[b.key()] = b
+		}
+	}
+	bans.Store(newBanSet(sortBans(byKey)))
+}
+
+func sortBans(byKey map[string]Ban) []Ban {
+	list := make([]Ban, 0, len(byKey))
+	for _, b := range byKey {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].key() < list[j].key()
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list
+}
+
+// updateBans applies fn to a copy of active bans, persists the result and makes it active.
+// Active bans are left untouched if persisting fails.
+func updateBans(fn func(byKey map[string]Ban) bool) error {
+	banMu.Lock()
+	defer banMu.Unlock()
+	byKey := map[string]Ban{}
+	for _, b := range bans.Load().bans {
+		byKey[b.key()] = b
+	}
+	if !fn(byKey) {
+		return nil
+	}
+	list := sortBans(byKey)
+	data, err := json.MarshalIndent(blacklist{Bans: list}, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+	if err := atomicfile.WriteFile(BlacklistPath, data); err != nil {
+		return errors.Err("cannot save bans: %v", err)
+	}
+	bans.Store(newBanSet(list))
+	return nil
+}
+
+// AddBan activates a ban, replacing an existing ban on the same IP range or ASN.
+func AddBan(b Ban) (Ban, error) {
+	if err := b.normalize(); err != nil {
+		return b, err
+	}
+	now := time.Now()
+	if b.Expired(now) {
+		return b, errors.Err("ban expiry is in the past")
+	}
+	b.CreatedAt = now
+	err := updateBans(func(byKey map[string]Ban) bool {
+		byKey[b.key()] = b
+		return true
+	})
+	if err != nil {
+		return b, err
+	}
+	Logger.Infof("%v banned by %v until %v: %v", b.key(), b.CreatedBy, expiryString(b), b.Reason)
+	if b.ASN != 0 && providerDB.Load() == nil {
+		Logger.Errorf("%v is not enforced, no ASN database is loaded", b.key())
+	}
+	return b, nil
+}
+
+// ASNBanCount returns the number of active ASN bans.
+func ASNBanCount() int {
+	return len(bans.Load().asns)
+}
+
+// RemoveBan lifts the ban on the IP range or ASN of b, the first return value is false if there was none.
+func RemoveBan(b Ban) (bool, error) {
+	if err := b.normalize(); err != nil {
+		return false, err
+	}
+	found := false
+	err := updateBans(func(byKey map[string]Ban) bool {
+		_, found = byKey[b.key()]
+		delete(byKey, b.key())
+		return found
+	})
+	if err == nil && found {
+		Logger.Infof("ban on %v lifted", b.key())
+	}
+	return found, err
+}
+
+// Bans returns all bans that are in effect.
+func Bans() []Ban {
+	now := time.Now()
+	var list []Ban
+	for _, b := range bans.Load().bans {
+		if !b.Expired(now) {
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+// PurgeExpiredBans removes expired bans and persists the remaining ones.
+func PurgeExpiredBans() error {
+	now := time.Now()
+	return updateBans(func(byKey map[string]Ban) bool {
+		changed := false
+		for k, b := range byKey {
+			if b.Expired(now) {
+				delete(byKey, k)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// StartBanExpiry purges expired bans every interval until the returned group is stopped.
+// Expired bans stop matching right away, purging only keeps the list and the file tidy.
+func StartBanExpiry(interval time.Duration) *stop.Group {
+	grp := stop.New()
+	grp.Add(1)
+	go func() {
+		defer grp.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-grp.Ch():
+				return
+			case <-t.C:
+				if err := PurgeExpiredBans(); err != nil {
+					Logger.Errorf("failed to purge expired bans: %v", err)
+				}
+			}
+		}
+	}()
+	return grp
+}
+
+// FindBan returns the ban in effect for ip, checking IP ranges first and then the ASN of ip.
+func FindBan(ip string) (Ban, bool) {
+	parsedIp, err := netip.ParseAddr(ip)
+	if err != nil {
+		Logger.Warnf("Error parsing IP %s: %s", ip, err)
+		return Ban{}, false
+	}
+	parsedIp = parsedIp.Unmap()
+	s := bans.Load()
+	now := time.Now()
+	if s.ips.Size() > 0 {
+		var found *Ban
+		s.ips.Supernets(netip.PrefixFrom(parsedIp, parsedIp.BitLen()))(func(_ netip.Prefix, b *Ban) bool {
+			if b.Expired(now) {
+				return true
+			}
+			found = b
+			return false
+		})
+		if found != nil {
+			return *found, true
+		}
+	}
+	if len(s.asns) == 0 {
+		return Ban{}, false
+	}
+	_, asn, err := GetProviderForIP(ip)
+	if err == nil {
+		if b, found := s.asns[asn]; found && !b.Expired(now) {
+			return *b, true
+		}
+	}
+	return Ban{}, false
+}
+
+func CheckBans(ip string) bool {
+	b, ok := FindBan(ip)
+	if ok {
+		Logger.Warnf("IP %s matches ban on %s (%s)", ip, b.key(), b.Reason)
+	}
+	return ok
+}
+
+func expiryString(b Ban) string {
+	if b.ExpiresAt == nil {
+		return "forever"
+	}
+	return b.ExpiresAt.UTC().Format(time.RFC3339)
+}
+
+// ParseBanTarget parses an IP, a CIDR range or an ASN in the AS<number> form into a ban.
+func ParseBanTarget(s string) (Ban, error) {
+	var b Ban
+	upper := strings.ToUpper(s)
+	if strings.HasPrefix(upper, "AS") {
+		asn, err := strconv.Atoi(strings.TrimPrefix(upper, "AS"))
+		if err != nil {
+			return b, errors.Err("invalid asn %v", s)
+		}
+		b.ASN = asn
+	} else {
+		b.IP = s
+	}
+	return b, b.normalize()
+}
@@ -0,0 +1,113 @@
+package firewall
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withBlacklist(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blacklist.json")
+	if content != "" {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	orig := BlacklistPath
+	BlacklistPath = path
+	ReloadBlacklist()
+	t.Cleanup(func() {
+		BlacklistPath = orig
+		bans.Store(newBanSet(nil))
+	})
+	return path
+}
+
+func TestReloadBlacklistLegacy(t *testing.T) {
+	withBlacklist(t, `{
+		"blacklisted_asn": [64500],
+		"blacklisted_ips": ["192.0.2.0/24", "198.51.100.7"],
+		"bans": [{"ip": "203.0.113.1", "reason": "scraping", "expires_at": "2000-01-01T00:00:00Z"}]
+	}`)
+
+	assert.True(t, CheckBans("192.0.2.44"))
+	assert.True(t, CheckBans("198.51.100.7"))
+	assert.False(t, CheckBans("198.51.100.8"))
+	// Expired bans are dropped on load.
+	assert.False(t, CheckBans("203.0.113.1"))
+	assert.Len(t, Bans(), 3)
+}
+
+func TestAddRemoveBan(t *testing.T) {
+	path := withBlacklist(t, "")
+
+	b, err := AddBan(Ban{IP: "2001:db8::1/64", Reason: "abuse", CreatedBy: "ops"})
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::/64", b.IP)
+	assert.False(t, b.CreatedAt.IsZero())
+	assert.True(t, CheckBans("2001:db8::abcd"))
+
+	_, err = AddBan(Ban{ASN: 64500, Reason: "hosting"})
+	require.NoError(t, err)
+	_, err = AddBan(Ban{IP: "192.0.2.1", ASN: 1})
+	assert.Error(t, err)
+	_, err = AddBan(Ban{IP: "not an ip"})
+	assert.Error(t, err)
+
+	var bl blacklist
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &bl))
+	require.Len(t, bl.Bans, 2)
+	assert.Equal(t, "ops", bl.Bans[0].CreatedBy)
+
+	// Bans survive a reload from disk.
+	bans.Store(newBanSet(nil))
+	ReloadBlacklist()
+	assert.True(t, CheckBans("2001:db8::abcd"))
+
+	target, err := ParseBanTarget("2001:db8::5/64")
+	require.NoError(t, err)
+	found, err := RemoveBan(target)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.False(t, CheckBans("2001:db8::abcd"))
+
+	target, err = ParseBanTarget("as64500")
+	require.NoError(t, err)
+	found, err = RemoveBan(target)
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = RemoveBan(target)
+	require.NoError(t, err)
+	assert.False(t, found)
+	assert.Empty(t, Bans())
+}
+
+func TestBanExpiry(t *testing.T) {
+	withBlacklist(t, "")
+
+	exp := time.Now().Add(50 * time.Millisecond)
+	_, err := AddBan(Ban{IP: "192.0.2.0/24", ExpiresAt: &exp})
+	require.NoError(t, err)
+	// A permanent ban on a narrower range does not hide an expired broader one and vice versa.
+	_, err = AddBan(Ban{IP: "192.0.2.128/25"})
+	require.NoError(t, err)
+	assert.True(t, CheckBans("192.0.2.1"))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, CheckBans("192.0.2.1"))
+	assert.True(t, CheckBans("192.0.2.200"))
+	assert.Len(t, Bans(), 1)
+
+	require.NoError(t, PurgeExpiredBans())
+	assert.Len(t, bans.Load().bans, 1)
+
+	past := time.Now().Add(-time.Minute)
+	_, err = AddBan(Ban{IP: "192.0.2.1", ExpiresAt: &past})
+	assert.Error(t, err)
+}
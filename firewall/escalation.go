@@ -0,0 +1,458 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Signal is a kind of abusive behavior reported to the escalator.
+type Signal string
+
+const (
+	SignalRateLimited     Signal = "rate_limited"
+	SignalFlaggedReferrer Signal = "flagged_referrer"
+	SignalDownloadAbuse   Signal = "download_abuse"
+	SignalClientError     Signal = "client_error" // 401 and 403 responses
+)
+
+// EscalatorName is recorded as the creator of bans issued by the escalator.
+const EscalatorName = "escalation"
+
+// EscalationPolicy configures how abuse signals turn into bans.
+// Each signal adds its weight to the client's score, which decays with HalfLife. When the score reaches
+// Threshold the IP is banned for the next duration in BanDurations, offenses are remembered for OffenseMemory.
+// When ASNThreshold different IPs from one ASN get banned within ASNWindow, the whole ASN is banned
+// following the same ladder.
+type EscalationPolicy struct {
+	Weights       map[Signal]float64 `json:"weights"`
+	Threshold     float64            `json:"threshold"`
+	HalfLife      Duration           `json:"half_life"`
+	BanDurations  []Duration         `json:"ban_durations"`
+	OffenseMemory Duration           `json:"offense_memory"`
+	ASNThreshold  int                `json:"asn_threshold"`
+	ASNWindow     Duration           `json:"asn_window"`
+	// MaxTracked bounds the number of IPs with a score.
+	MaxTracked int `json:"max_tracked"`
+	// DryRun only records decisions without banning.
+	DryRun bool `json:"dry_run"`
+}
+
+// DefaultEscalationPolicy returns the policy used when no configuration is supplied.
+func DefaultEscalationPolicy() EscalationPolicy {
+	return EscalationPolicy{
+		Weights: map[Signal]float64{
+			SignalRateLimited:     1,
+			SignalFlaggedReferrer: 2,
+			SignalDownloadAbuse:   3,
+			SignalClientError:     0.2,
+		},
+		Threshold: 20,
+		HalfLife:  Duration(10 * time.Minute),
+		BanDurations: []Duration{
+			Duration(10 * time.Minute),
+			Duration(time.Hour),
+			Duration(6 * time.Hour),
+			Duration(24 * time.Hour),
+			Duration(7 * 24 * time.Hour),
+		},
+		OffenseMemory: Duration(30 * 24 * time.Hour),
+		ASNThreshold:  20,
+		ASNWindow:     Duration(time.Hour),
+		MaxTracked:    100_000,
+	}
+}
+
+// LoadEscalationPolicy reads a policy from a JSON file, unset fields keep their default values.
+func LoadEscalationPolicy(path string) (EscalationPolicy, error) {
+	p := DefaultEscalationPolicy()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return p, errors.Err(err)
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return p, errors.Err("cannot parse escalation policy: %v", err)
+	}
+	if p.Threshold <= 0 || len(p.BanDurations) == 0 || p.HalfLife <= 0 {
+		return p, errors.Err("escalation policy needs a threshold, a half life and ban durations")
+	}
+	return p, nil
+}
+
+// Escalation records a ban decision and what led to it.
+type Escalation struct {
+	Time time.Time `json:"time"`
+	// Target is the banned IP or ASN (AS<number>).
+	Target   string         `json:"target"`
+	Offense  int            `json:"offense"`
+	Duration Duration       `json:"duration"`
+	Score    float64        `json:"score,omitempty"`
+	Signals  map[Signal]int `json:"signals,omitempty"`
+	// IPs are the banned IPs that triggered an ASN ban.
+	IPs    []string `json:"ips,omitempty"`
+	DryRun bool     `json:"dry_run,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+func (e Escalation) reason() string {
+	if len(e.IPs) > 0 {
+		return fmt.Sprintf("offense #%d: %d banned IPs in this ASN", e.Offense, len(e.IPs))
+	}
+	signals := make([]string, 0, len(e.Signals))
+	for s, n := range e.Signals {
+		signals = append(signals, fmt.Sprintf("%s=%d", s, n))
+	}
+	sort.Strings(signals)
+	return fmt.Sprintf("offense #%d: score %.1f (%s)", e.Offense, e.Score, strings.Join(signals, ", "))
+}
+
+const maxEscalations = 10
+
+type offender struct {
+	score    float64
+	updated  time.Time
+	signals  map[Signal]int
+	offenses int
+	lastBan  time.Time
+	history  []Escalation
+}
+
+// decay brings the score up to date.
+func (o *offender) decay(p *EscalationPolicy, now time.Time) {
+	if !o.updated.IsZero() {
+		o.score *= math.Pow(0.5, now.Sub(o.updated).Seconds()/time.Duration(p.HalfLife).Seconds())
+	}
+	o.updated = now
+}
+
+// offense counts a new offense, forgetting earlier ones if they are older than OffenseMemory.
+func (o *offender) offense(p *EscalationPolicy, now time.Time) (int, time.Duration) {
+	if !o.lastBan.IsZero() && now.Sub(o.lastBan) > time.Duration(p.OffenseMemory) {
+		o.offenses = 0
+	}
+	o.offenses++
+	o.lastBan = now
+	return o.offenses, time.Duration(p.BanDurations[min(o.offenses, len(p.BanDurations))-1])
+}
+
+func (o *offender) record(e Escalation) {
+	o.history = append(o.history, e)
+	if len(o.history) > maxEscalations {
+		o.history = o.history[len(o.history)-maxEscalations:]
+	}
+}
+
+// pendingBan is a ban decided while holding the escalator lock, issued once it's released.
+type pendingBan struct {
+	esc *Escalation
+	ban Ban
+	exp time.Time
+	o   *offender
+}
+
+type asnOffender struct {
+	offender
+	org string
+	// banned maps IPs banned recently to when they were banned.
+	banned map[string]time.Time
+}
+
+// Escalator accumulates abuse signals per IP and issues temporary bans of increasing duration.
+type Escalator struct {
+	policy atomic.Pointer[EscalationPolicy]
+
+	mu   sync.Mutex
+	ips  map[string]*offender
+	asns map[int]*asnOffender
+
+	exempt atomic.Pointer[func(ip string) bool]
+
+	// ban and asnOf are replaceable in tests.
+	ban   func(Ban) (Ban, error)
+	asnOf func(ip string) (string, int, error)
+}
+
+// NewEscalator creates an escalator issuing bans via AddBan.
+func NewEscalator(p EscalationPolicy) *Escalator {
+	e := &Escalator{
+		ips:   map[string]*offender{},
+		asns:  map[int]*asnOffender{},
+		ban:   AddBan,
+		asnOf: GetProviderForIP,
+	}
+	e.SetPolicy(p)
+	return e
+}
+
+// SetPolicy replaces the active policy, accumulated scores are preserved.
+func (e *Escalator) SetPolicy(p EscalationPolicy) {
+	e.policy.Store(&p)
+}
+
+// Policy returns the active policy.
+func (e *Escalator) Policy() EscalationPolicy {
+	return *e.policy.Load()
+}
+
+// SetExempt sets a function selecting IPs that signals are never accumulated for,
+// such as addresses of CDNs and proxies requests are passed on by.
+func (e *Escalator) SetExempt(exempt func(ip string) bool) {
+	e.exempt.Store(&exempt)
+}
+
+func (e *Escalator) exempted(ip string) bool {
+	f := e.exempt.Load()
+	return f != nil && *f != nil && (*f)(ip)
+}
+
+// Report adds a signal for ip, banning it if its score reaches the threshold.
+func (e *Escalator) Report(ip string, s Signal) {
+	if ip == "" || e.exempted(ip) {
+		return
+	}
+	p := e.policy.Load()
+	w := p.Weights[s]
+	if w <= 0 {
+		return
+	}
+	metrics.EscalationSignals.WithLabelValues(string(s)).Inc()
+	now := time.Now()
+
+	// Bans are written to disk, so they are issued after the lock is released.
+	var pending []pendingBan
+	defer func() {
+		e.issue(pending)
+	}()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	o, ok := e.ips[ip]
+	if !ok {
+		if p.MaxTracked > 0 && len(e.ips) >= p.MaxTracked {
+			e.prune(p, now)
+		}
+		o = &offender{signals: map[Signal]int{}}
+		e.ips[ip] = o
+	}
+	o.decay(p, now)
+	o.score += w
+	o.signals[s]++
+	if o.score < p.Threshold {
+		return
+	}
+
+	offense, d := o.offense(p, now)
+	esc := &Escalation{Time: now, Target: ip, Offense: offense, Duration: Duration(d), Score: o.score, Signals: o.signals, DryRun: p.DryRun}
+	pending = append(pending, pendingBan{esc: esc, ban: Ban{IP: ip}, exp: now.Add(d), o: o})
+	o.score = 0
+	o.signals = map[Signal]int{}
+
+	if asnBan, ok := e.escalateASN(p, ip, now); ok {
+		pending = append(pending, asnBan)
+	}
+}
+
+// escalateASN counts a banned IP against its ASN, returning a ban for the ASN if it reaches the threshold.
+// Must be called with e.mu held.
+func (e *Escalator) escalateASN(p *EscalationPolicy, ip string, now time.Time) (pendingBan, bool) {
+	if p.ASNThreshold <= 0 {
+		return pendingBan{}, false
+	}
+	org, asn, err := e.asnOf(ip)
+	if err != nil || asn == 0 {
+		return pendingBan{}, false
+	}
+	a, ok := e.asns[asn]
+	if !ok {
+		a = &asnOffender{banned: map[string]time.Time{}}
+		e.asns[asn] = a
+	}
+	a.org = org
+	a.banned[ip] = now
+	for k, t := range a.banned {
+		if now.Sub(t) > time.Duration(p.ASNWindow) {
+			delete(a.banned, k)
+		}
+	}
+	if len(a.banned) < p.ASNThreshold {
+		return pendingBan{}, false
+	}
+
+	offense, d := a.offense(p, now)
+	esc := &Escalation{Time: now, Target: fmt.Sprintf("AS%d", asn), Offense: offense, Duration: Duration(d), DryRun: p.DryRun}
+	for k := range a.banned {
+		esc.IPs = append(esc.IPs, k)
+	}
+	sort.Strings(esc.IPs)
+	a.banned = map[string]time.Time{}
+	return pendingBan{esc: esc, ban: Ban{ASN: asn}, exp: now.Add(d), o: &a.offender}, true
+}
+
+// issue applies pending bans and records them in the history of their offenders.
+// Must be called without e.mu held.
+func (e *Escalator) issue(pending []pendingBan) {
+	if len(pending) == 0 {
+		return
+	}
+	for _, pb := range pending {
+		e.apply(pb.esc, pb.ban, pb.exp)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, pb := range pending {
+		pb.o.record(*pb.esc)
+	}
+}
+
+// apply issues the ban for an escalation unless running in dry run mode.
+func (e *Escalator) apply(esc *Escalation, b Ban, exp time.Time) {
+	kind := "ip"
+	if b.ASN != 0 {
+		kind = "asn"
+	}
+	metrics.EscalationBans.WithLabelValues(kind, fmt.Sprint(esc.DryRun)).Inc()
+	if esc.DryRun {
+		Logger.Infof("escalation (dry run) would ban %v for %v: %v", esc.Target, time.Duration(esc.Duration), esc.reason())
+		return
+	}
+	b.Reason = esc.reason()
+	b.CreatedBy = EscalatorName
+	b.ExpiresAt = &exp
+	if _, err := e.ban(b); err != nil {
+		esc.Error = err.Error()
+		Logger.Errorf("escalation failed to ban %v: %v", esc.Target, err)
+		return
+	}
+	Logger.Warnf("escalation banned %v for %v: %v", esc.Target, time.Duration(esc.Duration), b.Reason)
+}
+
+// prune forgets IPs whose score has decayed and whose offenses are no longer remembered.
+// If none can be forgotten, the IP with the lowest score is dropped. Must be called with e.mu held.
+func (e *Escalator) prune(p *EscalationPolicy, now time.Time) {
+	var lowest string
+	lowestScore := math.Inf(1)
+	for ip, o := range e.ips {
+		o.decay(p, now)
+		forgotten := o.lastBan.IsZero() || now.Sub(o.lastBan) > time.Duration(p.OffenseMemory)
+		if o.score < 0.01*p.Threshold && forgotten {
+			delete(e.ips, ip)
+			continue
+		}
+		if o.score < lowestScore {
+			lowest, lowestScore = ip, o.score
+		}
+	}
+	if len(e.ips) >= p.MaxTracked {
+		delete(e.ips, lowest)
+	}
+}
+
+// Explanation describes the escalation state of an IP or ASN.
+type Explanation struct {
+	Target   string         `json:"target"`
+	Score    float64        `json:"score"`
+	Signals  map[Signal]int `json:"signals,omitempty"`
+	Offenses int            `json:"offenses"`
+	// NextBan is how long the next ban will last.
+	NextBan Duration     `json:"next_ban"`
+	History []Escalation `json:"history,omitempty"`
+	// Ban is the ban currently in effect, if any.
+	Ban *Ban `json:"ban,omitempty"`
+	// ASN is the explanation for the ASN of an IP.
+	ASN *Explanation `json:"asn,omitempty"`
+	Org string       `json:"org,omitempty"`
+	// RecentlyBannedIPs counts IPs of an ASN towards the ASN threshold.
+	RecentlyBannedIPs int `json:"recently_banned_ips,omitempty"`
+}
+
+func (e *Escalator) explain(p *EscalationPolicy, target string, o *offender, now time.Time) *Explanation {
+	x := &Explanation{Target: target, NextBan: p.BanDurations[0]}
+	if o == nil {
+		return x
+	}
+	o.decay(p, now)
+	offenses := o.offenses
+	if !o.lastBan.IsZero() && now.Sub(o.lastBan) > time.Duration(p.OffenseMemory) {
+		offenses = 0
+	}
+	x.Score = o.score
+	x.Offenses = offenses
+	x.NextBan = p.BanDurations[min(offenses+1, len(p.BanDurations))-1]
+	x.Signals = make(map[Signal]int, len(o.signals))
+	for s, n := range o.signals {
+		x.Signals[s] = n
+	}
+	x.History = append([]Escalation(nil), o.history...)
+	return x
+}
+
+// ExplainIP describes the escalation state of ip and its ASN, and the ban in effect for it.
+func (e *Escalator) ExplainIP(ip string) Explanation {
+	p := e.policy.Load()
+	now := time.Now()
+	org, asn, asnErr := e.asnOf(ip)
+
+	e.mu.Lock()
+	x := e.explain(p, ip, e.ips[ip], now)
+	if asnErr == nil && asn != 0 {
+		x.ASN = e.explainASN(p, asn, now)
+	}
+	e.mu.Unlock()
+
+	if b, ok := FindBan(ip); ok {
+		x.Ban = &b
+	}
+	if x.ASN != nil && x.ASN.Org == "" {
+		x.ASN.Org = org
+	}
+	return *x
+}
+
+// ExplainASN describes the escalation state of an ASN.
+func (e *Escalator) ExplainASN(asn int) Explanation {
+	e.mu.Lock()
+	x := e.explainASN(e.policy.Load(), asn, time.Now())
+	e.mu.Unlock()
+	for _, b := range Bans() {
+		if b.ASN == asn {
+			x.Ban = &b
+		}
+	}
+	return *x
+}
+
+// explainASN must be called with e.mu held.
+func (e *Escalator) explainASN(p *EscalationPolicy, asn int, now time.Time) *Explanation {
+	target := fmt.Sprintf("AS%d", asn)
+	a, ok := e.asns[asn]
+	if !ok {
+		return e.explain(p, target, nil, now)
+	}
+	x := e.explain(p, target, &a.offender, now)
+	x.Org = a.org
+	for _, t := range a.banned {
+		if now.Sub(t) <= time.Duration(p.ASNWindow) {
+			x.RecentlyBannedIPs++
+		}
+	}
+	return x
+}
+
+// Escalations is the process-wide escalator used by the player. Until a policy is configured it runs
+// the default policy in dry run mode, only logging the bans it would issue.
+var Escalations = NewEscalator(dryRun(DefaultEscalationPolicy()))
+
+func dryRun(p EscalationPolicy) EscalationPolicy {
+	p.DryRun = true
+	return p
+}
@@ -0,0 +1,161 @@
+package firewall
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testEscalator(p EscalationPolicy) (*Escalator, *[]Ban) {
+	var issued []Ban
+	e := NewEscalator(p)
+	e.ban = func(b Ban) (Ban, error) {
+		issued = append(issued, b)
+		return b, nil
+	}
+	e.asnOf = func(ip string) (string, int, error) {
+		return "TESTNET", 64500, nil
+	}
+	return e, &issued
+}
+
+func TestEscalatorLadder(t *testing.T) {
+	p := DefaultEscalationPolicy()
+	p.Threshold = 2.5
+	p.ASNThreshold = 0
+	e, issued := testEscalator(p)
+	ip := "192.0.2.1"
+
+	e.Report(ip, SignalRateLimited)
+	e.Report(ip, SignalRateLimited)
+	assert.Empty(t, *issued)
+	e.Report(ip, SignalRateLimited)
+	require.Len(t, *issued, 1)
+
+	b := (*issued)[0]
+	assert.Equal(t, ip, b.IP)
+	assert.Equal(t, EscalatorName, b.CreatedBy)
+	assert.Contains(t, b.Reason, "rate_limited=3")
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), *b.ExpiresAt, time.Second)
+
+	// The score is reset after a ban and the next one lasts longer.
+	e.Report(ip, SignalDownloadAbuse)
+	require.Len(t, *issued, 2)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *(*issued)[1].ExpiresAt, time.Second)
+
+	x := e.ExplainIP(ip)
+	assert.Equal(t, 2, x.Offenses)
+	assert.Equal(t, Duration(6*time.Hour), x.NextBan)
+	assert.Len(t, x.History, 2)
+	assert.Equal(t, map[Signal]int{SignalDownloadAbuse: 1}, x.History[1].Signals)
+	assert.Equal(t, "AS64500", x.ASN.Target)
+}
+
+func TestEscalatorDecay(t *testing.T) {
+	p := DefaultEscalationPolicy()
+	p.Threshold = 2
+	p.HalfLife = Duration(10 * time.Millisecond)
+	e, issued := testEscalator(p)
+
+	e.Report("192.0.2.1", SignalRateLimited)
+	time.Sleep(50 * time.Millisecond)
+	e.Report("192.0.2.1", SignalRateLimited)
+	assert.Empty(t, *issued)
+	assert.Less(t, e.ExplainIP("192.0.2.1").Score, 1.1)
+}
+
+func TestEscalatorASN(t *testing.T) {
+	p := DefaultEscalationPolicy()
+	p.Threshold = 1
+	p.ASNThreshold = 3
+	e, issued := testEscalator(p)
+
+	for i := 1; i <= 3; i++ {
+		e.Report(fmt.Sprintf("192.0.2.%d", i), SignalRateLimited)
+	}
+	require.Len(t, *issued, 4)
+	asnBan := (*issued)[3]
+	assert.Equal(t, 64500, asnBan.ASN)
+	assert.Contains(t, asnBan.Reason, "3 banned IPs")
+
+	x := e.ExplainASN(64500)
+	assert.Equal(t, 1, x.Offenses)
+	assert.Equal(t, "TESTNET", x.Org)
+	require.Len(t, x.History, 1)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}, x.History[0].IPs)
+}
+
+func TestEscalatorDryRun(t *testing.T) {
+	p := DefaultEscalationPolicy()
+	p.Threshold = 1
+	p.DryRun = true
+	e, issued := testEscalator(p)
+
+	e.Report("192.0.2.1", SignalFlaggedReferrer)
+	assert.Empty(t, *issued)
+	x := e.ExplainIP("192.0.2.1")
+	require.Len(t, x.History, 1)
+	assert.True(t, x.History[0].DryRun)
+}
+
+func TestEscalatorBounded(t *testing.T) {
+	p := DefaultEscalationPolicy()
+	p.MaxTracked = 10
+	e, _ := testEscalator(p)
+	for i := 0; i < 100; i++ {
+		e.Report(fmt.Sprintf("10.0.0.%d", i), SignalClientError)
+	}
+	assert.LessOrEqual(t, len(e.ips), 10)
+}
+
+func TestEscalatorBansApply(t *testing.T) {
+	withBlacklist(t, "")
+	p := DefaultEscalationPolicy()
+	p.Threshold = 1
+	p.ASNThreshold = 0
+	e := NewEscalator(p)
+
+	e.Report("198.51.100.1", SignalRateLimited)
+	assert.True(t, CheckBans("198.51.100.1"))
+	x := e.ExplainIP("198.51.100.1")
+	require.NotNil(t, x.Ban)
+	assert.Equal(t, EscalatorName, x.Ban.CreatedBy)
+}
+
+func TestEscalatorExempt(t *testing.T) {
+	p := DefaultEscalationPolicy()
+	p.Threshold = 1
+	e, issued := testEscalator(p)
+	e.SetExempt(func(ip string) bool { return ip == "10.0.0.1" })
+
+	e.Report("10.0.0.1", SignalRateLimited)
+	assert.Empty(t, *issued)
+	assert.Zero(t, e.ExplainIP("10.0.0.1").Score)
+	e.Report("192.0.2.1", SignalRateLimited)
+	assert.Len(t, *issued, 1)
+}
+
+func TestEscalationsDryRunByDefault(t *testing.T) {
+	assert.True(t, Escalations.Policy().DryRun)
+	assert.False(t, DefaultEscalationPolicy().DryRun, "policy files issue bans unless they set dry_run")
+}
+
+func TestEscalatorBansOutsideLock(t *testing.T) {
+	p := DefaultEscalationPolicy()
+	p.Threshold = 1
+	p.ASNThreshold = 0
+	e, _ := testEscalator(p)
+	var x Explanation
+	e.ban = func(b Ban) (Ban, error) {
+		// Takes the escalator lock, which would deadlock if bans were issued while holding it.
+		x = e.ExplainIP(b.IP)
+		return b, nil
+	}
+
+	e.Report("192.0.2.1", SignalRateLimited)
+	assert.Equal(t, 1, x.Offenses)
+	assert.Len(t, e.ExplainIP("192.0.2.1").History, 1)
+}
@@ -3,40 +3,23 @@ package firewall
 import (
 	"fmt"
 	"os"
-	"strconv"
+	"path/filepath"
 	"testing"
-	"time"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestCheckIPAccess(t *testing.T) {
-	ip := "192.168.0.1"
-	endpoint := "/api/v1/example"
-	WindowSize = 7 * time.Second
-	// Test the first five accesses for an IP don't exceed the limit
-	for i := 1; i <= MaxStringsPerIp; i++ {
-		result, _ := CheckAndRateLimitIp(ip, endpoint+strconv.Itoa(i))
-		assert.False(t, result, "Expected result to be false, got %v for endpoint %s", result, endpoint+strconv.Itoa(i))
-	}
-
-	// Test the sixth access for an IP exceeds the limit
-	result, _ := CheckAndRateLimitIp(ip, endpoint+"7")
-	assert.True(t, result, "Expected result to be true, got %v for endpoint %s", result, endpoint+"7")
-
-	// Wait for the window size to elapse
-	time.Sleep(WindowSize)
-
-	// Test the access for an IP after the window size elapses doesn't exceed the limit
-	result, _ = CheckAndRateLimitIp(ip, endpoint+"7")
-	assert.False(t, result, "Expected result to be false, got %v for endpoint %s", result, endpoint+"7")
-}
-
 func Test_initISPGeoIPDB(t *testing.T) {
 	if os.Getenv("MAXMIND_KEY") == "" {
 		t.Skip("Skipping test because MAXMIND_KEY is not set")
 	}
+	path := filepath.Join(t.TempDir(), "GeoLite2-ASN.mmdb")
+	require.NoError(t, NewASNUpdater(path, os.Getenv("MAXMIND_KEY"), 0).Update())
+	require.NoError(t, LoadASNDatabase(path))
+	t.Cleanup(UnloadASNDatabase)
+
 	ip := "1.1.1.1"
 	ASN, nr, err := GetProviderForIP(ip)
 	if !assert.NoError(t, err) {
@@ -47,15 +30,16 @@ func Test_initISPGeoIPDB(t *testing.T) {
 }
 
 func Test_checkBannedIp(t *testing.T) {
-	if os.Getenv("MAXMIND_KEY") == "" {
-		t.Skip("Skipping test because MAXMIND_KEY is not set")
-	}
+	withBlacklist(t, `{"blacklisted_ips": ["198.51.100.0/24"], "blacklisted_asn": [64500]}`)
+	withASNDatabase(t)
+
 	ip := "207.182.29.47"
-	ReloadBlacklist()
 	if !assert.True(t, CheckBans(ip)) {
 		return
 	}
+	assert.True(t, CheckBans("198.51.100.7"))
+	assert.True(t, CheckBans("::ffff:198.51.100.7"))
 	ip = "1.1.1.1"
 	assert.False(t, CheckBans(ip))
-
+	assert.False(t, CheckBans("not an ip"))
 }
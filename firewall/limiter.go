@@ -0,0 +1,431 @@
+package firewall
+
+import (
+	"encoding/json"
+	"hash/maphash"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/iprange"
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+
+	"github.com/gaissmai/bart"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Limited dimensions.
+const (
+	LimitRequests  = "requests"
+	LimitClaims    = "claims"
+	LimitDownloads = "downloads"
+	LimitBytes     = "bytes"
+)
+
+const limiterShards = 64
+
+// Limit is a token bucket refilled at Rate tokens per second up to Burst tokens.
+// A zero Burst disables the limit.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+// Limits configure the rate limiter. Clients are identified by their IPv4 address or by their IPv6 prefix.
+type Limits struct {
+	Requests Limit `json:"requests"`
+	// Claims limits how often a client can start requesting a claim it has not requested recently.
+	Claims Limit `json:"claims"`
+	// ClaimWindow is how long a claim is considered recently requested.
+	ClaimWindow Duration `json:"claim_window"`
+	Downloads   Limit    `json:"downloads"`
+	Bytes       Limit    `json:"bytes"`
+	// Exempt IPs and prefixes are never limited.
+	Exempt []string `json:"exempt"`
+	// IPv6PrefixLen is the prefix length IPv6 clients are grouped by.
+	IPv6PrefixLen int `json:"ipv6_prefix_len"`
+	// MaxClients bounds the number of clients tracked.
+	MaxClients int `json:"max_clients"`
+}
+
+// Duration is a time.Duration that is read from a JSON string like "2m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// DefaultLimits returns limits used when no configuration is supplied. Requests are not limited by
+// default: players issue a Range request per seek and a request per HLS fragment, so a request limit
+// has to be calibrated against real traffic before being enabled.
+func DefaultLimits() Limits {
+	return Limits{
+		Claims:        Limit{Rate: 10.0 / 120, Burst: 10},
+		ClaimWindow:   Duration(120 * time.Second),
+		Downloads:     Limit{Rate: 2.0 / 120, Burst: 2},
+		Exempt:        []string{"51.210.0.171"},
+		IPv6PrefixLen: 64,
+		MaxClients:    200_000,
+	}
+}
+
+// LoadLimits reads limits from a JSON file, unset fields keep their default values.
+func LoadLimits(path string) (Limits, error) {
+	l := DefaultLimits()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return l, errors.Err(err)
+	}
+	if err := json.Unmarshal(b, &l); err != nil {
+		return l, errors.Err("cannot parse rate limits: %v", err)
+	}
+	if l.IPv6PrefixLen <= 0 || l.IPv6PrefixLen > 128 {
+		return l, errors.Err("invalid ipv6_prefix_len %v", l.IPv6PrefixLen)
+	}
+	return l, nil
+}
+
+// Decision is the outcome of a rate limit check.
+type Decision struct {
+	Allowed bool
+	// Limit is the dimension reported in headers: the one that denied the request or the one closest to depletion.
+	Limit     string
+	Quota     float64
+	Remaining float64
+	// Reset is how long until the reported bucket is full again (or, if denied, has enough tokens).
+	Reset time.Duration
+}
+
+// SetHeaders adds RateLimit-* headers describing the decision, plus Retry-After for denied requests.
+func (d Decision) SetHeaders(h http.Header) {
+	if d.Limit == "" {
+		return
+	}
+	reset := strconv.Itoa(int(math.Ceil(d.Reset.Seconds())))
+	h.Set("RateLimit-Limit", strconv.FormatFloat(math.Floor(d.Quota), 'f', 0, 64))
+	h.Set("RateLimit-Remaining", strconv.FormatFloat(math.Max(0, math.Floor(d.Remaining)), 'f', 0, 64))
+	h.Set("RateLimit-Reset", reset)
+	if !d.Allowed {
+		h.Set("Retry-After", reset)
+	}
+}
+
+// Request describes what a client is asking for.
+type Request struct {
+	IP       string
+	ClaimID  string
+	Download bool
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill brings the bucket up to date, new buckets start full.
+func (b *bucket) refill(l Limit, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = l.Burst
+	} else {
+		b.tokens = math.Min(l.Burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	}
+	b.last = now
+}
+
+// wait is how long until the bucket holds n tokens.
+func (b *bucket) wait(l Limit, n float64) time.Duration {
+	if b.tokens >= n || l.Rate <= 0 {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / l.Rate * float64(time.Second))
+}
+
+type client struct {
+	requests, claims, downloads, bytes bucket
+	recentClaims                       map[string]time.Time
+	lastSeen                           time.Time
+}
+
+const maxRecentClaims = 64
+
+// headroom returns the lowest fill ratio of the client's buckets projected to now, 1 means the client
+// carries no information and can be forgotten.
+func (c *client) headroom(l *Limits, now time.Time) float64 {
+	ratio := 1.0
+	for _, ch := range []struct {
+		b   bucket
+		lim Limit
+	}{{c.requests, l.Requests}, {c.claims, l.Claims}, {c.downloads, l.Downloads}, {c.bytes, l.Bytes}} {
+		if ch.lim.Burst == 0 || ch.b.last.IsZero() {
+			continue
+		}
+		tokens := math.Min(ch.lim.Burst, ch.b.tokens+now.Sub(ch.b.last).Seconds()*ch.lim.Rate)
+		ratio = math.Min(ratio, tokens/ch.lim.Burst)
+	}
+	return ratio
+}
+
+type shard struct {
+	mu      sync.Mutex
+	clients map[netip.Prefix]*client
+}
+
+// Limiter enforces token bucket limits per client. Client state is kept in a sharded store bounded
+// by MaxClients. When a shard is full, clients whose buckets have completely refilled are dropped first,
+// then the client with the most tokens left, so clients that are being limited keep their state under pressure.
+type Limiter struct {
+	limits atomic.Pointer[Limits]
+	exempt atomic.Pointer[bart.Table[bool]]
+	seed   maphash.Seed
+	shards [limiterShards]shard
+}
+
+// NewLimiter creates a limiter with the supplied limits.
+func NewLimiter(l Limits) *Limiter {
+	lim := &Limiter{seed: maphash.MakeSeed()}
+	for i := range lim.shards {
+		lim.shards[i].clients = map[netip.Prefix]*client{}
+	}
+	lim.SetLimits(l)
+	return lim
+}
+
+// SetLimits replaces active limits, client state is preserved.
+func (l *Limiter) SetLimits(limits Limits) {
+	exempt := &bart.Table[bool]{}
+	for _, e := range limits.Exempt {
+		p, err := iprange.ParsePrefix(e)
+		if err != nil {
+			Logger.Warnf("invalid rate limit exemption %v: %v", e, err)
+			continue
+		}
+		exempt.Insert(p, true)
+	}
+	if limits.IPv6PrefixLen == 0 {
+		limits.IPv6PrefixLen = 64
+	}
+	l.exempt.Store(exempt)
+	l.limits.Store(&limits)
+}
+
+// Limits returns active limits.
+func (l *Limiter) Limits() Limits {
+	return *l.limits.Load()
+}
+
+// key maps an IP to the client key, the second return value is false for exempt or unparseable IPs.
+func (l *Limiter) key(ip string, limits *Limits) (netip.Prefix, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	if _, ok := l.exempt.Load().Lookup(addr); ok {
+		return netip.Prefix{}, false
+	}
+	bits := addr.BitLen()
+	if addr.Is6() {
+		bits = limits.IPv6PrefixLen
+	}
+	p, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return p, true
+}
+
+func (l *Limiter) shard(key netip.Prefix) *shard {
+	a := key.Addr().As16()
+	return &l.shards[maphash.Bytes(l.seed, a[:])%limiterShards]
+}
+
+// client returns state for key, evicting another client if the shard is full. Must be called with shard locked.
+func (s *shard) client(key netip.Prefix, limits *Limits, now time.Time) *client {
+	if c, ok := s.clients[key]; ok {
+		return c
+	}
+	if capacity := limits.MaxClients / limiterShards; capacity > 0 && len(s.clients) >= capacity {
+		s.evict(limits, now)
+	}
+	c := &client{}
+	s.clients[key] = c
+	return c
+}
+
+// evict drops all idle clients, or the least limited one if none are idle. Must be called with shard locked.
+func (s *shard) evict(limits *Limits, now time.Time) {
+	var victim netip.Prefix
+	best := -1.0
+	evicted := false
+	for k, c := range s.clients {
+		h := c.headroom(limits, now)
+		if h >= 1 {
+			delete(s.clients, k)
+			evicted = true
+			continue
+		}
+		if h > best {
+			victim, best = k, h
+		}
+	}
+	if !evicted && best >= 0 {
+		delete(s.clients, victim)
+		metrics.RateLimitEvictions.Inc()
+	}
+}
+
+// Allow checks the request against all limits and consumes tokens if it is allowed.
+func (l *Limiter) Allow(r Request) Decision {
+	limits := l.limits.Load()
+	key, ok := l.key(r.IP, limits)
+	if !ok {
+		return Decision{Allowed: true}
+	}
+	now := time.Now()
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(key, limits, now)
+	c.lastSeen = now
+
+	type check struct {
+		name string
+		b    *bucket
+		lim  Limit
+		cost float64
+	}
+	checks := []check{{LimitRequests, &c.requests, limits.Requests, 1}}
+	newClaim := false
+	if r.ClaimID != "" {
+		if seen, ok := c.recentClaims[r.ClaimID]; !ok || now.Sub(seen) > time.Duration(limits.ClaimWindow) {
+			newClaim = true
+			checks = append(checks, check{LimitClaims, &c.claims, limits.Claims, 1})
+		}
+	}
+	if r.Download {
+		checks = append(checks, check{LimitDownloads, &c.downloads, limits.Downloads, 1})
+	}
+	// Bytes are charged after serving, only an exhausted bucket denies further requests.
+	checks = append(checks, check{LimitBytes, &c.bytes, limits.Bytes, 0})
+
+	d := Decision{Allowed: true}
+	ratio := math.Inf(1)
+	for _, ch := range checks {
+		if ch.lim.Burst == 0 {
+			continue
+		}
+		ch.b.refill(ch.lim, now)
+		if ch.b.tokens < ch.cost {
+			metrics.RateLimited.WithLabelValues(ch.name).Inc()
+			return Decision{Limit: ch.name, Quota: ch.lim.Burst, Remaining: ch.b.tokens, Reset: ch.b.wait(ch.lim, math.Max(ch.cost, 1))}
+		}
+		if rem := (ch.b.tokens - ch.cost) / ch.lim.Burst; rem < ratio {
+			ratio = rem
+			d.Limit, d.Quota, d.Remaining = ch.name, ch.lim.Burst, ch.b.tokens-ch.cost
+		}
+	}
+	for _, ch := range checks {
+		if ch.lim.Burst != 0 {
+			ch.b.tokens -= ch.cost
+		}
+	}
+	for _, ch := range checks {
+		if ch.name == d.Limit {
+			d.Reset = ch.b.wait(ch.lim, ch.lim.Burst)
+		}
+	}
+	if newClaim {
+		c.rememberClaim(r.ClaimID, now)
+	}
+	return d
+}
+
+func (c *client) rememberClaim(claimID string, now time.Time) {
+	if c.recentClaims == nil {
+		c.recentClaims = map[string]time.Time{}
+	}
+	if len(c.recentClaims) >= maxRecentClaims {
+		var oldestID string
+		var oldest time.Time
+		for id, t := range c.recentClaims {
+			if oldest.IsZero() || t.Before(oldest) {
+				oldestID, oldest = id, t
+			}
+		}
+		delete(c.recentClaims, oldestID)
+	}
+	c.recentClaims[claimID] = now
+}
+
+// RecordBytes charges bytes served to the client's bytes bucket.
+func (l *Limiter) RecordBytes(ip string, n int64) {
+	limits := l.limits.Load()
+	if limits.Bytes.Burst == 0 || n <= 0 {
+		return
+	}
+	key, ok := l.key(ip, limits)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	s := l.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.client(key, limits, now)
+	c.bytes.refill(limits.Bytes, now)
+	c.bytes.tokens -= float64(n)
+}
+
+// Len returns the number of clients tracked.
+func (l *Limiter) Len() int {
+	n := 0
+	for i := range l.shards {
+		l.shards[i].mu.Lock()
+		n += len(l.shards[i].clients)
+		l.shards[i].mu.Unlock()
+	}
+	return n
+}
+
+// RateLimiter is the process-wide limiter used by the player.
+var RateLimiter = NewLimiter(DefaultLimits())
+
+var limitsPath string
+
+// ConfigureLimits loads limits from path into RateLimiter. The path is remembered for ReloadLimits.
+func ConfigureLimits(path string) error {
+	limitsPath = path
+	return ReloadLimits()
+}
+
+// ReloadLimits re-reads the limits file, the active limits are kept if that fails.
+func ReloadLimits() error {
+	if limitsPath == "" {
+		return nil
+	}
+	l, err := LoadLimits(limitsPath)
+	if err != nil {
+		return err
+	}
+	RateLimiter.SetLimits(l)
+	Logger.Infof("loaded rate limits from %v", limitsPath)
+	return nil
+}
@@ -0,0 +1,143 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterClaims(t *testing.T) {
+	l := NewLimiter(Limits{Claims: Limit{Rate: 0.001, Burst: 3}, ClaimWindow: Duration(time.Minute)})
+	ip := "192.168.0.1"
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.Allow(Request{IP: ip, ClaimID: fmt.Sprintf("claim%v", i)}).Allowed)
+	}
+	// Claims requested recently do not count again.
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.Allow(Request{IP: ip, ClaimID: "claim1"}).Allowed)
+	}
+	d := l.Allow(Request{IP: ip, ClaimID: "claim3"})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, LimitClaims, d.Limit)
+	assert.Greater(t, d.Reset, time.Duration(0))
+
+	assert.True(t, l.Allow(Request{IP: "192.168.0.2", ClaimID: "claim3"}).Allowed)
+}
+
+func TestLimiterDownloadsAndRequests(t *testing.T) {
+	l := NewLimiter(Limits{Requests: Limit{Rate: 0.001, Burst: 5}, Downloads: Limit{Rate: 0.001, Burst: 1}})
+	ip := "10.0.0.1"
+
+	assert.True(t, l.Allow(Request{IP: ip, Download: true}).Allowed)
+	d := l.Allow(Request{IP: ip, Download: true})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, LimitDownloads, d.Limit)
+
+	// The denied download did not consume a request token.
+	for i := 0; i < 4; i++ {
+		assert.True(t, l.Allow(Request{IP: ip}).Allowed)
+	}
+	d = l.Allow(Request{IP: ip})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, LimitRequests, d.Limit)
+}
+
+func TestLimiterRefill(t *testing.T) {
+	l := NewLimiter(Limits{Requests: Limit{Rate: 100, Burst: 1}})
+	assert.True(t, l.Allow(Request{IP: "10.0.0.1"}).Allowed)
+	assert.False(t, l.Allow(Request{IP: "10.0.0.1"}).Allowed)
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, l.Allow(Request{IP: "10.0.0.1"}).Allowed)
+}
+
+func TestLimiterBytes(t *testing.T) {
+	l := NewLimiter(Limits{Bytes: Limit{Rate: 1, Burst: 1000}})
+	ip := "10.0.0.1"
+	assert.True(t, l.Allow(Request{IP: ip}).Allowed)
+	l.RecordBytes(ip, 800)
+	assert.True(t, l.Allow(Request{IP: ip}).Allowed)
+	l.RecordBytes(ip, 800)
+	d := l.Allow(Request{IP: ip})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, LimitBytes, d.Limit)
+}
+
+func TestLimiterIPv6Prefix(t *testing.T) {
+	l := NewLimiter(Limits{Requests: Limit{Rate: 0.001, Burst: 2}, IPv6PrefixLen: 64})
+	assert.True(t, l.Allow(Request{IP: "2001:db8:1:1::1"}).Allowed)
+	assert.True(t, l.Allow(Request{IP: "2001:db8:1:1::2"}).Allowed)
+	assert.False(t, l.Allow(Request{IP: "2001:db8:1:1:ffff::3"}).Allowed)
+	assert.True(t, l.Allow(Request{IP: "2001:db8:1:2::1"}).Allowed)
+	assert.Equal(t, 2, l.Len())
+}
+
+func TestLimiterExempt(t *testing.T) {
+	l := NewLimiter(Limits{Requests: Limit{Rate: 0.001, Burst: 1}, Exempt: []string{"10.1.0.0/16", "192.168.0.1"}})
+	for i := 0; i < 5; i++ {
+		assert.True(t, l.Allow(Request{IP: "10.1.2.3"}).Allowed)
+		assert.True(t, l.Allow(Request{IP: "192.168.0.1"}).Allowed)
+		assert.True(t, l.Allow(Request{IP: ""}).Allowed)
+	}
+	assert.True(t, l.Allow(Request{IP: "10.2.0.1"}).Allowed)
+	assert.False(t, l.Allow(Request{IP: "10.2.0.1"}).Allowed)
+	assert.Equal(t, 1, l.Len())
+}
+
+func TestLimiterEviction(t *testing.T) {
+	l := NewLimiter(Limits{Requests: Limit{Rate: 0.001, Burst: 2}, MaxClients: 4 * limiterShards})
+	attacker := "10.0.0.1"
+	assert.True(t, l.Allow(Request{IP: attacker}).Allowed)
+	assert.True(t, l.Allow(Request{IP: attacker}).Allowed)
+	for i := 0; i < 1000; i++ {
+		l.Allow(Request{IP: fmt.Sprintf("10.1.%v.%v", i/256, i%256)})
+		assert.False(t, l.Allow(Request{IP: attacker}).Allowed)
+	}
+	assert.LessOrEqual(t, l.Len(), 4*limiterShards)
+}
+
+func TestDecisionHeaders(t *testing.T) {
+	l := NewLimiter(Limits{Requests: Limit{Rate: 1, Burst: 10}, Claims: Limit{Rate: 0.1, Burst: 2}, ClaimWindow: Duration(time.Minute)})
+	h := http.Header{}
+	l.Allow(Request{IP: "10.0.0.1", ClaimID: "a"}).SetHeaders(h)
+	assert.Equal(t, "2", h.Get("RateLimit-Limit"))
+	assert.Equal(t, "1", h.Get("RateLimit-Remaining"))
+	assert.Equal(t, "10", h.Get("RateLimit-Reset"))
+	assert.Empty(t, h.Get("Retry-After"))
+
+	l.Allow(Request{IP: "10.0.0.1", ClaimID: "b"})
+	h = http.Header{}
+	l.Allow(Request{IP: "10.0.0.1", ClaimID: "c"}).SetHeaders(h)
+	assert.Equal(t, "0", h.Get("RateLimit-Remaining"))
+	assert.Equal(t, "10", h.Get("Retry-After"))
+}
+
+func TestLoadLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	b, err := json.Marshal(map[string]any{
+		"downloads":    Limit{Rate: 1, Burst: 5},
+		"claim_window": "5m",
+		"exempt":       []string{"10.0.0.0/8"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0644))
+
+	l, err := LoadLimits(path)
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 1, Burst: 5}, l.Downloads)
+	assert.Equal(t, Duration(5*time.Minute), l.ClaimWindow)
+	assert.Equal(t, []string{"10.0.0.0/8"}, l.Exempt)
+	assert.Zero(t, l.Requests.Burst, "requests are not limited by default")
+	assert.Equal(t, 64, l.IPv6PrefixLen)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"ipv6_prefix_len": 200}`), 0644))
+	_, err = LoadLimits(path)
+	assert.Error(t, err)
+}
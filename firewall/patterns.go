@@ -0,0 +1,387 @@
+package firewall
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/OdyseeTeam/player-server/internal/atomicfile"
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/internal/reload"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// Request fields pattern rules can match.
+const (
+	FieldPath        = "path"
+	FieldURI         = "uri" // path and query string, escaped
+	FieldClaimName   = "claim_name"
+	FieldChannelName = "channel_name"
+	FieldSDHash      = "sd_hash"
+)
+
+var patternFields = []string{FieldPath, FieldURI, FieldClaimName, FieldChannelName, FieldSDHash}
+
+// PatternsPath is the file pattern rules are loaded from and persisted to. Rules are kept in memory only if it's empty.
+var PatternsPath string
+
+// PatternRule blocks requests whose field matches either a regular expression or a glob (* and ? wildcards).
+type PatternRule struct {
+	Name       string `json:"name"`
+	Field      string `json:"field"`
+	Regex      string `json:"regex,omitempty"`
+	Glob       string `json:"glob,omitempty"`
+	IgnoreCase bool   `json:"ignore_case,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	// Status is the response code for blocked requests, 403 if not set.
+	Status    int       `json:"status,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitempty"`
+}
+
+// PatternInput holds request fields to match, empty fields are skipped.
+type PatternInput struct {
+	Path        string
+	URI         string
+	ClaimName   string
+	ChannelName string
+	SDHash      string
+}
+
+func (in PatternInput) value(field string) string {
+	switch field {
+	case FieldPath:
+		return in.Path
+	case FieldURI:
+		return in.URI
+	case FieldClaimName:
+		return in.ClaimName
+	case FieldChannelName:
+		return in.ChannelName
+	case FieldSDHash:
+		return in.SDHash
+	}
+	return ""
+}
+
+// DefaultPatternRules returns rules in effect when no patterns file is configured.
+func DefaultPatternRules() []PatternRule {
+	return []PatternRule{
+		{Name: "katmovie18", Field: FieldURI, Glob: "*Katmovie18*", Reason: "abuse", Status: http.StatusForbidden},
+	}
+}
+
+func (r PatternRule) expression() string {
+	if r.IgnoreCase {
+		return "(?i)" + r.Regex
+	}
+	return r.Regex
+}
+
+// matchGlob matches value against a glob where * matches any sequence of characters and ? a single one.
+func matchGlob(glob, value string) bool {
+	// Backtracking only needs to resume after the last star, keeping matching linear in practice.
+	gi, vi := 0, 0
+	star, next := -1, 0
+	for vi < len(value) {
+		if gi < len(glob) {
+			switch glob[gi] {
+			case '*':
+				star, next = gi, vi
+				gi++
+				continue
+			case '?':
+				_, size := utf8.DecodeRuneInString(value[vi:])
+				gi++
+				vi += size
+				continue
+			default:
+				if glob[gi] == value[vi] {
+					gi++
+					vi++
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(value[next:])
+		next += size
+		gi, vi = star+1, next
+	}
+	for gi < len(glob) && glob[gi] == '*' {
+		gi++
+	}
+	return gi == len(glob)
+}
+
+// normalize validates the rule and fills in defaults.
+func (r *PatternRule) normalize() error {
+	if r.Name == "" {
+		return errors.Err("a pattern rule needs a name")
+	}
+	if !contains(patternFields, r.Field) {
+		return errors.Err("rule %v has invalid field %q, expected one of %v", r.Name, r.Field, strings.Join(patternFields, ", "))
+	}
+	if (r.Regex == "") == (r.Glob == "") {
+		return errors.Err("rule %v needs either a regex or a glob", r.Name)
+	}
+	if r.Status == 0 {
+		r.Status = http.StatusForbidden
+	}
+	if r.Status < 400 || r.Status > 599 {
+		return errors.Err("rule %v has invalid status %v", r.Name, r.Status)
+	}
+	if r.Regex != "" {
+		if _, err := regexp.Compile(r.expression()); err != nil {
+			return errors.Err("rule %v has invalid pattern: %v", r.Name, err)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type compiledRule struct {
+	rule *PatternRule
+	// glob is lowercased for rules ignoring case, re is only set for regex rules.
+	glob string
+	re   *regexp.Regexp
+	// substr is set for globs of the common *text* form, which need no wildcard matching.
+	substr string
+}
+
+func (cr compiledRule) match(value string) bool {
+	switch {
+	case cr.re != nil:
+		return cr.re.MatchString(value)
+	case cr.substr != "":
+		return strings.Contains(value, cr.substr)
+	default:
+		return matchGlob(cr.glob, value)
+	}
+}
+
+// fieldRules holds rules of one field. Regex rules are also combined into one expression,
+// so values that match none of them are rejected in a single pass.
+type fieldRules struct {
+	regexes *regexp.Regexp
+	rules   []compiledRule
+}
+
+// patternSet is an immutable snapshot of rules, swapped atomically so matching never takes a lock.
+type patternSet struct {
+	fields map[string]*fieldRules
+	rules  []PatternRule
+}
+
+func newPatternSet(rules []PatternRule) (*patternSet, error) {
+	ps := &patternSet{fields: map[string]*fieldRules{}, rules: rules}
+	exprs := map[string][]string{}
+	for i := range ps.rules {
+		r := &ps.rules[i]
+		if err := r.normalize(); err != nil {
+			return nil, err
+		}
+		fr := ps.fields[r.Field]
+		if fr == nil {
+			fr = &fieldRules{}
+			ps.fields[r.Field] = fr
+		}
+		cr := compiledRule{rule: r, glob: r.Glob}
+		if r.Regex != "" {
+			cr.re = regexp.MustCompile(r.expression())
+			exprs[r.Field] = append(exprs[r.Field], "(?:"+r.expression()+")")
+		} else {
+			if r.IgnoreCase {
+				cr.glob = strings.ToLower(r.Glob)
+			}
+			if inner := strings.TrimPrefix(strings.TrimSuffix(cr.glob, "*"), "*"); len(cr.glob) > 2 && "*"+inner+"*" == cr.glob && !strings.ContainsAny(inner, "*?") {
+				cr.substr = inner
+			}
+		}
+		fr.rules = append(fr.rules, cr)
+	}
+	for field, e := range exprs {
+		ps.fields[field].regexes = regexp.MustCompile(strings.Join(e, "|"))
+	}
+	return ps, nil
+}
+
+var (
+	patterns  atomic.Pointer[patternSet]
+	patternMu sync.Mutex
+)
+
+func init() {
+	ps, err := newPatternSet(DefaultPatternRules())
+	if err != nil {
+		panic(err)
+	}
+	patterns.Store(ps)
+}
+
+// patternFile is the on-disk format.
+type patternFile struct {
+	Rules []PatternRule `json:"rules"`
+}
+
+// ConfigurePatterns loads rules from path and persists rule changes to it.
+// Default rules stay in effect until the file is created.
+func ConfigurePatterns(path string) error {
+	PatternsPath = path
+	return ReloadPatterns()
+}
+
+// ReloadPatterns re-reads the patterns file, the active rules are kept if that fails.
+func ReloadPatterns() error {
+	if PatternsPath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(PatternsPath)
+	if os.IsNotExist(err) {
+		Logger.Warnf("patterns file %v does not exist, using %v built-in rules", PatternsPath, len(patterns.Load().rules))
+		return nil
+	} else if err != nil {
+		return errors.Err(err)
+	}
+	var f patternFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return errors.Err("cannot parse patterns file: %v", err)
+	}
+	ps, err := newPatternSet(f.Rules)
+	if err != nil {
+		return err
+	}
+	patterns.Store(ps)
+	Logger.Infof("loaded %v pattern rules from %v", len(ps.rules), PatternsPath)
+	return nil
+}
+
+// WatchPatterns reloads rules whenever the patterns file changes.
+func WatchPatterns(interval time.Duration) *stop.Group {
+	return reload.Watch(PatternsPath, interval, func() {
+		if err := ReloadPatterns(); err != nil {
+			Logger.Errorf("failed to reload pattern rules: %v", err)
+		}
+	})
+}
+
+// updatePatterns applies fn to rules by name, persists the result and activates it.
+func updatePatterns(fn func(byName map[string]PatternRule) bool) error {
+	patternMu.Lock()
+	defer patternMu.Unlock()
+	byName := map[string]PatternRule{}
+	for _, r := range patterns.Load().rules {
+		byName[r.Name] = r
+	}
+	if !fn(byName) {
+		return nil
+	}
+	rules := make([]PatternRule, 0, len(byName))
+	for _, r := range byName {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	ps, err := newPatternSet(rules)
+	if err != nil {
+		return err
+	}
+	if PatternsPath != "" {
+		data, err := json.MarshalIndent(patternFile{Rules: ps.rules}, "", "  ")
+		if err != nil {
+			return errors.Err(err)
+		}
+		if err := atomicfile.WriteFile(PatternsPath, data); err != nil {
+			return errors.Err("cannot save pattern rules: %v", err)
+		}
+	}
+	patterns.Store(ps)
+	return nil
+}
+
+// AddPatternRule activates a rule, replacing an existing rule with the same name.
+func AddPatternRule(r PatternRule) (PatternRule, error) {
+	if err := r.normalize(); err != nil {
+		return r, err
+	}
+	r.CreatedAt = time.Now()
+	err := updatePatterns(func(byName map[string]PatternRule) bool {
+		byName[r.Name] = r
+		return true
+	})
+	if err != nil {
+		return r, err
+	}
+	Logger.Infof("pattern rule %v on %v added by %v: %v", r.Name, r.Field, r.CreatedBy, r.Reason)
+	return r, nil
+}
+
+// RemovePatternRule deletes the rule with the given name, reporting whether it existed.
+func RemovePatternRule(name string) (bool, error) {
+	var found bool
+	err := updatePatterns(func(byName map[string]PatternRule) bool {
+		_, found = byName[name]
+		delete(byName, name)
+		return found
+	})
+	if err != nil || !found {
+		return false, err
+	}
+	Logger.Infof("pattern rule %v removed", name)
+	return true, nil
+}
+
+// PatternRules lists rules in effect.
+func PatternRules() []PatternRule {
+	rules := patterns.Load().rules
+	return append(make([]PatternRule, 0, len(rules)), rules...)
+}
+
+// MatchPatterns returns the first rule matching any of the input fields.
+func MatchPatterns(in PatternInput) (PatternRule, bool) {
+	ps := patterns.Load()
+	for _, field := range patternFields {
+		fr := ps.fields[field]
+		v := in.value(field)
+		if fr == nil || v == "" {
+			continue
+		}
+		regexMatched := fr.regexes != nil && fr.regexes.MatchString(v)
+		var lower string
+		for _, cr := range fr.rules {
+			if cr.re != nil && !regexMatched {
+				continue
+			}
+			value := v
+			if cr.re == nil && cr.rule.IgnoreCase {
+				if lower == "" {
+					lower = strings.ToLower(v)
+				}
+				value = lower
+			}
+			if cr.match(value) {
+				metrics.PatternMatches.WithLabelValues(cr.rule.Name, field).Inc()
+				return *cr.rule, true
+			}
+		}
+	}
+	return PatternRule{}, false
+}
@@ -0,0 +1,175 @@
+package firewall
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withPatterns(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "patterns.json")
+	if content != "" {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	orig, origSet := PatternsPath, patterns.Load()
+	require.NoError(t, ConfigurePatterns(path))
+	t.Cleanup(func() {
+		PatternsPath = orig
+		patterns.Store(origSet)
+	})
+	return path
+}
+
+func TestMatchPatternsDefault(t *testing.T) {
+	rule, ok := MatchPatterns(PatternInput{URI: "/api/v3/streams/free/Katmovie18-movie/abc/def"})
+	require.True(t, ok)
+	assert.Equal(t, "katmovie18", rule.Name)
+	assert.Equal(t, http.StatusForbidden, rule.Status)
+
+	// The query string is matched as well.
+	_, ok = MatchPatterns(PatternInput{Path: "/api/v3/streams/free/movie/abc/def", URI: "/api/v3/streams/free/movie/abc/def?ref=Katmovie18"})
+	assert.True(t, ok)
+
+	_, ok = MatchPatterns(PatternInput{Path: "/api/v3/streams/free/movie/abc/def", URI: "/api/v3/streams/free/movie/abc/def"})
+	assert.False(t, ok)
+}
+
+func TestMatchPatterns(t *testing.T) {
+	withPatterns(t, `{"rules": [
+		{"name": "spam-claims", "field": "claim_name", "glob": "*free-movies*", "ignore_case": true, "reason": "spam", "status": 410},
+		{"name": "spam-channel", "field": "channel_name", "regex": "^@spam[0-9]+$", "reason": "spam channel"},
+		{"name": "dmca", "field": "sd_hash", "glob": "abcdef0123", "reason": "dmca", "status": 451},
+		{"name": "legacy", "field": "path", "regex": "/content/claims/"}
+	]}`)
+
+	cases := []struct {
+		in   PatternInput
+		rule string
+	}{
+		{PatternInput{ClaimName: "watch-FREE-Movies-now"}, "spam-claims"},
+		{PatternInput{ClaimName: "free-movie"}, ""},
+		{PatternInput{ChannelName: "@spam42"}, "spam-channel"},
+		{PatternInput{ChannelName: "@spam42x"}, ""},
+		{PatternInput{SDHash: "abcdef0123"}, "dmca"},
+		{PatternInput{SDHash: "abcdef01234"}, ""},
+		{PatternInput{Path: "/content/claims/what/abc/stream"}, "legacy"},
+		// Default rules are replaced by the file.
+		{PatternInput{Path: "/api/v3/streams/free/Katmovie18/abc/def"}, ""},
+	}
+	for _, tc := range cases {
+		rule, ok := MatchPatterns(tc.in)
+		assert.Equal(t, tc.rule != "", ok, tc.in)
+		assert.Equal(t, tc.rule, rule.Name, tc.in)
+	}
+
+	rule, _ := MatchPatterns(PatternInput{ClaimName: "free-movies"})
+	assert.Equal(t, 410, rule.Status)
+	rule, _ = MatchPatterns(PatternInput{ChannelName: "@spam1"})
+	assert.Equal(t, http.StatusForbidden, rule.Status)
+}
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		glob, value string
+		match       bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"abc", "abc", true},
+		{"abc", "abcd", false},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"a?c", "abc", true},
+		{"a?c", "aéc", true},
+		{"a?c", "ac", false},
+		{"*ab*ab", "xabyabab", true},
+		{"*ab*ab", "xabyaba", false},
+		{"@spam*", "@spammer", true},
+		{"**x", "x", true},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.match, matchGlob(tc.glob, tc.value), "%v %v", tc.glob, tc.value)
+	}
+}
+
+func TestReloadPatternsInvalid(t *testing.T) {
+	path := withPatterns(t, `{"rules": [{"name": "a", "field": "path", "glob": "*bad*"}]}`)
+
+	for _, content := range []string{
+		`{"rules": [{"name": "b", "field": "path", "regex": "("}]}`,
+		`{"rules": [{"name": "b", "field": "title", "glob": "*"}]}`,
+		`{"rules": [{"name": "b", "field": "path", "glob": "*", "regex": ".*"}]}`,
+		`{"rules": [{"name": "b", "field": "path", "glob": "*", "status": 200}]}`,
+		`{"rules": [{"field": "path", "glob": "*"}]}`,
+		`not json`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		assert.Error(t, ReloadPatterns(), content)
+		// The active rules are kept.
+		_, ok := MatchPatterns(PatternInput{Path: "/bad/"})
+		assert.True(t, ok)
+	}
+}
+
+func TestAddRemovePatternRule(t *testing.T) {
+	path := withPatterns(t, "")
+
+	_, err := AddPatternRule(PatternRule{Name: "bad", Field: FieldPath, Regex: "("})
+	require.Error(t, err)
+
+	rule, err := AddPatternRule(PatternRule{Name: "spam", Field: FieldClaimName, Glob: "spam-*", Reason: "spam", CreatedBy: "admin"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, rule.Status)
+	assert.False(t, rule.CreatedAt.IsZero())
+
+	_, ok := MatchPatterns(PatternInput{ClaimName: "spam-1"})
+	assert.True(t, ok)
+
+	var saved patternFile
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &saved))
+	names := []string{}
+	for _, r := range saved.Rules {
+		names = append(names, r.Name)
+	}
+	assert.Equal(t, []string{"katmovie18", "spam"}, names)
+
+	// Rules survive a reload from the saved file.
+	require.NoError(t, ReloadPatterns())
+	assert.Len(t, PatternRules(), 2)
+
+	found, err := RemovePatternRule("spam")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = RemovePatternRule("spam")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, ok = MatchPatterns(PatternInput{ClaimName: "spam-1"})
+	assert.False(t, ok)
+}
+
+func BenchmarkMatchPatterns(b *testing.B) {
+	rules := []PatternRule{}
+	for _, g := range []string{"*spam*", "*free-movies*", "*warez*", "*Katmovie18*", "*crack*", "*keygen*"} {
+		rules = append(rules, PatternRule{Name: g, Field: FieldPath, Glob: g}, PatternRule{Name: "c" + g, Field: FieldClaimName, Glob: g})
+	}
+	ps, err := newPatternSet(rules)
+	require.NoError(b, err)
+	orig := patterns.Load()
+	patterns.Store(ps)
+	defer patterns.Store(orig)
+
+	in := PatternInput{Path: "/api/v3/streams/free/some-claim/0123456789abcdef/0123456789", ClaimName: "some-claim", ChannelName: "@channel"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		MatchPatterns(in)
+	}
+}
@@ -0,0 +1,42 @@
+// Package atomicfile replaces files so that readers, including the player itself after a crash,
+// never see them partially written.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Write creates the file at path with the contents written by write. A temporary file in the same directory
+// is passed to write and renamed to path once write succeeds, path is left untouched if it fails.
+// Missing parent directories are created.
+func Write(path string, write func(f *os.File) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = tmp.Chmod(0644)
+	if err == nil {
+		err = write(tmp)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WriteFile replaces the file at path with data.
+func WriteFile(path string, data []byte) error {
+	return Write(path, func(f *os.File) error {
+		_, err := f.Write(data)
+		return err
+	})
+}
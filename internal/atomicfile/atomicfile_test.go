@@ -0,0 +1,32 @@
+package atomicfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "bans.json")
+	require.NoError(t, WriteFile(path, []byte("[1]")))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "[1]", string(b))
+
+	// A failed write leaves the file and no temporary files behind.
+	err = Write(path, func(f *os.File) error {
+		f.Write([]byte("[1, 2"))
+		return errors.New("interrupted")
+	})
+	assert.EqualError(t, err, "interrupted")
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "[1]", string(b))
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -3,8 +3,12 @@ package config
 import (
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/OdyseeTeam/player-server/firewall"
+	"github.com/OdyseeTeam/player-server/internal/iapi"
+	"github.com/OdyseeTeam/player-server/pkg/edgetoken"
+	"github.com/OdyseeTeam/player-server/pkg/health"
 	"github.com/OdyseeTeam/player-server/player"
 
 	"github.com/gin-gonic/gin"
@@ -13,12 +17,29 @@ import (
 var UserName string
 var Password string
 
+// EdgeTokens is the edge token set reloaded by the config endpoint.
+var EdgeTokens *edgetoken.Set
+
+// Health is the readiness checker drained by the config endpoint.
+var Health *health.Checker
+
 func InstallConfigRoute(r *gin.Engine) {
 	authorized := r.Group("/config", gin.BasicAuth(gin.Accounts{
 		UserName: Password,
 	}))
 	authorized.POST("/throttle", throttle)
 	authorized.POST("/blacklist", reloadBlacklist)
+	authorized.GET("/bans", listBans)
+	authorized.POST("/bans", addBan)
+	authorized.DELETE("/bans", removeBan)
+	authorized.GET("/escalation", explainEscalation)
+	authorized.GET("/patterns", listPatterns)
+	authorized.POST("/patterns", addPattern)
+	authorized.DELETE("/patterns", removePattern)
+	authorized.POST("/edge-tokens", reloadEdgeTokens)
+	authorized.POST("/blocked-content", refreshBlockedContent)
+	authorized.POST("/rate-limits", reloadRateLimits)
+	authorized.POST("/drain", drain)
 }
 
 // throttle allows for live configuration of the throttle scalar for the player (MB/s)
@@ -50,3 +71,161 @@ func reloadBlacklist(c *gin.Context) {
 	firewall.ReloadBlacklist()
 	c.String(http.StatusOK, "blacklist reloaded")
 }
+
+// reloadRateLimits reloads rate limits from the limits file
+func reloadRateLimits(c *gin.Context) {
+	if err := firewall.ReloadLimits(); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, firewall.RateLimiter.Limits())
+}
+
+// drain makes the player report itself not ready ahead of a shutdown, or ready again with enabled=false.
+// curl -u user:pass -d enabled=true http://localhost:8080/config/drain
+func drain(c *gin.Context) {
+	if Health == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "readiness checks are not enabled"})
+		return
+	}
+	enabled, err := strconv.ParseBool(c.DefaultPostForm("enabled", "true"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to parse enabled " + c.PostForm("enabled")})
+		return
+	}
+	Health.SetDraining(enabled)
+	c.JSON(http.StatusOK, gin.H{"draining": Health.Draining()})
+}
+
+// listBans lists bans in effect
+func listBans(c *gin.Context) {
+	c.JSON(http.StatusOK, firewall.Bans())
+}
+
+type banRequest struct {
+	firewall.Ban
+	// TTL is a duration (24h) the ban lasts for, an alternative to setting expires_at.
+	TTL string `json:"ttl"`
+}
+
+// addBan bans an IP, a CIDR range or an ASN. The creator defaults to the authenticated user.
+// curl -u user:pass -d '{"ip": "192.0.2.0/24", "reason": "scraping", "ttl": "24h"}' http://localhost:8080/config/bans
+func addBan(c *gin.Context) {
+	var req banRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "failed to parse ttl " + req.TTL})
+			return
+		}
+		exp := time.Now().Add(ttl)
+		req.ExpiresAt = &exp
+	}
+	if req.CreatedBy == "" {
+		req.CreatedBy = c.GetString(gin.AuthUserKey)
+	}
+	ban, err := firewall.AddBan(req.Ban)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ban)
+}
+
+// removeBan lifts a ban on an IP, a CIDR range or an ASN (AS<number>) given in the target parameter
+func removeBan(c *gin.Context) {
+	target, err := firewall.ParseBanTarget(c.Query("target"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	found, err := firewall.RemoveBan(target)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no such ban"})
+		return
+	}
+	c.String(http.StatusOK, "ban lifted")
+}
+
+// listPatterns lists pattern rules in effect
+func listPatterns(c *gin.Context) {
+	c.JSON(http.StatusOK, firewall.PatternRules())
+}
+
+// addPattern adds a rule blocking requests by url path, claim name, channel name or sd hash, replacing a rule with the same name.
+// curl -u user:pass -d '{"name": "spam", "field": "claim_name", "glob": "*free-movies*", "reason": "spam", "status": 410}' http://localhost:8080/config/patterns
+func addPattern(c *gin.Context) {
+	var rule firewall.PatternRule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if rule.CreatedBy == "" {
+		rule.CreatedBy = c.GetString(gin.AuthUserKey)
+	}
+	rule, err := firewall.AddPatternRule(rule)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// removePattern deletes the pattern rule given in the name parameter
+func removePattern(c *gin.Context) {
+	found, err := firewall.RemovePatternRule(c.Query("name"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no such pattern rule"})
+		return
+	}
+	c.String(http.StatusOK, "pattern rule removed")
+}
+
+// explainEscalation describes abuse signals, offenses and bans of an ip or asn given as a parameter
+// http://localhost:8080/config/escalation?ip=192.0.2.1
+func explainEscalation(c *gin.Context) {
+	if ip := c.Query("ip"); ip != "" {
+		c.JSON(http.StatusOK, firewall.Escalations.ExplainIP(ip))
+		return
+	}
+	asn, err := strconv.Atoi(c.Query("asn"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "ip or asn is required"})
+		return
+	}
+	c.JSON(http.StatusOK, firewall.Escalations.ExplainASN(asn))
+}
+
+// refreshBlockedContent forces a sync of the blocked content list
+func refreshBlockedContent(c *gin.Context) {
+	if err := iapi.RefreshBlocklist(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	c.String(http.StatusOK, "blocked content list refreshed")
+}
+
+// reloadEdgeTokens reloads edge tokens from the tokens file
+func reloadEdgeTokens(c *gin.Context) {
+	if EdgeTokens == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "edge tokens are not configured"})
+		return
+	}
+	if err := EdgeTokens.Reload(); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.String(http.StatusOK, "%v edge tokens loaded", EdgeTokens.Len())
+}
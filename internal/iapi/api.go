@@ -4,10 +4,31 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"os"
+	"sync/atomic"
 	"time"
 
-	"github.com/bluele/gcache"
+	"github.com/OdyseeTeam/player-server/internal/atomicfile"
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
 	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+var Logger = logger.GetLogger()
+
+// DefaultBlocklistURL is the internal-apis endpoint listing blocked claims.
+const DefaultBlocklistURL = "https://api.odysee.com/file/list_blocked?with_claim_id=true"
+
+// FailPolicy decides what happens to requests when the blocked content list is unavailable.
+type FailPolicy string
+
+const (
+	// FailOpen serves all content when the list is unavailable.
+	FailOpen FailPolicy = "open"
+	// FailClosed blocks all content when the list is unavailable.
+	FailClosed FailPolicy = "closed"
 )
 
 type BlockedContent struct {
@@ -15,50 +36,246 @@ type BlockedContent struct {
 	//Outpoint string `json:"outpoint"`
 }
 
-var blockedCache = gcache.New(10).Expiration(2 * time.Minute).Build()
+// BlocklistOpts configure blocked content list syncing.
+type BlocklistOpts struct {
+	URL string
+	// SnapshotPath is where the last successfully fetched list is kept, used at startup
+	// until the first sync succeeds. Empty disables snapshots.
+	SnapshotPath string
+	Interval     time.Duration
+	// MaxAge is how old the list can get when syncs keep failing before it is considered unavailable.
+	// Zero means the last known list is used indefinitely.
+	MaxAge     time.Duration
+	FailPolicy FailPolicy
+}
+
+// snapshot is an immutable version of the list, also used as the on-disk format.
+type snapshot struct {
+	FetchedAt    time.Time `json:"fetched_at"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ClaimIDs     []string  `json:"claim_ids"`
 
-func GetBlockedContent() (map[string]bool, error) {
-	cachedVal, err := blockedCache.Get("blocked")
-	if err == nil && cachedVal != nil {
-		return cachedVal.(map[string]bool), nil
+	blocked map[string]bool
+}
+
+// Blocklist keeps the blocked content list in memory, syncing it in the background.
+type Blocklist struct {
+	opts   BlocklistOpts
+	client *http.Client
+	list   atomic.Pointer[snapshot]
+	grp    *stop.Group
+}
+
+var current atomic.Pointer[Blocklist]
+
+// NewBlocklist creates a blocklist, loading the snapshot from disk if there is one.
+func NewBlocklist(opts BlocklistOpts) *Blocklist {
+	if opts.URL == "" {
+		opts.URL = DefaultBlocklistURL
+	}
+	if opts.Interval == 0 {
+		opts.Interval = 2 * time.Minute
+	}
+	if opts.FailPolicy == "" {
+		opts.FailPolicy = FailOpen
+	}
+	b := &Blocklist{opts: opts, client: &http.Client{Timeout: 30 * time.Second}, grp: stop.New()}
+	if opts.SnapshotPath != "" {
+		if err := b.loadSnapshot(); err != nil && !os.IsNotExist(errors.Unwrap(err)) {
+			Logger.Warnf("cannot load blocked content snapshot: %v", err)
+		}
 	}
+	return b
+}
 
-	url := "https://api.odysee.com/file/list_blocked?with_claim_id=true"
-	method := "GET"
-	type APIResponse struct {
-		Data []BlockedContent
+// InitBlocklist creates the process-wide blocklist, syncs it and keeps syncing in the background.
+func InitBlocklist(opts BlocklistOpts) *Blocklist {
+	b := NewBlocklist(opts)
+	if err := b.Refresh(); err != nil {
+		Logger.Errorf("initial blocked content sync failed: %v", err)
+	}
+	b.Start()
+	current.Store(b)
+	return b
+}
+
+// IsBlocked checks any of the IDs against the process-wide blocklist.
+// Nothing is blocked if the blocklist was never initialized.
+func IsBlocked(ids ...string) bool {
+	b := current.Load()
+	if b == nil {
+		return false
 	}
+	return b.Blocked(ids...)
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest(method, url, nil)
+// RefreshBlocklist forces a sync of the process-wide blocklist.
+func RefreshBlocklist() error {
+	b := current.Load()
+	if b == nil {
+		return errors.Err("blocked content list is not initialized")
+	}
+	return b.Refresh()
+}
+
+// Blocked checks if any of the IDs is on the list. Empty IDs are ignored.
+// The fail policy applies when the list is unavailable.
+func (b *Blocklist) Blocked(ids ...string) bool {
+	s := b.list.Load()
+	if s == nil || (b.opts.MaxAge > 0 && time.Since(s.FetchedAt) > b.opts.MaxAge) {
+		return b.opts.FailPolicy == FailClosed
+	}
+	for _, id := range ids {
+		if id != "" && s.blocked[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of blocked claims.
+func (b *Blocklist) Len() int {
+	if s := b.list.Load(); s != nil {
+		return len(s.ClaimIDs)
+	}
+	return 0
+}
 
+// Age returns time since the list was last fetched successfully, zero if it never was.
+func (b *Blocklist) Age() time.Duration {
+	if s := b.list.Load(); s != nil {
+		return time.Since(s.FetchedAt)
+	}
+	return 0
+}
+
+// Start syncs the list every Interval until Shutdown is called.
+func (b *Blocklist) Start() {
+	b.grp.Add(1)
+	go func() {
+		defer b.grp.Done()
+		t := time.NewTicker(b.opts.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-b.grp.Ch():
+				return
+			case <-t.C:
+				if err := b.Refresh(); err != nil {
+					Logger.Errorf("blocked content sync failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops background syncing.
+func (b *Blocklist) Shutdown() {
+	b.grp.StopAndWait()
+}
+
+// Refresh fetches the list if it has changed since the last sync.
+func (b *Blocklist) Refresh() error {
+	err := b.refresh()
 	if err != nil {
-		return nil, errors.Err(err)
+		metrics.BlocklistSyncs.WithLabelValues("error").Inc()
 	}
-	res, err := client.Do(req)
+	metrics.BlocklistAge.Set(b.Age().Seconds())
+	return err
+}
+
+func (b *Blocklist) refresh() error {
+	prev := b.list.Load()
+	req, err := http.NewRequest(http.MethodGet, b.opts.URL, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+	res, err := b.client.Do(req)
 	if err != nil {
-		return nil, errors.Err(err)
+		return errors.Err(err)
 	}
 	defer res.Body.Close()
-	if res.StatusCode != 200 {
-		return nil, errors.Err("unexpected status code %d", res.StatusCode)
+
+	if res.StatusCode == http.StatusNotModified && prev != nil {
+		next := *prev
+		next.FetchedAt = time.Now()
+		b.list.Store(&next)
+		metrics.BlocklistSyncs.WithLabelValues("not_modified").Inc()
+		return nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.Err("unexpected status code %d", res.StatusCode)
 	}
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, errors.Err(err)
+		return errors.Err(err)
+	}
+	var response struct {
+		Data []BlockedContent
 	}
-	var response APIResponse
 	err = json.Unmarshal(body, &response)
 	if err != nil {
-		return nil, errors.Err(err)
+		return errors.Err(err)
+	}
+
+	s := &snapshot{
+		FetchedAt:    time.Now(),
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		ClaimIDs:     make([]string, 0, len(response.Data)),
 	}
-	blockedMap := make(map[string]bool, len(response.Data))
 	for _, bc := range response.Data {
-		blockedMap[bc.ClaimID] = true
+		s.ClaimIDs = append(s.ClaimIDs, bc.ClaimID)
+	}
+	s.index()
+	b.list.Store(s)
+	metrics.BlocklistSyncs.WithLabelValues("updated").Inc()
+	metrics.BlocklistSize.Set(float64(len(s.ClaimIDs)))
+
+	if b.opts.SnapshotPath != "" {
+		if err := b.saveSnapshot(s); err != nil {
+			Logger.Errorf("cannot save blocked content snapshot: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *snapshot) index() {
+	s.blocked = make(map[string]bool, len(s.ClaimIDs))
+	for _, id := range s.ClaimIDs {
+		s.blocked[id] = true
 	}
-	err = blockedCache.Set("blocked", blockedMap)
+}
+
+func (b *Blocklist) loadSnapshot() error {
+	data, err := os.ReadFile(b.opts.SnapshotPath)
+	if err != nil {
+		return errors.Err(err)
+	}
+	s := &snapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return errors.Err(err)
+	}
+	s.index()
+	b.list.Store(s)
+	metrics.BlocklistSize.Set(float64(len(s.ClaimIDs)))
+	Logger.Infof("loaded %v blocked claims from snapshot taken at %v", len(s.ClaimIDs), s.FetchedAt)
+	return nil
+}
+
+func (b *Blocklist) saveSnapshot(s *snapshot) error {
+	data, err := json.Marshal(s)
 	if err != nil {
-		return blockedMap, errors.Err(err)
+		return errors.Err(err)
 	}
-	return blockedMap, nil
+	return errors.Err(atomicfile.WriteFile(b.opts.SnapshotPath, data))
 }
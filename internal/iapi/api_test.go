@@ -0,0 +1,80 @@
+package iapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlocklist(t *testing.T) {
+	var requests, notModified atomic.Int32
+	var down atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"success": true, "data": [{"claim_id": "blocked1"}, {"claim_id": "channel1"}]}`))
+	}))
+	defer ts.Close()
+
+	snapshotPath := filepath.Join(t.TempDir(), "blocked.json")
+	b := NewBlocklist(BlocklistOpts{URL: ts.URL, SnapshotPath: snapshotPath})
+	assert.False(t, b.Blocked("blocked1"))
+
+	require.NoError(t, b.Refresh())
+	assert.Equal(t, 2, b.Len())
+	assert.True(t, b.Blocked("blocked1"))
+	assert.True(t, b.Blocked("other", "channel1"))
+	assert.False(t, b.Blocked("other", ""))
+
+	require.NoError(t, b.Refresh())
+	assert.EqualValues(t, 1, notModified.Load())
+	assert.True(t, b.Blocked("blocked1"))
+
+	// Snapshot is used when the source is down at startup
+	down.Store(true)
+	b2 := NewBlocklist(BlocklistOpts{URL: ts.URL, SnapshotPath: snapshotPath, FailPolicy: FailClosed})
+	assert.Error(t, b2.Refresh())
+	assert.True(t, b2.Blocked("blocked1"))
+	assert.False(t, b2.Blocked("other"))
+}
+
+func TestBlocklistFailPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	open := NewBlocklist(BlocklistOpts{URL: ts.URL, FailPolicy: FailOpen})
+	assert.Error(t, open.Refresh())
+	assert.False(t, open.Blocked("any"))
+
+	closed := NewBlocklist(BlocklistOpts{URL: ts.URL, FailPolicy: FailClosed, MaxAge: time.Minute})
+	assert.Error(t, closed.Refresh())
+	assert.True(t, closed.Blocked("any"))
+
+	// Stale lists count as unavailable
+	closed.list.Store(&snapshot{FetchedAt: time.Now().Add(-2 * time.Minute), blocked: map[string]bool{}})
+	assert.True(t, closed.Blocked("any"))
+	closed.list.Store(&snapshot{FetchedAt: time.Now(), blocked: map[string]bool{}})
+	assert.False(t, closed.Blocked("any"))
+}
+
+func TestIsBlockedUninitialized(t *testing.T) {
+	assert.False(t, IsBlocked("any"))
+	assert.Error(t, RefreshBlocklist())
+}
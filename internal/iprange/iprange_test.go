@@ -0,0 +1,29 @@
+package iprange
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrefix(t *testing.T) {
+	cases := map[string]string{
+		"192.0.2.1":            "192.0.2.1/32",
+		"192.0.2.77/24":        "192.0.2.0/24",
+		"2001:db8::1":          "2001:db8::1/128",
+		"2001:db8::ff/64":      "2001:db8::/64",
+		"::ffff:192.0.2.1":     "192.0.2.1/32",
+		"::ffff:192.0.2.1/120": "192.0.2.0/24",
+	}
+	for in, out := range cases {
+		p, err := ParsePrefix(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, out, p.String(), in)
+	}
+
+	for _, in := range []string{"", "192.0.2", "192.0.2.1/33", "example.com"} {
+		_, err := ParsePrefix(in)
+		assert.Error(t, err, in)
+	}
+}
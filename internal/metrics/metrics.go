@@ -29,8 +29,13 @@ const (
 
 	ResolveSourceCache          = "cache"
 	ResolveSourceOApi           = "oapi"
+	ResolveSourceCatalog        = "catalog"
 	ResolveFailureGeneral       = "general"
 	ResolveFailureClaimNotFound = "claim_not_found"
+
+	ShareAbuseClientIP    = "client_ip"
+	ShareAbuseSession     = "session"
+	ShareAbuseConcurrency = "concurrency"
 )
 
 var (
@@ -63,6 +68,57 @@ var (
 		Name:      "tc_out_bytes",
 		Help:      "Total number of bytes streamed out via transcoded content",
 	})
+	TcFragmentTTFB = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Name:      "tc_fragment_ttfb_seconds",
+		Help:      "Time to first byte of transcoded fragments by cache result (hit, miss, prefetched)",
+		Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"cache"})
+	TcFragmentCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "tc_fragment_cache_total",
+		Help:      "Total number of transcoded fragments served by cache result (hit, miss, prefetched)",
+	}, []string{"result"})
+	TcPrefetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "tc_prefetches_total",
+		Help:      "Total number of transcoded segment prefetches by result (fetched, failed, dropped when the queue is full)",
+	}, []string{"result"})
+	TcRestoreRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "tc_restore_running",
+		Help:      "Set to 1 while the transcoder cache is being restored from disk",
+	})
+	TcRestoreItems = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "tc_restore_items",
+		Help:      "Number of transcoded fragments restored into the transcoder cache",
+	})
+	TcRestoreSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "tc_restore_seconds",
+		Help:      "Time spent restoring the transcoder cache so far",
+	})
+	TcRestoreFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Name:      "tc_restore_fallbacks_total",
+		Help:      "Total number of requests served the original stream because the transcoder cache was being restored",
+	})
+	TcSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "tc_sessions",
+		Help:      "Number of viewer sessions of transcoded streams carrying an access decision",
+	})
+	HealthCheckFailing = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "health_check_failing",
+		Help:      "Set to 1 while a readiness check is failing",
+	}, []string{"check"})
+	HealthDraining = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Name:      "health_draining",
+		Help:      "Set to 1 while the player is draining and reports itself not ready",
+	})
 	HotCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: ns,
 		Subsystem: "hotcache",
@@ -128,6 +184,132 @@ var (
 		Buckets:   []float64{1, 2, 5, 25, 50, 100, 250, 400, 1000},
 	})
 
+	AdmissionRuleMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "admission",
+		Name:      "rule_matches_total",
+		Help:      "Total number of requests matched by admission policy rules",
+	}, []string{"rule", "action", "dry_run"})
+
+	PaidTokenShareAbuse = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "paid",
+		Name:      "token_share_abuse_total",
+		Help:      "Total number of paid tokens rejected for being used outside of their client, session or concurrency limits",
+	}, []string{"reason"})
+
+	GeoRestricted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "geo",
+		Name:      "restricted_total",
+		Help:      "Total number of requests rejected due to geo restrictions by client country",
+	}, []string{"country"})
+
+	BlocklistSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "blocklist",
+		Name:      "size",
+		Help:      "Number of claims on the blocked content list",
+	})
+	BlocklistAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "blocklist",
+		Name:      "age_seconds",
+		Help:      "Time since the blocked content list was last synced successfully",
+	})
+	BlocklistSyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "blocklist",
+		Name:      "syncs_total",
+		Help:      "Total number of blocked content list syncs by result",
+	}, []string{"result"})
+
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "ratelimit",
+		Name:      "limited_total",
+		Help:      "Total number of requests rejected by the rate limiter by exhausted limit",
+	}, []string{"limit"})
+	RateLimitEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "ratelimit",
+		Name:      "evictions_total",
+		Help:      "Total number of clients with non-idle rate limit state evicted from a full store",
+	})
+
+	BansActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "firewall",
+		Name:      "bans",
+		Help:      "Number of active bans by type (ip, asn)",
+	}, []string{"type"})
+
+	EscalationSignals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "firewall",
+		Name:      "abuse_signals_total",
+		Help:      "Total number of abuse signals reported to the escalation engine by signal",
+	}, []string{"signal"})
+	EscalationBans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "firewall",
+		Name:      "escalation_bans_total",
+		Help:      "Total number of temporary bans issued by the escalation engine by type (ip, asn)",
+	}, []string{"type", "dry_run"})
+	PatternMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "firewall",
+		Name:      "pattern_matches_total",
+		Help:      "Total number of requests blocked by pattern rules by rule name and matched field",
+	}, []string{"rule", "field"})
+
+	TranscodingRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "transcoding",
+		Name:      "requests_total",
+		Help:      "Total number of on-demand transcoding requests by result (submitted, failed, forbidden, dropped)",
+	}, []string{"result"})
+	TranscodingRequestsPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: "transcoding",
+		Name:      "requests_pending",
+		Help:      "Number of on-demand transcoding requests waiting to be submitted",
+	})
+	TranscodingCoverageBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "transcoding",
+		Name:      "coverage_bytes_total",
+		Help:      "Total number of bytes of video streams served by variant (original, transcoded)",
+	}, []string{"variant"})
+
+	AuditEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "audit",
+		Name:      "events_total",
+		Help:      "Total number of audit events by sink and result (written, dropped when the queue is full, failed after retries)",
+	}, []string{"sink", "result"})
+
+	ClientIPResolutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "http",
+		Name:      "client_ip_resolutions_total",
+		Help:      "Total number of requests by where the client IP was taken from (provider name, proxy or direct)",
+	}, []string{"source"})
+
+	DownloadQuotaRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "downloads",
+		Name:      "quota_rejections_total",
+		Help:      "Total number of downloads rejected by quotas by reason (ip_files, ip_bytes, account_files, account_bytes, disabled)",
+	}, []string{"reason"})
+
+	EdgeTokenChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: "edge",
+		Name:      "token_checks_total",
+		Help:      "Total number of edge token verifications by token name, scope and result",
+	}, []string{"token", "scope", "result"})
+
 	playerInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: ns,
 		Subsystem: "hotcache",
@@ -0,0 +1,31 @@
+// Package mmdb opens MaxMind databases so they can be replaced while lookups are in flight.
+package mmdb
+
+import (
+	"os"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Open reads the database at path into memory and validates it, dbType has to be
+// part of its database type (e.g. "ASN" or "Country"). Readers are not backed by
+// the file, so replaced readers can be dropped without closing them.
+func Open(path, dbType string) (*maxminddb.Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	db, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, errors.Err("invalid %v database %v: %v", dbType, path, err)
+	}
+	if !strings.Contains(db.Metadata.DatabaseType, dbType) {
+		return nil, errors.Err("%v is a %v database, not a %v one", path, db.Metadata.DatabaseType, dbType)
+	}
+	if err := db.Verify(); err != nil {
+		return nil, errors.Err("corrupt %v database %v: %v", dbType, path, err)
+	}
+	return db, nil
+}
@@ -0,0 +1,34 @@
+package mmdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OdyseeTeam/player-server/internal/mmdbtest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	country := filepath.Join(dir, "country.mmdb")
+	require.NoError(t, mmdbtest.Write(country, "GeoLite2-Country", map[string]map[string]any{
+		"1.1.1.0/24": {"country": map[string]any{"iso_code": "AU"}},
+	}))
+	db, err := Open(country, "Country")
+	require.NoError(t, err)
+	assert.Equal(t, "GeoLite2-Country", db.Metadata.DatabaseType)
+
+	_, err = Open(country, "ASN")
+	assert.ErrorContains(t, err, "not a ASN one")
+
+	garbage := filepath.Join(dir, "garbage.mmdb")
+	require.NoError(t, os.WriteFile(garbage, []byte("not a database"), 0644))
+	_, err = Open(garbage, "Country")
+	assert.ErrorContains(t, err, "invalid Country database")
+
+	_, err = Open(filepath.Join(dir, "missing.mmdb"), "Country")
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+// Package mmdbtest writes small MaxMind DB files for tests.
+package mmdbtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+)
+
+// Write creates an IPv6 MaxMind DB at path with records attached to networks in CIDR notation.
+// IPv4 networks are mapped into ::/96 the way MaxMind databases do. Record values can be
+// strings, unsigned integers or nested map[string]any.
+func Write(path, dbType string, records map[string]map[string]any) error {
+	var data bytes.Buffer
+	root := &node{}
+	nets := make([]string, 0, len(records))
+	for n := range records {
+		nets = append(nets, n)
+	}
+	sort.Strings(nets)
+
+	for _, n := range nets {
+		p, err := netip.ParsePrefix(n)
+		if err != nil {
+			return err
+		}
+		p = p.Masked()
+		bits := p.Bits()
+		addr := p.Addr().As16()
+		if p.Addr().Is4() {
+			// As16 returns an IPv4-mapped address, MaxMind places IPv4 under ::/96 instead.
+			bits += 96
+			addr[10], addr[11] = 0, 0
+		}
+		offset := data.Len()
+		if err := encode(&data, records[n]); err != nil {
+			return err
+		}
+		root.insert(addr, bits, offset)
+	}
+
+	nodes := root.number()
+	nodeCount := len(nodes)
+	var out bytes.Buffer
+	for _, nd := range nodes {
+		var rec [2]uint32
+		for i, child := range nd.children {
+			switch {
+			case child == nil:
+				rec[i] = uint32(nodeCount)
+			case child.leaf:
+				rec[i] = uint32(nodeCount + 16 + child.offset)
+			default:
+				rec[i] = uint32(child.id)
+			}
+		}
+		out.Write([]byte{byte(rec[0] >> 16), byte(rec[0] >> 8), byte(rec[0]), byte(rec[1] >> 16), byte(rec[1] >> 8), byte(rec[1])})
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	err := encode(&out, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"database_type":               dbType,
+		"description":                 map[string]any{"en": "Test database"},
+		"ip_version":                  uint16(6),
+		"languages":                   []string{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0644)
+}
+
+type node struct {
+	children [2]*node
+	leaf     bool
+	offset   int
+	id       int
+}
+
+func (n *node) insert(addr [16]byte, bits, offset int) {
+	cur := n
+	for i := 0; i < bits; i++ {
+		bit := (addr[i/8] >> (7 - uint(i%8))) & 1
+		if i == bits-1 {
+			cur.children[bit] = &node{leaf: true, offset: offset}
+			return
+		}
+		next := cur.children[bit]
+		if next == nil || next.leaf {
+			next = &node{}
+			cur.children[bit] = next
+		}
+		cur = next
+	}
+}
+
+// number assigns IDs to inner nodes in breadth-first order and returns them.
+func (n *node) number() []*node {
+	var nodes []*node
+	queue := []*node{n}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		cur.id = len(nodes)
+		nodes = append(nodes, cur)
+		for _, c := range cur.children {
+			if c != nil && !c.leaf {
+				queue = append(queue, c)
+			}
+		}
+	}
+	return nodes
+}
+
+func encode(w *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case string:
+		writeControl(w, 2, len(v))
+		w.WriteString(v)
+	case uint16:
+		writeUint(w, 5, uint64(v))
+	case uint32:
+		writeUint(w, 6, uint64(v))
+	case uint64:
+		writeUint(w, 9, v)
+	case int:
+		writeUint(w, 6, uint64(v))
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeControl(w, 7, len(v))
+		for _, k := range keys {
+			if err := encode(w, k); err != nil {
+				return err
+			}
+			if err := encode(w, v[k]); err != nil {
+				return err
+			}
+		}
+	case []string:
+		writeControl(w, 11, len(v))
+		for _, s := range v {
+			if err := encode(w, s); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+func writeUint(w *bytes.Buffer, typ int, v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	i := 0
+	for i < 8 && b[i] == 0 {
+		i++
+	}
+	writeControl(w, typ, 8-i)
+	w.Write(b[i:])
+}
+
+func writeControl(w *bytes.Buffer, typ, size int) {
+	if size >= 29+256 {
+		panic("mmdbtest: values of 285 bytes or more are not supported")
+	}
+	sizeBits := size
+	if size >= 29 {
+		sizeBits = 29
+	}
+	if typ <= 7 {
+		w.WriteByte(byte(typ<<5 | sizeBits))
+	} else {
+		w.WriteByte(byte(sizeBits))
+		w.WriteByte(byte(typ - 7))
+	}
+	if size >= 29 {
+		w.WriteByte(byte(size - 29))
+	}
+}
@@ -0,0 +1,69 @@
+package reload
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// DefaultInterval is how often watched paths are checked for changes.
+const DefaultInterval = 10 * time.Second
+
+// Watch polls path (a file or a directory) every interval and calls onChange whenever
+// its contents appear to have been modified. Call StopAndWait on the returned group to stop watching.
+func Watch(path string, interval time.Duration, onChange func()) *stop.Group {
+	grp := stop.New()
+	last := Fingerprint(path)
+
+	grp.Add(1)
+	go func() {
+		defer grp.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-grp.Ch():
+				return
+			case <-t.C:
+				current := Fingerprint(path)
+				if current != last {
+					last = current
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return grp
+}
+
+// Fingerprint returns a cheap summary of path state, consisting of the latest modification time
+// and total size of the file or of all files directly inside the directory.
+func Fingerprint(path string) [2]int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return [2]int64{}
+	}
+	if !info.IsDir() {
+		return [2]int64{info.ModTime().UnixNano(), info.Size()}
+	}
+
+	var fp [2]int64
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fp
+	}
+	for _, e := range entries {
+		fi, err := os.Stat(filepath.Join(path, e.Name()))
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		if fi.ModTime().UnixNano() > fp[0] {
+			fp[0] = fi.ModTime().UnixNano()
+		}
+		fp[1] += fi.Size() + 1
+	}
+	return fp
+}
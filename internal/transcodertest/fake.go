@@ -0,0 +1,129 @@
+// Package transcodertest provides an in-memory transcoder serving canned HLS renditions for tests.
+package transcodertest
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	tclient "github.com/OdyseeTeam/transcoder/client"
+)
+
+// Content types of rendition files by extension.
+var contentTypes = map[string]string{
+	".m3u8": "application/x-mpegurl",
+	".ts":   "video/mp2t",
+	".mp4":  "video/mp4",
+	".m4s":  "video/iso.segment",
+}
+
+// Fake is a transcoder keeping renditions in memory. It behaves like the transcoder client:
+// playback paths are only returned for streams that have a rendition and fragments are served
+// with the same headers.
+type Fake struct {
+	mu      sync.Mutex
+	streams map[string]map[string][]byte
+	played  []string
+	// Err is returned from PlayFragment if set.
+	Err error
+	// RestoreGate, if set, makes RestoreCache wait until it is closed.
+	RestoreGate chan struct{}
+}
+
+// New creates a fake with no renditions.
+func New() *Fake {
+	return &Fake{streams: map[string]map[string][]byte{}}
+}
+
+// AddStream adds a rendition made of the given files, which must include master.m3u8.
+func (f *Fake) AddStream(sdHash string, files map[string][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streams[sdHash] = files
+}
+
+// AddHLSStream adds a rendition with a master playlist, one variant and the given number of
+// segments, either MPEG-TS or fragmented MP4 ones with an init segment.
+func (f *Fake) AddHLSStream(sdHash string, segments int, fmp4 bool) {
+	files := map[string][]byte{
+		tclient.MasterPlaylistName: []byte("#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-STREAM-INF:BANDWIDTH=1500000,RESOLUTION=1280x720\nv0.m3u8\n"),
+	}
+	ext := ".ts"
+	var variant strings.Builder
+	variant.WriteString("#EXTM3U\n#EXT-X-VERSION:6\n#EXT-X-TARGETDURATION:6\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+	if fmp4 {
+		ext = ".m4s"
+		variant.WriteString("#EXT-X-MAP:URI=\"v0_init.mp4\"\n")
+		files["v0_init.mp4"] = []byte("ftyp-init-" + sdHash)
+	}
+	for i := 0; i < segments; i++ {
+		name := fmt.Sprintf("v0_s%06d%v", i, ext)
+		fmt.Fprintf(&variant, "#EXTINF:6.000,\n%v\n", name)
+		files[name] = []byte(fmt.Sprintf("segment-%v-%d", sdHash, i))
+	}
+	variant.WriteString("#EXT-X-ENDLIST\n")
+	files["v0.m3u8"] = []byte(variant.String())
+	f.AddStream(sdHash, files)
+}
+
+// GetPlaybackPath returns the master playlist path of the rendition, or an empty string if there's none.
+func (f *Fake) GetPlaybackPath(lbryURL, sdHash string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.streams[sdHash][tclient.MasterPlaylistName]; !ok {
+		return ""
+	}
+	return fmt.Sprintf("%v/%v/%v", strings.Replace(lbryURL, "#", "/", 1), sdHash, tclient.MasterPlaylistName)
+}
+
+// PlayFragment serves a rendition file.
+func (f *Fake) PlayFragment(lbryURL, sdHash, fragmentName string, w http.ResponseWriter, r *http.Request) (int64, error) {
+	f.mu.Lock()
+	content, ok := f.streams[sdHash][fragmentName]
+	err := f.Err
+	if err == nil && ok {
+		f.played = append(f.played, sdHash+"/"+fragmentName)
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, tclient.ErrNotFound
+	}
+
+	w.Header().Set("x-cache", "HIT")
+	if ct, ok := contentTypes[path.Ext(fragmentName)]; ok {
+		w.Header().Set("content-type", ct)
+	}
+	w.Header().Set("cache-control", "public, max-age=21239")
+	w.Header().Set("access-control-allow-origin", "*")
+	w.Header().Set("access-control-allow-methods", "GET, OPTIONS")
+	http.ServeContent(w, r, fragmentName, time.Time{}, bytes.NewReader(content))
+	return int64(len(content)), nil
+}
+
+// RestoreCache returns the number of rendition files.
+func (f *Fake) RestoreCache() (int64, error) {
+	if f.RestoreGate != nil {
+		<-f.RestoreGate
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int64
+	for _, files := range f.streams {
+		n += int64(len(files))
+	}
+	return n, nil
+}
+
+// Played lists files served by PlayFragment as sd_hash/name.
+func (f *Fake) Played() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.played...)
+}
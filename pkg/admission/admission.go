@@ -0,0 +1,344 @@
+// Package admission decides whether media requests are allowed, flagged or denied
+// based on their referrer, origin, user agent and other client-supplied headers.
+package admission
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/internal/reload"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+var Logger = logger.GetLogger()
+
+// Action is what should happen to a request matched by a rule.
+type Action string
+
+const (
+	Allow Action = "allow"
+	Flag  Action = "flag"
+	Deny  Action = "deny"
+)
+
+// Endpoint families that rules can be scoped to.
+const (
+	FamilyV1     = "v1"
+	FamilyV2     = "v2"
+	FamilyV3     = "v3"
+	FamilyV4     = "v4"
+	FamilyV5     = "v5"
+	FamilyV6     = "v6"
+	FamilySpeech = "speech"
+)
+
+const headerXRequestedWith = "X-Requested-With"
+
+// Rule matches a request if any of its conditions is satisfied.
+type Rule struct {
+	Name   string `json:"name"`
+	Action Action `json:"action"`
+	// Endpoints limits the rule to the listed endpoint families, empty means all endpoints.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// DryRun rules are only counted in metrics and never affect the decision.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Origins and Referrers are matched exactly.
+	Origins   []string `json:"origins,omitempty"`
+	Referrers []string `json:"referrers,omitempty"`
+	// OriginHosts and ReferrerHosts match the host part of the header and all its subdomains.
+	OriginHosts   []string `json:"origin_hosts,omitempty"`
+	ReferrerHosts []string `json:"referrer_hosts,omitempty"`
+
+	UserAgentPrefixes []string `json:"user_agent_prefixes,omitempty"`
+	XRequestedWith    []string `json:"x_requested_with,omitempty"`
+	// Headers match if the request has any of them set, regardless of the value.
+	Headers []string `json:"headers,omitempty"`
+	// Any matches all requests, useful for scoping a decision to endpoint families.
+	Any bool `json:"any,omitempty"`
+}
+
+// Policy is an ordered list of rules. The first matching rule that is not in dry-run mode
+// determines the outcome, DefaultAction is applied when no rule matches.
+type Policy struct {
+	DefaultAction Action `json:"default_action"`
+	Rules         []Rule `json:"rules"`
+}
+
+// Decision is the outcome of a policy evaluation.
+type Decision struct {
+	Action Action
+	// Rule is the name of the matched rule, empty if the default action was applied.
+	Rule string
+}
+
+// DefaultPolicy returns the built-in policy which is used when no policy file is configured.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		DefaultAction: Flag,
+		Rules: []Rule{
+			{
+				Name:   "odysee",
+				Action: Allow,
+				Origins: []string{
+					"https://odysee.com",
+					"https://neko.odysee.tv",
+					"https://salt.odysee.tv",
+					"https://kp.odysee.tv",
+					"https://inf.odysee.tv",
+					"https://stashu.odysee.tv",
+					"https://odysee.ap.ngrok.io",
+				},
+				ReferrerHosts: []string{"odysee.com", "odysee.tv"},
+			},
+			{
+				Name:      "third-party-players",
+				Action:    Allow,
+				Origins:   []string{"https://www.gstatic.com"},
+				Referrers: []string{"https://piped.kavin.rocks/", "https://piped.video/", "https://www.gstatic.com/", "http://localhost:9090/"},
+			},
+			{Name: "apps", Action: Allow, UserAgentPrefixes: []string{"LBRY/", "Roku/"}, XRequestedWith: []string{"com.odysee.app"}},
+			{Name: "monitoring", Action: Allow, Headers: []string{"X-Cf-Lb-Monitor"}},
+			{Name: "legacy-api", Action: Allow, Endpoints: []string{FamilyV3}, Any: true},
+		},
+	}
+}
+
+// ParsePolicy decodes and validates a JSON policy.
+func ParsePolicy(b []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, errors.Err("cannot parse admission policy: %v", err)
+	}
+	if p.DefaultAction == "" {
+		p.DefaultAction = Flag
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	if !validAction(p.DefaultAction) {
+		return errors.Err("invalid default action %q", p.DefaultAction)
+	}
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			return errors.Err("rule #%v has no name", i)
+		}
+		if !validAction(r.Action) {
+			return errors.Err("rule %v has invalid action %q", r.Name, r.Action)
+		}
+	}
+	return nil
+}
+
+func validAction(a Action) bool {
+	return a == Allow || a == Flag || a == Deny
+}
+
+// Evaluate applies the policy to a request for the given endpoint family.
+func (p *Policy) Evaluate(r *http.Request, family string) Decision {
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if !rule.appliesTo(family) || !rule.matches(r) {
+			continue
+		}
+		metrics.AdmissionRuleMatches.WithLabelValues(rule.Name, string(rule.Action), dryRunLabel(rule.DryRun)).Inc()
+		if rule.DryRun {
+			Logger.Debugf("dry-run admission rule %v matched %v (action: %v)", rule.Name, r.URL.Path, rule.Action)
+			continue
+		}
+		return Decision{Action: rule.Action, Rule: rule.Name}
+	}
+	metrics.AdmissionRuleMatches.WithLabelValues("", string(p.DefaultAction), dryRunLabel(false)).Inc()
+	return Decision{Action: p.DefaultAction}
+}
+
+func (r *Rule) appliesTo(family string) bool {
+	if len(r.Endpoints) == 0 {
+		return true
+	}
+	for _, e := range r.Endpoints {
+		if e == family {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matches(req *http.Request) bool {
+	if r.Any {
+		return true
+	}
+	origin := req.Header.Get("Origin")
+	if origin != "" {
+		if contains(r.Origins, origin) || matchHost(r.OriginHosts, origin) {
+			return true
+		}
+	}
+	referrer := req.Header.Get("Referer")
+	if referrer != "" {
+		if contains(r.Referrers, referrer) || matchHost(r.ReferrerHosts, referrer) {
+			return true
+		}
+	}
+	ua := req.Header.Get("User-Agent")
+	for _, prefix := range r.UserAgentPrefixes {
+		if ua != "" && strings.HasPrefix(ua, prefix) {
+			return true
+		}
+	}
+	if xrw := req.Header.Get(headerXRequestedWith); xrw != "" && contains(r.XRequestedWith, xrw) {
+		return true
+	}
+	for _, h := range r.Headers {
+		if _, ok := req.Header[http.CanonicalHeaderKey(h)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost checks if the host of rawURL equals one of the hosts or is a subdomain of it.
+func matchHost(hosts []string, rawURL string) bool {
+	if len(hosts) == 0 {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return false
+	}
+	for _, h := range hosts {
+		h = strings.ToLower(h)
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func dryRunLabel(dryRun bool) string {
+	if dryRun {
+		return "true"
+	}
+	return "false"
+}
+
+// EndpointFamily maps a request path to the endpoint family used for rule scoping.
+func EndpointFamily(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/speech/"):
+		return FamilySpeech
+	case strings.HasPrefix(path, "/content/claims/"):
+		return FamilyV1
+	case strings.HasPrefix(path, "/api/v2/"):
+		return FamilyV2
+	case strings.HasPrefix(path, "/api/v3/"):
+		return FamilyV3
+	case strings.HasPrefix(path, "/api/v4/"):
+		return FamilyV4
+	case strings.HasPrefix(path, "/v5/"):
+		return FamilyV5
+	case strings.HasPrefix(path, "/v6/"):
+		return FamilyV6
+	}
+	return ""
+}
+
+// Gate holds the active admission policy and reloads it from disk when the policy file changes.
+type Gate struct {
+	path    string
+	policy  atomic.Pointer[Policy]
+	watcher *stop.Group
+}
+
+// NewGate creates a gate with the policy loaded from path. The built-in policy is used if path is empty.
+func NewGate(path string) (*Gate, error) {
+	g := &Gate{path: path}
+	if path == "" {
+		g.policy.Store(DefaultPolicy())
+		return g, nil
+	}
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// NewGateWithPolicy creates a gate with a fixed policy.
+func NewGateWithPolicy(p *Policy) *Gate {
+	g := &Gate{}
+	g.policy.Store(p)
+	return g
+}
+
+// Reload reads the policy file again. The active policy is kept if the file cannot be loaded.
+func (g *Gate) Reload() error {
+	if g.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(g.path)
+	if err != nil {
+		return errors.Err(err)
+	}
+	p, err := ParsePolicy(b)
+	if err != nil {
+		return err
+	}
+	g.policy.Store(p)
+	Logger.Infof("loaded admission policy from %v (%v rules)", g.path, len(p.Rules))
+	return nil
+}
+
+// Watch enables policy reloading whenever the policy file changes.
+func (g *Gate) Watch(interval time.Duration) {
+	if g.path == "" {
+		return
+	}
+	g.watcher = reload.Watch(g.path, interval, func() {
+		if err := g.Reload(); err != nil {
+			Logger.Errorf("failed to reload admission policy: %v", err)
+		}
+	})
+}
+
+// Shutdown stops watching the policy file.
+func (g *Gate) Shutdown() {
+	if g.watcher != nil {
+		g.watcher.StopAndWait()
+	}
+}
+
+// Policy returns the currently active policy.
+func (g *Gate) Policy() *Policy {
+	return g.policy.Load()
+}
+
+// Evaluate applies the active policy to the request.
+func (g *Gate) Evaluate(r *http.Request) Decision {
+	return g.policy.Load().Evaluate(r, EndpointFamily(r.URL.Path))
+}
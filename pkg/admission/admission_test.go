@@ -0,0 +1,114 @@
+package admission
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRequest(path string, headers map[string]string) *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, path, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	g := NewGateWithPolicy(DefaultPolicy())
+	v6 := "/v6/streams/abc/def"
+
+	cases := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		action  Action
+	}{
+		{"no headers", v6, nil, Flag},
+		{"odysee origin", v6, map[string]string{"Origin": "https://odysee.com"}, Allow},
+		{"unknown origin", v6, map[string]string{"Origin": "https://example.com"}, Flag},
+		{"odysee referrer", v6, map[string]string{"Referer": "https://odysee.com/@chan/video"}, Allow},
+		{"odysee subdomain referrer", v6, map[string]string{"Referer": "https://neko.odysee.tv/"}, Allow},
+		{"lookalike referrer", v6, map[string]string{"Referer": "https://evil-odysee.com.attacker.net/"}, Flag},
+		{"referrer with odysee in path", v6, map[string]string{"Referer": "https://attacker.net/odysee.com"}, Flag},
+		{"suffix referrer", v6, map[string]string{"Referer": "https://notodysee.com/"}, Flag},
+		{"piped referrer", v6, map[string]string{"Referer": "https://piped.video/"}, Allow},
+		{"app user agent", v6, map[string]string{"User-Agent": "LBRY/0.1"}, Allow},
+		{"browser user agent", v6, map[string]string{"User-Agent": "Mozilla/5.0"}, Flag},
+		{"android app", v6, map[string]string{"X-Requested-With": "com.odysee.app"}, Allow},
+		{"monitoring header", v6, map[string]string{"X-Cf-Lb-Monitor": ""}, Allow},
+		{"v3 is exempt", "/api/v3/streams/free/a/b/c", nil, Allow},
+		{"v4 is not exempt", "/api/v4/streams/free/a/b/c", nil, Flag},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.action, g.Evaluate(newRequest(tc.path, tc.headers)).Action)
+		})
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	p, err := ParsePolicy([]byte(`{
+		"default_action": "allow",
+		"rules": [
+			{"name": "dry", "action": "deny", "any": true, "dry_run": true},
+			{"name": "bots", "action": "deny", "user_agent_prefixes": ["curl/"], "endpoints": ["v5", "v6"]},
+			{"name": "speech-scrapers", "action": "flag", "user_agent_prefixes": ["curl/"], "endpoints": ["speech"]}
+		]
+	}`))
+	require.NoError(t, err)
+
+	d := p.Evaluate(newRequest("/v6/streams/a/b", map[string]string{"User-Agent": "curl/8.0"}), FamilyV6)
+	assert.Equal(t, Decision{Action: Deny, Rule: "bots"}, d)
+
+	d = p.Evaluate(newRequest("/speech/a.jpg", map[string]string{"User-Agent": "curl/8.0"}), FamilySpeech)
+	assert.Equal(t, Decision{Action: Flag, Rule: "speech-scrapers"}, d)
+
+	d = p.Evaluate(newRequest("/api/v4/streams/free/a/b/c", map[string]string{"User-Agent": "curl/8.0"}), FamilyV4)
+	assert.Equal(t, Decision{Action: Allow}, d)
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	_, err := ParsePolicy([]byte(`{"rules": [{"name": "x", "action": "block"}]}`))
+	assert.ErrorContains(t, err, "invalid action")
+	_, err = ParsePolicy([]byte(`{"rules": [{"action": "allow"}]}`))
+	assert.ErrorContains(t, err, "has no name")
+	_, err = ParsePolicy([]byte(`{"default_action": "maybe"}`))
+	assert.ErrorContains(t, err, "invalid default action")
+	_, err = ParsePolicy([]byte(`{`))
+	assert.Error(t, err)
+}
+
+func TestEndpointFamily(t *testing.T) {
+	assert.Equal(t, FamilyV1, EndpointFamily("/content/claims/a/b/c"))
+	assert.Equal(t, FamilyV3, EndpointFamily("/api/v3/streams/free/a/b/c"))
+	assert.Equal(t, FamilyV5, EndpointFamily("/v5/streams/start/a/b"))
+	assert.Equal(t, FamilyV6, EndpointFamily("/v6/streams/a/b.mp4"))
+	assert.Equal(t, FamilySpeech, EndpointFamily("/speech/abc.jpg"))
+	assert.Equal(t, "", EndpointFamily("/metrics"))
+}
+
+func TestGateReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"default_action": "flag"}`), 0644))
+
+	g, err := NewGate(path)
+	require.NoError(t, err)
+	g.Watch(10 * time.Millisecond)
+	defer g.Shutdown()
+
+	r := newRequest("/v6/streams/a/b", nil)
+	assert.Equal(t, Flag, g.Evaluate(r).Action)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"default_action": "allow", "rules": []}`), 0644))
+	assert.Eventually(t, func() bool { return g.Evaluate(r).Action == Allow }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"default_action": "nope"}`), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, Allow, g.Evaluate(r).Action)
+}
@@ -9,6 +9,9 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/OdyseeTeam/player-server/pkg/clientip"
+	"github.com/OdyseeTeam/player-server/pkg/edgetoken"
+	"github.com/OdyseeTeam/player-server/pkg/health"
 	"github.com/OdyseeTeam/player-server/pkg/logger"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -41,6 +44,8 @@ type App struct {
 
 	stopChan    chan os.Signal
 	stopWait    time.Duration
+	health      *health.Checker
+	drainPeriod time.Duration
 	server      *http.Server
 	peerServer  *peer.Server
 	http3Server *http3.Server
@@ -53,7 +58,15 @@ type Opts struct {
 	StopWaitSeconds int
 	Listener        *http.Server
 	BlobStore       store.BlobStore
-	EdgeToken       string
+	// EdgeTokens supplies the token for the reflector blob server, which only supports a single
+	// static token, so the first active token with blob-server scope at startup is used.
+	EdgeTokens *edgetoken.Set
+	// ClientIP resolves client IPs returned by c.ClientIP(), the connection address is used if not set.
+	ClientIP *clientip.Resolver
+	// Health, if set, is switched to draining on a shutdown signal, DrainPeriod before the HTTP server
+	// stops accepting requests, so load balancers can take the player out of rotation first.
+	Health      *health.Checker
+	DrainPeriod time.Duration
 }
 
 // New returns a new App HTTP server initialized with settings from supplied Opts.
@@ -64,22 +77,31 @@ func New(opts Opts) *App {
 			"Access-Control-Allow-Origin": "*",
 			"Server":                      "Odysee media player",
 		},
-		Address:   opts.Address,
-		BlobStore: opts.BlobStore,
-		stopWait:  15 * time.Second,
+		Address:     opts.Address,
+		BlobStore:   opts.BlobStore,
+		stopWait:    15 * time.Second,
+		health:      opts.Health,
+		drainPeriod: opts.DrainPeriod,
 	}
 
 	if opts.StopWaitSeconds != 0 {
 		a.stopWait = time.Second * time.Duration(opts.StopWaitSeconds)
 	}
 
-	a.Router = a.newRouter()
+	if opts.ClientIP == nil {
+		opts.ClientIP, _ = clientip.NewResolver(clientip.Config{})
+	}
+	a.Router = a.newRouter(opts.ClientIP)
 	a.server = a.newServer()
 
 	if a.BlobStore != nil {
 		a.peerServer = peer.NewServer(a.BlobStore)
 		a.http3Server = http3.NewServer(a.BlobStore, 200)
-		a.httpServer = reflectorHttp.NewServer(a.BlobStore, 200, opts.EdgeToken)
+		var blobServerToken string
+		if opts.EdgeTokens != nil {
+			blobServerToken = opts.EdgeTokens.Secret(edgetoken.ScopeBlobServer)
+		}
+		a.httpServer = reflectorHttp.NewServer(a.BlobStore, 200, blobServerToken)
 	}
 
 	return a
@@ -100,9 +122,12 @@ func (a *App) newServer() *http.Server {
 	}
 }
 
-func (a *App) newRouter() *gin.Engine {
+func (a *App) newRouter(resolver *clientip.Resolver) *gin.Engine {
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
+	if err := resolver.Install(r); err != nil {
+		Logger.Fatal(err)
+	}
 	r.Use(gin.Logger())
 	// Install nice.Recovery, passing the handler to call after recovery
 	r.Use(nice.Recovery(func(c *gin.Context, err interface{}) {
@@ -164,6 +189,12 @@ func (a *App) ServeUntilShutdown() {
 	signal.Notify(a.stopChan, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
 	sig := <-a.stopChan
 
+	if a.health != nil && a.drainPeriod > 0 {
+		Logger.Printf("caught a signal (%v), draining for %v...", sig, a.drainPeriod)
+		a.health.SetDraining(true)
+		time.Sleep(a.drainPeriod)
+	}
+
 	Logger.Printf("caught a signal (%v), shutting down http server...", sig)
 
 	err := a.Shutdown()
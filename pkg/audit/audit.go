@@ -0,0 +1,223 @@
+// Package audit records denied requests as structured events and ships them to sinks
+// (a rotated JSONL file, an HTTP webhook) in the background.
+//
+// Recording never blocks request handling: every sink has a bounded queue, and events are
+// dropped and counted when a sink falls behind, e.g. while a webhook is failing and being retried.
+package audit
+
+import (
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+var Logger = logger.GetLogger()
+
+// Reasons for denials recorded by the player, other reasons name the failed check (geo, access, quota...).
+const (
+	ReasonBanned         = "banned"
+	ReasonAdmission      = "admission"
+	ReasonFlagged        = "flagged"
+	ReasonPattern        = "pattern"
+	ReasonBlockedContent = "blocked_content"
+	ReasonRateLimited    = "rate_limited"
+	ReasonSignature      = "signature"
+)
+
+// Event is a denied request.
+type Event struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	ASN       int       `json:"asn,omitempty"`
+	ASNOrg    string    `json:"asn_org,omitempty"`
+	ClaimID   string    `json:"claim_id,omitempty"`
+	ClaimName string    `json:"claim_name,omitempty"`
+	ChannelID string    `json:"channel_id,omitempty"`
+	Channel   string    `json:"channel,omitempty"`
+	Reason    string    `json:"reason"`
+	// Rule is the rule, ban reason or error the denial was caused by.
+	Rule string `json:"rule,omitempty"`
+	// Endpoint is the route pattern, Path the requested path.
+	Endpoint  string `json:"endpoint"`
+	Path      string `json:"path"`
+	Method    string `json:"method"`
+	Status    int    `json:"status"`
+	Referrer  string `json:"referrer,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// Sink writes batches of events.
+type Sink interface {
+	Name() string
+	Write(events []Event) error
+	Close() error
+}
+
+// Opts configures delivery to sinks.
+type Opts struct {
+	// QueueSize is the number of events buffered per sink, further events are dropped.
+	QueueSize int
+	// BatchSize is the maximum number of events written at once.
+	BatchSize int
+	// FlushInterval is how long events are collected before a partial batch is written.
+	FlushInterval time.Duration
+	// MaxRetries is how many times a failed batch is retried before it is dropped.
+	// Retries back off exponentially starting at RetryBackoff, up to a minute.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// ASNLookup fills in ASN details of events.
+	ASNLookup func(ip string) (string, int, error)
+}
+
+// DefaultOpts returns delivery settings suitable for production.
+func DefaultOpts() Opts {
+	return Opts{
+		QueueSize:     10000,
+		BatchSize:     100,
+		FlushInterval: 5 * time.Second,
+		MaxRetries:    5,
+		RetryBackoff:  time.Second,
+	}
+}
+
+// Log delivers events to its sinks.
+type Log struct {
+	opts   Opts
+	queues []*queue
+	grp    *stop.Group
+}
+
+type queue struct {
+	sink   Sink
+	events chan Event
+}
+
+// New starts delivering recorded events to sinks. Unset options are taken from DefaultOpts.
+func New(opts Opts, sinks ...Sink) *Log {
+	def := DefaultOpts()
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = def.QueueSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = def.BatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = def.FlushInterval
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = def.RetryBackoff
+	}
+	l := &Log{opts: opts, grp: stop.New()}
+	for _, s := range sinks {
+		q := &queue{sink: s, events: make(chan Event, opts.QueueSize)}
+		l.queues = append(l.queues, q)
+		l.grp.Add(1)
+		go l.deliver(q)
+	}
+	return l
+}
+
+// Record queues the event for all sinks without blocking. Time and ASN details are filled in if missing.
+func (l *Log) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.ASN == 0 && l.opts.ASNLookup != nil && e.IP != "" {
+		if org, asn, err := l.opts.ASNLookup(e.IP); err == nil {
+			e.ASNOrg, e.ASN = org, asn
+		}
+	}
+	for _, q := range l.queues {
+		select {
+		case q.events <- e:
+		default:
+			metrics.AuditEvents.WithLabelValues(q.sink.Name(), "dropped").Inc()
+		}
+	}
+}
+
+// Shutdown writes queued events and closes sinks. Failed batches are not retried anymore.
+func (l *Log) Shutdown() {
+	l.grp.StopAndWait()
+	for _, q := range l.queues {
+		if err := q.sink.Close(); err != nil {
+			Logger.Errorf("failed to close audit sink %v: %v", q.sink.Name(), err)
+		}
+	}
+}
+
+func (l *Log) deliver(q *queue) {
+	defer l.grp.Done()
+	t := time.NewTicker(l.opts.FlushInterval)
+	defer t.Stop()
+	batch := make([]Event, 0, l.opts.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			l.write(q.sink, batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case e := <-q.events:
+			batch = append(batch, e)
+			if len(batch) >= l.opts.BatchSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case <-l.grp.Ch():
+			for {
+				select {
+				case e := <-q.events:
+					batch = append(batch, e)
+					if len(batch) >= l.opts.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// write delivers a batch, retrying with backoff. The queue fills up while retrying,
+// so a failing sink sheds new events instead of piling them up in memory.
+func (l *Log) write(s Sink, batch []Event) {
+	backoff := l.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.Write(batch)
+		if err == nil {
+			metrics.AuditEvents.WithLabelValues(s.Name(), "written").Add(float64(len(batch)))
+			return
+		}
+		if attempt >= l.opts.MaxRetries {
+			Logger.Errorf("audit sink %v dropped %v events: %v", s.Name(), len(batch), err)
+			metrics.AuditEvents.WithLabelValues(s.Name(), "failed").Add(float64(len(batch)))
+			return
+		}
+		Logger.Warnf("audit sink %v failed, retrying in %v: %v", s.Name(), backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-l.grp.Ch():
+			metrics.AuditEvents.WithLabelValues(s.Name(), "failed").Add(float64(len(batch)))
+			return
+		}
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// Default is the process-wide audit log, events are discarded if it's not set.
+var Default *Log
+
+// Record queues the event in the Default log.
+func Record(e Event) {
+	if Default != nil {
+		Default.Record(e)
+	}
+}
@@ -0,0 +1,192 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memorySink struct {
+	mu      sync.Mutex
+	batches [][]Event
+	fail    atomic.Int32
+	block   chan struct{}
+	writing chan struct{}
+}
+
+func (s *memorySink) Name() string { return "memory" }
+
+func (s *memorySink) Write(events []Event) error {
+	if s.writing != nil {
+		s.writing <- struct{}{}
+	}
+	if s.block != nil {
+		<-s.block
+	}
+	if s.fail.Load() > 0 {
+		s.fail.Add(-1)
+		return errors.Err("sink unavailable")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, append([]Event{}, events...))
+	return nil
+}
+
+func (s *memorySink) Close() error { return nil }
+
+func (s *memorySink) events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []Event
+	for _, b := range s.batches {
+		all = append(all, b...)
+	}
+	return all
+}
+
+func TestLogBatches(t *testing.T) {
+	s := &memorySink{}
+	l := New(Opts{BatchSize: 3, FlushInterval: time.Hour, ASNLookup: func(ip string) (string, int, error) {
+		return "Example", 64500, nil
+	}}, s)
+
+	for i := 0; i < 7; i++ {
+		l.Record(Event{IP: "192.0.2.1", Reason: ReasonBanned})
+	}
+	require.Eventually(t, func() bool { return len(s.events()) == 6 }, time.Second, 10*time.Millisecond)
+	l.Shutdown()
+
+	events := s.events()
+	require.Len(t, events, 7)
+	assert.Len(t, s.batches, 3)
+	assert.Equal(t, 64500, events[0].ASN)
+	assert.Equal(t, "Example", events[0].ASNOrg)
+	assert.False(t, events[0].Time.IsZero())
+}
+
+func TestLogFlushInterval(t *testing.T) {
+	s := &memorySink{}
+	l := New(Opts{BatchSize: 100, FlushInterval: 20 * time.Millisecond}, s)
+	defer l.Shutdown()
+
+	l.Record(Event{IP: "192.0.2.1"})
+	assert.Eventually(t, func() bool { return len(s.events()) == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestLogRetries(t *testing.T) {
+	s := &memorySink{}
+	s.fail.Store(2)
+	l := New(Opts{BatchSize: 1, MaxRetries: 3, RetryBackoff: time.Millisecond}, s)
+	l.Record(Event{IP: "192.0.2.1"})
+	assert.Eventually(t, func() bool { return len(s.events()) == 1 }, time.Second, 10*time.Millisecond)
+	l.Shutdown()
+
+	s = &memorySink{}
+	s.fail.Store(10)
+	l = New(Opts{BatchSize: 1, MaxRetries: 1, RetryBackoff: time.Millisecond}, s)
+	l.Record(Event{IP: "192.0.2.1"})
+	assert.Eventually(t, func() bool { return s.fail.Load() == 8 }, time.Second, 10*time.Millisecond)
+	l.Shutdown()
+	assert.Empty(t, s.events())
+}
+
+func TestLogBackPressure(t *testing.T) {
+	s := &memorySink{block: make(chan struct{}), writing: make(chan struct{}, 10)}
+	l := New(Opts{QueueSize: 2, BatchSize: 1}, s)
+	l.Record(Event{IP: "192.0.2.1"})
+	<-s.writing
+
+	done := make(chan struct{})
+	go func() {
+		// Recording never blocks, even with a stuck sink and a full queue.
+		for i := 0; i < 9; i++ {
+			l.Record(Event{IP: "192.0.2.1"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Record blocked")
+	}
+	close(s.block)
+	l.Shutdown()
+	// One event was being written, two were queued, the rest got dropped.
+	assert.Len(t, s.events(), 3)
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	s, err := NewFileSink(path, 300, 2)
+	require.NoError(t, err)
+
+	e := Event{Time: time.Unix(0, 0).UTC(), IP: "192.0.2.1", Reason: ReasonPattern, Rule: "spam", Status: 403}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, s.Write([]Event{e}))
+	}
+	require.NoError(t, s.Close())
+
+	assert.FileExists(t, path)
+	assert.FileExists(t, path+".1")
+	assert.FileExists(t, path+".2")
+	assert.NoFileExists(t, path+".3")
+
+	f, err := os.Open(path + ".1")
+	require.NoError(t, err)
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	lines := 0
+	for sc.Scan() {
+		var read Event
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &read))
+		assert.Equal(t, e, read)
+		lines++
+	}
+	assert.Positive(t, lines)
+
+	st, err := os.Stat(path + ".1")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, st.Size(), int64(300))
+
+	// Reopening appends to the current file.
+	s, err = NewFileSink(path, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Write([]Event{e}))
+	require.NoError(t, s.Close())
+}
+
+func TestWebhookSink(t *testing.T) {
+	var received [][]Event
+	var mu sync.Mutex
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		var batch []Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		mu.Lock()
+		received = append(received, batch)
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	s := NewWebhookSink(ts.URL, "secret")
+	require.NoError(t, s.Write([]Event{{IP: "192.0.2.1"}, {IP: "192.0.2.2"}}))
+	require.Len(t, received, 1)
+	assert.Len(t, received[0], 2)
+
+	status = http.StatusServiceUnavailable
+	assert.Error(t, s.Write([]Event{{IP: "192.0.2.1"}}))
+}
@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// WebhookSink posts batches of events as a JSON array to an HTTP endpoint.
+type WebhookSink struct {
+	URL string
+	// Token is sent as a bearer token if set.
+	Token  string
+	Client *http.Client
+}
+
+// NewWebhookSink creates a sink posting to url.
+func NewWebhookSink(url, token string) *WebhookSink {
+	return &WebhookSink{URL: url, Token: token, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name identifies the sink in metrics.
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+// Write posts events, any response status other than 2xx is an error.
+func (s *WebhookSink) Write(events []Event) error {
+	b, err := json.Marshal(events)
+	if err != nil {
+		return errors.Err(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(b))
+	if err != nil {
+		return errors.Err(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.Err("audit webhook responded with status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// Close is a no-op, the webhook has no resources to release.
+func (s *WebhookSink) Close() error {
+	return nil
+}
@@ -0,0 +1,132 @@
+package catalog
+
+import (
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/stream"
+)
+
+// maxSDBlobSize is the size threshold above which blobs are not considered to be sd blobs.
+const maxSDBlobSize = 1024 * 1024
+
+var reUnsafeName = regexp.MustCompile(`[^a-z0-9\-]+`)
+
+// Build scans a directory of blobs (flat or sharded by hash prefix, as laid out by the disk cache)
+// and returns catalog entries for every stream whose sd blob is found.
+// Claim IDs are derived from sd hashes since raw blobs carry no claim information.
+func Build(blobsDir string) ([]Entry, error) {
+	blobs := map[string]string{}
+	err := filepath.WalkDir(blobsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		blobs[d.Name()] = path
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	var entries []Entry
+	for hash, path := range blobs {
+		info, err := os.Stat(path)
+		if err != nil || info.Size() > maxSDBlobSize {
+			continue
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		if len(b) == 0 || b[0] != '{' {
+			continue
+		}
+		var sd stream.SDBlob
+		if err := sd.FromBlob(b); err != nil || len(sd.BlobInfos) == 0 {
+			continue
+		}
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != stream.BlobHashHexLength {
+			hash = sd.HashHex()
+		}
+
+		e := Entry{
+			ClaimID:     hash[:40],
+			Name:        nameFromFile(sd.SuggestedFileName, hash),
+			SdHash:      hash,
+			ContentType: mime.TypeByExtension(filepath.Ext(sd.SuggestedFileName)),
+			ReleaseTime: info.ModTime().Unix(),
+			Filename:    sd.SuggestedFileName,
+		}
+		if e.ContentType == "" {
+			e.ContentType = "application/octet-stream"
+		}
+		if size, err := streamSize(&sd, blobs); err == nil {
+			e.Size = size
+		} else {
+			Logger.Infof("size of stream %v is unknown and will be detected at playback: %v", hash, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Merge combines freshly built entries with existing ones. Entries already in the catalog
+// keep their metadata, so claim IDs, names and tags edited by hand survive a rebuild.
+func Merge(existing, built []Entry) []Entry {
+	seen := make(map[string]bool, len(existing))
+	merged := append([]Entry{}, existing...)
+	for _, e := range existing {
+		seen[e.SdHash] = true
+	}
+	for _, e := range built {
+		if !seen[e.SdHash] {
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+// ReadEntries loads raw entries from a catalog file or directory.
+func ReadEntries(path string) ([]Entry, error) {
+	return readPath(path)
+}
+
+// streamSize calculates exact stream size if the last content blob is available locally.
+func streamSize(sd *stream.SDBlob, blobs map[string]string) (uint64, error) {
+	numChunks := len(sd.BlobInfos) - 1 // Last blob is the empty stream terminator
+	if numChunks <= 0 {
+		return 0, nil
+	}
+	last := sd.BlobInfos[numChunks-1]
+	path, ok := blobs[hex.EncodeToString(last.BlobHash)]
+	if !ok {
+		return 0, errors.Err("last blob is not available")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	chunk, err := stream.DecryptBlob(b, sd.Key, last.IV)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	return uint64(stream.MaxBlobSize-1)*uint64(numChunks-1) + uint64(len(chunk)), nil
+}
+
+func nameFromFile(filename, sdHash string) string {
+	name := strings.ToLower(strings.TrimSuffix(filename, filepath.Ext(filename)))
+	name = strings.Trim(reUnsafeName.ReplaceAllString(name, "-"), "-")
+	if name == "" {
+		return sdHash[:8]
+	}
+	return name
+}
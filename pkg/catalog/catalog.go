@@ -0,0 +1,237 @@
+// Package catalog implements an offline stream index that lets the player serve content
+// without an SDK. A catalog maps claim IDs and names to sd hashes and basic stream metadata.
+package catalog
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/atomicfile"
+	"github.com/OdyseeTeam/player-server/internal/reload"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	ljsonrpc "github.com/lbryio/lbry.go/v2/extras/jsonrpc"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	pb "github.com/lbryio/types/v2/go"
+)
+
+var Logger = logger.GetLogger()
+
+// Entry describes a single stream available in the catalog.
+type Entry struct {
+	ClaimID     string   `json:"claim_id"`
+	Name        string   `json:"name"`
+	SdHash      string   `json:"sd_hash"`
+	ContentType string   `json:"content_type"`
+	Size        uint64   `json:"size,omitempty"`
+	ReleaseTime int64    `json:"release_time,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Filename    string   `json:"filename,omitempty"`
+	ChannelID   string   `json:"channel_id,omitempty"`
+	ChannelName string   `json:"channel_name,omitempty"`
+}
+
+// File is the on-disk catalog format.
+type File struct {
+	Streams []Entry `json:"streams"`
+}
+
+type index struct {
+	byClaimID map[string]*Entry
+	byName    map[string][]*Entry
+}
+
+// Catalog is a hot-reloadable, read-only index of catalog entries.
+type Catalog struct {
+	path    string
+	idx     atomic.Pointer[index]
+	watcher *stop.Group
+}
+
+// Load reads a catalog from path, which can be either a single JSON file
+// or a directory containing several of them.
+func Load(path string) (*Catalog, error) {
+	c := &Catalog{path: path}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// New creates an in-memory catalog from the provided entries.
+func New(entries []Entry) *Catalog {
+	c := &Catalog{}
+	c.idx.Store(newIndex(entries))
+	return c
+}
+
+// Reload re-reads catalog contents from disk. The currently loaded catalog stays active if reading fails.
+func (c *Catalog) Reload() error {
+	entries, err := readPath(c.path)
+	if err != nil {
+		return err
+	}
+	c.idx.Store(newIndex(entries))
+	Logger.Infof("loaded %v streams from catalog %v", len(entries), c.path)
+	return nil
+}
+
+// Watch enables reloading of the catalog whenever it changes on disk.
+func (c *Catalog) Watch(interval time.Duration) {
+	c.watcher = reload.Watch(c.path, interval, func() {
+		if err := c.Reload(); err != nil {
+			Logger.Errorf("failed to reload catalog %v: %v", c.path, err)
+		}
+	})
+}
+
+// Shutdown stops watching the catalog for changes.
+func (c *Catalog) Shutdown() {
+	if c.watcher != nil {
+		c.watcher.StopAndWait()
+	}
+}
+
+// Len returns the number of streams in the catalog.
+func (c *Catalog) Len() int {
+	return len(c.idx.Load().byClaimID)
+}
+
+// Lookup finds a catalog entry by URI. Accepted URI forms are a full claim ID, `name`,
+// `name#claim_id` (including short claim ID prefixes) and lbry:// URLs.
+func (c *Catalog) Lookup(uri string) (*Entry, bool) {
+	idx := c.idx.Load()
+
+	uri = strings.TrimPrefix(uri, "lbry://")
+	if i := strings.LastIndex(uri, "/"); i >= 0 {
+		uri = uri[i+1:]
+	}
+	name, claimID, _ := strings.Cut(uri, "#")
+
+	if e, ok := idx.byClaimID[claimID]; ok {
+		return e, true
+	}
+	if e, ok := idx.byClaimID[name]; ok {
+		return e, true
+	}
+
+	candidates := idx.byName[strings.ToLower(name)]
+	for _, e := range candidates {
+		if strings.HasPrefix(e.ClaimID, claimID) {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Claim builds an SDK-compatible claim out of the catalog entry.
+func (e *Entry) Claim() (*ljsonrpc.Claim, error) {
+	sdHash, err := hex.DecodeString(e.SdHash)
+	if err != nil {
+		return nil, errors.Err("invalid sd hash for claim %v: %v", e.ClaimID, err)
+	}
+	claim := &ljsonrpc.Claim{
+		ClaimID:        e.ClaimID,
+		Name:           e.Name,
+		NormalizedName: strings.ToLower(e.Name),
+		CanonicalURL:   "lbry://" + e.Name + "#" + e.ClaimID,
+		PermanentURL:   "lbry://" + e.Name + "#" + e.ClaimID,
+		Timestamp:      int(e.ReleaseTime),
+		ValueType:      "stream",
+		Value: pb.Claim{
+			Title: e.Name,
+			Tags:  e.Tags,
+			Type: &pb.Claim_Stream{Stream: &pb.Stream{
+				ReleaseTime: e.ReleaseTime,
+				Source: &pb.Source{
+					SdHash:    sdHash,
+					Name:      e.Filename,
+					Size:      e.Size,
+					MediaType: e.ContentType,
+				},
+			}},
+		},
+	}
+	if e.ChannelID != "" {
+		claim.SigningChannel = &ljsonrpc.Claim{
+			ClaimID: e.ChannelID,
+			Name:    e.ChannelName,
+		}
+	}
+	return claim, nil
+}
+
+func newIndex(entries []Entry) *index {
+	idx := &index{
+		byClaimID: make(map[string]*Entry, len(entries)),
+		byName:    make(map[string][]*Entry, len(entries)),
+	}
+	for i := range entries {
+		e := &entries[i]
+		idx.byClaimID[e.ClaimID] = e
+		name := strings.ToLower(e.Name)
+		idx.byName[name] = append(idx.byName[name], e)
+	}
+	// Newest release goes first so that bare name lookups resolve to the latest stream, like the SDK does.
+	for _, es := range idx.byName {
+		sort.SliceStable(es, func(i, j int) bool { return es[i].ReleaseTime > es[j].ReleaseTime })
+	}
+	return idx
+}
+
+func readPath(path string) ([]Entry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if !info.IsDir() {
+		return readFile(path)
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.json"))
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	var entries []Entry
+	for _, f := range files {
+		fe, err := readFile(f)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fe...)
+	}
+	return entries, nil
+}
+
+func readFile(path string) ([]Entry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	var f File
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, errors.Err("failed to parse catalog %v: %v", path, err)
+	}
+	for _, e := range f.Streams {
+		if e.ClaimID == "" || e.SdHash == "" {
+			return nil, errors.Err("catalog %v contains an entry without claim_id or sd_hash", path)
+		}
+	}
+	return f.Streams, nil
+}
+
+// Write atomically saves entries into a catalog file at path.
+func Write(path string, entries []Entry) error {
+	b, err := json.MarshalIndent(File{Streams: entries}, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(atomicfile.WriteFile(path, b))
+}
@@ -0,0 +1,138 @@
+package catalog
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/stream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestStream(t *testing.T, dir, filename string, size int) string {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	enc := stream.NewEncoder(bytes.NewReader(data))
+	s, err := enc.Stream()
+	require.NoError(t, err)
+
+	sd := enc.SDBlob()
+	sd.SuggestedFileName = filename
+	s[0] = sd.ToBlob()
+
+	for _, b := range s {
+		hash := b.HashHex()
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, hash[:2]), os.ModePerm))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, hash[:2], hash), b, 0644))
+	}
+	return s[0].HashHex()
+}
+
+func TestBuild(t *testing.T) {
+	dir := t.TempDir()
+	sdHash := writeTestStream(t, dir, "My Holiday Video.mp4", 3*stream.MaxBlobSize)
+
+	entries, err := Build(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	e := entries[0]
+	assert.Equal(t, sdHash, e.SdHash)
+	assert.Equal(t, sdHash[:40], e.ClaimID)
+	assert.Equal(t, "my-holiday-video", e.Name)
+	assert.Equal(t, "video/mp4", e.ContentType)
+	assert.EqualValues(t, 3*stream.MaxBlobSize, e.Size)
+	assert.Equal(t, "My Holiday Video.mp4", e.Filename)
+}
+
+func TestLookup(t *testing.T) {
+	c := New([]Entry{
+		{ClaimID: "aaaa1bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", Name: "video", SdHash: "ab", ReleaseTime: 1},
+		{ClaimID: "aaaa2bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", Name: "video", SdHash: "cd", ReleaseTime: 2},
+		{ClaimID: "cccccccccccccccccccccccccccccccccccccccc", Name: "other", SdHash: "ef"},
+	})
+
+	idA1 := "aaaa1bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	idA2 := "aaaa2bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	idC := "cccccccccccccccccccccccccccccccccccccccc"
+	cases := []struct {
+		uri, claimID string
+	}{
+		{idA1, idA1},
+		{"video#" + idA1, idA1},
+		{"video#aaaa1", idA1},
+		{"VIDEO#aaaa2", idA2},
+		{"video", idA2},
+		{"other#" + idC, idC},
+		{"wrongname#" + idC, idC},
+		{"lbry://other#" + idC, idC},
+		{"lbry://@chan#1/other#c", idC},
+		{"lbry://@chan#1/video#" + idA1, idA1},
+	}
+	for _, tc := range cases {
+		e, ok := c.Lookup(tc.uri)
+		if assert.True(t, ok, tc.uri) {
+			assert.Equal(t, tc.claimID, e.ClaimID, tc.uri)
+		}
+	}
+
+	for _, uri := range []string{"missing", "video#ffff", "dddddddddddddddddddddddddddddddddddddddd"} {
+		_, ok := c.Lookup(uri)
+		assert.False(t, ok, uri)
+	}
+}
+
+func TestEntryClaim(t *testing.T) {
+	sdHash := hex.EncodeToString(bytes.Repeat([]byte{0xab}, stream.BlobHashSize))
+	e := Entry{
+		ClaimID: "cccccccccccccccccccccccccccccccccccccccc", Name: "video", SdHash: sdHash,
+		ContentType: "video/mp4", Size: 100, ReleaseTime: 1700000000, Tags: []string{"c:members-only"},
+		ChannelID: "dddddddddddddddddddddddddddddddddddddddd", ChannelName: "@chan",
+	}
+	claim, err := e.Claim()
+	require.NoError(t, err)
+
+	s := claim.Value.GetStream()
+	require.NotNil(t, s)
+	assert.Equal(t, sdHash, hex.EncodeToString(s.GetSource().SdHash))
+	assert.Equal(t, "video/mp4", s.GetSource().MediaType)
+	assert.EqualValues(t, 100, s.GetSource().Size)
+	assert.EqualValues(t, 1700000000, s.ReleaseTime)
+	assert.Equal(t, []string{"c:members-only"}, claim.Value.Tags)
+	assert.Equal(t, "dddddddddddddddddddddddddddddddddddddddd", claim.SigningChannel.ClaimID)
+
+	e.SdHash = "nothex"
+	_, err = e.Claim()
+	assert.Error(t, err)
+}
+
+func TestLoadAndReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "catalog.json")
+	require.NoError(t, Write(path, []Entry{{ClaimID: "cccccccccccccccccccccccccccccccccccccccc", Name: "one", SdHash: "ab"}}))
+
+	c, err := Load(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, c.Len())
+
+	c.Watch(10 * time.Millisecond)
+	defer c.Shutdown()
+
+	require.NoError(t, Write(filepath.Join(dir, "more.json"), []Entry{{ClaimID: "dddddddddddddddddddddddddddddddddddddddd", Name: "two", SdHash: "cd"}}))
+	assert.Eventually(t, func() bool { return c.Len() == 2 }, time.Second, 10*time.Millisecond)
+
+	_, ok := c.Lookup("two")
+	assert.True(t, ok)
+
+	// Broken catalog files must not replace the loaded catalog
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, c.Len())
+}
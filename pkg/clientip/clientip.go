@@ -0,0 +1,254 @@
+// Package clientip resolves the real client IP of requests arriving through CDNs and proxies.
+//
+// Client IP headers and query parameters are only trusted when the request comes from the address
+// ranges of the provider that sets them, so they cannot be spoofed by connecting directly.
+package clientip
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/iprange"
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/internal/reload"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	"github.com/gaissmai/bart"
+	"github.com/gin-gonic/gin"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+var Logger = logger.GetLogger()
+
+// Header carries the resolved client IP inside the player. Values sent by clients are discarded.
+// The gin engine trusts it as its platform header, so c.ClientIP() returns the resolved IP.
+const Header = "X-Player-Client-IP"
+
+// Sources of the resolved IP, besides provider names.
+const (
+	SourceDirect = "direct"
+	SourceProxy  = "proxy"
+)
+
+// Provider is a CDN or proxy that passes the client IP in a header or a query parameter.
+type Provider struct {
+	Name string `json:"name"`
+	// CIDRs are address ranges requests from the provider come from.
+	CIDRs []string `json:"cidrs"`
+	// Header is checked first, QueryParam is used if the header is missing.
+	Header     string `json:"header,omitempty"`
+	QueryParam string `json:"query_param,omitempty"`
+}
+
+// Config lists providers and generic proxies whose X-Forwarded-For is trusted.
+type Config struct {
+	Providers      []Provider `json:"providers"`
+	TrustedProxies []string   `json:"trusted_proxies"`
+}
+
+// LoadConfig reads a JSON config file.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Err(err)
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, errors.Err("cannot parse client IP config: %v", err)
+	}
+	return cfg, nil
+}
+
+type ruleset struct {
+	providers *bart.Table[*Provider]
+	proxies   *bart.Table[bool]
+}
+
+func compile(cfg Config) (*ruleset, error) {
+	rs := &ruleset{providers: &bart.Table[*Provider]{}, proxies: &bart.Table[bool]{}}
+	for i := range cfg.Providers {
+		p := &cfg.Providers[i]
+		if p.Name == "" || len(p.CIDRs) == 0 {
+			return nil, errors.Err("client IP provider needs a name and address ranges")
+		}
+		if p.Header == "" && p.QueryParam == "" {
+			return nil, errors.Err("client IP provider %v needs a header or a query parameter", p.Name)
+		}
+		for _, c := range p.CIDRs {
+			pfx, err := iprange.ParsePrefix(c)
+			if err != nil {
+				return nil, errors.Err("provider %v: invalid range %v: %v", p.Name, c, err)
+			}
+			rs.providers.Insert(pfx, p)
+		}
+	}
+	for _, c := range cfg.TrustedProxies {
+		pfx, err := iprange.ParsePrefix(c)
+		if err != nil {
+			return nil, errors.Err("invalid trusted proxy %v: %v", c, err)
+		}
+		rs.proxies.Insert(pfx, true)
+	}
+	return rs, nil
+}
+
+func parseAddr(s string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// Resolver determines client IPs according to the active config.
+type Resolver struct {
+	path    string
+	rules   atomic.Pointer[ruleset]
+	watcher *stop.Group
+}
+
+// NewResolver creates a resolver from cfg. A zero Config trusts no one, using the connection address.
+func NewResolver(cfg Config) (*Resolver, error) {
+	rs, err := compile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &Resolver{}
+	r.rules.Store(rs)
+	return r, nil
+}
+
+// LoadResolver creates a resolver from the config file at path.
+func LoadResolver(path string) (*Resolver, error) {
+	r := &Resolver{path: path}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the config file again, the active config is kept if that fails.
+func (r *Resolver) Reload() error {
+	if r.path == "" {
+		return nil
+	}
+	cfg, err := LoadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	rs, err := compile(cfg)
+	if err != nil {
+		return err
+	}
+	r.rules.Store(rs)
+	Logger.Infof("loaded client IP config from %v (%v providers, %v trusted proxy ranges)", r.path, len(cfg.Providers), rs.proxies.Size())
+	return nil
+}
+
+// Watch enables config reloading whenever the file changes.
+func (r *Resolver) Watch(interval time.Duration) {
+	if r.path == "" {
+		return
+	}
+	r.watcher = reload.Watch(r.path, interval, func() {
+		if err := r.Reload(); err != nil {
+			Logger.Errorf("failed to reload client IP config: %v", err)
+		}
+	})
+}
+
+// Shutdown stops watching the config file.
+func (r *Resolver) Shutdown() {
+	if r.watcher != nil {
+		r.watcher.StopAndWait()
+	}
+}
+
+// Resolve returns the client IP of req and where it was taken from: a provider name, SourceProxy or SourceDirect.
+func (r *Resolver) Resolve(req *http.Request) (string, string) {
+	rs := r.rules.Load()
+	host, _, err := net.SplitHostPort(strings.TrimSpace(req.RemoteAddr))
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	remote, ok := parseAddr(host)
+	if !ok {
+		return host, SourceDirect
+	}
+
+	if p, ok := rs.providers.Lookup(remote); ok {
+		if p.Header != "" {
+			if addr, ok := parseAddr(req.Header.Get(p.Header)); ok {
+				return addr.String(), p.Name
+			}
+		}
+		if p.QueryParam != "" {
+			if addr, ok := parseAddr(req.URL.Query().Get(p.QueryParam)); ok {
+				return addr.String(), p.Name
+			}
+		}
+	}
+
+	if _, ok := rs.proxies.Lookup(remote); ok {
+		// Walk X-Forwarded-For from the right, the first address not belonging to a trusted proxy is the client.
+		hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, ok := parseAddr(hops[i])
+			if !ok {
+				break
+			}
+			client = addr
+			if _, trusted := rs.proxies.Lookup(addr); !trusted {
+				break
+			}
+		}
+		if client != remote {
+			return client.String(), SourceProxy
+		}
+	}
+	return remote.String(), SourceDirect
+}
+
+// Trusted checks if ip belongs to a provider or a trusted proxy.
+func (r *Resolver) Trusted(ip string) bool {
+	addr, ok := parseAddr(ip)
+	if !ok {
+		return false
+	}
+	rs := r.rules.Load()
+	if _, ok := rs.providers.Lookup(addr); ok {
+		return true
+	}
+	_, ok = rs.proxies.Lookup(addr)
+	return ok
+}
+
+// Middleware resolves the client IP of every request and stores it in Header.
+// The engine has to be configured with TrustedPlatform set to Header.
+func (r *Resolver) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Header.Del(Header)
+		ip, source := r.Resolve(c.Request)
+		c.Request.Header.Set(Header, ip)
+		metrics.ClientIPResolutions.WithLabelValues(source).Inc()
+		c.Next()
+	}
+}
+
+// Install makes the engine use the resolver for c.ClientIP().
+func (r *Resolver) Install(e *gin.Engine) error {
+	e.TrustedPlatform = Header
+	if err := e.SetTrustedProxies(nil); err != nil {
+		return errors.Err(err)
+	}
+	e.Use(r.Middleware())
+	return nil
+}
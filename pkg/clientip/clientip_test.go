@@ -0,0 +1,130 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testConfig = Config{
+	Providers: []Provider{
+		{Name: "cloudflare", CIDRs: []string{"173.245.48.0/20", "2400:cb00::/32"}, Header: "CF-Connecting-IP"},
+		{Name: "stackpath", CIDRs: []string{"151.139.0.0/16"}, Header: "X-Real-IP", QueryParam: "ip"},
+	},
+	TrustedProxies: []string{"10.0.0.0/8"},
+}
+
+func newRequest(remote, target string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = remote
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+func TestResolve(t *testing.T) {
+	r, err := NewResolver(testConfig)
+	require.NoError(t, err)
+
+	cases := []struct {
+		name, remote, target string
+		headers              map[string]string
+		ip, source           string
+	}{
+		{"direct", "198.51.100.1:1234", "/", nil, "198.51.100.1", SourceDirect},
+		{"spoofed provider header", "198.51.100.1:1234", "/", map[string]string{"CF-Connecting-IP": "192.0.2.1"}, "198.51.100.1", SourceDirect},
+		{"spoofed forwarded for", "198.51.100.1:1234", "/", map[string]string{"X-Forwarded-For": "192.0.2.1"}, "198.51.100.1", SourceDirect},
+		{"cloudflare", "173.245.49.1:443", "/", map[string]string{"CF-Connecting-IP": "192.0.2.1"}, "192.0.2.1", "cloudflare"},
+		{"cloudflare ipv6 edge", "[2400:cb00::1]:443", "/", map[string]string{"CF-Connecting-IP": "2001:db8::1"}, "2001:db8::1", "cloudflare"},
+		{"cloudflare wrong header", "173.245.49.1:443", "/", map[string]string{"X-Real-IP": "192.0.2.1"}, "173.245.49.1", SourceDirect},
+		{"cloudflare invalid header", "173.245.49.1:443", "/", map[string]string{"CF-Connecting-IP": "junk"}, "173.245.49.1", SourceDirect},
+		{"stackpath header", "151.139.1.1:443", "/?ip=192.0.2.9", map[string]string{"X-Real-IP": "192.0.2.1"}, "192.0.2.1", "stackpath"},
+		{"stackpath query", "151.139.1.1:443", "/?ip=192.0.2.9", nil, "192.0.2.9", "stackpath"},
+		{"query from elsewhere", "198.51.100.1:1234", "/?ip=192.0.2.9", nil, "198.51.100.1", SourceDirect},
+		{"proxy", "10.0.0.1:80", "/", map[string]string{"X-Forwarded-For": "192.0.2.1, 10.0.0.2"}, "192.0.2.1", SourceProxy},
+		{"proxy spoofed chain", "10.0.0.1:80", "/", map[string]string{"X-Forwarded-For": "203.0.113.5, 192.0.2.1"}, "192.0.2.1", SourceProxy},
+		{"proxy without header", "10.0.0.1:80", "/", nil, "10.0.0.1", SourceDirect},
+		{"mapped ipv4", "[::ffff:198.51.100.1]:1234", "/", nil, "198.51.100.1", SourceDirect},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ip, source := r.Resolve(newRequest(c.remote, c.target, c.headers))
+			assert.Equal(t, c.ip, ip)
+			assert.Equal(t, c.source, source)
+		})
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	_, err := NewResolver(Config{Providers: []Provider{{Name: "cdn", Header: "X-Real-IP"}}})
+	assert.Error(t, err)
+	_, err = NewResolver(Config{Providers: []Provider{{Name: "cdn", CIDRs: []string{"10.0.0.0/8"}}}})
+	assert.Error(t, err)
+	_, err = NewResolver(Config{TrustedProxies: []string{"nope"}})
+	assert.Error(t, err)
+}
+
+func TestExampleConfig(t *testing.T) {
+	r, err := LoadResolver("../../client_ip.example.json")
+	require.NoError(t, err)
+	ip, source := r.Resolve(newRequest("104.16.0.1:443", "/", map[string]string{"CF-Connecting-IP": "192.0.2.1"}))
+	assert.Equal(t, "192.0.2.1", ip)
+	assert.Equal(t, "cloudflare", source)
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client_ip.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"trusted_proxies": ["10.0.0.0/8"]}`), 0644))
+	r, err := LoadResolver(path)
+	require.NoError(t, err)
+
+	req := newRequest("10.0.0.1:80", "/", map[string]string{"X-Forwarded-For": "192.0.2.1"})
+	ip, _ := r.Resolve(req)
+	assert.Equal(t, "192.0.2.1", ip)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"trusted_proxies": ["bad"]}`), 0644))
+	assert.Error(t, r.Reload())
+	ip, _ = r.Resolve(req)
+	assert.Equal(t, "192.0.2.1", ip)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{}`), 0644))
+	require.NoError(t, r.Reload())
+	ip, _ = r.Resolve(req)
+	assert.Equal(t, "10.0.0.1", ip)
+}
+
+func TestInstall(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r, err := NewResolver(testConfig)
+	require.NoError(t, err)
+	e := gin.New()
+	require.NoError(t, r.Install(e))
+	e.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.ClientIP())
+	})
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, newRequest("173.245.49.1:443", "/", map[string]string{"CF-Connecting-IP": "192.0.2.1"}))
+	assert.Equal(t, "192.0.2.1", w.Body.String())
+
+	// The internal header cannot be set by clients.
+	w = httptest.NewRecorder()
+	e.ServeHTTP(w, newRequest("198.51.100.1:1234", "/", map[string]string{Header: "192.0.2.1", "X-Forwarded-For": "192.0.2.1"}))
+	assert.Equal(t, "198.51.100.1", w.Body.String())
+}
+
+func TestTrusted(t *testing.T) {
+	r, err := NewResolver(testConfig)
+	require.NoError(t, err)
+	assert.True(t, r.Trusted("173.245.49.1"))
+	assert.True(t, r.Trusted("::ffff:10.1.2.3"))
+	assert.False(t, r.Trusted("192.0.2.1"))
+	assert.False(t, r.Trusted("not an ip"))
+}
@@ -0,0 +1,229 @@
+// Package edgetoken manages the set of tokens that trusted edge nodes use to access protected content.
+package edgetoken
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	lerrors "github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+var Logger = logger.GetLogger()
+
+// Scope is a class of protected content or service a token grants access to.
+type Scope string
+
+const (
+	ScopeMembersOnly Scope = "members-only"
+	ScopeRental      Scope = "rental"
+	ScopePurchase    Scope = "purchase"
+	ScopeUnlisted    Scope = "unlisted"
+	ScopeScheduled   Scope = "scheduled"
+	ScopeBlobServer  Scope = "blob-server"
+)
+
+// AllScopes lists every known scope.
+var AllScopes = []Scope{ScopeMembersOnly, ScopeRental, ScopePurchase, ScopeUnlisted, ScopeScheduled, ScopeBlobServer}
+
+var (
+	ErrNoTokens      = errors.New("no edge tokens configured")
+	ErrInvalidToken  = errors.New("edge token is not valid")
+	ErrScopeMismatch = errors.New("edge token is not valid for this content")
+)
+
+// Token is a named edge credential. NotBefore and ExpiresAt are optional and define the window
+// when the token is accepted, overlapping windows of the old and new token allow for rotation without downtime.
+type Token struct {
+	Name      string    `json:"name"`
+	Secret    string    `json:"token"`
+	Scopes    []Scope   `json:"scopes"`
+	NotBefore time.Time `json:"not_before,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+
+	digest [sha256.Size]byte
+	legacy bool
+}
+
+// minSecretLen is the minimum length of token secrets.
+const minSecretLen = 16
+
+// Legacy returns the token set with the single edge token flag, which predates token sets. It grants all scopes
+// and is exempt from the minimum secret length, so existing deployments keep working.
+func Legacy(secret string) Token {
+	return Token{Name: "default", Secret: secret, Scopes: AllScopes, legacy: true}
+}
+
+type tokensFile struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// Active checks if the token is within its validity window.
+func (t *Token) Active(now time.Time) bool {
+	if !t.NotBefore.IsZero() && now.Before(t.NotBefore) {
+		return false
+	}
+	if !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt) {
+		return false
+	}
+	return true
+}
+
+// HasScope checks if the token was granted scope.
+func (t *Token) HasScope(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Set is a reloadable collection of edge tokens.
+type Set struct {
+	path   string
+	extra  []Token
+	tokens atomic.Pointer[[]Token]
+}
+
+// NewSet creates a static token set.
+func NewSet(tokens ...Token) (*Set, error) {
+	s := &Set{extra: tokens}
+	if err := s.store(nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads tokens from a JSON file at path. Extra tokens, such as the one supplied
+// via the command line, are always kept in the set in addition to the ones from the file.
+// A static set of extra tokens is returned if path is empty.
+func Load(path string, extra ...Token) (*Set, error) {
+	if path == "" {
+		return NewSet(extra...)
+	}
+	s := &Set{path: path, extra: extra}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload re-reads tokens file. The current set is kept if the file cannot be loaded.
+func (s *Set) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return lerrors.Err(err)
+	}
+	var f tokensFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return lerrors.Err("cannot parse edge tokens file: %v", err)
+	}
+	if err := s.store(f.Tokens); err != nil {
+		return err
+	}
+	Logger.Infof("loaded %v edge tokens from %v", len(f.Tokens), s.path)
+	return nil
+}
+
+func (s *Set) store(fromFile []Token) error {
+	tokens := make([]Token, 0, len(fromFile)+len(s.extra))
+	names := map[string]bool{}
+	for _, t := range append(append([]Token{}, s.extra...), fromFile...) {
+		if t.Name == "" {
+			return lerrors.Err("edge token without a name")
+		}
+		if names[t.Name] {
+			return lerrors.Err("duplicate edge token name %v", t.Name)
+		}
+		if len(t.Secret) < minSecretLen {
+			if !t.legacy {
+				return lerrors.Err("edge token %v is too short, at least %v characters required", t.Name, minSecretLen)
+			}
+			Logger.Warnf("edge token is shorter than %v characters, short tokens are deprecated and will be rejected in a future release", minSecretLen)
+		}
+		for _, sc := range t.Scopes {
+			if !validScope(sc) {
+				return lerrors.Err("edge token %v has unknown scope %v", t.Name, sc)
+			}
+		}
+		names[t.Name] = true
+		t.digest = sha256.Sum256([]byte(t.Secret))
+		tokens = append(tokens, t)
+	}
+	s.tokens.Store(&tokens)
+	return nil
+}
+
+func validScope(scope Scope) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of configured tokens.
+func (s *Set) Len() int {
+	return len(*s.tokens.Load())
+}
+
+// Verify checks the supplied secret against all active tokens and returns the matched one
+// if it grants every one of scopes. Secrets are compared in constant time.
+func (s *Set) Verify(secret string, scopes ...Scope) (*Token, error) {
+	tokens := *s.tokens.Load()
+	if len(tokens) == 0 {
+		return nil, ErrNoTokens
+	}
+
+	digest := sha256.Sum256([]byte(secret))
+	var matched *Token
+	for i := range tokens {
+		if subtle.ConstantTimeCompare(digest[:], tokens[i].digest[:]) == 1 {
+			matched = &tokens[i]
+		}
+	}
+
+	if matched == nil || !matched.Active(time.Now()) {
+		for _, scope := range scopes {
+			metrics.EdgeTokenChecks.WithLabelValues("", string(scope), "invalid").Inc()
+		}
+		Logger.WithField("scopes", scopes).Warn("edge token rejected")
+		return nil, ErrInvalidToken
+	}
+	for _, scope := range scopes {
+		if !matched.HasScope(scope) {
+			metrics.EdgeTokenChecks.WithLabelValues(matched.Name, string(scope), "scope_mismatch").Inc()
+			Logger.WithField("token", matched.Name).WithField("scope", scope).Warn("edge token used outside of its scope")
+			return nil, ErrScopeMismatch
+		}
+	}
+	for _, scope := range scopes {
+		metrics.EdgeTokenChecks.WithLabelValues(matched.Name, string(scope), "accepted").Inc()
+	}
+	Logger.WithField("token", matched.Name).WithField("scopes", scopes).Info("edge token accepted")
+	return matched, nil
+}
+
+// Secret returns the secret of the first currently active token granting scope.
+// This is meant for components that only support a single static token.
+func (s *Set) Secret(scope Scope) string {
+	now := time.Now()
+	for _, t := range *s.tokens.Load() {
+		if t.Active(now) && t.HasScope(scope) {
+			return t.Secret
+		}
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package edgetoken
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	s, err := NewSet(
+		Token{Name: "members", Secret: "members-secret-0001", Scopes: []Scope{ScopeMembersOnly}},
+		Token{Name: "old", Secret: "old-secret-00000001", Scopes: []Scope{ScopeRental}, ExpiresAt: now.Add(-time.Minute)},
+		Token{Name: "new", Secret: "new-secret-00000001", Scopes: []Scope{ScopeRental}, NotBefore: now.Add(-time.Hour)},
+		Token{Name: "future", Secret: "future-secret-00001", Scopes: AllScopes, NotBefore: now.Add(time.Hour)},
+	)
+	require.NoError(t, err)
+
+	tok, err := s.Verify("members-secret-0001", ScopeMembersOnly)
+	require.NoError(t, err)
+	assert.Equal(t, "members", tok.Name)
+
+	_, err = s.Verify("members-secret-0001", ScopeRental)
+	assert.ErrorIs(t, err, ErrScopeMismatch)
+	// Tokens have to grant all the scopes content is restricted to.
+	_, err = s.Verify("members-secret-0001", ScopeMembersOnly, ScopeUnlisted)
+	assert.ErrorIs(t, err, ErrScopeMismatch)
+	_, err = s.Verify("members-secret-0001", ScopeUnlisted, ScopeMembersOnly)
+	assert.ErrorIs(t, err, ErrScopeMismatch)
+
+	tok, err = s.Verify("new-secret-00000001", ScopeRental)
+	require.NoError(t, err)
+	assert.Equal(t, "new", tok.Name)
+
+	_, err = s.Verify("old-secret-00000001", ScopeRental)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = s.Verify("future-secret-00001", ScopeRental)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = s.Verify("wrong", ScopeRental)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	assert.Equal(t, "", s.Secret(ScopeBlobServer))
+	assert.Equal(t, "new-secret-00000001", s.Secret(ScopeRental))
+
+	empty, err := NewSet()
+	require.NoError(t, err)
+	_, err = empty.Verify("members-secret-0001", ScopeMembersOnly)
+	assert.ErrorIs(t, err, ErrNoTokens)
+}
+
+func TestNewSetValidation(t *testing.T) {
+	_, err := NewSet(Token{Name: "short", Secret: "short", Scopes: AllScopes})
+	assert.Error(t, err)
+	// The legacy single token is exempt from the minimum length.
+	legacy, err := NewSet(Legacy("short"))
+	require.NoError(t, err)
+	tok, err := legacy.Verify("short", ScopeRental)
+	require.NoError(t, err)
+	assert.Equal(t, "default", tok.Name)
+	_, err = NewSet(Token{Name: "bad-scope", Secret: "long-enough-secret-1", Scopes: []Scope{"everything"}})
+	assert.Error(t, err)
+	_, err = NewSet(
+		Token{Name: "dup", Secret: "long-enough-secret-1"},
+		Token{Name: "dup", Secret: "long-enough-secret-2"},
+	)
+	assert.Error(t, err)
+}
+
+func TestLoadAndReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	write := func(tokens ...Token) {
+		b, err := json.Marshal(tokensFile{Tokens: tokens})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, b, 0644))
+	}
+	write(Token{Name: "cdn-1", Secret: "cdn-secret-00000001", Scopes: []Scope{ScopeBlobServer}})
+
+	s, err := Load(path, Token{Name: "default", Secret: "default-secret-0001", Scopes: AllScopes})
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+	_, err = s.Verify("cdn-secret-00000001", ScopeBlobServer)
+	require.NoError(t, err)
+
+	write(Token{Name: "cdn-2", Secret: "cdn-secret-00000002", Scopes: []Scope{ScopeBlobServer}})
+	require.NoError(t, s.Reload())
+	_, err = s.Verify("cdn-secret-00000001", ScopeBlobServer)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = s.Verify("cdn-secret-00000002", ScopeBlobServer)
+	require.NoError(t, err)
+	_, err = s.Verify("default-secret-0001", ScopeUnlisted)
+	require.NoError(t, err)
+
+	// Invalid file must not replace the loaded tokens
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0644))
+	assert.Error(t, s.Reload())
+	assert.Equal(t, 2, s.Len())
+}
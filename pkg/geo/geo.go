@@ -0,0 +1,283 @@
+// Package geo restricts playback of claims and channels to or from specific countries.
+//
+// Rules come from a policy file, keyed by claim and channel ID, and from claim tags
+// in the form of `geo:allow:us,ca` or `geo:deny:de` (optionally prefixed with `c:`).
+package geo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/internal/mmdb"
+	"github.com/OdyseeTeam/player-server/internal/reload"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	lerrors "github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var Logger = logger.GetLogger()
+
+const (
+	tagAllow = "geo:allow:"
+	tagDeny  = "geo:deny:"
+)
+
+// ErrRestricted is matched by all RestrictedError values.
+var ErrRestricted = errors.New("content is not available in your country")
+
+// RestrictedError is returned when content cannot be played in the client's country.
+type RestrictedError struct {
+	Country string
+	Reason  string
+}
+
+func (e *RestrictedError) Error() string {
+	msg := ErrRestricted.Error()
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+func (e *RestrictedError) Is(target error) bool {
+	return target == ErrRestricted
+}
+
+// Rule limits where content can be played. If Allow is not empty, only the listed countries
+// are allowed, countries listed in Deny are always blocked. Countries are ISO 3166-1 alpha-2 codes.
+type Rule struct {
+	Allow  []string `json:"allow,omitempty"`
+	Deny   []string `json:"deny,omitempty"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// Policy maps claim and channel IDs to rules.
+type Policy struct {
+	Claims   map[string]Rule `json:"claims"`
+	Channels map[string]Rule `json:"channels"`
+}
+
+// Permits checks if the rule allows playback in country. An empty country (unknown location)
+// is only blocked by allow lists.
+func (r Rule) Permits(country string) bool {
+	country = strings.ToUpper(country)
+	for _, c := range r.Deny {
+		if strings.EqualFold(c, country) {
+			return false
+		}
+	}
+	if len(r.Allow) == 0 {
+		return true
+	}
+	for _, c := range r.Allow {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// TagRule builds a rule from claim tags, the second return value is false if there are no geo tags.
+func TagRule(tags []string) (Rule, bool) {
+	var r Rule
+	found := false
+	for _, t := range tags {
+		t = strings.TrimPrefix(t, "c:")
+		switch {
+		case strings.HasPrefix(t, tagAllow):
+			r.Allow = append(r.Allow, splitCountries(strings.TrimPrefix(t, tagAllow))...)
+			found = true
+		case strings.HasPrefix(t, tagDeny):
+			r.Deny = append(r.Deny, splitCountries(strings.TrimPrefix(t, tagDeny))...)
+			found = true
+		}
+	}
+	if found {
+		r.Reason = "restricted by the publisher"
+	}
+	return r, found
+}
+
+func splitCountries(s string) []string {
+	var countries []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			countries = append(countries, strings.ToUpper(c))
+		}
+	}
+	return countries
+}
+
+// Content identifies what is being played.
+type Content struct {
+	ClaimID   string
+	ChannelID string
+	Tags      []string
+}
+
+// Restricted checks if the content has any geo rules at all.
+func (p *Policy) Restricted(c Content) bool {
+	if _, ok := p.Claims[c.ClaimID]; ok {
+		return true
+	}
+	if _, ok := p.Channels[c.ChannelID]; ok && c.ChannelID != "" {
+		return true
+	}
+	_, ok := TagRule(c.Tags)
+	return ok
+}
+
+// Check returns a RestrictedError if content cannot be played in country.
+// Claim rules from the policy are checked first, then claim tags and finally channel rules.
+func (p *Policy) Check(c Content, country string) error {
+	var rules []Rule
+	if r, ok := p.Claims[c.ClaimID]; ok {
+		rules = append(rules, r)
+	}
+	if r, ok := TagRule(c.Tags); ok {
+		rules = append(rules, r)
+	}
+	if r, ok := p.Channels[c.ChannelID]; ok && c.ChannelID != "" {
+		rules = append(rules, r)
+	}
+	for _, r := range rules {
+		if !r.Permits(country) {
+			return &RestrictedError{Country: country, Reason: r.Reason}
+		}
+	}
+	return nil
+}
+
+// ParsePolicy decodes a JSON policy.
+func ParsePolicy(b []byte) (*Policy, error) {
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, lerrors.Err("cannot parse geo policy: %v", err)
+	}
+	return &p, nil
+}
+
+// Restrictor looks up client countries and applies the active policy.
+type Restrictor struct {
+	dbPath     string
+	db         atomic.Pointer[maxminddb.Reader]
+	policyPath string
+	policy     atomic.Pointer[Policy]
+	watchers   []*stop.Group
+}
+
+// NewRestrictor opens the country database at dbPath and loads the policy from policyPath.
+// Only tag rules are applied if policyPath is empty.
+func NewRestrictor(dbPath, policyPath string) (*Restrictor, error) {
+	r := &Restrictor{dbPath: dbPath, policyPath: policyPath}
+	r.policy.Store(&Policy{})
+	if err := r.LoadDatabase(); err != nil {
+		return nil, err
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LoadDatabase validates the country database and makes it active.
+// The active database is kept if validation fails.
+func (r *Restrictor) LoadDatabase() error {
+	db, err := mmdb.Open(r.dbPath, "Country")
+	if err != nil {
+		return lerrors.Err("cannot open country database: %v", err)
+	}
+	r.db.Store(db)
+	Logger.Infof("loaded country database %v built at %v", r.dbPath, time.Unix(int64(db.Metadata.BuildEpoch), 0).UTC())
+	return nil
+}
+
+// Reload reads the policy file again, the active policy is kept if that fails.
+func (r *Restrictor) Reload() error {
+	if r.policyPath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(r.policyPath)
+	if err != nil {
+		return lerrors.Err(err)
+	}
+	p, err := ParsePolicy(b)
+	if err != nil {
+		return err
+	}
+	r.policy.Store(p)
+	Logger.Infof("loaded geo policy from %v (%v claims, %v channels)", r.policyPath, len(p.Claims), len(p.Channels))
+	return nil
+}
+
+// Watch enables reloading of the country database and the policy whenever their files change.
+func (r *Restrictor) Watch(interval time.Duration) {
+	r.watchers = append(r.watchers, reload.Watch(r.dbPath, interval, func() {
+		if err := r.LoadDatabase(); err != nil {
+			Logger.Errorf("failed to reload country database: %v", err)
+		}
+	}))
+	if r.policyPath == "" {
+		return
+	}
+	r.watchers = append(r.watchers, reload.Watch(r.policyPath, interval, func() {
+		if err := r.Reload(); err != nil {
+			Logger.Errorf("failed to reload geo policy: %v", err)
+		}
+	}))
+}
+
+// Shutdown stops watching the country database and the policy file.
+func (r *Restrictor) Shutdown() {
+	for _, w := range r.watchers {
+		w.StopAndWait()
+	}
+}
+
+// Country returns the ISO country code for ip, or an empty string if it is not known.
+func (r *Restrictor) Country(ip string) (string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", fmt.Errorf("invalid ip %q", ip)
+	}
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := r.db.Load().Lookup(parsed, &rec); err != nil {
+		return "", lerrors.Err(err)
+	}
+	return rec.Country.ISOCode, nil
+}
+
+// Restricted checks if the content has any geo rules.
+func (r *Restrictor) Restricted(c Content) bool {
+	return r.policy.Load().Restricted(c)
+}
+
+// Check returns a RestrictedError if content cannot be played from ip.
+func (r *Restrictor) Check(c Content, ip string) error {
+	p := r.policy.Load()
+	if !p.Restricted(c) {
+		return nil
+	}
+	country, err := r.Country(ip)
+	if err != nil {
+		Logger.Warnf("cannot determine country of %v: %v", ip, err)
+	}
+	if err := p.Check(c, country); err != nil {
+		metrics.GeoRestricted.WithLabelValues(country).Inc()
+		return err
+	}
+	return nil
+}
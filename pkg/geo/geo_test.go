@@ -0,0 +1,116 @@
+package geo
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/mmdbtest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	ipUS = "203.0.113.10"
+	ipDE = "198.51.100.10"
+	ipFR = "2001:db8::10"
+	// Not present in the test database
+	ipUnknown = "192.0.2.10"
+)
+
+func writeCountryDB(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	require.NoError(t, mmdbtest.Write(path, "GeoLite2-Country", map[string]map[string]any{
+		"203.0.113.0/24":  {"country": map[string]any{"iso_code": "US"}},
+		"198.51.100.0/24": {"country": map[string]any{"iso_code": "DE"}},
+		"2001:db8::/32":   {"country": map[string]any{"iso_code": "FR"}},
+	}))
+	return path
+}
+
+func TestTagRule(t *testing.T) {
+	r, ok := TagRule([]string{"gaming", "geo:allow:us, ca", "c:geo:deny:de"})
+	require.True(t, ok)
+	assert.Equal(t, []string{"US", "CA"}, r.Allow)
+	assert.Equal(t, []string{"DE"}, r.Deny)
+
+	_, ok = TagRule([]string{"gaming"})
+	assert.False(t, ok)
+}
+
+func TestRulePermits(t *testing.T) {
+	assert.True(t, Rule{Deny: []string{"DE"}}.Permits("US"))
+	assert.False(t, Rule{Deny: []string{"DE"}}.Permits("de"))
+	assert.True(t, Rule{Deny: []string{"DE"}}.Permits(""))
+	assert.True(t, Rule{Allow: []string{"US", "CA"}}.Permits("CA"))
+	assert.False(t, Rule{Allow: []string{"US", "CA"}}.Permits("DE"))
+	assert.False(t, Rule{Allow: []string{"US"}}.Permits(""))
+}
+
+func TestRestrictor(t *testing.T) {
+	policyPath := filepath.Join(t.TempDir(), "geo.json")
+	require.NoError(t, os.WriteFile(policyPath, []byte(`{
+		"claims": {"claim1": {"allow": ["US"], "reason": "licensed for the US only"}},
+		"channels": {"channel1": {"deny": ["FR"], "reason": "legal request"}}
+	}`), 0644))
+
+	r, err := NewRestrictor(writeCountryDB(t), policyPath)
+	require.NoError(t, err)
+	r.Watch(10 * time.Millisecond)
+	defer r.Shutdown()
+
+	country, err := r.Country(ipFR)
+	require.NoError(t, err)
+	assert.Equal(t, "FR", country)
+	country, err = r.Country("::ffff:" + ipDE)
+	require.NoError(t, err)
+	assert.Equal(t, "DE", country)
+
+	claim := Content{ClaimID: "claim1", ChannelID: "channel1"}
+	assert.NoError(t, r.Check(claim, ipUS))
+	err = r.Check(claim, ipDE)
+	assert.ErrorIs(t, err, ErrRestricted)
+	assert.EqualError(t, err, "content is not available in your country: licensed for the US only")
+	assert.ErrorIs(t, r.Check(claim, ipUnknown), ErrRestricted)
+
+	channel := Content{ClaimID: "claim2", ChannelID: "channel1"}
+	assert.NoError(t, r.Check(channel, ipDE))
+	assert.ErrorIs(t, r.Check(channel, ipFR), ErrRestricted)
+	assert.NoError(t, r.Check(channel, ipUnknown))
+
+	tagged := Content{ClaimID: "claim3", Tags: []string{"geo:deny:us"}}
+	assert.True(t, r.Restricted(tagged))
+	assert.ErrorIs(t, r.Check(tagged, ipUS), ErrRestricted)
+	assert.NoError(t, r.Check(tagged, ipDE))
+
+	free := Content{ClaimID: "claim4", ChannelID: "channel2"}
+	assert.False(t, r.Restricted(free))
+	assert.NoError(t, r.Check(free, "not an ip"))
+
+	require.NoError(t, os.WriteFile(policyPath, []byte(`{"claims": {"claim4": {"deny": ["DE"]}}}`), 0644))
+	assert.Eventually(t, func() bool { return r.Check(free, ipDE) != nil }, time.Second, 10*time.Millisecond)
+	assert.NoError(t, r.Check(claim, ipDE))
+}
+
+func TestRestrictorReloadsDatabase(t *testing.T) {
+	dbPath := writeCountryDB(t)
+	r, err := NewRestrictor(dbPath, "")
+	require.NoError(t, err)
+	r.Watch(10 * time.Millisecond)
+	defer r.Shutdown()
+
+	tagged := Content{ClaimID: "claim1", Tags: []string{"geo:deny:de"}}
+	assert.NoError(t, r.Check(tagged, ipUS))
+
+	// An invalid database is ignored.
+	require.NoError(t, os.WriteFile(dbPath, []byte("not a database"), 0644))
+	assert.Error(t, r.LoadDatabase())
+	assert.NoError(t, r.Check(tagged, ipUS))
+
+	require.NoError(t, mmdbtest.Write(dbPath, "GeoLite2-Country", map[string]map[string]any{
+		"203.0.113.0/24": {"country": map[string]any{"iso_code": "DE"}},
+	}))
+	assert.Eventually(t, func() bool { return r.Check(tagged, ipUS) != nil }, time.Second, 10*time.Millisecond)
+}
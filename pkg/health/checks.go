@@ -0,0 +1,63 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// probeHash is a blob hash that doesn't exist, looked up to see if a blob store responds.
+var probeHash = strings.Repeat("0", 96)
+
+// BlobStore checks that a blob store answers lookups. Missing blobs are fine, errors are not.
+func BlobStore(s store.BlobStore) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := s.Has(probeHash)
+		return err
+	}
+}
+
+// HTTP checks that a server responds to a GET request with anything but a server error.
+func HTTP(client *http.Client, url string) func(ctx context.Context) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+		if res.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%v responded with %v", url, res.Status)
+		}
+		return nil
+	}
+}
+
+// DiskSpace checks that the filesystem path is on has at least minFree bytes available.
+func DiskSpace(path string, minFree uint64) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(path, &fs); err != nil {
+			return fmt.Errorf("cannot stat filesystem of %v: %w", path, err)
+		}
+		free := fs.Bavail * uint64(fs.Bsize)
+		if free < minFree {
+			return fmt.Errorf("%v available in %v, %v required", datasize.ByteSize(free).HR(), path, datasize.ByteSize(minFree).HR())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,266 @@
+// Package health reports whether the player is alive and whether it should receive traffic.
+// Readiness is derived from checks of the dependencies streams are served from. Check results
+// are cached, so frequent probes from several load balancers don't put load on dependencies.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/singleflight"
+)
+
+var Logger = logger.GetLogger()
+
+// Statuses of checks.
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// Check is a dependency readiness depends on.
+type Check struct {
+	Name string
+	// Run returns an error if the dependency can't be used. It should return once ctx is done,
+	// results of runs that don't are discarded after the timeout.
+	Run func(ctx context.Context) error
+	// Optional checks are reported but don't make the player unready when failing,
+	// for dependencies the player can serve streams without.
+	Optional bool
+}
+
+// Opts configure how checks are run.
+type Opts struct {
+	// Timeout is how long a check is allowed to run before it is considered failing.
+	Timeout time.Duration
+	// CacheTTL is how long check results are reused for.
+	CacheTTL time.Duration
+}
+
+// DefaultOpts returns options suitable for production.
+func DefaultOpts() Opts {
+	return Opts{
+		Timeout:  2 * time.Second,
+		CacheTTL: 5 * time.Second,
+	}
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Optional  bool      `json:"optional,omitempty"`
+	Duration  float64   `json:"duration_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the readiness of the player along with results of all checks.
+type Report struct {
+	Ready    bool              `json:"ready"`
+	Draining bool              `json:"draining,omitempty"`
+	Checks   map[string]Result `json:"checks"`
+}
+
+type check struct {
+	Check
+	mu      sync.Mutex
+	result  Result
+	expires time.Time
+	// running is set while Run hasn't returned, including runs that timed out.
+	running bool
+}
+
+// Checker runs checks and keeps their results.
+type Checker struct {
+	opts     Opts
+	mu       sync.RWMutex
+	checks   []*check
+	sf       singleflight.Group
+	draining atomic.Bool
+	now      func() time.Time
+}
+
+// New returns a checker with no checks, under which the player is always ready unless draining.
+func New(opts Opts) *Checker {
+	d := DefaultOpts()
+	if opts.Timeout <= 0 {
+		opts.Timeout = d.Timeout
+	}
+	if opts.CacheTTL < 0 {
+		opts.CacheTTL = 0
+	}
+	return &Checker{opts: opts, now: time.Now}
+}
+
+// Add registers checks. Checks are identified by name, adding a check with a name already
+// registered replaces it.
+func (c *Checker) Add(checks ...Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Ready iterates over the slice without holding the lock, so it's never modified in place.
+	registered := slices.Clone(c.checks)
+	for _, ch := range checks {
+		i := slices.IndexFunc(registered, func(e *check) bool { return e.Name == ch.Name })
+		if i >= 0 {
+			registered[i] = &check{Check: ch}
+		} else {
+			registered = append(registered, &check{Check: ch})
+		}
+	}
+	c.checks = registered
+}
+
+// SetDraining makes the player report itself not ready regardless of checks, so it's taken out
+// of rotation ahead of a shutdown while still serving requests in flight.
+func (c *Checker) SetDraining(draining bool) {
+	if c.draining.Swap(draining) != draining {
+		Logger.Infof("readiness draining set to %v", draining)
+	}
+	v := 0.0
+	if draining {
+		v = 1
+	}
+	metrics.HealthDraining.Set(v)
+}
+
+// Draining checks if the player has been set to draining.
+func (c *Checker) Draining() bool {
+	return c.draining.Load()
+}
+
+// Ready runs checks whose cached results have expired and reports readiness.
+func (c *Checker) Ready() Report {
+	c.mu.RLock()
+	checks := c.checks
+	c.mu.RUnlock()
+
+	r := Report{Ready: true, Draining: c.Draining(), Checks: make(map[string]Result, len(checks))}
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, ch := range checks {
+		wg.Add(1)
+		go func(i int, ch *check) {
+			defer wg.Done()
+			results[i] = c.result(ch)
+		}(i, ch)
+	}
+	wg.Wait()
+
+	for i, ch := range checks {
+		res := results[i]
+		r.Checks[ch.Name] = res
+		if res.Status != StatusOK && !ch.Optional {
+			r.Ready = false
+		}
+	}
+	if r.Draining {
+		r.Ready = false
+	}
+	return r
+}
+
+// result returns the cached result of a check, running it if expired. Concurrent callers share a run.
+func (c *Checker) result(ch *check) Result {
+	ch.mu.Lock()
+	if c.now().Before(ch.expires) {
+		defer ch.mu.Unlock()
+		return ch.result
+	}
+	ch.mu.Unlock()
+
+	v, _, _ := c.sf.Do(ch.Name, func() (interface{}, error) {
+		res := c.run(ch)
+		ch.mu.Lock()
+		ch.result = res
+		ch.expires = res.CheckedAt.Add(c.opts.CacheTTL)
+		ch.mu.Unlock()
+		return res, nil
+	})
+	return v.(Result)
+}
+
+// run runs a check, giving up on it after the timeout. A check still running since a previous
+// timeout is not started again, so checks hanging on a dependency don't pile up.
+func (c *Checker) run(ch *check) Result {
+	start := c.now()
+	res := Result{Status: StatusOK, Optional: ch.Optional, CheckedAt: start}
+
+	ch.mu.Lock()
+	if ch.running {
+		ch.mu.Unlock()
+		res.Status = StatusFailing
+		res.Error = "previous check has not returned yet"
+		c.record(ch, res)
+		return res
+	}
+	ch.running = true
+	ch.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		err := ch.Run(ctx)
+		ch.mu.Lock()
+		ch.running = false
+		ch.mu.Unlock()
+		done <- err
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %v", c.opts.Timeout)
+	}
+	res.Duration = float64(c.now().Sub(start).Microseconds()) / 1000
+	if err != nil {
+		res.Status = StatusFailing
+		res.Error = err.Error()
+	}
+	c.record(ch, res)
+	return res
+}
+
+func (c *Checker) record(ch *check, res Result) {
+	v := 0.0
+	if res.Status != StatusOK {
+		v = 1
+		Logger.Warnf("readiness check %v failing: %v", ch.Name, res.Error)
+	}
+	metrics.HealthCheckFailing.WithLabelValues(ch.Name).Set(v)
+}
+
+// HandleLiveness responds as long as the process is able to serve requests.
+func (c *Checker) HandleLiveness(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(http.StatusOK, gin.H{"status": StatusOK})
+}
+
+// HandleReadiness responds with the readiness report, with a 503 if the player should not receive traffic.
+func (c *Checker) HandleReadiness(ctx *gin.Context) {
+	r := c.Ready()
+	status := http.StatusOK
+	if !r.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	ctx.Header("Cache-Control", "no-store")
+	ctx.JSON(status, r)
+}
+
+// InstallRoutes adds liveness and readiness endpoints to the router.
+func InstallRoutes(r *gin.Engine, c *Checker) {
+	r.GET("/healthz", c.HandleLiveness)
+	r.HEAD("/healthz", c.HandleLiveness)
+	r.GET("/readyz", c.HandleReadiness)
+	r.HEAD("/readyz", c.HandleReadiness)
+}
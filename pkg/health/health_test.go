@@ -0,0 +1,190 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lbryio/reflector.go/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestChecker(opts Opts) (*Checker, *clock) {
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h := New(opts)
+	h.now = c.now
+	return h, c
+}
+
+func failing(err error) func(context.Context) error {
+	return func(context.Context) error { return err }
+}
+
+func TestReady(t *testing.T) {
+	h, _ := newTestChecker(DefaultOpts())
+	assert.True(t, h.Ready().Ready, "no checks")
+
+	h.Add(
+		Check{Name: "origin", Run: failing(nil)},
+		Check{Name: "transcoder", Run: failing(errors.New("connection refused")), Optional: true},
+	)
+	r := h.Ready()
+	assert.True(t, r.Ready, "optional checks don't affect readiness")
+	assert.Equal(t, StatusOK, r.Checks["origin"].Status)
+	assert.Equal(t, Result{Status: StatusFailing, Error: "connection refused", Optional: true, CheckedAt: r.Checks["transcoder"].CheckedAt}, r.Checks["transcoder"])
+
+	// Checks with a registered name are replaced.
+	h.Add(Check{Name: "origin", Run: failing(errors.New("upstream error"))})
+	r = h.Ready()
+	assert.False(t, r.Ready)
+	assert.Len(t, r.Checks, 2)
+	assert.Equal(t, "upstream error", r.Checks["origin"].Error)
+}
+
+func TestCaching(t *testing.T) {
+	h, c := newTestChecker(Opts{CacheTTL: 5 * time.Second})
+	var runs atomic.Int32
+	release := make(chan struct{})
+	h.Add(Check{Name: "origin", Run: func(context.Context) error {
+		runs.Add(1)
+		<-release
+		return nil
+	}})
+
+	// Concurrent probes share a run.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.True(t, h.Ready().Ready)
+		}()
+	}
+	require.Eventually(t, func() bool { return runs.Load() == 1 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.EqualValues(t, 1, runs.Load())
+
+	c.advance(4 * time.Second)
+	h.Ready()
+	assert.EqualValues(t, 1, runs.Load())
+	c.advance(time.Second)
+	h.Ready()
+	assert.EqualValues(t, 2, runs.Load())
+}
+
+func TestTimeout(t *testing.T) {
+	h, _ := newTestChecker(Opts{Timeout: 10 * time.Millisecond})
+	release := make(chan struct{})
+	h.Add(Check{Name: "resolver", Run: func(context.Context) error {
+		// Doesn't respect the context, like clients without context support.
+		<-release
+		return nil
+	}})
+
+	r := h.Ready()
+	assert.False(t, r.Ready)
+	assert.Equal(t, "timed out after 10ms", r.Checks["resolver"].Error)
+
+	// The hanging check is not started again until it returns.
+	r = h.Ready()
+	assert.Equal(t, "previous check has not returned yet", r.Checks["resolver"].Error)
+
+	close(release)
+	require.Eventually(t, func() bool { return h.Ready().Ready }, time.Second, time.Millisecond)
+}
+
+func TestDraining(t *testing.T) {
+	h, _ := newTestChecker(DefaultOpts())
+	h.Add(Check{Name: "origin", Run: failing(nil)})
+
+	h.SetDraining(true)
+	r := h.Ready()
+	assert.False(t, r.Ready)
+	assert.True(t, r.Draining)
+	assert.Equal(t, StatusOK, r.Checks["origin"].Status)
+
+	h.SetDraining(false)
+	assert.True(t, h.Ready().Ready)
+}
+
+func TestRoutes(t *testing.T) {
+	h, _ := newTestChecker(DefaultOpts())
+	h.Add(Check{Name: "decrypted_cache_index", Run: failing(errors.New("dial tcp: connection refused"))})
+	r := gin.New()
+	InstallRoutes(r, h)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	var report Report
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.False(t, report.Ready)
+	assert.Equal(t, StatusFailing, report.Checks["decrypted_cache_index"].Status)
+	assert.Equal(t, "dial tcp: connection refused", report.Checks["decrypted_cache_index"].Error)
+}
+
+func TestBlobStore(t *testing.T) {
+	assert.NoError(t, BlobStore(store.NewMemStore())(context.Background()))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	assert.ErrorContains(t, BlobStore(store.NewHttpStore(ts.Listener.Addr().String(), ""))(context.Background()), "502")
+}
+
+func TestHTTP(t *testing.T) {
+	status := http.StatusNotFound
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	check := HTTP(nil, ts.URL)
+	assert.NoError(t, check(context.Background()), "any response short of a server error means the server is reachable")
+	status = http.StatusServiceUnavailable
+	assert.EqualError(t, check(context.Background()), ts.URL+" responded with 503 Service Unavailable")
+
+	ts.Close()
+	assert.Error(t, check(context.Background()))
+}
+
+func TestDiskSpace(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, DiskSpace(dir, 1)(context.Background()))
+	assert.ErrorContains(t, DiskSpace(dir, math.MaxUint64)(context.Background()), "required")
+	assert.ErrorContains(t, DiskSpace(dir+"/missing", 1)(context.Background()), "cannot stat filesystem")
+}
@@ -0,0 +1,431 @@
+// Package hlssession keeps track of viewers of transcoded streams. Access decisions are carried over
+// between fragment requests of the same viewer and segments following the ones being watched are
+// retrieved into the local transcoder cache ahead of time.
+package hlssession
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+var Logger = logger.GetLogger()
+
+const masterPlaylist = "master.m3u8"
+
+// Transcoder serves rendition files, retrieving them into its local cache first if needed.
+type Transcoder interface {
+	PlayFragment(lbryURL, sdHash, fragmentName string, w http.ResponseWriter, r *http.Request) (int64, error)
+}
+
+// Opts configure sessions and prefetching.
+type Opts struct {
+	// Lookahead is the number of segments following a requested one that are prefetched, 0 disables prefetching.
+	Lookahead int
+	// SessionTTL is how long a session is kept after its last request.
+	SessionTTL time.Duration
+	// DecisionTTL caps how long an access decision is carried over, so blocks take effect within it.
+	DecisionTTL time.Duration
+	// MaxSessions and MaxRenditions cap the number of sessions and rendition indexes kept.
+	MaxSessions   int
+	MaxRenditions int
+	// Workers is the number of concurrent prefetches, QueueSize the number of prefetches waiting for one.
+	Workers   int
+	QueueSize int
+}
+
+// DefaultOpts returns options suitable for production.
+func DefaultOpts() Opts {
+	return Opts{
+		Lookahead:     3,
+		SessionTTL:    10 * time.Minute,
+		DecisionTTL:   5 * time.Minute,
+		MaxSessions:   100000,
+		MaxRenditions: 10000,
+		Workers:       8,
+		QueueSize:     1000,
+	}
+}
+
+// Results of fragment requests and prefetches, used as metric labels.
+const (
+	ResultHit        = "hit"
+	ResultMiss       = "miss"
+	ResultPrefetched = "prefetched"
+
+	resultFetched = "fetched"
+	resultFailed  = "failed"
+	resultDropped = "dropped"
+)
+
+// indexRetry is how long a rendition whose playlists could not be read is left alone.
+const indexRetry = time.Minute
+
+// Key identifies a viewer session of a rendition.
+type Key struct {
+	Client  string
+	ClaimID string
+	SdHash  string
+	// Credentials fingerprints the tokens the viewer presented, so decisions for protected streams
+	// aren't carried over to other viewers behind the same address.
+	Credentials string
+}
+
+type session struct {
+	granted  time.Time
+	lastSeen time.Time
+	// channelID of the claim, so checks of the channel can be repeated without resolving the claim.
+	channelID string
+}
+
+type segment struct {
+	variant string
+	pos     int
+}
+
+// rendition indexes segments of a rendition by their position in variant playlists.
+type rendition struct {
+	loaded   bool
+	loading  bool
+	failedAt time.Time
+	lastUsed time.Time
+	// lastPlayed is prefetched after once the index is loaded.
+	lastPlayed string
+	variants   map[string][]string
+	segments   map[string]segment
+	// pending are segments queued for prefetching, fetched the ones already prefetched.
+	pending map[string]bool
+	fetched map[string]bool
+}
+
+type job struct {
+	lbryURL, sdHash, name string
+}
+
+// Cache holds viewer sessions and rendition indexes used for prefetching.
+type Cache struct {
+	opts Opts
+	tc   Transcoder
+	now  func() time.Time
+
+	mu         sync.Mutex
+	sessions   map[Key]*session
+	renditions map[string]*rendition
+	queue      chan job
+	grp        *stop.Group
+}
+
+// New creates a session cache, Start has to be called for prefetching to happen.
+func New(tc Transcoder, opts Opts) *Cache {
+	def := DefaultOpts()
+	if opts.Lookahead < 0 {
+		opts.Lookahead = 0
+	}
+	if opts.SessionTTL <= 0 {
+		opts.SessionTTL = def.SessionTTL
+	}
+	if opts.DecisionTTL <= 0 {
+		opts.DecisionTTL = def.DecisionTTL
+	}
+	if opts.MaxSessions <= 0 {
+		opts.MaxSessions = def.MaxSessions
+	}
+	if opts.MaxRenditions <= 0 {
+		opts.MaxRenditions = def.MaxRenditions
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = def.Workers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = def.QueueSize
+	}
+	return &Cache{
+		opts:       opts,
+		tc:         tc,
+		now:        time.Now,
+		sessions:   map[Key]*session{},
+		renditions: map[string]*rendition{},
+		queue:      make(chan job, opts.QueueSize),
+		grp:        stop.New(),
+	}
+}
+
+// Start runs prefetch workers and expires idle sessions until Shutdown is called.
+func (c *Cache) Start() {
+	for i := 0; i < c.opts.Workers; i++ {
+		c.grp.Add(1)
+		go func() {
+			defer c.grp.Done()
+			for {
+				select {
+				case <-c.grp.Ch():
+					return
+				case j := <-c.queue:
+					c.process(j)
+				}
+			}
+		}()
+	}
+	c.grp.Add(1)
+	go func() {
+		defer c.grp.Done()
+		t := time.NewTicker(c.opts.SessionTTL / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-c.grp.Ch():
+				return
+			case <-t.C:
+				c.expire()
+			}
+		}
+	}()
+}
+
+// Shutdown stops prefetching, queued prefetches are dropped.
+func (c *Cache) Shutdown() {
+	c.grp.StopAndWait()
+}
+
+// Allowed checks if the viewer passed access checks for the rendition within DecisionTTL,
+// returning the channel ID recorded with the decision.
+func (c *Cache) Allowed(k Key) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.sessions[k]
+	if !ok {
+		return "", false
+	}
+	now := c.now()
+	if now.Sub(s.lastSeen) >= c.opts.SessionTTL || now.Sub(s.granted) >= c.opts.DecisionTTL {
+		return "", false
+	}
+	s.lastSeen = now
+	return s.channelID, true
+}
+
+// Allow records that the viewer passed access checks for the rendition of a claim in channelID.
+func (c *Cache) Allow(k Key, channelID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	s, ok := c.sessions[k]
+	if !ok {
+		if len(c.sessions) >= c.opts.MaxSessions {
+			c.expireLocked()
+		}
+		if len(c.sessions) >= c.opts.MaxSessions {
+			return
+		}
+		s = &session{}
+		c.sessions[k] = s
+	}
+	s.granted, s.lastSeen, s.channelID = now, now, channelID
+	metrics.TcSessions.Set(float64(len(c.sessions)))
+}
+
+// Played notes that a fragment of the rendition was served and queues prefetching of the segments
+// following it. It reports whether the fragment had been prefetched.
+func (c *Cache) Played(lbryURL, sdHash, name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.rendition(sdHash)
+	r.lastUsed = c.now()
+	prefetched := r.fetched[name]
+	if c.opts.Lookahead == 0 || strings.HasSuffix(name, ".m3u8") {
+		return prefetched
+	}
+	if !r.loaded {
+		r.lastPlayed = name
+		if !r.loading && c.now().Sub(r.failedAt) >= indexRetry {
+			r.loading = c.enqueue(job{lbryURL: lbryURL, sdHash: sdHash})
+		}
+		return prefetched
+	}
+	c.prefetchAfter(r, lbryURL, sdHash, name)
+	return prefetched
+}
+
+// prefetchAfter queues segments following name in its variant playlist.
+func (c *Cache) prefetchAfter(r *rendition, lbryURL, sdHash, name string) {
+	seg, ok := r.segments[name]
+	if !ok {
+		return
+	}
+	list := r.variants[seg.variant]
+	for _, next := range list[seg.pos+1 : min(seg.pos+1+c.opts.Lookahead, len(list))] {
+		if r.fetched[next] || r.pending[next] {
+			continue
+		}
+		if c.enqueue(job{lbryURL: lbryURL, sdHash: sdHash, name: next}) {
+			r.pending[next] = true
+		}
+	}
+}
+
+func (c *Cache) enqueue(j job) bool {
+	select {
+	case c.queue <- j:
+		return true
+	default:
+		metrics.TcPrefetches.WithLabelValues(resultDropped).Inc()
+		return false
+	}
+}
+
+// rendition returns the index of a rendition, creating an empty one if needed. Must be called with mu held.
+func (c *Cache) rendition(sdHash string) *rendition {
+	r, ok := c.renditions[sdHash]
+	if ok {
+		return r
+	}
+	if len(c.renditions) >= c.opts.MaxRenditions {
+		c.evictRendition()
+	}
+	r = &rendition{pending: map[string]bool{}, fetched: map[string]bool{}}
+	c.renditions[sdHash] = r
+	return r
+}
+
+// evictRendition drops the least recently used rendition index that is not being loaded.
+func (c *Cache) evictRendition() {
+	var oldest string
+	var oldestUse time.Time
+	for h, r := range c.renditions {
+		if r.loading {
+			continue
+		}
+		if oldest == "" || r.lastUsed.Before(oldestUse) {
+			oldest, oldestUse = h, r.lastUsed
+		}
+	}
+	delete(c.renditions, oldest)
+}
+
+func (c *Cache) process(j job) {
+	if j.name == "" {
+		c.loadIndex(j)
+		return
+	}
+	_, err := c.tc.PlayFragment(j.lbryURL, j.sdHash, j.name, discard{}, prefetchRequest())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.renditions[j.sdHash]
+	if ok {
+		delete(r.pending, j.name)
+	}
+	if err != nil {
+		Logger.Debugf("failed to prefetch %v/%v: %v", j.sdHash, j.name, err)
+		metrics.TcPrefetches.WithLabelValues(resultFailed).Inc()
+		return
+	}
+	metrics.TcPrefetches.WithLabelValues(resultFetched).Inc()
+	if ok {
+		r.fetched[j.name] = true
+	}
+}
+
+// loadIndex reads master and variant playlists of a rendition to learn the order of its segments.
+func (c *Cache) loadIndex(j job) {
+	variants := map[string][]string{}
+	master, err := c.readPlaylist(j.lbryURL, j.sdHash, masterPlaylist)
+	for _, v := range master {
+		if err != nil {
+			break
+		}
+		variants[v], err = c.readPlaylist(j.lbryURL, j.sdHash, v)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.rendition(j.sdHash)
+	r.loading = false
+	if err != nil {
+		Logger.Infof("cannot index rendition %v for prefetching: %v", j.sdHash, err)
+		r.failedAt = c.now()
+		return
+	}
+	r.loaded = true
+	r.variants = variants
+	r.segments = map[string]segment{}
+	for v, list := range variants {
+		for i, name := range list {
+			r.segments[name] = segment{variant: v, pos: i}
+		}
+	}
+	c.prefetchAfter(r, j.lbryURL, j.sdHash, r.lastPlayed)
+}
+
+// readPlaylist returns URIs listed in a playlist.
+func (c *Cache) readPlaylist(lbryURL, sdHash, name string) ([]string, error) {
+	var buf bufferWriter
+	buf.header = http.Header{}
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	if _, err := c.tc.PlayFragment(lbryURL, sdHash, name, &buf, r); err != nil {
+		return nil, err
+	}
+	var uris []string
+	s := bufio.NewScanner(&buf.body)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if i := strings.IndexByte(l, '?'); i >= 0 {
+			l = l[:i]
+		}
+		uris = append(uris, l)
+	}
+	return uris, s.Err()
+}
+
+func (c *Cache) expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expireLocked()
+}
+
+// expireLocked drops idle sessions and renditions. Must be called with mu held.
+func (c *Cache) expireLocked() {
+	now := c.now()
+	for k, s := range c.sessions {
+		if now.Sub(s.lastSeen) >= c.opts.SessionTTL {
+			delete(c.sessions, k)
+		}
+	}
+	for h, r := range c.renditions {
+		if !r.loading && now.Sub(r.lastUsed) >= c.opts.SessionTTL {
+			delete(c.renditions, h)
+		}
+	}
+	metrics.TcSessions.Set(float64(len(c.sessions)))
+}
+
+// prefetchRequest is a HEAD request, making the transcoder retrieve a fragment without serving its content.
+func prefetchRequest() *http.Request {
+	r, _ := http.NewRequest(http.MethodHead, "/", nil)
+	return r
+}
+
+type discard struct{}
+
+func (discard) Header() http.Header         { return http.Header{} }
+func (discard) Write(p []byte) (int, error) { return len(p), nil }
+func (discard) WriteHeader(int)             {}
+
+type bufferWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (b *bufferWriter) Header() http.Header         { return b.header }
+func (b *bufferWriter) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferWriter) WriteHeader(int)             {}
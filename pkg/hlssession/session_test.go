@@ -0,0 +1,156 @@
+package hlssession
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/transcodertest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sdHash = "a4c55d0c5b0e1fbf4bd5e1bb7c2f2ba1bf8ae7d4cfaa14dd05e53e1d85cdf1f5d0fbc2b10e0da7dd5a8bd1f0c2a9a3c1"
+
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestCache(t *testing.T, tc Transcoder, opts Opts) (*Cache, *clock) {
+	t.Helper()
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := New(tc, opts)
+	s.now = c.now
+	s.Start()
+	t.Cleanup(s.Shutdown)
+	return s, c
+}
+
+func segmentName(i int) string {
+	return fmt.Sprintf("v0_s%06d.ts", i)
+}
+
+func TestSessions(t *testing.T) {
+	s, c := newTestCache(t, transcodertest.New(), Opts{SessionTTL: 10 * time.Minute, DecisionTTL: 5 * time.Minute})
+	k := Key{Client: "192.0.2.1", ClaimID: "claim", SdHash: sdHash}
+	allowed := func(k Key) bool {
+		_, ok := s.Allowed(k)
+		return ok
+	}
+
+	assert.False(t, allowed(k))
+	s.Allow(k, "channel")
+	channelID, ok := s.Allowed(k)
+	assert.True(t, ok)
+	assert.Equal(t, "channel", channelID)
+	assert.False(t, allowed(Key{Client: "192.0.2.2", ClaimID: "claim", SdHash: sdHash}))
+	assert.False(t, allowed(Key{Client: "192.0.2.1", ClaimID: "claim", SdHash: "other"}))
+
+	// Decisions are only carried over for DecisionTTL, even if the session is active.
+	c.advance(4 * time.Minute)
+	assert.True(t, allowed(k))
+	c.advance(time.Minute)
+	assert.False(t, allowed(k))
+
+	s.Allow(k, "channel")
+	c.advance(10 * time.Minute)
+	s.expire()
+	s.mu.Lock()
+	assert.Empty(t, s.sessions)
+	s.mu.Unlock()
+}
+
+func TestMaxSessions(t *testing.T) {
+	s, c := newTestCache(t, transcodertest.New(), Opts{MaxSessions: 2, SessionTTL: time.Minute})
+	allowed := func(k Key) bool {
+		_, ok := s.Allowed(k)
+		return ok
+	}
+	s.Allow(Key{Client: "a"}, "")
+	s.Allow(Key{Client: "b"}, "")
+	s.Allow(Key{Client: "c"}, "")
+	assert.False(t, allowed(Key{Client: "c"}), "no room for new sessions")
+
+	c.advance(time.Minute)
+	s.Allow(Key{Client: "c"}, "")
+	assert.True(t, allowed(Key{Client: "c"}), "idle sessions make room")
+}
+
+func TestPrefetch(t *testing.T) {
+	tc := transcodertest.New()
+	tc.AddHLSStream(sdHash, 6, false)
+	s, _ := newTestCache(t, tc, Opts{Lookahead: 2})
+
+	played := func() []string {
+		var names []string
+		for _, p := range tc.Played() {
+			names = append(names, p[len(sdHash)+1:])
+		}
+		return names
+	}
+
+	assert.False(t, s.Played("claim", sdHash, segmentName(0)))
+	// The rendition is indexed first, then segments following the played one are retrieved.
+	require.Eventually(t, func() bool { return len(tc.Played()) == 4 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"master.m3u8", "v0.m3u8"}, played()[:2])
+	assert.ElementsMatch(t, []string{segmentName(1), segmentName(2)}, played()[2:])
+
+	require.Eventually(t, func() bool { return s.Played("claim", sdHash, segmentName(1)) }, time.Second, time.Millisecond)
+	require.Eventually(t, func() bool { return len(tc.Played()) == 5 }, time.Second, time.Millisecond)
+	assert.Equal(t, segmentName(3), played()[4])
+
+	// Prefetching stops at the end of the playlist.
+	s.Played("claim", sdHash, segmentName(5))
+	s.Played("claim", sdHash, segmentName(3))
+	require.Eventually(t, func() bool { return len(tc.Played()) == 7 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	assert.Len(t, tc.Played(), 7)
+	assert.ElementsMatch(t, []string{segmentName(4), segmentName(5)}, played()[5:])
+}
+
+func TestPrefetchDisabled(t *testing.T) {
+	tc := transcodertest.New()
+	tc.AddHLSStream(sdHash, 3, false)
+	s, _ := newTestCache(t, tc, Opts{Lookahead: 0})
+
+	s.Played("claim", sdHash, segmentName(0))
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, tc.Played())
+}
+
+func TestPrefetchIndexFailure(t *testing.T) {
+	tc := transcodertest.New()
+	s, c := newTestCache(t, tc, Opts{Lookahead: 2})
+
+	s.Played("claim", sdHash, segmentName(0))
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return !s.renditions[sdHash].failedAt.IsZero()
+	}, time.Second, time.Millisecond)
+
+	// Renditions that could not be indexed are retried later.
+	tc.AddHLSStream(sdHash, 3, false)
+	s.Played("claim", sdHash, segmentName(0))
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, tc.Played())
+
+	c.advance(indexRetry)
+	s.Played("claim", sdHash, segmentName(0))
+	require.Eventually(t, func() bool { return len(tc.Played()) == 4 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,327 @@
+package paid
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/atomicfile"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// Kinds of paid access defined by claim tags.
+const (
+	KindPurchase = "purchase"
+	KindRental   = "rental"
+	// KindPreview tokens let creators watch their content before its scheduled release.
+	KindPreview = "preview"
+)
+
+// DefaultCurrency is assumed when tags do not specify one.
+const DefaultCurrency = "USD"
+
+var (
+	ErrEntitlementRequired = errors.New("this content requires a purchase or rental")
+	ErrEntitlementMismatch = errors.New("entitlement is not valid for this content")
+	ErrRentalExpired       = errors.New("rental has expired")
+)
+
+// Terms describe how paid content can be accessed, as parsed from claim tags.
+type Terms struct {
+	Kind     string
+	Price    float64
+	Currency string
+	// Duration is how long a rental lasts from the first play.
+	Duration time.Duration
+}
+
+// ParseTerms looks for purchase and rental tags and returns terms of the first valid one.
+// Supported formats, with an optional `c:` prefix, are
+//
+//	purchase:<price>[:<currency>]
+//	rental:<price>[:<currency>]:<duration>
+//
+// where duration is either a number of seconds or a Go duration string (48h).
+func ParseTerms(tags []string) (Terms, bool) {
+	for _, tag := range tags {
+		parts := strings.Split(strings.TrimPrefix(tag, "c:"), ":")
+		var t Terms
+		switch {
+		case parts[0] == KindPurchase && (len(parts) == 2 || len(parts) == 3):
+			t.Kind = KindPurchase
+		case parts[0] == KindRental && (len(parts) == 3 || len(parts) == 4):
+			t.Kind = KindRental
+			d, err := parseDuration(parts[len(parts)-1])
+			if err != nil || d <= 0 {
+				continue
+			}
+			t.Duration = d
+			parts = parts[:len(parts)-1]
+		default:
+			continue
+		}
+		price, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || price < 0 {
+			continue
+		}
+		t.Price = price
+		t.Currency = DefaultCurrency
+		if len(parts) == 3 {
+			t.Currency = strings.ToUpper(parts[2])
+		}
+		return t, true
+	}
+	return Terms{}, false
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// EntitlementToken is issued to a viewer who purchased or rented a stream.
+// Its ID identifies the entitlement for tracking when the rental was first played.
+type EntitlementToken struct {
+	ClaimID string `json:"cid"`
+	Kind    string `json:"kind"`
+	jwt.StandardClaims
+}
+
+// CreateEntitlementToken issues an entitlement token for claimID, expiring at exp (Unix time).
+func CreateEntitlementToken(id, claimID, kind string, exp int64) (string, error) {
+	if km == nil || km.privKey == nil {
+		return "", fmt.Errorf("cannot create a token, private key is not initialized (call InitPrivateKey)")
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &EntitlementToken{
+		ClaimID: claimID,
+		Kind:    kind,
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			ExpiresAt: exp,
+			IssuedAt:  time.Now().UTC().Unix(),
+		},
+	})
+	return token.SignedString(km.privKey)
+}
+
+// VerifyEntitlement checks that stringToken grants access to claimID under terms.
+// Rentals are valid for terms.Duration from the first time the entitlement was played on this player.
+func VerifyEntitlement(claimID string, terms Terms, stringToken string) error {
+	if stringToken == "" {
+		return ErrEntitlementRequired
+	}
+	et, err := parseEntitlement(claimID, stringToken)
+	if err != nil {
+		return err
+	}
+	// A purchase also grants access to content that is available for rent.
+	if et.Kind != terms.Kind && et.Kind != KindPurchase {
+		return ErrEntitlementMismatch
+	}
+	if et.Kind == KindRental {
+		// The first play has to be remembered for as long as the token itself is valid,
+		// otherwise the rental window would restart once the record is gone.
+		var until time.Time
+		if et.ExpiresAt > 0 {
+			until = time.Unix(et.ExpiresAt, 0)
+		}
+		first := FirstPlays.Record(et.Id, time.Now(), until)
+		if time.Since(first) > terms.Duration {
+			return ErrRentalExpired
+		}
+	}
+	return nil
+}
+
+// VerifyPreview checks that stringToken is a preview token for claimID.
+func VerifyPreview(claimID string, stringToken string) error {
+	et, err := parseEntitlement(claimID, stringToken)
+	if err != nil {
+		return err
+	}
+	if et.Kind != KindPreview {
+		return ErrEntitlementMismatch
+	}
+	return nil
+}
+
+func parseEntitlement(claimID string, stringToken string) (*EntitlementToken, error) {
+	k := pubKM.Load()
+	if k == nil {
+		return nil, ErrNoPubKey
+	}
+	token, err := jwt.ParseWithClaims(stringToken, &EntitlementToken{}, k.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	et, ok := token.Claims.(*EntitlementToken)
+	if !ok || !token.Valid {
+		return nil, ErrEntitlementMismatch
+	}
+	if et.ClaimID != claimID || et.Id == "" {
+		return nil, ErrEntitlementMismatch
+	}
+	return et, nil
+}
+
+// FirstPlays tracks when rentals were first played.
+var FirstPlays = NewFirstPlayStore("")
+
+// FirstPlayFlushInterval is how often first plays are saved and entries saved by other nodes are picked up.
+const FirstPlayFlushInterval = 5 * time.Second
+
+// FirstPlayStore records the time each entitlement was first played, optionally persisting it to a file
+// so rental windows survive restarts. Entries are saved in the background, off the request path. The file
+// is merged with entries in memory on every save, so nodes sharing it agree on first plays within
+// a flush interval, the earliest play wins.
+type FirstPlayStore struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]firstPlay
+	dirty   bool
+	grp     *stop.Group
+	// saveMu serializes flushes, which read and write the file without holding mu.
+	saveMu sync.Mutex
+}
+
+type firstPlay struct {
+	At time.Time `json:"at"`
+	// Until is when the entry can be forgotten, zero means never.
+	Until time.Time `json:"until"`
+}
+
+// NewFirstPlayStore creates a store persisted to path, or kept in memory only if path is empty.
+func NewFirstPlayStore(path string) *FirstPlayStore {
+	return &FirstPlayStore{path: path, entries: map[string]firstPlay{}}
+}
+
+// LoadFirstPlayStore creates a store persisted to path, loading existing entries from it.
+func LoadFirstPlayStore(path string) (*FirstPlayStore, error) {
+	s := NewFirstPlayStore(path)
+	entries, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.entries = entries
+	return s, nil
+}
+
+func (s *FirstPlayStore) read() (map[string]firstPlay, error) {
+	entries := map[string]firstPlay{}
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("cannot parse rental state %v: %w", s.path, err)
+	}
+	return entries, nil
+}
+
+// Record returns when id was first played, recording now if it was never played before.
+// The entry is kept until the until time, or forever if it is zero.
+func (s *FirstPlayStore) Record(id string, now time.Time, until time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[id]; ok {
+		return e.At
+	}
+	s.entries[id] = firstPlay{At: now, Until: until}
+	s.dirty = true
+	return now
+}
+
+// Start saves entries and picks up entries saved by other nodes every interval until Shutdown is called.
+func (s *FirstPlayStore) Start(interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	s.grp = stop.New()
+	s.grp.Add(1)
+	go func() {
+		defer s.grp.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.grp.Ch():
+				return
+			case <-t.C:
+				if err := s.Flush(); err != nil {
+					Logger.Errorf("failed to save rental state: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops background saving and saves entries recorded since the last flush.
+func (s *FirstPlayStore) Shutdown() {
+	if s.grp != nil {
+		s.grp.StopAndWait()
+	}
+	if err := s.Flush(); err != nil {
+		Logger.Errorf("failed to save rental state: %v", err)
+	}
+}
+
+// Flush merges entries saved in the file into the store, drops expired ones and saves the result.
+func (s *FirstPlayStore) Flush() error {
+	if s.path == "" {
+		return nil
+	}
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	saved, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	changed := s.dirty
+	for id, e := range saved {
+		if cur, ok := s.entries[id]; !ok || e.At.Before(cur.At) {
+			s.entries[id] = e
+		} else if !e.At.Equal(cur.At) {
+			changed = true
+		}
+	}
+	for id, e := range s.entries {
+		if !e.Until.IsZero() && now.After(e.Until) {
+			delete(s.entries, id)
+			changed = true
+		} else if _, ok := saved[id]; !ok {
+			// Another node saved the file without the entry, it has to be written back or it's lost on restart.
+			changed = true
+		}
+	}
+	if !changed {
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.entries)
+	s.dirty = false
+	s.mu.Unlock()
+	if err == nil {
+		err = atomicfile.WriteFile(s.path, b)
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package paid
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testClaimID = "81b1749f773bad5b9b53d21508051560f2746cdc"
+
+func TestParseTerms(t *testing.T) {
+	cases := []struct {
+		tags  []string
+		terms Terms
+		ok    bool
+	}{
+		{[]string{"gaming", "purchase:4.99"}, Terms{Kind: KindPurchase, Price: 4.99, Currency: "USD"}, true},
+		{[]string{"c:purchase:10:eur"}, Terms{Kind: KindPurchase, Price: 10, Currency: "EUR"}, true},
+		{[]string{"rental:1.5:172800"}, Terms{Kind: KindRental, Price: 1.5, Currency: "USD", Duration: 48 * time.Hour}, true},
+		{[]string{"c:rental:2:USD:24h"}, Terms{Kind: KindRental, Price: 2, Currency: "USD", Duration: 24 * time.Hour}, true},
+		{[]string{"rental:2", "purchase:3"}, Terms{Kind: KindPurchase, Price: 3, Currency: "USD"}, true},
+		{[]string{"rental:2:0"}, Terms{}, false},
+		{[]string{"purchase:free"}, Terms{}, false},
+		{[]string{"c:rental", "c:purchase"}, Terms{}, false},
+		{nil, Terms{}, false},
+	}
+	for _, c := range cases {
+		terms, ok := ParseTerms(c.tags)
+		assert.Equal(t, c.ok, ok, c.tags)
+		assert.Equal(t, c.terms, terms, c.tags)
+	}
+}
+
+func TestVerifyEntitlement(t *testing.T) {
+	plays := FirstPlays
+	t.Cleanup(func() { FirstPlays = plays })
+	statePath := filepath.Join(t.TempDir(), "rentals.json")
+	FirstPlays = NewFirstPlayStore(statePath)
+
+	rental := Terms{Kind: KindRental, Price: 1, Currency: "USD", Duration: time.Hour}
+	purchase := Terms{Kind: KindPurchase, Price: 5, Currency: "USD"}
+	exp := time.Now().Add(24 * time.Hour).Unix()
+
+	assert.ErrorIs(t, VerifyEntitlement(testClaimID, rental, ""), ErrEntitlementRequired)
+
+	rentalToken, err := CreateEntitlementToken("ent-1", testClaimID, KindRental, exp)
+	require.NoError(t, err)
+	assert.NoError(t, VerifyEntitlement(testClaimID, rental, rentalToken))
+	assert.NoError(t, VerifyEntitlement(testClaimID, rental, rentalToken))
+	assert.ErrorIs(t, VerifyEntitlement(testClaimID, purchase, rentalToken), ErrEntitlementMismatch)
+	assert.ErrorIs(t, VerifyEntitlement("ffffffffffffffffffffffffffffffffffffffff", rental, rentalToken), ErrEntitlementMismatch)
+
+	purchaseToken, err := CreateEntitlementToken("ent-2", testClaimID, KindPurchase, exp)
+	require.NoError(t, err)
+	assert.NoError(t, VerifyEntitlement(testClaimID, purchase, purchaseToken))
+	assert.NoError(t, VerifyEntitlement(testClaimID, rental, purchaseToken))
+
+	// Rental window starts at the first play, which was persisted
+	expiredToken, err := CreateEntitlementToken("ent-3", testClaimID, KindRental, exp)
+	require.NoError(t, err)
+	FirstPlays.Record("ent-3", time.Now().Add(-2*time.Hour), time.Unix(exp, 0))
+	require.NoError(t, FirstPlays.Flush())
+	FirstPlays, err = LoadFirstPlayStore(statePath)
+	require.NoError(t, err)
+	assert.ErrorIs(t, VerifyEntitlement(testClaimID, rental, expiredToken), ErrRentalExpired)
+	assert.NoError(t, VerifyEntitlement(testClaimID, rental, rentalToken))
+
+	staleToken, err := CreateEntitlementToken("ent-4", testClaimID, KindRental, 1)
+	require.NoError(t, err)
+	assert.Regexp(t, "token is expired", VerifyEntitlement(testClaimID, rental, staleToken))
+}
+
+func TestFirstPlayStoreShared(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "rentals.json")
+	a, b := NewFirstPlayStore(statePath), NewFirstPlayStore(statePath)
+	now := time.Now()
+	until := now.Add(time.Hour)
+
+	assert.Equal(t, now, a.Record("ent-1", now, until))
+	assert.Equal(t, now.Add(-time.Minute), b.Record("ent-1", now.Add(-time.Minute), until))
+	b.Record("ent-2", now, until)
+	b.Record("ent-expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	_, err := os.Stat(statePath)
+	assert.ErrorIs(t, err, os.ErrNotExist, "nothing is written in the request path")
+
+	// Nodes sharing the file agree on the earliest play after flushing.
+	require.NoError(t, a.Flush())
+	require.NoError(t, b.Flush())
+	require.NoError(t, a.Flush())
+	for _, s := range []*FirstPlayStore{a, b} {
+		assert.True(t, now.Add(-time.Minute).Equal(s.Record("ent-1", now, until)))
+		assert.True(t, now.Equal(s.Record("ent-2", now.Add(time.Minute), until)))
+	}
+	loaded, err := LoadFirstPlayStore(statePath)
+	require.NoError(t, err)
+	assert.Len(t, loaded.entries, 2)
+
+	// A node that read the file before another one saved it overwrites it without the other's entries,
+	// they are saved again on the next flush.
+	otherPath := filepath.Join(t.TempDir(), "rentals.json")
+	c := NewFirstPlayStore(otherPath)
+	c.Record("ent-3", now, until)
+	require.NoError(t, c.Flush())
+	overwritten, err := os.ReadFile(otherPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(statePath, overwritten, 0644))
+	require.NoError(t, a.Flush())
+	loaded, err = LoadFirstPlayStore(statePath)
+	require.NoError(t, err)
+	assert.Len(t, loaded.entries, 3)
+	assert.True(t, now.Add(-time.Minute).Equal(loaded.Record("ent-1", now, until)))
+}
+
+func TestVerifyPreview(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	preview, err := CreateEntitlementToken("preview-1", testClaimID, KindPreview, exp)
+	require.NoError(t, err)
+	assert.NoError(t, VerifyPreview(testClaimID, preview))
+	assert.ErrorIs(t, VerifyPreview("ffffffffffffffffffffffffffffffffffffffff", preview), ErrEntitlementMismatch)
+
+	purchase, err := CreateEntitlementToken("ent-5", testClaimID, KindPurchase, exp)
+	require.NoError(t, err)
+	assert.ErrorIs(t, VerifyPreview(testClaimID, purchase), ErrEntitlementMismatch)
+	// Preview tokens do not grant paid access
+	assert.ErrorIs(t, VerifyEntitlement(testClaimID, Terms{Kind: KindPurchase}, preview), ErrEntitlementMismatch)
+}
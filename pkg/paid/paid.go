@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/OdyseeTeam/player-server/internal/iprange"
 	"github.com/OdyseeTeam/player-server/pkg/logger"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -29,9 +30,22 @@ type Expfunc func(uint64) int64
 type StreamToken struct {
 	StreamID string `json:"sid"`
 	TxID     string `json:"txid"`
+	// ClientIP binds the token to a single IP address or a network prefix in CIDR notation.
+	ClientIP string `json:"cip,omitempty"`
+	// SessionID binds the token to a playback session supplied by the client.
+	SessionID string `json:"ssn,omitempty"`
+	// MaxStreams limits how many clients can stream with the token at the same time.
+	MaxStreams int `json:"mcs,omitempty"`
 	jwt.StandardClaims
 }
 
+// Binding holds optional restrictions on where and how a token can be used.
+type Binding struct {
+	ClientIP   string
+	SessionID  string
+	MaxStreams int
+}
+
 type keyManager struct {
 	privKey         *rsa.PrivateKey
 	pubKeyMarshaled []byte
@@ -50,11 +64,17 @@ func InitPrivateKey(rawKey []byte) error {
 }
 
 // CreateToken takes stream ID, purchase transaction id and stream size to generate a JWS.
-// In addition it accepts expiry function that takes streamSize and returns token expiry date as Unix time
+// In addition it accepts expiry function that takes streamSize and returns token expiry date as Unix time,
+// TokenExpiry is used if it's nil.
 func CreateToken(streamID string, txid string, streamSize uint64, expfunc Expfunc) (string, error) {
 	return km.createToken(streamID, txid, streamSize, expfunc)
 }
 
+// CreateBoundToken is like CreateToken but restricts token usage as described by binding.
+func CreateBoundToken(streamID string, txid string, streamSize uint64, expfunc Expfunc, binding Binding) (string, error) {
+	return km.createBoundToken(streamID, txid, streamSize, expfunc, binding)
+}
+
 // GeneratePrivateKey generates an in-memory private key
 func GeneratePrivateKey() error {
 	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -78,13 +98,28 @@ func GeneratePrivateKey() error {
 }
 
 func (k *keyManager) createToken(streamID string, txid string, streamSize uint64, expfunc Expfunc) (string, error) {
+	return k.createBoundToken(streamID, txid, streamSize, expfunc, Binding{})
+}
+
+func (k *keyManager) createBoundToken(streamID string, txid string, streamSize uint64, expfunc Expfunc, binding Binding) (string, error) {
 	if k.privKey == nil {
 		return "", fmt.Errorf("cannot create a token, private key is not initialized (call InitPrivateKey)")
 	}
+	if binding.ClientIP != "" {
+		if _, err := iprange.ParsePrefix(binding.ClientIP); err != nil {
+			return "", err
+		}
+	}
+	if expfunc == nil {
+		expfunc = TokenExpiry.Func()
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &StreamToken{
-		streamID,
-		txid,
-		jwt.StandardClaims{
+		StreamID:   streamID,
+		TxID:       txid,
+		ClientIP:   binding.ClientIP,
+		SessionID:  binding.SessionID,
+		MaxStreams: binding.MaxStreams,
+		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expfunc(streamSize),
 			IssuedAt:  time.Now().UTC().Unix(),
 		},
@@ -118,7 +153,8 @@ func (k *keyManager) PublicKeyBytes() []byte {
 }
 
 func (k *keyManager) PublicKeyManager() *pubKeyManager {
-	return &pubKeyManager{key: &k.privKey.PublicKey}
+	key := &k.privKey.PublicKey
+	return &pubKeyManager{keys: map[string]*rsa.PublicKey{"": key}, defaultKey: key}
 }
 
 func (k *keyManager) marshalPublicKey() ([]byte, error) {
@@ -135,10 +171,48 @@ func (k *keyManager) marshalPublicKey() ([]byte, error) {
 	return pubBytes, nil
 }
 
-// ExpTenSecPer100MB returns expiry date as calculated by 10 seconds times the stream size in MB.
-// Note: this does not actually accept entire uint64 range and will oveflow and return dates in the past
-// with multi-petabyte sizes.
-func ExpTenSecPer100MB(streamSize uint64) int64 {
-	expiresAt := time.Now().UTC().Add(time.Duration(streamSize/1024^2*10) * time.Second)
-	return expiresAt.Unix()
+// ExpiryPolicy calculates token validity from stream size.
+type ExpiryPolicy struct {
+	// Base is added to every token lifetime.
+	Base time.Duration
+	// PerUnit is added for every Unit bytes of the stream, partial units are rounded up.
+	PerUnit time.Duration
+	Unit    uint64
+	// Max caps the lifetime, zero means no cap.
+	Max time.Duration
+}
+
+// Lifetime returns how long a token for a stream of streamSize bytes should be valid.
+func (p ExpiryPolicy) Lifetime(streamSize uint64) time.Duration {
+	d := p.Base
+	if p.Unit > 0 {
+		units := streamSize / p.Unit
+		if streamSize%p.Unit != 0 {
+			units++
+		}
+		if p.Max > 0 && units > uint64(p.Max/max(p.PerUnit, 1)) {
+			return p.Max
+		}
+		d += time.Duration(units) * p.PerUnit
+	}
+	if p.Max > 0 && d > p.Max {
+		return p.Max
+	}
+	return d
+}
+
+// Func returns an Expfunc suitable for CreateToken.
+func (p ExpiryPolicy) Func() Expfunc {
+	return func(streamSize uint64) int64 {
+		return time.Now().UTC().Add(p.Lifetime(streamSize)).Unix()
+	}
+}
+
+// TokenExpiry is the policy for tokens created without an expiry function.
+var TokenExpiry = ExpiryPolicy{PerUnit: 10 * time.Second, Unit: 1024 * 1024}
+
+// ExpTenSecPerMB returns expiry date as calculated by 10 seconds times the stream size in MB,
+// partial megabytes counting as whole ones.
+func ExpTenSecPerMB(streamSize uint64) int64 {
+	return ExpiryPolicy{PerUnit: 10 * time.Second, Unit: 1024 * 1024}.Func()(streamSize)
 }
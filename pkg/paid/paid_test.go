@@ -47,8 +47,7 @@ func TestMain(m *testing.M) {
 		panic(err)
 	}
 
-	pubKM = &pubKeyManager{}
-	err = pubKM.loadFromBytes(km.PublicKeyBytes())
+	err = InitPubKey(km.PublicKeyBytes())
 	if err != nil {
 		panic(err)
 	}
@@ -61,7 +60,7 @@ func TestMain(m *testing.M) {
 
 func TestCreateToken(t *testing.T) {
 	size := uint64(mrand.Int63n(1000_000_000))
-	token, err := CreateToken(testStreamID, testTxID, size, ExpTenSecPer100MB)
+	token, err := CreateToken(testStreamID, testTxID, size, ExpTenSecPerMB)
 	require.NoError(t, err)
 
 	streamToken, err := km.PublicKeyManager().ValidateToken(token)
@@ -70,6 +69,32 @@ func TestCreateToken(t *testing.T) {
 	assert.Equal(t, streamToken.TxID, testTxID)
 }
 
+func TestExpiryPolicy(t *testing.T) {
+	assert.Equal(t, 10*time.Second, ExpiryPolicy{PerUnit: 10 * time.Second, Unit: 1024 * 1024}.Lifetime(1))
+	assert.Equal(t, 1150*time.Second, ExpiryPolicy{PerUnit: 10 * time.Second, Unit: 1024 * 1024}.Lifetime(120_000_000))
+
+	p := ExpiryPolicy{Base: time.Hour, PerUnit: time.Minute, Unit: 1024 * 1024, Max: 6 * time.Hour}
+	assert.Equal(t, time.Hour, p.Lifetime(0))
+	assert.Equal(t, time.Hour+3*time.Minute, p.Lifetime(3*1024*1024))
+	assert.Equal(t, 6*time.Hour, p.Lifetime(100*1024*1024*1024))
+	assert.Equal(t, 6*time.Hour, p.Lifetime(1<<63))
+
+	exp := ExpTenSecPerMB(1024 * 1024 * 1024)
+	assert.InDelta(t, time.Now().Add(10240*time.Second).Unix(), exp, 1)
+}
+
+func TestCreateTokenDefaultExpiry(t *testing.T) {
+	orig := TokenExpiry
+	TokenExpiry = ExpiryPolicy{Base: time.Minute, PerUnit: time.Second, Unit: 1000}
+	t.Cleanup(func() { TokenExpiry = orig })
+
+	token, err := CreateToken(testStreamID, testTxID, 60_000, nil)
+	require.NoError(t, err)
+	streamToken, err := km.PublicKeyManager().ValidateToken(token)
+	require.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(2*time.Minute).Unix(), streamToken.ExpiresAt, 1)
+}
+
 func TestPublicKeyBytes(t *testing.T) {
 	b, r := pem.Decode(km.PublicKeyBytes())
 	assert.NotNil(t, b)
@@ -78,7 +103,7 @@ func TestPublicKeyBytes(t *testing.T) {
 
 func BenchmarkCreateToken(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		if _, err := CreateToken(testStreamID, testTxID, 100_000_000, ExpTenSecPer100MB); err != nil {
+		if _, err := CreateToken(testStreamID, testTxID, 100_000_000, ExpTenSecPerMB); err != nil {
 			b.Fatal(err)
 		}
 	}
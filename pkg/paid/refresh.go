@@ -0,0 +1,111 @@
+package paid
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/atomicfile"
+
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+// PubKeyRefresher keeps the public key set up to date by periodically downloading it from URL.
+// The last successfully loaded key set is stored at CachePath so the player can start
+// verifying tokens when the URL is unavailable.
+type PubKeyRefresher struct {
+	URL       string
+	CachePath string
+	Client    *http.Client
+
+	grp *stop.Group
+}
+
+// NewPubKeyRefresher creates a refresher for the key set at url. cachePath can be empty to disable the disk cache.
+func NewPubKeyRefresher(url, cachePath string) *PubKeyRefresher {
+	return &PubKeyRefresher{
+		URL:       url,
+		CachePath: cachePath,
+		Client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Load initializes the key set from URL, falling back to the cached copy on disk.
+// An error is returned only if neither source could be loaded.
+func (r *PubKeyRefresher) Load() error {
+	err := r.Refresh()
+	if err == nil {
+		return nil
+	}
+	if r.CachePath == "" {
+		return err
+	}
+	Logger.Warnf("failed to load public keys from %v, trying cached copy: %v", r.URL, err)
+	b, cerr := os.ReadFile(r.CachePath)
+	if cerr != nil {
+		return fmt.Errorf("%v, cache: %w", err, cerr)
+	}
+	if cerr := InitPubKey(b); cerr != nil {
+		return fmt.Errorf("%v, cache: %w", err, cerr)
+	}
+	Logger.Infof("loaded cached public keys from %v", r.CachePath)
+	return nil
+}
+
+// Refresh downloads the key set and replaces the active one if it is valid.
+func (r *PubKeyRefresher) Refresh() error {
+	resp, err := r.Client.Get(r.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %v fetching public keys", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if cur := pubKM.Load(); cur != nil && string(cur.raw) == string(b) {
+		return nil
+	}
+	if err := InitPubKey(b); err != nil {
+		return err
+	}
+	if r.CachePath != "" {
+		if err := atomicfile.WriteFile(r.CachePath, b); err != nil {
+			Logger.Errorf("failed to cache public keys: %v", err)
+		}
+	}
+	return nil
+}
+
+// Start refreshes the key set every interval until Shutdown is called.
+func (r *PubKeyRefresher) Start(interval time.Duration) {
+	r.grp = stop.New()
+	r.grp.Add(1)
+	go func() {
+		defer r.grp.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-r.grp.Ch():
+				return
+			case <-t.C:
+				if err := r.Refresh(); err != nil {
+					Logger.Errorf("failed to refresh public keys, keeping the current set: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops periodic refreshing.
+func (r *PubKeyRefresher) Shutdown() {
+	if r.grp != nil {
+		r.grp.StopAndWait()
+	}
+}
@@ -0,0 +1,68 @@
+package paid
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPubKeyRefresher(t *testing.T) {
+	current := pubKM.Load()
+	t.Cleanup(func() { pubKM.Store(current) })
+
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var served atomic.Value
+	served.Store(encodePubKey(t, oldKey, "old"))
+	var down atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write(served.Load().([]byte))
+	}))
+	defer ts.Close()
+
+	cachePath := filepath.Join(t.TempDir(), "keys", "pubkey.pem")
+	r := NewPubKeyRefresher(ts.URL, cachePath)
+	require.NoError(t, r.Load())
+	require.NoError(t, VerifyStreamAccess(testStreamID, signWithKid(t, oldKey, "old"), Client{}))
+
+	cached, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+	assert.Equal(t, served.Load(), cached)
+
+	served.Store(append(encodePubKey(t, oldKey, "old"), encodePubKey(t, newKey, "new")...))
+	r.Start(10 * time.Millisecond)
+	defer r.Shutdown()
+	assert.Eventually(t, func() bool {
+		return VerifyStreamAccess(testStreamID, signWithKid(t, newKey, "new"), Client{}) == nil
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// Broken key sets must not replace the active one
+	served.Store([]byte("garbage"))
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, VerifyStreamAccess(testStreamID, signWithKid(t, newKey, "new"), Client{}))
+	r.Shutdown()
+
+	// Key URL is down at boot, cached copy should be used
+	down.Store(true)
+	pubKM.Store(nil)
+	require.NoError(t, NewPubKeyRefresher(ts.URL, cachePath).Load())
+	assert.NoError(t, VerifyStreamAccess(testStreamID, signWithKid(t, newKey, "new"), Client{}))
+
+	pubKM.Store(nil)
+	assert.Error(t, NewPubKeyRefresher(ts.URL, filepath.Join(t.TempDir(), "missing.pem")).Load())
+	assert.ErrorIs(t, VerifyStreamAccess(testStreamID, signWithKid(t, newKey, "new"), Client{}), ErrNoPubKey)
+}
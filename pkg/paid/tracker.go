@@ -0,0 +1,70 @@
+package paid
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// ActiveStreamWindow is how long a client is considered to be streaming after its last request.
+var ActiveStreamWindow = 2 * time.Minute
+
+var activeStreams = newStreamTracker()
+
+// streamTracker keeps track of clients using each token within this process.
+type streamTracker struct {
+	mu        sync.Mutex
+	tokens    map[[sha256.Size]byte]map[string]time.Time
+	lastSweep time.Time
+}
+
+func newStreamTracker() *streamTracker {
+	return &streamTracker{tokens: map[[sha256.Size]byte]map[string]time.Time{}}
+}
+
+// admit records viewer as streaming with token and reports whether the token is within its limit
+// of concurrently streaming viewers. Viewers that are already streaming are always admitted.
+func (t *streamTracker) admit(token, viewer string, limit int) bool {
+	now := time.Now()
+	key := sha256.Sum256([]byte(token))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastSweep) > ActiveStreamWindow {
+		t.sweep(now)
+	}
+
+	viewers := t.tokens[key]
+	if viewers == nil {
+		viewers = map[string]time.Time{}
+		t.tokens[key] = viewers
+	}
+	if _, ok := viewers[viewer]; !ok {
+		for v, seen := range viewers {
+			if now.Sub(seen) > ActiveStreamWindow {
+				delete(viewers, v)
+			}
+		}
+		if len(viewers) >= limit {
+			return false
+		}
+	}
+	viewers[viewer] = now
+	return true
+}
+
+// sweep removes viewers and tokens that have been inactive for longer than ActiveStreamWindow.
+func (t *streamTracker) sweep(now time.Time) {
+	for key, viewers := range t.tokens {
+		for v, seen := range viewers {
+			if now.Sub(seen) > ActiveStreamWindow {
+				delete(viewers, v)
+			}
+		}
+		if len(viewers) == 0 {
+			delete(t.tokens, key)
+		}
+	}
+	t.lastSweep = now
+}
@@ -6,56 +6,163 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/OdyseeTeam/player-server/internal/iprange"
+	"github.com/OdyseeTeam/player-server/internal/metrics"
 
 	"github.com/golang-jwt/jwt/v4"
 )
 
+// kidHeader is the PEM block header carrying the key ID that tokens reference in their `kid` header.
+const kidHeader = "Kid"
+
+var (
+	ErrNoPubKey                 = errors.New("public key is not initialized")
+	ErrUnknownKeyID             = errors.New("token signed with unknown key")
+	ErrUnsupportedSigningMethod = errors.New("unsupported token signing method")
+	ErrClientMismatch           = errors.New("token is not valid for this client")
+	ErrSessionMismatch          = errors.New("token is not valid for this session")
+	ErrTooManyStreams           = errors.New("token is used by too many clients at once")
+)
+
+// Client identifies the viewer presenting a token.
+type Client struct {
+	IP        string
+	SessionID string
+}
+
+// pubKeyManager holds a set of public keys tokens can be signed with, selected by the token `kid` header.
+// A key without an ID (or the only key in the set) is used for tokens that carry no `kid`.
 type pubKeyManager struct {
-	key *rsa.PublicKey
+	keys       map[string]*rsa.PublicKey
+	defaultKey *rsa.PublicKey
+	raw        []byte
 }
 
-var pubKM *pubKeyManager
+var pubKM atomic.Pointer[pubKeyManager]
 
-// InitPubKey should be called with pubkey url as an argument before VerifyStreamAccess can be called
+// InitPubKey loads a PEM-encoded key set, replacing the current one. It should be called
+// before VerifyStreamAccess can be called.
 func InitPubKey(rawKey []byte) error {
 	k := &pubKeyManager{}
-	k.loadFromBytes(rawKey)
-	pubKM = k
+	if err := k.loadFromBytes(rawKey); err != nil {
+		return err
+	}
+	pubKM.Store(k)
 	return nil
 }
 
-// VerifyStreamAccess is the main entry point for players to validate paid media tokens
-func VerifyStreamAccess(streamID string, stringToken string) error {
-	t, err := pubKM.ValidateToken(stringToken)
+// VerifyStreamAccess is the main entry point for players to validate paid media tokens.
+// Client IP, session and concurrent stream restrictions carried by the token are enforced against client.
+func VerifyStreamAccess(streamID string, stringToken string, client Client) error {
+	k := pubKM.Load()
+	if k == nil {
+		return ErrNoPubKey
+	}
+	t, err := k.ValidateToken(stringToken)
 	if err != nil {
 		return err
 	}
 	if t.StreamID != streamID {
 		return fmt.Errorf("stream mismatch: requested %v, token valid for %v", streamID, t.StreamID)
 	}
+	return checkBinding(t, stringToken, client)
+}
+
+func checkBinding(t *StreamToken, stringToken string, client Client) error {
+	if t.ClientIP != "" {
+		prefix, err := iprange.ParsePrefix(t.ClientIP)
+		if err != nil {
+			return err
+		}
+		addr, err := netip.ParseAddr(client.IP)
+		if err != nil || !prefix.Contains(addr.Unmap()) {
+			metrics.PaidTokenShareAbuse.WithLabelValues(metrics.ShareAbuseClientIP).Inc()
+			Logger.Infof("token for %v (txid %v) used from %v, bound to %v", t.StreamID, t.TxID, client.IP, t.ClientIP)
+			return ErrClientMismatch
+		}
+	}
+	if t.SessionID != "" && t.SessionID != client.SessionID {
+		metrics.PaidTokenShareAbuse.WithLabelValues(metrics.ShareAbuseSession).Inc()
+		Logger.Infof("token for %v (txid %v) used outside of its session", t.StreamID, t.TxID)
+		return ErrSessionMismatch
+	}
+	if t.MaxStreams > 0 {
+		viewer := client.SessionID
+		if viewer == "" {
+			viewer = client.IP
+		}
+		if !activeStreams.admit(stringToken, viewer, t.MaxStreams) {
+			metrics.PaidTokenShareAbuse.WithLabelValues(metrics.ShareAbuseConcurrency).Inc()
+			Logger.Infof("token for %v (txid %v) exceeded %v concurrent streams", t.StreamID, t.TxID, t.MaxStreams)
+			return ErrTooManyStreams
+		}
+	}
 	return nil
 }
 
+// loadFromBytes parses one or more PEM blocks containing RSA public keys, optionally with a `Kid` header.
 func (k *pubKeyManager) loadFromBytes(b []byte) error {
-	block, _ := pem.Decode(b)
-	if block == nil {
+	k.keys = map[string]*rsa.PublicKey{}
+	k.raw = b
+	rest := b
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		key, ok := pubKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key %q is not an RSA public key", block.Headers[kidHeader])
+		}
+		kid := block.Headers[kidHeader]
+		if _, ok := k.keys[kid]; ok {
+			return fmt.Errorf("duplicate key id %q", kid)
+		}
+		k.keys[kid] = key
+		Logger.Infof("loaded a public RSA key %q (%v bytes)", kid, key.Size())
+	}
+	if len(k.keys) == 0 {
 		return errors.New("no PEM blob found")
 	}
-	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
-	key := pubKey.(*rsa.PublicKey)
-	if err != nil {
-		return err
+	if key, ok := k.keys[""]; ok {
+		k.defaultKey = key
+	} else if len(k.keys) == 1 {
+		for _, key := range k.keys {
+			k.defaultKey = key
+		}
 	}
-	k.key = key
-	Logger.Infof("loaded a private RSA key (%v bytes)", key.Size())
 	return nil
 }
 
+func (k *pubKeyManager) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() != jwt.SigningMethodRS256.Alg() {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedSigningMethod, token.Method.Alg())
+	}
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if k.defaultKey == nil {
+			return nil, ErrUnknownKeyID
+		}
+		return k.defaultKey, nil
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKeyID, kid)
+	}
+	return key, nil
+}
+
 // ValidateToken parses a setialized JWS stream token, verifies its signature, expiry date and returns StreamToken
 func (k *pubKeyManager) ValidateToken(stringToken string) (*StreamToken, error) {
-	token, err := jwt.ParseWithClaims(stringToken, &StreamToken{}, func(token *jwt.Token) (interface{}, error) {
-		return k.key, nil
-	})
+	token, err := jwt.ParseWithClaims(stringToken, &StreamToken{}, k.keyFunc)
 	if err != nil {
 		Logger.Debugf("token is not valid")
 		return nil, err
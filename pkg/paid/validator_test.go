@@ -3,8 +3,12 @@ package paid
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -22,7 +26,7 @@ func TestVerifyStreamAccess(t *testing.T) {
 		{
 			name: "valid",
 			makeToken: func() (string, error) {
-				return CreateToken(testStreamID, testTxID, 120_000_000, ExpTenSecPer100MB)
+				return CreateToken(testStreamID, testTxID, 120_000_000, ExpTenSecPerMB)
 			},
 			checkError: noError,
 		},
@@ -39,14 +43,14 @@ func TestVerifyStreamAccess(t *testing.T) {
 			makeToken: func() (string, error) {
 				otherPkey, _ := rsa.GenerateKey(rand.Reader, 2048)
 				otherKM := &keyManager{privKey: otherPkey}
-				return otherKM.createToken(testStreamID, testTxID, 120_000_000, ExpTenSecPer100MB)
+				return otherKM.createToken(testStreamID, testTxID, 120_000_000, ExpTenSecPerMB)
 			},
 			checkError: func(t *testing.T, err error) { assert.EqualError(t, err, "crypto/rsa: verification error") },
 		},
 		{
 			name: "wrong_stream",
 			makeToken: func() (string, error) {
-				return CreateToken("wrOngsTream", testTxID, 120_000_000, ExpTenSecPer100MB)
+				return CreateToken("wrOngsTream", testTxID, 120_000_000, ExpTenSecPerMB)
 			},
 			checkError: func(t *testing.T, err error) {
 				assert.EqualError(t, err, "stream mismatch: requested bea4d30a1868a00e98297cfe8cdefc1be6c141b54bea3b7c95b34a66786c22ab4e9f35ae19aa453b3630e76afbd24fe2, token valid for wrOngsTream")
@@ -77,19 +81,125 @@ func TestVerifyStreamAccess(t *testing.T) {
 			token, err := tt.makeToken()
 			require.NoError(t, err)
 
-			err = VerifyStreamAccess(testStreamID, token)
+			err = VerifyStreamAccess(testStreamID, token, Client{})
 			tt.checkError(t, err)
 		})
 	}
 }
 
 func BenchmarkParseToken(b *testing.B) {
-	token, err := CreateToken(testStreamID, testTxID, 100_000_000, ExpTenSecPer100MB)
+	token, err := CreateToken(testStreamID, testTxID, 100_000_000, ExpTenSecPerMB)
 	require.NoError(b, err)
 
 	for i := 0; i < b.N; i++ {
-		if err := VerifyStreamAccess(testStreamID, token); err != nil {
+		if err := VerifyStreamAccess(testStreamID, token, Client{}); err != nil {
 			b.Fatal(err)
 		}
 	}
 }
+
+func signWithKid(t *testing.T, key *rsa.PrivateKey, kid string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, &StreamToken{StreamID: testStreamID, TxID: testTxID})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return s
+}
+
+func encodePubKey(t *testing.T, key *rsa.PrivateKey, kid string) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	block := &pem.Block{Type: "RSA PUBLIC KEY", Bytes: der}
+	if kid != "" {
+		block.Headers = map[string]string{kidHeader: kid}
+	}
+	return pem.EncodeToMemory(block)
+}
+
+func TestValidateTokenKeyID(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	k := &pubKeyManager{}
+	require.NoError(t, k.loadFromBytes(append(encodePubKey(t, oldKey, "2024-05"), encodePubKey(t, newKey, "2024-06")...)))
+
+	_, err := k.ValidateToken(signWithKid(t, oldKey, "2024-05"))
+	assert.NoError(t, err)
+	_, err = k.ValidateToken(signWithKid(t, newKey, "2024-06"))
+	assert.NoError(t, err)
+	_, err = k.ValidateToken(signWithKid(t, newKey, "2024-05"))
+	assert.EqualError(t, err, "crypto/rsa: verification error")
+	_, err = k.ValidateToken(signWithKid(t, newKey, "2024-07"))
+	assert.ErrorIs(t, err, ErrUnknownKeyID)
+	_, err = k.ValidateToken(signWithKid(t, newKey, ""))
+	assert.ErrorIs(t, err, ErrUnknownKeyID)
+
+	single := &pubKeyManager{}
+	require.NoError(t, single.loadFromBytes(encodePubKey(t, newKey, "2024-06")))
+	_, err = single.ValidateToken(signWithKid(t, newKey, ""))
+	assert.NoError(t, err)
+}
+
+func TestValidateTokenSigningMethod(t *testing.T) {
+	for _, method := range []jwt.SigningMethod{jwt.SigningMethodHS256, jwt.SigningMethodNone} {
+		token := jwt.NewWithClaims(method, &StreamToken{StreamID: testStreamID, TxID: testTxID})
+		var key interface{} = km.PublicKeyBytes()
+		if method == jwt.SigningMethodNone {
+			key = jwt.UnsafeAllowNoneSignatureType
+		}
+		s, err := token.SignedString(key)
+		require.NoError(t, err)
+		err = VerifyStreamAccess(testStreamID, s, Client{})
+		assert.ErrorIs(t, err, ErrUnsupportedSigningMethod, method.Alg())
+	}
+}
+
+func TestInitPubKeyError(t *testing.T) {
+	assert.Error(t, InitPubKey([]byte("not a key")))
+	assert.NotNil(t, pubKM.Load())
+}
+
+func TestVerifyStreamAccessBinding(t *testing.T) {
+	ipBound, err := CreateBoundToken(testStreamID, testTxID, 120_000_000, ExpTenSecPerMB, Binding{ClientIP: "203.0.113.0/24"})
+	require.NoError(t, err)
+	assert.NoError(t, VerifyStreamAccess(testStreamID, ipBound, Client{IP: "203.0.113.7"}))
+	assert.NoError(t, VerifyStreamAccess(testStreamID, ipBound, Client{IP: "::ffff:203.0.113.7"}))
+	assert.ErrorIs(t, VerifyStreamAccess(testStreamID, ipBound, Client{IP: "198.51.100.1"}), ErrClientMismatch)
+	assert.ErrorIs(t, VerifyStreamAccess(testStreamID, ipBound, Client{}), ErrClientMismatch)
+
+	sessionBound, err := CreateBoundToken(testStreamID, testTxID, 120_000_000, ExpTenSecPerMB, Binding{SessionID: "abc"})
+	require.NoError(t, err)
+	assert.NoError(t, VerifyStreamAccess(testStreamID, sessionBound, Client{IP: "198.51.100.1", SessionID: "abc"}))
+	assert.ErrorIs(t, VerifyStreamAccess(testStreamID, sessionBound, Client{IP: "198.51.100.1", SessionID: "abd"}), ErrSessionMismatch)
+
+	limited, err := CreateBoundToken(testStreamID, testTxID, 120_000_000, ExpTenSecPerMB, Binding{MaxStreams: 2})
+	require.NoError(t, err)
+	assert.NoError(t, VerifyStreamAccess(testStreamID, limited, Client{IP: "198.51.100.1"}))
+	assert.NoError(t, VerifyStreamAccess(testStreamID, limited, Client{IP: "198.51.100.2"}))
+	assert.NoError(t, VerifyStreamAccess(testStreamID, limited, Client{IP: "198.51.100.1"}))
+	assert.ErrorIs(t, VerifyStreamAccess(testStreamID, limited, Client{IP: "198.51.100.3"}), ErrTooManyStreams)
+
+	_, err = CreateBoundToken(testStreamID, testTxID, 120_000_000, ExpTenSecPerMB, Binding{ClientIP: "nonsense"})
+	assert.Error(t, err)
+}
+
+func TestStreamTracker(t *testing.T) {
+	window := ActiveStreamWindow
+	ActiveStreamWindow = 50 * time.Millisecond
+	t.Cleanup(func() { ActiveStreamWindow = window })
+
+	tr := newStreamTracker()
+	assert.True(t, tr.admit("token", "a", 1))
+	assert.True(t, tr.admit("token", "a", 1))
+	assert.False(t, tr.admit("token", "b", 1))
+	assert.True(t, tr.admit("other", "b", 1))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, tr.admit("token", "b", 1))
+	assert.False(t, tr.admit("token", "a", 1))
+	tr.mu.Lock()
+	assert.Len(t, tr.tokens, 1)
+	tr.mu.Unlock()
+}
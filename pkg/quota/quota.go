@@ -0,0 +1,435 @@
+// Package quota enforces daily download quotas per client IP and per account.
+//
+// Usage is counted per UTC day. Claims and channels can have downloads disabled or exempted from
+// quotas, either in the policy file or with `download:disabled` and `download:unlimited` claim tags
+// (optionally prefixed with `c:`).
+package quota
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/atomicfile"
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/internal/reload"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	lerrors "github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+var Logger = logger.GetLogger()
+
+const (
+	tagDisabled  = "download:disabled"
+	tagUnlimited = "download:unlimited"
+)
+
+// Quota scopes.
+const (
+	ScopeIP      = "ip"
+	ScopeAccount = "account"
+)
+
+var (
+	// ErrQuotaExceeded is matched by all ExceededError values.
+	ErrQuotaExceeded = errors.New("daily download quota exceeded")
+	// ErrDownloadDisabled is matched by all DisabledError values.
+	ErrDownloadDisabled = errors.New("downloads are disabled for this content")
+)
+
+// ExceededError is returned when a client has used up a daily quota.
+type ExceededError struct {
+	Scope string
+	// Limit is either "files" or "bytes".
+	Limit string
+	Reset time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%v: %v limit per %v reached, resets at %v", ErrQuotaExceeded, e.Limit, e.Scope, e.Reset.UTC().Format(time.RFC3339))
+}
+
+func (e *ExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// RetryAfter returns seconds until the quota resets.
+func (e *ExceededError) RetryAfter() int {
+	return int(time.Until(e.Reset).Seconds()) + 1
+}
+
+// DisabledError is returned for content that cannot be downloaded.
+type DisabledError struct {
+	Reason string
+}
+
+func (e *DisabledError) Error() string {
+	if e.Reason == "" {
+		return ErrDownloadDisabled.Error()
+	}
+	return ErrDownloadDisabled.Error() + ": " + e.Reason
+}
+
+func (e *DisabledError) Is(target error) bool {
+	return target == ErrDownloadDisabled
+}
+
+// Limits are daily allowances, zero means unlimited.
+type Limits struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Override changes download rules for a claim or a channel.
+type Override struct {
+	// Disabled blocks downloads entirely.
+	Disabled bool `json:"disabled,omitempty"`
+	// Unlimited downloads do not count towards quotas.
+	Unlimited bool   `json:"unlimited,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Policy holds quotas and per-content overrides.
+type Policy struct {
+	IP       Limits              `json:"ip"`
+	Account  Limits              `json:"account"`
+	Claims   map[string]Override `json:"claims"`
+	Channels map[string]Override `json:"channels"`
+}
+
+// DefaultPolicy returns quotas used when no policy file is supplied.
+func DefaultPolicy() Policy {
+	return Policy{
+		IP:      Limits{Files: 50, Bytes: 50 << 30},
+		Account: Limits{Files: 100, Bytes: 100 << 30},
+	}
+}
+
+// ParsePolicy decodes a JSON policy, unset quotas keep their default values.
+func ParsePolicy(b []byte) (*Policy, error) {
+	p := DefaultPolicy()
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, lerrors.Err("cannot parse download quota policy: %v", err)
+	}
+	return &p, nil
+}
+
+// override returns the override for content, claim overrides take precedence over tags and channels.
+func (p *Policy) override(d Download) (Override, bool) {
+	if o, ok := p.Claims[d.ClaimID]; ok {
+		return o, true
+	}
+	for _, t := range d.Tags {
+		switch strings.TrimPrefix(t, "c:") {
+		case tagDisabled:
+			return Override{Disabled: true, Reason: "disabled by the publisher"}, true
+		case tagUnlimited:
+			return Override{Unlimited: true}, true
+		}
+	}
+	if o, ok := p.Channels[d.ChannelID]; ok && d.ChannelID != "" {
+		return o, true
+	}
+	return Override{}, false
+}
+
+// Download describes a download request.
+type Download struct {
+	IP string
+	// Account is an opaque account token, only its hash is stored. Empty for anonymous clients.
+	Account   string
+	ClaimID   string
+	ChannelID string
+	Tags      []string
+}
+
+type usage struct {
+	Day   string `json:"day"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+	// Claims are the claims counted as files, each claim counts once a day whatever ranges of it are requested.
+	Claims map[string]bool `json:"claims,omitempty"`
+}
+
+// newFile checks if downloading claimID counts as a new file under limits.
+func (u *usage) newFile(claimID string, limits Limits) bool {
+	return limits.Files > 0 && !u.Claims[claimID]
+}
+
+// Opts configure a Quota.
+type Opts struct {
+	// PolicyPath is reloaded on change, DefaultPolicy applies if empty.
+	PolicyPath string
+	// StatePath is where usage is persisted, usage is kept in memory only if empty.
+	StatePath string
+	// SaveInterval is how often usage is persisted.
+	SaveInterval time.Duration
+}
+
+// Quota tracks daily download usage.
+type Quota struct {
+	opts   Opts
+	policy atomic.Pointer[Policy]
+
+	mu    sync.Mutex
+	usage map[string]*usage
+	// day usage is being counted for, usage of earlier days is dropped once it changes.
+	day   string
+	dirty bool
+
+	grp *stop.Group
+	now func() time.Time
+}
+
+// New creates a quota, loading the policy and persisted usage.
+func New(opts Opts) (*Quota, error) {
+	if opts.SaveInterval == 0 {
+		opts.SaveInterval = 30 * time.Second
+	}
+	q := &Quota{opts: opts, usage: map[string]*usage{}, grp: stop.New(), now: time.Now}
+	p := DefaultPolicy()
+	q.policy.Store(&p)
+	if err := q.Reload(); err != nil {
+		return nil, err
+	}
+	if opts.StatePath != "" {
+		if err := q.load(); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// Reload reads the policy file again, the active policy is kept if that fails.
+func (q *Quota) Reload() error {
+	if q.opts.PolicyPath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(q.opts.PolicyPath)
+	if err != nil {
+		return lerrors.Err(err)
+	}
+	p, err := ParsePolicy(b)
+	if err != nil {
+		return err
+	}
+	q.policy.Store(p)
+	Logger.Infof("loaded download quota policy from %v (%v claims, %v channels)", q.opts.PolicyPath, len(p.Claims), len(p.Channels))
+	return nil
+}
+
+// Start watches the policy file and persists usage periodically until Shutdown is called.
+func (q *Quota) Start() {
+	if q.opts.PolicyPath != "" {
+		w := reload.Watch(q.opts.PolicyPath, reload.DefaultInterval, func() {
+			if err := q.Reload(); err != nil {
+				Logger.Errorf("failed to reload download quota policy: %v", err)
+			}
+		})
+		q.grp.Add(1)
+		go func() {
+			defer q.grp.Done()
+			<-q.grp.Ch()
+			w.StopAndWait()
+		}()
+	}
+	if q.opts.StatePath == "" {
+		return
+	}
+	q.grp.Add(1)
+	go func() {
+		defer q.grp.Done()
+		t := time.NewTicker(q.opts.SaveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-q.grp.Ch():
+				return
+			case <-t.C:
+				if err := q.Save(); err != nil {
+					Logger.Errorf("failed to save download quota state: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops background work and persists usage.
+func (q *Quota) Shutdown() {
+	q.grp.StopAndWait()
+	if q.opts.StatePath != "" {
+		if err := q.Save(); err != nil {
+			Logger.Errorf("failed to save download quota state: %v", err)
+		}
+	}
+}
+
+func day(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+func nextReset(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+type counter struct {
+	key    string
+	scope  string
+	limits Limits
+}
+
+// counters returns usage counters a download is counted against. IPv6 clients are counted per /64.
+func counters(p *Policy, d Download) []counter {
+	var k []counter
+	if addr, err := netip.ParseAddr(d.IP); err == nil {
+		addr = addr.Unmap()
+		ip := addr.String()
+		if addr.Is6() {
+			pfx, _ := addr.Prefix(64)
+			ip = pfx.String()
+		}
+		k = append(k, counter{"ip:" + ip, ScopeIP, p.IP})
+	}
+	if d.Account != "" {
+		h := sha256.Sum256([]byte(d.Account))
+		k = append(k, counter{"account:" + hex.EncodeToString(h[:16]), ScopeAccount, p.Account})
+	}
+	return k
+}
+
+// rollover drops usage of past days when the day changes, whether usage is persisted or not.
+// Must be called with q.mu held.
+func (q *Quota) rollover(today string) {
+	if q.day == today {
+		return
+	}
+	for k, u := range q.usage {
+		if u.Day != today {
+			delete(q.usage, k)
+		}
+	}
+	q.day = today
+}
+
+// current returns today's usage for key. Must be called with q.mu held.
+func (q *Quota) current(key, today string) *usage {
+	q.rollover(today)
+	u, ok := q.usage[key]
+	if !ok || u.Day != today {
+		u = &usage{Day: today}
+		q.usage[key] = u
+	}
+	return u
+}
+
+// Admit checks a download against overrides and quotas, counting the file if it is allowed.
+func (q *Quota) Admit(d Download) error {
+	p := q.policy.Load()
+	o, ok := p.override(d)
+	if ok && o.Disabled {
+		metrics.DownloadQuotaRejections.WithLabelValues("disabled").Inc()
+		return &DisabledError{Reason: o.Reason}
+	}
+	if ok && o.Unlimited {
+		return nil
+	}
+
+	now := q.now()
+	today := day(now)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cs := counters(p, d)
+	for _, c := range cs {
+		u := q.current(c.key, today)
+		limit := ""
+		if u.newFile(d.ClaimID, c.limits) && u.Files >= c.limits.Files {
+			limit = "files"
+		} else if c.limits.Bytes > 0 && u.Bytes >= c.limits.Bytes {
+			limit = "bytes"
+		}
+		if limit != "" {
+			metrics.DownloadQuotaRejections.WithLabelValues(c.scope + "_" + limit).Inc()
+			return &ExceededError{Scope: c.scope, Limit: limit, Reset: nextReset(now)}
+		}
+	}
+	for _, c := range cs {
+		u := q.current(c.key, today)
+		if !u.newFile(d.ClaimID, c.limits) {
+			continue
+		}
+		if u.Claims == nil {
+			u.Claims = map[string]bool{}
+		}
+		u.Claims[d.ClaimID] = true
+		u.Files++
+		q.dirty = true
+	}
+	return nil
+}
+
+// Record adds bytes served for a download admitted earlier.
+func (q *Quota) Record(d Download, n int64) {
+	if n <= 0 {
+		return
+	}
+	p := q.policy.Load()
+	if o, ok := p.override(d); ok && o.Unlimited {
+		return
+	}
+	today := day(q.now())
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, c := range counters(p, d) {
+		q.current(c.key, today).Bytes += n
+	}
+	q.dirty = true
+}
+
+// Save persists today's usage.
+func (q *Quota) Save() error {
+	q.mu.Lock()
+	if !q.dirty {
+		q.mu.Unlock()
+		return nil
+	}
+	q.rollover(day(q.now()))
+	b, err := json.Marshal(q.usage)
+	q.dirty = false
+	q.mu.Unlock()
+	if err != nil {
+		return lerrors.Err(err)
+	}
+	return atomicfile.WriteFile(q.opts.StatePath, b)
+}
+
+func (q *Quota) load() error {
+	b, err := os.ReadFile(q.opts.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return lerrors.Err(err)
+	}
+	state := map[string]*usage{}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return lerrors.Err("cannot parse download quota state %v: %v", q.opts.StatePath, err)
+	}
+	today := day(q.now())
+	for k, u := range state {
+		if u.Day == today {
+			q.usage[k] = u
+		}
+	}
+	Logger.Infof("loaded download quota usage of %v clients", len(q.usage))
+	return nil
+}
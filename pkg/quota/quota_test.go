@@ -0,0 +1,133 @@
+package quota
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePolicy(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "quota.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestAdmitFiles(t *testing.T) {
+	q, err := New(Opts{PolicyPath: writePolicy(t, `{"ip": {"files": 2}, "account": {"files": 3}}`)})
+	require.NoError(t, err)
+
+	d := Download{IP: "192.0.2.1", ClaimID: "a"}
+	require.NoError(t, q.Admit(d))
+	// Requesting a claim again, from the start or from any offset, does not count as a new file.
+	require.NoError(t, q.Admit(d))
+	require.NoError(t, q.Admit(Download{IP: "192.0.2.1", ClaimID: "b"}))
+	require.NoError(t, q.Admit(d))
+	err = q.Admit(Download{IP: "192.0.2.1", ClaimID: "c"})
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	var exceeded *ExceededError
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, ScopeIP, exceeded.Scope)
+	assert.Equal(t, "files", exceeded.Limit)
+	assert.Greater(t, exceeded.RetryAfter(), 0)
+	assert.LessOrEqual(t, exceeded.RetryAfter(), 86401)
+
+	assert.NoError(t, q.Admit(Download{IP: "192.0.2.1", ClaimID: "b"}))
+
+	// The account quota applies across IPs.
+	for i, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		require.NoError(t, q.Admit(Download{IP: ip, Account: "token", ClaimID: string(rune('a' + i))}))
+	}
+	err = q.Admit(Download{IP: "198.51.100.4", Account: "token", ClaimID: "d"})
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, ScopeAccount, exceeded.Scope)
+}
+
+func TestAdmitBytes(t *testing.T) {
+	q, err := New(Opts{PolicyPath: writePolicy(t, `{"ip": {"bytes": 1000}, "account": {}}`)})
+	require.NoError(t, err)
+
+	d := Download{IP: "2001:db8::1"}
+	require.NoError(t, q.Admit(d))
+	q.Record(d, 1000)
+	// Other addresses in the same /64 share the quota.
+	err = q.Admit(Download{IP: "2001:db8::2"})
+	var exceeded *ExceededError
+	require.ErrorAs(t, err, &exceeded)
+	assert.Equal(t, "bytes", exceeded.Limit)
+	assert.NoError(t, q.Admit(Download{IP: "2001:db8:0:1::1"}))
+}
+
+func TestOverrides(t *testing.T) {
+	q, err := New(Opts{PolicyPath: writePolicy(t, `{
+		"ip": {"files": 1},
+		"claims": {"free": {"unlimited": true}, "locked": {"disabled": true, "reason": "rights holder request"}},
+		"channels": {"chan": {"disabled": true}}
+	}`)})
+	require.NoError(t, err)
+	ip := "192.0.2.1"
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, q.Admit(Download{IP: ip, ClaimID: "free"}))
+		require.NoError(t, q.Admit(Download{IP: ip, ClaimID: "tagged", Tags: []string{"c:download:unlimited"}}))
+	}
+
+	err = q.Admit(Download{IP: ip, ClaimID: "locked"})
+	require.ErrorIs(t, err, ErrDownloadDisabled)
+	assert.Contains(t, err.Error(), "rights holder request")
+	assert.ErrorIs(t, q.Admit(Download{IP: ip, ClaimID: "x", ChannelID: "chan"}), ErrDownloadDisabled)
+	assert.ErrorIs(t, q.Admit(Download{IP: ip, ClaimID: "y", Tags: []string{"download:disabled"}}), ErrDownloadDisabled)
+	// A claim override takes precedence over its channel.
+	assert.NoError(t, q.Admit(Download{IP: ip, ClaimID: "free", ChannelID: "chan"}))
+
+	require.NoError(t, q.Admit(Download{IP: ip, ClaimID: "z"}))
+	assert.ErrorIs(t, q.Admit(Download{IP: ip, ClaimID: "z2"}), ErrQuotaExceeded)
+}
+
+func TestRollover(t *testing.T) {
+	q, err := New(Opts{PolicyPath: writePolicy(t, `{"ip": {"files": 1}}`)})
+	require.NoError(t, err)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		require.NoError(t, q.Admit(Download{IP: ip, ClaimID: "a"}))
+	}
+	assert.Len(t, q.usage, 3)
+
+	// Usage of past days is dropped without persistence as well.
+	q.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	require.NoError(t, q.Admit(Download{IP: "192.0.2.1", ClaimID: "b"}))
+	assert.Len(t, q.usage, 1)
+}
+
+func TestPersistence(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state", "quota.json")
+	policy := writePolicy(t, `{"ip": {"files": 2}}`)
+	q, err := New(Opts{PolicyPath: policy, StatePath: state})
+	require.NoError(t, err)
+	d := Download{IP: "192.0.2.1", Account: "secret-token", ClaimID: "a"}
+	require.NoError(t, q.Admit(d))
+	require.NoError(t, q.Admit(Download{IP: "192.0.2.1", ClaimID: "b"}))
+	q.Start()
+	q.Shutdown()
+
+	b, err := os.ReadFile(state)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "secret-token")
+
+	q, err = New(Opts{PolicyPath: policy, StatePath: state})
+	require.NoError(t, err)
+	assert.NoError(t, q.Admit(d), "claims counted before the restart are remembered")
+	d.ClaimID = "c"
+	assert.ErrorIs(t, q.Admit(d), ErrQuotaExceeded)
+
+	// Usage from previous days is dropped.
+	q.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	assert.NoError(t, q.Admit(d))
+	require.NoError(t, q.Save())
+	q, err = New(Opts{PolicyPath: policy, StatePath: state})
+	require.NoError(t, err)
+	assert.Empty(t, q.usage)
+}
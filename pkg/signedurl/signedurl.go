@@ -0,0 +1,276 @@
+// Package signedurl mints and verifies HMAC-signed, expiring playback URLs.
+//
+// A signed URL carries its expiry, the ID of the key it was signed with, an optional client IP
+// or network prefix binding, a list of allowed operations and optionally the channel of the claim,
+// so content of blocked channels can be refused without resolving the claim. The signature
+// additionally covers claim ID and sd hash of the stream, so it cannot be reused for other content.
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/iprange"
+	"github.com/OdyseeTeam/player-server/internal/reload"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	lerrors "github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+var Logger = logger.GetLogger()
+
+// Query parameters of a signed URL.
+const (
+	ParamExpires    = "exp"
+	ParamKeyID      = "kid"
+	ParamClientIP   = "cip"
+	ParamOperations = "ops"
+	ParamChannelID  = "ch"
+	ParamSignature  = "sig"
+)
+
+// Operations that can be allowed by a signed URL.
+const (
+	OpDownload = "download"
+	// OpHLS grants access to playlists and segments of a transcoded rendition.
+	OpHLS = "hls"
+)
+
+var (
+	ErrNotSigned        = errors.New("url is not signed")
+	ErrUnknownKey       = errors.New("url signed with unknown key")
+	ErrInvalidSignature = errors.New("invalid url signature")
+	ErrExpired          = errors.New("signed url expired")
+	ErrClientMismatch   = errors.New("signed url is not valid for this client")
+)
+
+// Params describe what a signed URL grants access to.
+type Params struct {
+	ClaimID string
+	SdHash  string
+	Expires time.Time
+	// ClientIP binds the URL to a single IP address or a network prefix in CIDR notation.
+	ClientIP   string
+	Operations []string
+	// ChannelID is the channel the claim was signed by when the URL was minted.
+	ChannelID string
+}
+
+// Allows checks if the operation was granted.
+func (p Params) Allows(op string) bool {
+	for _, o := range p.Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// KeysFile is the on-disk format of a signing keyring.
+type KeysFile struct {
+	// SigningKey is the ID of the key used for minting new URLs.
+	SigningKey string `json:"signing_key"`
+	// Keys map key IDs to secrets. All keys listed are accepted for verification.
+	Keys map[string]string `json:"keys"`
+}
+
+type keyset struct {
+	signingKey string
+	keys       map[string][]byte
+}
+
+// Keyring holds HMAC keys used for signing and verification. Several keys can be active at once,
+// which allows for rotation: add a new key, switch signing_key to it, remove the old key once
+// URLs signed with it have expired.
+type Keyring struct {
+	path    string
+	ks      atomic.Pointer[keyset]
+	watcher *stop.Group
+}
+
+// NewKeyring creates a keyring from key ID to secret map.
+func NewKeyring(signingKey string, keys map[string]string) (*Keyring, error) {
+	k := &Keyring{}
+	ks, err := newKeyset(KeysFile{SigningKey: signingKey, Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	k.ks.Store(ks)
+	return k, nil
+}
+
+// LoadKeyring reads a keyring from a JSON file.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the keyring file, the current keys are kept if that fails.
+func (k *Keyring) Reload() error {
+	b, err := os.ReadFile(k.path)
+	if err != nil {
+		return lerrors.Err(err)
+	}
+	var kf KeysFile
+	if err := json.Unmarshal(b, &kf); err != nil {
+		return lerrors.Err("cannot parse keyring %v: %v", k.path, err)
+	}
+	ks, err := newKeyset(kf)
+	if err != nil {
+		return err
+	}
+	k.ks.Store(ks)
+	Logger.Infof("loaded %v url signing keys, signing with %v", len(ks.keys), ks.signingKey)
+	return nil
+}
+
+// Watch enables reloading the keyring file when it changes.
+func (k *Keyring) Watch(interval time.Duration) {
+	k.watcher = reload.Watch(k.path, interval, func() {
+		if err := k.Reload(); err != nil {
+			Logger.Errorf("failed to reload url signing keys: %v", err)
+		}
+	})
+}
+
+// Shutdown stops watching the keyring file.
+func (k *Keyring) Shutdown() {
+	if k.watcher != nil {
+		k.watcher.StopAndWait()
+	}
+}
+
+func newKeyset(kf KeysFile) (*keyset, error) {
+	ks := &keyset{signingKey: kf.SigningKey, keys: map[string][]byte{}}
+	for id, secret := range kf.Keys {
+		if id == "" || strings.ContainsAny(id, ",&=") {
+			return nil, lerrors.Err("invalid key id %q", id)
+		}
+		if len(secret) < 16 {
+			return nil, lerrors.Err("key %v is too short, at least 16 characters required", id)
+		}
+		ks.keys[id] = []byte(secret)
+	}
+	if _, ok := ks.keys[ks.signingKey]; !ok {
+		return nil, lerrors.Err("signing key %q is not in the keyring", ks.signingKey)
+	}
+	return ks, nil
+}
+
+// Sign returns query values that should be added to a URL for it to be signed with the current signing key.
+func (k *Keyring) Sign(p Params) (url.Values, error) {
+	ks := k.ks.Load()
+	if p.ClientIP != "" {
+		if _, err := iprange.ParsePrefix(p.ClientIP); err != nil {
+			return nil, lerrors.Err(err)
+		}
+	}
+	v := url.Values{}
+	v.Set(ParamExpires, strconv.FormatInt(p.Expires.Unix(), 10))
+	v.Set(ParamKeyID, ks.signingKey)
+	if p.ClientIP != "" {
+		v.Set(ParamClientIP, p.ClientIP)
+	}
+	if len(p.Operations) > 0 {
+		v.Set(ParamOperations, strings.Join(p.Operations, ","))
+	}
+	if p.ChannelID != "" {
+		v.Set(ParamChannelID, p.ChannelID)
+	}
+	v.Set(ParamSignature, sign(ks.keys[ks.signingKey], p.ClaimID, p.SdHash, v))
+	return v, nil
+}
+
+// SignURL adds signature parameters to rawURL.
+func (k *Keyring) SignURL(rawURL string, p Params) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", lerrors.Err(err)
+	}
+	sv, err := k.Sign(p)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for name := range sv {
+		q.Set(name, sv.Get(name))
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Verify checks signature parameters in query against the requested stream and client IP.
+// ErrNotSigned is returned if query contains no signature.
+func (k *Keyring) Verify(query url.Values, claimID, sdHash, clientIP string) (*Params, error) {
+	sig := query.Get(ParamSignature)
+	if sig == "" {
+		return nil, ErrNotSigned
+	}
+	ks := k.ks.Load()
+	key, ok := ks.keys[query.Get(ParamKeyID)]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if !hmac.Equal([]byte(sig), []byte(sign(key, claimID, sdHash, query))) {
+		return nil, ErrInvalidSignature
+	}
+
+	exp, err := strconv.ParseInt(query.Get(ParamExpires), 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	p := &Params{
+		ClaimID:   claimID,
+		SdHash:    sdHash,
+		Expires:   time.Unix(exp, 0),
+		ClientIP:  query.Get(ParamClientIP),
+		ChannelID: query.Get(ParamChannelID),
+	}
+	if ops := query.Get(ParamOperations); ops != "" {
+		p.Operations = strings.Split(ops, ",")
+	}
+	if time.Now().After(p.Expires) {
+		return p, ErrExpired
+	}
+	if p.ClientIP != "" {
+		prefix, err := iprange.ParsePrefix(p.ClientIP)
+		if err != nil {
+			return p, ErrInvalidSignature
+		}
+		addr, err := netip.ParseAddr(clientIP)
+		if err != nil || !prefix.Contains(addr.Unmap()) {
+			return p, ErrClientMismatch
+		}
+	}
+	return p, nil
+}
+
+// sign calculates the signature over stream identifiers and signed query parameters.
+// URLs carrying a channel are signed in the v2 format, others keep the v1 format so URLs minted
+// before channels were added stay valid.
+func sign(key []byte, claimID, sdHash string, v url.Values) string {
+	mac := hmac.New(sha256.New, key)
+	if ch := v.Get(ParamChannelID); ch != "" {
+		fmt.Fprintf(mac, "v2\n%s\n%s\n%s\n%s\n%s\n%s\n%s",
+			claimID, sdHash, v.Get(ParamExpires), v.Get(ParamKeyID), v.Get(ParamClientIP), v.Get(ParamOperations), ch)
+	} else {
+		fmt.Fprintf(mac, "v1\n%s\n%s\n%s\n%s\n%s\n%s",
+			claimID, sdHash, v.Get(ParamExpires), v.Get(ParamKeyID), v.Get(ParamClientIP), v.Get(ParamOperations))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,148 @@
+package signedurl
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testClaimID = "2742f9e8eea0c4654ea8b51507dbb7f23f1f5235"
+	testSdHash  = "a3eb2e6bf8b8bc4a5a8fa3e5e7c4dc0a8f09c8bbd1b5a6ae6d12c4f6f5a4b7c8d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4"
+)
+
+func testKeyring(t *testing.T) *Keyring {
+	k, err := NewKeyring("k2", map[string]string{
+		"k1": "0123456789abcdef0123456789abcdef",
+		"k2": "fedcba9876543210fedcba9876543210",
+	})
+	require.NoError(t, err)
+	return k
+}
+
+func TestSignAndVerify(t *testing.T) {
+	k := testKeyring(t)
+	exp := time.Now().Add(time.Hour)
+
+	signed, err := k.SignURL("https://player.odycdn.com/v6/streams/"+testClaimID+"/"+testSdHash+".mp4?download=true", Params{
+		ClaimID: testClaimID, SdHash: testSdHash, Expires: exp, Operations: []string{OpDownload},
+	})
+	require.NoError(t, err)
+	u, err := url.Parse(signed)
+	require.NoError(t, err)
+	assert.Equal(t, "true", u.Query().Get("download"))
+	assert.Equal(t, "k2", u.Query().Get(ParamKeyID))
+
+	p, err := k.Verify(u.Query(), testClaimID, testSdHash, "1.2.3.4")
+	require.NoError(t, err)
+	assert.True(t, p.Allows(OpDownload))
+	assert.Equal(t, exp.Unix(), p.Expires.Unix())
+
+	_, err = k.Verify(u.Query(), "0000000000000000000000000000000000000000", testSdHash, "1.2.3.4")
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	tampered := u.Query()
+	tampered.Set(ParamExpires, "9999999999")
+	_, err = k.Verify(tampered, testClaimID, testSdHash, "1.2.3.4")
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	tampered = u.Query()
+	tampered.Del(ParamOperations)
+	_, err = k.Verify(tampered, testClaimID, testSdHash, "1.2.3.4")
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	_, err = k.Verify(url.Values{}, testClaimID, testSdHash, "1.2.3.4")
+	assert.ErrorIs(t, err, ErrNotSigned)
+}
+
+func TestSignChannel(t *testing.T) {
+	k := testKeyring(t)
+	v, err := k.Sign(Params{ClaimID: testClaimID, SdHash: testSdHash, Expires: time.Now().Add(time.Hour), Operations: []string{OpHLS}, ChannelID: "chan1"})
+	require.NoError(t, err)
+	p, err := k.Verify(v, testClaimID, testSdHash, "1.2.3.4")
+	require.NoError(t, err)
+	assert.Equal(t, "chan1", p.ChannelID)
+
+	// The channel can be neither changed nor dropped.
+	tampered := url.Values{}
+	for name := range v {
+		tampered.Set(name, v.Get(name))
+	}
+	tampered.Set(ParamChannelID, "chan2")
+	_, err = k.Verify(tampered, testClaimID, testSdHash, "1.2.3.4")
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+	tampered.Del(ParamChannelID)
+	_, err = k.Verify(tampered, testClaimID, testSdHash, "1.2.3.4")
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestVerifyExpired(t *testing.T) {
+	k := testKeyring(t)
+	v, err := k.Sign(Params{ClaimID: testClaimID, SdHash: testSdHash, Expires: time.Now().Add(-time.Second)})
+	require.NoError(t, err)
+	_, err = k.Verify(v, testClaimID, testSdHash, "1.2.3.4")
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestVerifyClientBinding(t *testing.T) {
+	k := testKeyring(t)
+	exp := time.Now().Add(time.Hour)
+
+	v, err := k.Sign(Params{ClaimID: testClaimID, SdHash: testSdHash, Expires: exp, ClientIP: "1.2.3.4"})
+	require.NoError(t, err)
+	_, err = k.Verify(v, testClaimID, testSdHash, "1.2.3.4")
+	assert.NoError(t, err)
+	_, err = k.Verify(v, testClaimID, testSdHash, "::ffff:1.2.3.4")
+	assert.NoError(t, err)
+	_, err = k.Verify(v, testClaimID, testSdHash, "1.2.3.5")
+	assert.ErrorIs(t, err, ErrClientMismatch)
+
+	v, err = k.Sign(Params{ClaimID: testClaimID, SdHash: testSdHash, Expires: exp, ClientIP: "2001:db8:1::/48"})
+	require.NoError(t, err)
+	_, err = k.Verify(v, testClaimID, testSdHash, "2001:db8:1:ffff::1")
+	assert.NoError(t, err)
+	_, err = k.Verify(v, testClaimID, testSdHash, "2001:db8:2::1")
+	assert.ErrorIs(t, err, ErrClientMismatch)
+
+	_, err = k.Sign(Params{ClaimID: testClaimID, SdHash: testSdHash, Expires: exp, ClientIP: "not-an-ip"})
+	assert.Error(t, err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"signing_key": "old", "keys": {"old": "0123456789abcdef0123456789abcdef"}}`), 0600))
+
+	k, err := LoadKeyring(path)
+	require.NoError(t, err)
+	exp := time.Now().Add(time.Hour)
+	oldSigned, err := k.Sign(Params{ClaimID: testClaimID, SdHash: testSdHash, Expires: exp})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"signing_key": "new", "keys": {"old": "0123456789abcdef0123456789abcdef", "new": "fedcba9876543210fedcba9876543210"}}`), 0600))
+	require.NoError(t, k.Reload())
+	newSigned, err := k.Sign(Params{ClaimID: testClaimID, SdHash: testSdHash, Expires: exp})
+	require.NoError(t, err)
+	assert.Equal(t, "new", newSigned.Get(ParamKeyID))
+
+	_, err = k.Verify(oldSigned, testClaimID, testSdHash, "1.2.3.4")
+	assert.NoError(t, err)
+	_, err = k.Verify(newSigned, testClaimID, testSdHash, "1.2.3.4")
+	assert.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"signing_key": "new", "keys": {"new": "fedcba9876543210fedcba9876543210"}}`), 0600))
+	require.NoError(t, k.Reload())
+	_, err = k.Verify(oldSigned, testClaimID, testSdHash, "1.2.3.4")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestNewKeyringErrors(t *testing.T) {
+	_, err := NewKeyring("missing", map[string]string{"k1": "0123456789abcdef0123456789abcdef"})
+	assert.ErrorContains(t, err, "not in the keyring")
+	_, err = NewKeyring("k1", map[string]string{"k1": "short"})
+	assert.ErrorContains(t, err, "too short")
+}
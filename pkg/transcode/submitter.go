@@ -0,0 +1,82 @@
+package transcode
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// TowerSubmitter submits streams through the video API of the transcoder tower,
+// which queues a transcoding request for streams it has no rendition of.
+type TowerSubmitter struct {
+	Server string
+	Client *http.Client
+}
+
+// NewTowerSubmitter creates a submitter for the tower at server (host:port or a URL).
+func NewTowerSubmitter(server string) *TowerSubmitter {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	return &TowerSubmitter{
+		Server: strings.TrimSuffix(server, "/"),
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+			// A redirect means the rendition exists, there's no need to follow it.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+}
+
+// Submit requests a rendition of the stream. A stream that's already transcoded counts as submitted.
+func (s *TowerSubmitter) Submit(uri, sdHash string) error {
+	res, err := s.Client.Get(s.Server + "/api/v1/video/hls/" + url.PathEscape(uri))
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	switch res.StatusCode {
+	case http.StatusAccepted, http.StatusSeeOther, http.StatusOK:
+		return nil
+	case http.StatusForbidden:
+		return errors.Err(ErrForbidden)
+	default:
+		return errors.Err("transcoder responded with status %d", res.StatusCode)
+	}
+}
+
+// FakeSubmitter records submissions instead of making them, for tests.
+type FakeSubmitter struct {
+	mu sync.Mutex
+	// Err is returned from Submit if set.
+	Err         error
+	submissions []string
+}
+
+// Submit records the sd hash of the stream.
+func (f *FakeSubmitter) Submit(uri, sdHash string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.submissions = append(f.submissions, sdHash)
+	return f.Err
+}
+
+// SetErr changes the error returned by Submit.
+func (f *FakeSubmitter) SetErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Err = err
+}
+
+// Submissions lists sd hashes of submitted streams, including failed submissions.
+func (f *FakeSubmitter) Submissions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.submissions...)
+}
@@ -0,0 +1,235 @@
+// Package transcode asks the transcoder to produce renditions of streams that are popular
+// but are still being served in their original form.
+package transcode
+
+import (
+	"sync"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/pkg/logger"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/lbryio/lbry.go/v2/extras/stop"
+)
+
+var Logger = logger.GetLogger()
+
+// ErrForbidden is returned by submitters when the transcoder refuses to transcode a stream,
+// usually because its channel is not enabled. Such streams are retried after MaxBackoff.
+var ErrForbidden = errors.Base("transcoding is not allowed for this stream")
+
+// Submitter requests a rendition of a stream from the transcoder.
+type Submitter interface {
+	Submit(uri, sdHash string) error
+}
+
+// Policy decides when streams are submitted.
+type Policy struct {
+	// Threshold is the number of original plays within Window that makes a stream popular.
+	Threshold int
+	Window    time.Duration
+	// Resubmit is how long a submitted stream is left alone, giving the transcoder time to finish.
+	Resubmit time.Duration
+	// Failed submissions are retried with exponential backoff between MinBackoff and MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxTracked caps the number of streams play counts are kept for.
+	MaxTracked int
+	// Workers is the number of concurrent submissions, QueueSize the number of submissions waiting for one.
+	Workers   int
+	QueueSize int
+}
+
+// DefaultPolicy returns a policy suitable for production.
+func DefaultPolicy() Policy {
+	return Policy{
+		Threshold:  10,
+		Window:     time.Hour,
+		Resubmit:   6 * time.Hour,
+		MinBackoff: time.Minute,
+		MaxBackoff: 24 * time.Hour,
+		MaxTracked: 100000,
+		Workers:    2,
+		QueueSize:  1000,
+	}
+}
+
+// Results of submissions and plays, used as metric labels.
+const (
+	resultSubmitted = "submitted"
+	resultFailed    = "failed"
+	resultForbidden = "forbidden"
+	resultDropped   = "dropped"
+)
+
+type stream struct {
+	uri         string
+	plays       int
+	windowStart time.Time
+	// pending is set while the stream is queued or being submitted.
+	pending bool
+	// next is when the stream may be submitted again after a submission or a failure.
+	next     time.Time
+	failures int
+}
+
+// Trigger counts original plays per stream and submits streams crossing the popularity threshold.
+type Trigger struct {
+	policy    Policy
+	submitter Submitter
+	now       func() time.Time
+
+	mu      sync.Mutex
+	streams map[string]*stream
+	queue   chan string
+	grp     *stop.Group
+}
+
+// NewTrigger creates a trigger, Start has to be called for submissions to be made.
+func NewTrigger(s Submitter, p Policy) *Trigger {
+	def := DefaultPolicy()
+	if p.Threshold <= 0 {
+		p.Threshold = def.Threshold
+	}
+	if p.Window <= 0 {
+		p.Window = def.Window
+	}
+	if p.Resubmit <= 0 {
+		p.Resubmit = def.Resubmit
+	}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = def.MinBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = max(def.MaxBackoff, p.MinBackoff)
+	}
+	if p.MaxTracked <= 0 {
+		p.MaxTracked = def.MaxTracked
+	}
+	if p.Workers <= 0 {
+		p.Workers = def.Workers
+	}
+	if p.QueueSize <= 0 {
+		p.QueueSize = def.QueueSize
+	}
+	return &Trigger{
+		policy:    p,
+		submitter: s,
+		now:       time.Now,
+		streams:   map[string]*stream{},
+		queue:     make(chan string, p.QueueSize),
+		grp:       stop.New(),
+	}
+}
+
+// Start runs submission workers until Shutdown is called.
+func (t *Trigger) Start() {
+	for i := 0; i < t.policy.Workers; i++ {
+		t.grp.Add(1)
+		go func() {
+			defer t.grp.Done()
+			for {
+				select {
+				case <-t.grp.Ch():
+					return
+				case sdHash := <-t.queue:
+					t.submit(sdHash)
+				}
+			}
+		}()
+	}
+}
+
+// Shutdown stops submission workers, queued streams are not submitted.
+func (t *Trigger) Shutdown() {
+	t.grp.StopAndWait()
+}
+
+// RecordPlay notes that the stream was served without a rendition, queueing it for submission
+// once it gets popular. Streams already queued, submitted recently or backing off are skipped.
+func (t *Trigger) RecordPlay(uri, sdHash string) {
+	now := t.now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.streams[sdHash]
+	if !ok {
+		if len(t.streams) >= t.policy.MaxTracked && !t.evict(now) {
+			return
+		}
+		s = &stream{uri: uri, windowStart: now}
+		t.streams[sdHash] = s
+	}
+	if now.Sub(s.windowStart) >= t.policy.Window {
+		s.plays, s.windowStart = 0, now
+	}
+	s.plays++
+	if s.pending || s.plays < t.policy.Threshold || now.Before(s.next) {
+		return
+	}
+	select {
+	case t.queue <- sdHash:
+		s.pending = true
+		metrics.TranscodingRequestsPending.Inc()
+	default:
+		metrics.TranscodingRequests.WithLabelValues(resultDropped).Inc()
+	}
+}
+
+// evict drops streams that are neither popular nor waiting for a retry. It reports whether there's room left.
+func (t *Trigger) evict(now time.Time) bool {
+	for h, s := range t.streams {
+		if !s.pending && now.After(s.next) && (s.plays < t.policy.Threshold || now.Sub(s.windowStart) >= t.policy.Window) {
+			delete(t.streams, h)
+		}
+	}
+	return len(t.streams) < t.policy.MaxTracked
+}
+
+func (t *Trigger) submit(sdHash string) {
+	t.mu.Lock()
+	s := t.streams[sdHash]
+	t.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	err := t.submitter.Submit(s.uri, sdHash)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	metrics.TranscodingRequestsPending.Dec()
+	s.pending = false
+	now := t.now()
+	switch {
+	case err == nil:
+		s.failures = 0
+		s.next = now.Add(t.policy.Resubmit)
+		metrics.TranscodingRequests.WithLabelValues(resultSubmitted).Inc()
+		Logger.Infof("submitted %v (%v) for transcoding after %v plays", s.uri, sdHash, s.plays)
+	case errors.Is(err, ErrForbidden):
+		s.next = now.Add(t.policy.MaxBackoff)
+		metrics.TranscodingRequests.WithLabelValues(resultForbidden).Inc()
+		Logger.Debugf("transcoding of %v refused: %v", s.uri, err)
+	default:
+		backoff := t.policy.MinBackoff << min(s.failures, 30)
+		if backoff <= 0 || backoff > t.policy.MaxBackoff {
+			backoff = t.policy.MaxBackoff
+		}
+		s.failures++
+		s.next = now.Add(backoff)
+		metrics.TranscodingRequests.WithLabelValues(resultFailed).Inc()
+		Logger.Warnf("failed to submit %v for transcoding, retrying in %v: %v", s.uri, backoff, err)
+	}
+}
+
+// RecordServed counts bytes of video streams served in original or transcoded form,
+// showing how much of the video traffic is covered by renditions.
+func RecordServed(transcoded bool, bytes int64) {
+	variant := metrics.StreamOriginal
+	if transcoded {
+		variant = metrics.StreamTranscoded
+	}
+	metrics.TranscodingCoverageBytes.WithLabelValues(variant).Add(float64(bytes))
+}
@@ -0,0 +1,186 @@
+package transcode
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func newTestTrigger(t *testing.T, s Submitter, p Policy) (*Trigger, *clock) {
+	t.Helper()
+	c := &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tr := NewTrigger(s, p)
+	tr.now = c.now
+	tr.Start()
+	t.Cleanup(tr.Shutdown)
+	return tr, c
+}
+
+// settle waits for queued submissions to finish.
+func settle(t *testing.T, tr *Trigger) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		for _, s := range tr.streams {
+			if s.pending {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond)
+}
+
+func TestTriggerThreshold(t *testing.T) {
+	f := &FakeSubmitter{}
+	tr, c := newTestTrigger(t, f, Policy{Threshold: 3, Window: time.Hour, Resubmit: time.Hour})
+
+	tr.RecordPlay("a#1", "sd1")
+	tr.RecordPlay("a#1", "sd1")
+	tr.RecordPlay("b#2", "sd2")
+	settle(t, tr)
+	assert.Empty(t, f.Submissions())
+
+	tr.RecordPlay("a#1", "sd1")
+	settle(t, tr)
+	assert.Equal(t, []string{"sd1"}, f.Submissions())
+
+	// Further plays are deduplicated until Resubmit passes.
+	for i := 0; i < 10; i++ {
+		tr.RecordPlay("a#1", "sd1")
+	}
+	settle(t, tr)
+	assert.Len(t, f.Submissions(), 1)
+
+	c.advance(time.Hour)
+	tr.RecordPlay("a#1", "sd1")
+	settle(t, tr)
+	assert.Len(t, f.Submissions(), 1, "play counts start over in a new window")
+	tr.RecordPlay("a#1", "sd1")
+	tr.RecordPlay("a#1", "sd1")
+	settle(t, tr)
+	assert.Equal(t, []string{"sd1", "sd1"}, f.Submissions())
+}
+
+func TestTriggerWindow(t *testing.T) {
+	f := &FakeSubmitter{}
+	tr, c := newTestTrigger(t, f, Policy{Threshold: 2, Window: time.Minute})
+
+	tr.RecordPlay("a#1", "sd1")
+	c.advance(2 * time.Minute)
+	tr.RecordPlay("a#1", "sd1")
+	settle(t, tr)
+	assert.Empty(t, f.Submissions())
+}
+
+func TestTriggerBackoff(t *testing.T) {
+	f := &FakeSubmitter{Err: errors.Err("transcoder unavailable")}
+	tr, c := newTestTrigger(t, f, Policy{Threshold: 1, MinBackoff: time.Minute, MaxBackoff: 3 * time.Minute})
+
+	play := func() {
+		tr.RecordPlay("a#1", "sd1")
+		settle(t, tr)
+	}
+	play()
+	require.Len(t, f.Submissions(), 1)
+
+	play()
+	assert.Len(t, f.Submissions(), 1, "backing off")
+	c.advance(time.Minute)
+	play()
+	assert.Len(t, f.Submissions(), 2)
+
+	// The second failure doubles the backoff.
+	c.advance(time.Minute)
+	play()
+	assert.Len(t, f.Submissions(), 2)
+	c.advance(time.Minute)
+	play()
+	assert.Len(t, f.Submissions(), 3)
+
+	// Backoff is capped at MaxBackoff.
+	c.advance(3 * time.Minute)
+	play()
+	assert.Len(t, f.Submissions(), 4)
+
+	f.SetErr(errors.Err(ErrForbidden))
+	c.advance(3 * time.Minute)
+	play()
+	assert.Len(t, f.Submissions(), 5)
+	c.advance(2 * time.Minute)
+	play()
+	assert.Len(t, f.Submissions(), 5, "forbidden streams wait for MaxBackoff")
+}
+
+func TestTriggerMaxTracked(t *testing.T) {
+	f := &FakeSubmitter{}
+	tr, _ := newTestTrigger(t, f, Policy{Threshold: 2, MaxTracked: 2})
+
+	tr.RecordPlay("a#1", "sd1")
+	tr.RecordPlay("a#1", "sd1")
+	settle(t, tr)
+	tr.RecordPlay("b#2", "sd2")
+	// Unpopular streams make room, submitted ones are kept to stay deduplicated.
+	tr.RecordPlay("c#3", "sd3")
+	tr.mu.Lock()
+	assert.Len(t, tr.streams, 2)
+	assert.Contains(t, tr.streams, "sd1")
+	assert.Contains(t, tr.streams, "sd3")
+	tr.mu.Unlock()
+
+	tr.RecordPlay("a#1", "sd1")
+	settle(t, tr)
+	assert.Len(t, f.Submissions(), 1)
+}
+
+func TestTowerSubmitter(t *testing.T) {
+	status := http.StatusAccepted
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+		if status == http.StatusSeeOther {
+			http.Redirect(w, r, "/somewhere", status)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	s := NewTowerSubmitter(ts.Listener.Addr().String())
+	require.NoError(t, s.Submit("what#6769855a9aa43b67086f9ff3c1a5bacb5698a27a", "sd1"))
+	assert.Equal(t, "/api/v1/video/hls/what%236769855a9aa43b67086f9ff3c1a5bacb5698a27a", path)
+
+	status = http.StatusSeeOther
+	assert.NoError(t, s.Submit("what#1", "sd1"))
+
+	status = http.StatusForbidden
+	assert.ErrorIs(t, s.Submit("what#1", "sd1"), ErrForbidden)
+
+	status = http.StatusInternalServerError
+	err := s.Submit("what#1", "sd1")
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrForbidden)
+}
@@ -1,8 +1,10 @@
 package player
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/OdyseeTeam/gody-cdn/cleanup"
 	"github.com/OdyseeTeam/gody-cdn/configs"
@@ -22,6 +24,8 @@ import (
 // DecryptedCache Stores and retrieves unencrypted blobs on disk.
 type DecryptedCache struct {
 	cache   *objectStore.CachingStore
+	index   *objectStore.DBBackedStore
+	path    string
 	sf      *singleflight.Group
 	stopper *stop.Group
 }
@@ -81,6 +85,8 @@ func NewDecryptedCache(origin store.BlobStore) *DecryptedCache {
 
 	h := &DecryptedCache{
 		cache:   finalStore,
+		index:   dbs,
+		path:    configs.Configuration.DiskCache.Path,
 		sf:      new(singleflight.Group),
 		stopper: stopper,
 	}
@@ -119,6 +125,17 @@ func (h *DecryptedCache) IsCached(hash string) bool {
 	return has
 }
 
+// Path returns the directory decrypted blobs are stored in.
+func (h *DecryptedCache) Path() string {
+	return h.path
+}
+
+// CheckIndex is a readiness check looking up a blob that doesn't exist in the database indexing the cache.
+func (h *DecryptedCache) CheckIndex(ctx context.Context) error {
+	_, err := h.index.Has(strings.Repeat("0", 96), nil)
+	return err
+}
+
 func (h *DecryptedCache) Shutdown() {
 	h.cache.Shutdown()
 	h.stopper.StopAndWait()
@@ -2,6 +2,8 @@ package player
 
 import (
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
@@ -10,8 +12,27 @@ var (
 	ErrEdgeAuthenticationFailed        = errors.New("edge authentication failed")
 	ErrEdgeCredentialsMissing          = errors.New("edge credentials missing")
 	ErrClaimNotFound                   = errors.New("could not resolve stream URI")
+	ErrScheduledRelease                = errors.New("stream is not released yet")
 
 	ErrSeekBeforeStart = errors.New("seeking before the beginning of file")
 	ErrSeekOutOfBounds = errors.New("seeking out of bounds")
 	ErrStreamSizeZero  = errors.New("stream size is zero")
 )
+
+// ScheduledReleaseError is returned for streams requested before their scheduled release time.
+type ScheduledReleaseError struct {
+	ReleaseTime time.Time
+}
+
+func (e *ScheduledReleaseError) Error() string {
+	return fmt.Sprintf("%v, it will be available at %v", ErrScheduledRelease, e.ReleaseTime.UTC().Format(time.RFC3339))
+}
+
+func (e *ScheduledReleaseError) Is(target error) bool {
+	return target == ErrScheduledRelease
+}
+
+// RetryAfter returns the number of seconds left until the release, at least 1.
+func (e *ScheduledReleaseError) RetryAfter() int {
+	return max(int(time.Until(e.ReleaseTime).Seconds()+0.5), 1)
+}
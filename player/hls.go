@@ -0,0 +1,185 @@
+package player
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/pkg/signedurl"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultHLSSignatureTTL is how long signed playlist and segment URLs are valid for by default.
+// It has to cover the whole playback of a video as segment URLs are only refreshed with the playlist.
+const DefaultHLSSignatureTTL = 6 * time.Hour
+
+// hlsIPv6PrefixLen is the network prefix IPv6 clients are bound to, as they tend to rotate addresses within it.
+const hlsIPv6PrefixLen = 64
+
+var (
+	errHLSNotAllowed = errors.New("signed url does not allow hls playback")
+
+	reURIAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+)
+
+// signHLS returns query values signing rendition URLs of the stream for the client,
+// or nil if URL signing is not configured. The channel is carried along so channel blocks
+// can still be checked for signed requests without resolving the stream.
+func (p *Player) signHLS(claimID, sdHash, channelID, ip string) (url.Values, error) {
+	if p.options.urlSigner == nil {
+		return nil, nil
+	}
+	return p.options.urlSigner.Sign(signedurl.Params{
+		ClaimID:    claimID,
+		SdHash:     sdHash,
+		ChannelID:  channelID,
+		Expires:    time.Now().Add(p.options.hlsSignatureTTL),
+		ClientIP:   hlsClientBinding(ip),
+		Operations: []string{signedurl.OpHLS},
+	})
+}
+
+// verifyHLS checks the signature of a rendition URL, returning its parameters if the request carries a valid one.
+// Unsigned requests are not an error, they have to go through the full set of checks instead.
+func (p *Player) verifyHLS(query url.Values, claimID, sdHash, ip string) (*signedurl.Params, error) {
+	if p.options.urlSigner == nil {
+		return nil, nil
+	}
+	signed, err := p.options.urlSigner.Verify(query, claimID, sdHash, ip)
+	if errors.Is(err, signedurl.ErrNotSigned) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !signed.Allows(signedurl.OpHLS) {
+		return nil, errHLSNotAllowed
+	}
+	return signed, nil
+}
+
+// hlsCredentials fingerprints the access credentials of a fragment request, to tell apart viewers sharing an address.
+func hlsCredentials(c *gin.Context) string {
+	th := c.Request.Header.Get(edgeTokenHeader)
+	entitlement := c.Query(paramEntitlement)
+	session := c.Query(paramSession)
+	if th == "" && entitlement == "" && session == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(th + "\n" + entitlement + "\n" + session))
+	return hex.EncodeToString(h[:])
+}
+
+// hlsClientBinding returns the address or network prefix signed rendition URLs are bound to.
+func hlsClientBinding(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	if addr.Is4() {
+		return addr.String()
+	}
+	p, _ := addr.Prefix(hlsIPv6PrefixLen)
+	return p.String()
+}
+
+// isPlaylist checks if a rendition fragment is a playlist.
+func isPlaylist(fragment string) bool {
+	return strings.HasSuffix(fragment, ".m3u8")
+}
+
+// servePlaylist serves a playlist retrieved from the transcoder with all variant and segment URIs signed.
+func (h *RequestHandler) servePlaylist(c *gin.Context, claimID, sdHash, fragment string, sig url.Values) (int64, error) {
+	// Retrieve the whole playlist regardless of conditional or range headers of the original request.
+	r := c.Request.Clone(c.Request.Context())
+	r.Method = http.MethodGet
+	r.Header = http.Header{}
+	buf := newResponseBuffer()
+	if _, err := h.player.tclient.PlayFragment(claimID, sdHash, fragment, buf, r); err != nil {
+		return 0, err
+	}
+
+	body := buf.body.Bytes()
+	if buf.status == http.StatusOK {
+		body = signPlaylist(body, sig)
+	}
+	for k, v := range buf.header {
+		switch k {
+		case "Content-Length", "Cache-Control", "Last-Modified", "Etag", "Accept-Ranges", "Content-Range":
+			continue
+		}
+		c.Writer.Header()[k] = v
+	}
+	// Playlists are signed for a single client and cannot be shared by caches.
+	c.Header("Cache-Control", "private, no-store")
+	c.Header("Content-Length", fmt.Sprintf("%v", len(body)))
+	c.Status(buf.status)
+	if c.Request.Method == http.MethodHead {
+		return 0, nil
+	}
+	n, err := c.Writer.Write(body)
+	return int64(n), err
+}
+
+// signPlaylist adds signature parameters to every URI in an m3u8 playlist: variant and segment lines
+// as well as URI attributes of tags like EXT-X-MAP and EXT-X-MEDIA. Absolute URIs point elsewhere and are left alone.
+func signPlaylist(body []byte, sig url.Values) []byte {
+	lines := bytes.Split(body, []byte("\n"))
+	for i, l := range lines {
+		line := strings.TrimRight(string(l), "\r")
+		lines[i] = []byte(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			if strings.Contains(line, `URI="`) {
+				lines[i] = []byte(reURIAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+					uri := reURIAttribute.FindStringSubmatch(attr)[1]
+					return fmt.Sprintf(`URI="%s"`, signURI(uri, sig))
+				}))
+			}
+		default:
+			lines[i] = []byte(signURI(line, sig))
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// signURI adds signature parameters to a relative URI.
+func signURI(uri string, sig url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.IsAbs() || u.Host != "" {
+		return uri
+	}
+	q := u.Query()
+	for k := range sig {
+		q.Set(k, sig.Get(k))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// responseBuffer collects a response in memory.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: http.Header{}, status: http.StatusOK}
+}
+
+func (b *responseBuffer) Header() http.Header { return b.header }
+
+func (b *responseBuffer) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+func (b *responseBuffer) WriteHeader(status int) { b.status = status }
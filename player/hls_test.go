@@ -0,0 +1,475 @@
+package player
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/firewall"
+	"github.com/OdyseeTeam/player-server/internal/transcodertest"
+	"github.com/OdyseeTeam/player-server/pkg/catalog"
+	"github.com/OdyseeTeam/player-server/pkg/hlssession"
+	"github.com/OdyseeTeam/player-server/pkg/signedurl"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	hlsClaimID  = "6769855a9aa43b67086f9ff3c1a5bacb5698a27a"
+	hlsSdHash   = "a4c55d0c5b0e1fbf4bd5e1bb7c2f2ba1bf8ae7d4cfaa14dd05e53e1d85cdf1f5d0fbc2b10e0da7dd5a8bd1f0c2a9a3c1"
+	fmp4ClaimID = "81b1749f773bad5b9b53d21508051560f2746cdc"
+	fmp4SdHash  = "b4c55d0c5b0e1fbf4bd5e1bb7c2f2ba1bf8ae7d4cfaa14dd05e53e1d85cdf1f5d0fbc2b10e0da7dd5a8bd1f0c2a9a3c1"
+)
+
+var hlsClientIP atomic.Int32
+
+type hlsEnv struct {
+	router *gin.Engine
+	player *Player
+	tc     *transcodertest.Fake
+}
+
+func newHLSEnv(t *testing.T, opts ...func(*PlayerOptions)) *hlsEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	c := catalog.New([]catalog.Entry{
+		{ClaimID: hlsClaimID, Name: "hls-video", SdHash: hlsSdHash, ContentType: "video/mp4", Size: 1000},
+		{ClaimID: fmp4ClaimID, Name: "fmp4-video", SdHash: fmp4SdHash, ContentType: "video/mp4", Size: 1000},
+	})
+	tc := transcodertest.New()
+	tc.AddHLSStream(hlsSdHash, 3, false)
+	tc.AddHLSStream(fmp4SdHash, 2, true)
+
+	p := NewPlayer(nil, append([]func(*PlayerOptions){WithCatalog(c)}, opts...)...)
+	p.AddTranscoderClient(tc, "")
+	r := gin.New()
+	InstallPlayerRoutes(r, p)
+	return &hlsEnv{router: r, player: p, tc: tc}
+}
+
+func (e *hlsEnv) request(t *testing.T, method, url string) *httptest.ResponseRecorder {
+	t.Helper()
+	// Every request comes from a different client to stay clear of rate limits.
+	return e.requestFrom(t, method, url, fmt.Sprintf("192.0.2.%d", hlsClientIP.Add(1)%250+1))
+}
+
+func (e *hlsEnv) requestFrom(t *testing.T, method, url, ip string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, url, nil)
+	req.Header.Set("Origin", "https://odysee.com")
+	req.RemoteAddr = net.JoinHostPort(ip, "1234")
+	rec := httptest.NewRecorder()
+	e.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// playlistEntries returns URIs listed in an m3u8 playlist.
+func playlistEntries(body string) []string {
+	var uris []string
+	for _, l := range strings.Split(body, "\n") {
+		if l != "" && !strings.HasPrefix(l, "#") {
+			uris = append(uris, l)
+		}
+	}
+	return uris
+}
+
+func TestHLSRoutes(t *testing.T) {
+	e := newHLSEnv(t)
+
+	cases := []struct {
+		name, start, playlist string
+	}{
+		{
+			"v4",
+			fmt.Sprintf("/api/v4/streams/free/hls-video/%v/%v", hlsClaimID, hlsSdHash[:6]),
+			fmt.Sprintf("/api/v4/streams/tc/hls-video/%v/%v/master.m3u8", hlsClaimID, hlsSdHash),
+		},
+		{
+			"v5",
+			fmt.Sprintf("/v5/streams/start/%v/%v", hlsClaimID, hlsSdHash[:6]),
+			fmt.Sprintf("/v5/streams/hls/%v/%v/master.m3u8", hlsClaimID, hlsSdHash),
+		},
+		{
+			"v6",
+			fmt.Sprintf("/v6/streams/%v/%v.mp4", hlsClaimID, hlsSdHash[:6]),
+			fmt.Sprintf("/v6/streams/%v/%v/master.m3u8", hlsClaimID, hlsSdHash),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := e.request(t, http.MethodHead, tc.start)
+			require.Equal(t, http.StatusPermanentRedirect, rec.Code, rec.Body.String())
+			require.Equal(t, tc.playlist, rec.Header().Get("Location"))
+
+			rec = e.request(t, http.MethodGet, tc.playlist)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+			assert.Equal(t, "application/x-mpegurl", rec.Header().Get("Content-Type"))
+			assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+			variants := playlistEntries(rec.Body.String())
+			require.Equal(t, []string{"v0.m3u8"}, variants)
+
+			base := strings.TrimSuffix(tc.playlist, "master.m3u8")
+			rec = e.request(t, http.MethodGet, base+variants[0])
+			require.Equal(t, http.StatusOK, rec.Code)
+			segments := playlistEntries(rec.Body.String())
+			require.Len(t, segments, 3)
+
+			for i, s := range segments {
+				rec = e.request(t, http.MethodGet, base+s)
+				require.Equal(t, http.StatusOK, rec.Code)
+				assert.Equal(t, "video/mp2t", rec.Header().Get("Content-Type"))
+				assert.Equal(t, fmt.Sprintf("segment-%v-%d", hlsSdHash, i), rec.Body.String())
+			}
+
+			rec = e.request(t, http.MethodHead, base+segments[0])
+			assert.Equal(t, http.StatusOK, rec.Code)
+		})
+	}
+}
+
+func TestHLSRoutesFMP4(t *testing.T) {
+	e := newHLSEnv(t)
+	base := fmt.Sprintf("/v6/streams/%v/%v/", fmp4ClaimID, fmp4SdHash)
+
+	rec := e.request(t, http.MethodGet, base+"v0.m3u8")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `#EXT-X-MAP:URI="v0_init.mp4"`)
+
+	rec = e.request(t, http.MethodGet, base+"v0_init.mp4")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "video/mp4", rec.Header().Get("Content-Type"))
+
+	rec = e.request(t, http.MethodGet, base+"v0_s000001.m4s")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "video/iso.segment", rec.Header().Get("Content-Type"))
+	assert.Equal(t, fmt.Sprintf("segment-%v-1", fmp4SdHash), rec.Body.String())
+
+	// Segments support range requests like files served from disk.
+	req := httptest.NewRequest(http.MethodGet, base+"v0_s000001.m4s", nil)
+	req.Header.Set("Range", "bytes=0-6")
+	req.RemoteAddr = "198.51.100.1:1234"
+	r := httptest.NewRecorder()
+	e.router.ServeHTTP(r, req)
+	assert.Equal(t, http.StatusPartialContent, r.Code)
+	assert.Equal(t, "segment", r.Body.String())
+}
+
+func TestHLSRoutesErrors(t *testing.T) {
+	e := newHLSEnv(t)
+
+	rec := e.request(t, http.MethodGet, fmt.Sprintf("/v6/streams/%v/%v/v0_s000099.ts", hlsClaimID, hlsSdHash))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = e.request(t, http.MethodGet, fmt.Sprintf("/v6/streams/%v/%v/master.m3u8", "0000000000000000000000000000000000000000", hlsSdHash))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Fragments are only served from a transcoder once one is added.
+	p := NewPlayer(nil, WithCatalog(catalog.New(nil)))
+	r := gin.New()
+	InstallPlayerRoutes(r, p)
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v5/streams/hls/%v/%v/master.m3u8", hlsClaimID, hlsSdHash), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	assert.Len(t, e.tc.Played(), 0)
+}
+
+func newSignedHLSEnv(t *testing.T) (*hlsEnv, *signedurl.Keyring) {
+	t.Helper()
+	k, err := signedurl.NewKeyring("k1", map[string]string{"k1": "0123456789abcdef"})
+	require.NoError(t, err)
+	return newHLSEnv(t, WithURLSigner(k), WithHLSSignatureTTL(time.Hour)), k
+}
+
+func TestHLSSignedPlaylists(t *testing.T) {
+	e, _ := newSignedHLSEnv(t)
+	ip := "198.51.100.7"
+	base := fmt.Sprintf("/v6/streams/%v/%v/", fmp4ClaimID, fmp4SdHash)
+
+	rec := e.requestFrom(t, http.MethodHead, fmt.Sprintf("/v6/streams/%v/%v.mp4", fmp4ClaimID, fmp4SdHash[:6]), ip)
+	require.Equal(t, http.StatusPermanentRedirect, rec.Code, rec.Body.String())
+	loc, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, base+"master.m3u8", loc.Path)
+	assert.Equal(t, signedurl.OpHLS, loc.Query().Get(signedurl.ParamOperations))
+	assert.Equal(t, ip, loc.Query().Get(signedurl.ParamClientIP))
+
+	rec = e.requestFrom(t, http.MethodGet, loc.String(), ip)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "private, no-store", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, "application/x-mpegurl", rec.Header().Get("Content-Type"))
+	variants := playlistEntries(rec.Body.String())
+	require.Len(t, variants, 1)
+	assert.True(t, strings.HasPrefix(variants[0], "v0.m3u8?"), variants[0])
+
+	rec = e.requestFrom(t, http.MethodGet, base+variants[0], ip)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	body := rec.Body.String()
+	assert.Regexp(t, `#EXT-X-MAP:URI="v0_init\.mp4\?[^"]*sig=[^"]+"`, body)
+	segments := playlistEntries(body)
+	require.Len(t, segments, 2)
+	for i, s := range segments {
+		assert.Contains(t, s, signedurl.ParamSignature+"=")
+		rec = e.requestFrom(t, http.MethodGet, base+s, ip)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.Equal(t, fmt.Sprintf("segment-%v-%d", fmp4SdHash, i), rec.Body.String())
+	}
+
+	// Signed URLs are bound to the client.
+	rec = e.requestFrom(t, http.MethodGet, base+segments[0], "198.51.100.8")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = e.requestFrom(t, http.MethodHead, base+variants[0], ip)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	assert.NotEmpty(t, rec.Header().Get("Content-Length"))
+}
+
+func TestHLSSignedFragments(t *testing.T) {
+	e, k := newSignedHLSEnv(t)
+	ip := "2001:db8:1:2::5"
+	sign := func(claimID string, p signedurl.Params) string {
+		p.ClaimID = claimID
+		p.SdHash = hlsSdHash
+		v, err := k.Sign(p)
+		require.NoError(t, err)
+		return fmt.Sprintf("/v6/streams/%v/%v/v0_s000000.ts?%v", claimID, hlsSdHash, v.Encode())
+	}
+	valid := signedurl.Params{Expires: time.Now().Add(time.Hour), ClientIP: hlsClientBinding(ip), Operations: []string{signedurl.OpHLS}}
+
+	// Signed fragments are served without resolving the stream, so it doesn't have to be in the catalog.
+	unknownClaim := "1111111111111111111111111111111111111111"
+	rec := e.requestFrom(t, http.MethodGet, fmt.Sprintf("/v6/streams/%v/%v/v0_s000000.ts", unknownClaim, hlsSdHash), ip)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = e.requestFrom(t, http.MethodGet, sign(unknownClaim, valid), ip)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// IPv6 clients are bound to their /64.
+	rec = e.requestFrom(t, http.MethodGet, sign(hlsClaimID, valid), "2001:db8:1:2::6")
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	rec = e.requestFrom(t, http.MethodGet, sign(hlsClaimID, valid), "2001:db8:1:3::5")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	expired := valid
+	expired.Expires = time.Now().Add(-time.Minute)
+	rec = e.requestFrom(t, http.MethodGet, sign(hlsClaimID, expired), ip)
+	assert.Equal(t, http.StatusGone, rec.Code)
+
+	download := valid
+	download.Operations = []string{signedurl.OpDownload}
+	rec = e.requestFrom(t, http.MethodGet, sign(hlsClaimID, download), ip)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	tampered := strings.Replace(sign(hlsClaimID, valid), hlsClaimID, fmp4ClaimID, 1)
+	rec = e.requestFrom(t, http.MethodGet, tampered, ip)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	// Unsigned requests are resolved and have to use the sd hash of the stream.
+	rec = e.requestFrom(t, http.MethodGet, fmt.Sprintf("/v6/streams/%v/%v/v0_s000000.ts", hlsClaimID, hlsSdHash), ip)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = e.requestFrom(t, http.MethodGet, fmt.Sprintf("/v6/streams/%v/%v/v0_s000000.ts", fmp4ClaimID, hlsSdHash), ip)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestHLSSignedFragmentsFirewall(t *testing.T) {
+	e, k := newSignedHLSEnv(t)
+	ip := "198.51.100.20"
+	v, err := k.Sign(signedurl.Params{
+		ClaimID: hlsClaimID, SdHash: hlsSdHash, Expires: time.Now().Add(time.Hour),
+		ClientIP: hlsClientBinding(ip), Operations: []string{signedurl.OpHLS},
+	})
+	require.NoError(t, err)
+	signed := fmt.Sprintf("/v6/streams/%v/%v/v0_s000000.ts?%v", hlsClaimID, hlsSdHash, v.Encode())
+	rec := e.requestFrom(t, http.MethodGet, signed, ip)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// Signatures stand in for resolving the stream only, bans and pattern rules still apply.
+	origPath := firewall.BlacklistPath
+	firewall.BlacklistPath = filepath.Join(t.TempDir(), "blacklist.json")
+	ban, err := firewall.AddBan(firewall.Ban{IP: ip, Reason: "scraping"})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = firewall.RemoveBan(ban)
+		firewall.BlacklistPath = origPath
+	})
+	rec = e.requestFrom(t, http.MethodGet, signed, ip)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	_, err = firewall.RemoveBan(ban)
+	require.NoError(t, err)
+
+	_, err = firewall.AddPatternRule(firewall.PatternRule{Name: "test-sd-hash", Field: firewall.FieldSDHash, Glob: hlsSdHash})
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = firewall.RemovePatternRule("test-sd-hash") })
+	rec = e.requestFrom(t, http.MethodGet, signed, ip)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func Test_signPlaylist(t *testing.T) {
+	sig := url.Values{"sig": {"x"}}
+	in := "#EXTM3U\r\n#EXT-X-MEDIA:TYPE=AUDIO,URI=\"a/0.m3u8\"\r\nv0.m3u8?x=1\r\nhttps://cdn.example/v1.m3u8\r\n"
+	assert.Equal(t,
+		"#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,URI=\"a/0.m3u8?sig=x\"\nv0.m3u8?sig=x&x=1\nhttps://cdn.example/v1.m3u8\n",
+		string(signPlaylist([]byte(in), sig)),
+	)
+}
+
+func TestHLSSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	require.NoError(t, catalog.Write(path, []catalog.Entry{
+		{ClaimID: hlsClaimID, Name: "hls-video", SdHash: hlsSdHash, ContentType: "video/mp4", Size: 1000},
+	}))
+	c, err := catalog.Load(path)
+	require.NoError(t, err)
+	tc := transcodertest.New()
+	tc.AddHLSStream(hlsSdHash, 3, false)
+	s := hlssession.New(tc, hlssession.Opts{Lookahead: 1})
+	s.Start()
+	t.Cleanup(s.Shutdown)
+
+	p := NewPlayer(nil, WithCatalog(c))
+	p.AddTranscoderClient(tc, "")
+	p.AddHLSSessions(s)
+	r := gin.New()
+	InstallPlayerRoutes(r, p)
+	e := &hlsEnv{router: r, tc: tc}
+	ip := "203.0.113.9"
+	base := fmt.Sprintf("/v6/streams/%v/%v/", hlsClaimID, hlsSdHash)
+
+	rec := e.requestFrom(t, http.MethodGet, base+"v0_s000000.ts", ip)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Eventually(t, func() bool {
+		for _, f := range tc.Played() {
+			if f == hlsSdHash+"/v0_s000001.ts" {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond, "next segment is prefetched")
+
+	// Viewers behind the same address are told apart by the credentials they present.
+	withToken := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, base+"v0_s000001.ts", nil)
+		req.Header.Set(edgeTokenHeader, edgeTokenPrefix+"token")
+		req.RemoteAddr = net.JoinHostPort(ip, "1234")
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	require.Equal(t, http.StatusOK, withToken("203.0.113.11").Code)
+
+	// The stream is gone, but the access decision is carried over for the viewer that passed the checks.
+	require.NoError(t, catalog.Write(path, nil))
+	require.NoError(t, c.Reload())
+	rec = e.requestFrom(t, http.MethodGet, base+"v0_s000001.ts", ip)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, fmt.Sprintf("segment-%v-1", hlsSdHash), rec.Body.String())
+	rec = e.requestFrom(t, http.MethodGet, base+"v0_s000001.ts", "203.0.113.10")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, http.StatusOK, withToken("203.0.113.11").Code)
+	rec = e.requestFrom(t, http.MethodGet, base+"v0_s000001.ts", "203.0.113.11")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "decisions are not carried over to requests without the credentials")
+}
+
+func Test_fragmentCacheResult(t *testing.T) {
+	assert.Equal(t, hlssession.ResultHit, fragmentCacheResult(http.Header{"X-Cache": {"HIT"}}, false))
+	assert.Equal(t, hlssession.ResultMiss, fragmentCacheResult(http.Header{"X-Cache": {"MISS"}}, false))
+	assert.Equal(t, hlssession.ResultPrefetched, fragmentCacheResult(http.Header{"X-Cache": {"HIT"}}, true))
+}
+
+func TestHLSNegotiation(t *testing.T) {
+	e := newHLSEnv(t)
+	start := fmt.Sprintf("/v6/streams/%v/%v.mp4", hlsClaimID, hlsSdHash[:6])
+	playlist := fmt.Sprintf("/v6/streams/%v/%v/master.m3u8", hlsClaimID, hlsSdHash)
+	request := func(method, url, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Origin", "https://odysee.com")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		req.RemoteAddr = fmt.Sprintf("192.0.2.%d:1234", hlsClientIP.Add(1)%250+1)
+		rec := httptest.NewRecorder()
+		e.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request(http.MethodGet, start, "application/vnd.apple.mpegurl")
+	require.Equal(t, http.StatusPermanentRedirect, rec.Code, rec.Body.String())
+	assert.Equal(t, playlist, rec.Header().Get("Location"))
+	assert.Equal(t, "Accept", rec.Header().Get("Vary"))
+	assert.Equal(t,
+		fmt.Sprintf(`<%[1]v?format=mp4>; rel="alternate"; type="video/mp4", <%[1]v?format=hls>; rel="alternate"; type="application/vnd.apple.mpegurl"`, start),
+		rec.Header().Get("Link"),
+	)
+
+	rec = request(http.MethodGet, start+"?format=hls", "video/mp4")
+	assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+
+	// The original stream is left to be served when it comes first.
+	stream, err := e.player.ResolveStream(hlsClaimID)
+	require.NoError(t, err)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodHead, start, nil)
+	h := NewRequestHandler(e.player)
+	assert.False(t, h.serveNegotiated(c, stream, []string{formatMP4, formatHLS}, "192.0.2.1", false))
+	assert.True(t, h.serveNegotiated(c, stream, []string{formatDASH, formatHLS, formatMP4}, "192.0.2.1", false))
+	assert.Equal(t, http.StatusPermanentRedirect, c.Writer.Status())
+
+	rec = request(http.MethodGet, start+"?format=dash", "")
+	assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+	rec = request(http.MethodGet, start+"?format=webm", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Without a rendition, clients accepting only HLS or DASH cannot be served.
+	e.tc.AddStream(hlsSdHash, map[string][]byte{})
+	rec = request(http.MethodGet, start, "application/dash+xml, application/vnd.apple.mpegurl;q=0.5")
+	assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+	c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, start, nil)
+	assert.False(t, h.serveNegotiated(c, stream, []string{formatHLS, formatMP4}, "192.0.2.1", false))
+}
+
+func Test_streamFormats(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cases := []struct {
+		method, url, accept string
+		formats             []string
+	}{
+		{http.MethodGet, "/", "", []string{formatMP4}},
+		{http.MethodHead, "/", "", []string{formatHLS, formatMP4}},
+		{http.MethodGet, "/", "text/html,application/xhtml+xml,*/*;q=0.8", []string{formatMP4}},
+		{http.MethodHead, "/", "*/*", []string{formatHLS, formatMP4}},
+		{http.MethodGet, "/", "video/webm,video/ogg,video/*;q=0.9,*/*;q=0.5", []string{formatMP4}},
+		{http.MethodGet, "/", "application/x-mpegURL", []string{formatHLS}},
+		{http.MethodGet, "/", "application/vnd.apple.mpegurl;q=0.8, application/dash+xml", []string{formatDASH, formatHLS}},
+		{http.MethodGet, "/", "application/vnd.apple.mpegurl, */*;q=0.2", []string{formatHLS, formatMP4}},
+		{http.MethodHead, "/", "video/mp4, */*;q=0.2", []string{formatMP4, formatHLS}},
+		{http.MethodGet, "/", "application/vnd.apple.mpegurl;q=0, video/mp4", []string{formatMP4}},
+		{http.MethodGet, "/?format=HLS", "video/mp4", []string{formatHLS}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.method+" "+tc.url+" "+tc.accept, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(tc.method, tc.url, nil)
+			c.Request.Header.Set("Accept", tc.accept)
+			formats, err := streamFormats(c)
+			require.NoError(t, err)
+			assert.Equal(t, tc.formats, formats)
+		})
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/?format=flv", nil)
+	_, err := streamFormats(c)
+	assert.Error(t, err)
+}
@@ -1,7 +1,6 @@
 package player
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -15,23 +14,39 @@ import (
 	"github.com/OdyseeTeam/player-server/firewall"
 	"github.com/OdyseeTeam/player-server/internal/iapi"
 	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/pkg/admission"
 	"github.com/OdyseeTeam/player-server/pkg/app"
+	"github.com/OdyseeTeam/player-server/pkg/audit"
+	"github.com/OdyseeTeam/player-server/pkg/geo"
+	"github.com/OdyseeTeam/player-server/pkg/hlssession"
 	"github.com/OdyseeTeam/player-server/pkg/logger"
+	"github.com/OdyseeTeam/player-server/pkg/paid"
+	"github.com/OdyseeTeam/player-server/pkg/quota"
+	"github.com/OdyseeTeam/player-server/pkg/signedurl"
+	"github.com/OdyseeTeam/player-server/pkg/transcode"
 	tclient "github.com/OdyseeTeam/transcoder/client"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/gin-gonic/gin"
-	"github.com/sirupsen/logrus"
 )
 
 // SpeechPrefix is root level prefix for speech URLs.
 const SpeechPrefix = "/speech/"
 
 const (
-	paramDownload = "download"
-	paramHashHLS  = "hash-hls" // Nested hash parameter for signed hls url to use with StackPath
-	paramClientIP = "ip"       // Nested client IP parameter for hls urls to use with StackPath
-	paramHash77   = "hash77"   // Nested hash parameter for signed url to use with CDN77
+	paramDownload    = "download"
+	paramHashHLS     = "hash-hls"    // Nested hash parameter for signed hls url to use with StackPath
+	paramClientIP    = "ip"          // Nested client IP parameter for hls urls to use with StackPath
+	paramHash77      = "hash77"      // Nested hash parameter for signed url to use with CDN77
+	paramSession     = "session"     // Playback session ID for session-bound paid tokens
+	paramEntitlement = "entitlement" // Rental or purchase entitlement token
+	paramAuthToken   = "auth_token"  // Account token, used to identify accounts for download quotas
+
+	authTokenHeader = "X-Lbry-Auth-Token"
+
+	// Context keys for the resolved stream and the reason a request was rejected.
+	ctxStream = "player_stream"
+	ctxDenial = "player_denial"
 )
 
 var (
@@ -63,34 +78,6 @@ func NewRequestHandler(p *Player) *RequestHandler {
 	return &RequestHandler{p}
 }
 
-var allowedReferrers = map[string]bool{
-	"https://piped.kavin.rocks/": true,
-	"https://piped.video/":       true,
-	"https://www.gstatic.com/":   true,
-	"http://localhost:9090/":     true,
-}
-var allowedTldReferrers = map[string]bool{
-	"odysee.com": true,
-	"odysee.tv":  true,
-}
-var allowedOrigins = map[string]bool{
-	"https://odysee.com":         true,
-	"https://neko.odysee.tv":     true,
-	"https://salt.odysee.tv":     true,
-	"https://kp.odysee.tv":       true,
-	"https://inf.odysee.tv":      true,
-	"https://stashu.odysee.tv":   true,
-	"https://www.gstatic.com":    true,
-	"https://odysee.ap.ngrok.io": true,
-}
-var allowedUserAgents = []string{
-	"LBRY/",
-	"Roku/",
-}
-var allowedSpecialHeaders = map[string]bool{"x-cf-lb-monitor": true}
-
-var allowedXRequestedWith = "com.odysee.app"
-
 // Handle is responsible for all HTTP media delivery via player module.
 func (h *RequestHandler) Handle(c *gin.Context) {
 	addExtraResponseHeaders(c)
@@ -124,98 +111,53 @@ func (h *RequestHandler) Handle(c *gin.Context) {
 		}
 	}
 
-	magicTimestamp, exists := c.GetQuery("magic")
-	magicPass := false
-	if exists && magicTimestamp != "" {
-		unixT, err := strconv.Atoi(magicTimestamp)
-		if err == nil {
-			genesisTime := time.Unix(int64(unixT), 0)
-			if time.Since(genesisTime) < 5*time.Minute {
-				magicPass = true
-			}
-		}
-	}
-
-	flagged := true
-	for header, v := range c.Request.Header {
-		hasHeaderToCheck := header != "User-Agent" && header != "Referer" && header != "Origin" && header != "X-Requested-With"
-		if hasHeaderToCheck && !allowedSpecialHeaders[strings.ToLower(header)] {
-			continue
-		}
-		if strings.ToLower(header) == "origin" && allowedOrigins[v[0]] {
-			flagged = false
-			break
-		}
-		if strings.ToLower(header) == "referer" {
-			if allowedReferrers[v[0]] {
-				flagged = false
-				break
-			}
-			//check if the referrer is from an allowed tld (weak check)
-			for tld := range allowedTldReferrers {
-				if strings.Contains(v[0], tld) {
-					flagged = false
-					break
-				}
-			}
-		}
-
-		if strings.ToLower(header) == "user-agent" {
-			for _, ua := range allowedUserAgents {
-				if strings.HasPrefix(v[0], ua) {
-					flagged = false
-					break
-				}
-			}
-		}
-		if allowedSpecialHeaders[strings.ToLower(header)] {
-			flagged = false
-			break
-		}
-		if strings.ToLower(header) == "x-requested-with" && v[0] == allowedXRequestedWith {
-			flagged = false
-			break
-		}
-	}
-	//if the request is flagged and the magic pass is not set then we will not serve the request
-	//with an exception for /v3/ endpoints for now
-	flagged = !magicPass && flagged && !strings.HasPrefix(c.Request.URL.String(), "/api/v3/")
-
 	//this is here temporarily due to abuse. a better solution will be found
 	ip := c.ClientIP()
-	if firewall.CheckBans(ip) {
+	defer auditDenial(c, ip)
+	if ban, banned := firewall.FindBan(ip); banned {
+		deny(c, audit.ReasonBanned, ban.Reason)
 		c.AbortWithStatus(http.StatusTooManyRequests)
 		return
 	}
+	defer reportClientError(c, ip)
 
-	if strings.Contains(c.Request.URL.String(), "Katmovie18") {
+	decision := h.player.options.admission.Evaluate(c.Request)
+	if decision.Action == admission.Deny {
+		firewall.Escalations.Report(ip, firewall.SignalFlaggedReferrer)
+		deny(c, audit.ReasonAdmission, decision.Rule)
 		c.String(http.StatusForbidden, "this content cannot be accessed")
 		return
 	}
+	//flagged requests are only served if they carry a valid signature
+	flagged := decision.Action == admission.Flag
+
+	if rejectPatterns(c, firewall.PatternInput{Path: c.Request.URL.Path, URI: c.Request.URL.String(), ClaimName: c.Param("claim_name")}) {
+		return
+	}
 	//end of abuse block
 
-	blocked, err := iapi.GetBlockedContent()
-	if err == nil {
-		if blocked[c.Param("claim_id")] {
-			c.String(http.StatusForbidden, "this content cannot be accessed")
-			return
-		}
+	if iapi.IsBlocked(c.Param("claim_id")) {
+		deny(c, audit.ReasonBlockedContent, "")
+		c.String(http.StatusForbidden, "this content cannot be accessed")
+		return
 	}
 	isDownload, _ := strconv.ParseBool(c.Query(paramDownload))
 
-	if isDownload {
-		// log all headers for download requests
-		//encode headers in a json string
-		headers, err := json.MarshalIndent(c.Request.Header, "", "  ")
-		if err == nil {
-			logrus.Infof("download request for %s with IP %s and headers: %+v", uri, ip, string(headers))
-		}
-	}
-	//don't allow downloads if either flagged or disabled
-	if isDownload && (!h.player.options.downloadsEnabled || flagged) {
+	if isDownload && !h.player.options.downloadsEnabled {
 		c.String(http.StatusForbidden, "downloads are currently disabled")
 		return
 	}
+	// v6 streams are served in the format negotiated with the client.
+	var formats []string
+	if reV6StartEndpoint.MatchString(c.FullPath()) {
+		c.Header("Vary", "Accept")
+		f, err := streamFormats(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		formats = f
+	}
 
 	stream, err := h.player.ResolveStream(uri)
 	addBreadcrumb(c.Request, "sdk", fmt.Sprintf("resolve %v", uri))
@@ -228,20 +170,48 @@ func (h *RequestHandler) Handle(c *gin.Context) {
 	if hasValidChannel {
 		channelClaimId = &stream.Claim.SigningChannel.ClaimID
 	}
+	c.Set(ctxStream, stream)
 	if firewall.IsStreamBlocked(uri, channelClaimId) {
+		deny(c, audit.ReasonBlockedContent, "")
 		c.String(http.StatusForbidden, "this content cannot be accessed")
 		return
 	}
+	if rejectPatterns(c, streamPatternInput(c, stream)) {
+		return
+	}
+	if err := h.player.VerifyRegion(stream, ip); err != nil {
+		processStreamError("geo", c, uri, err)
+		return
+	}
 
-	abusiveIP, abuseCount := firewall.CheckAndRateLimitIp(ip, stream.ClaimID)
-	if abusiveIP {
-		Logger.Warnf("IP %s is abusing resources (count: %d): %s - %s", ip, abuseCount, stream.ClaimID, stream.Claim.Name)
-		if abuseCount > 10 {
-			c.String(http.StatusTooManyRequests, "Try again later")
+	if h.player.options.urlSigner != nil {
+		signed, err := h.player.options.urlSigner.Verify(c.Request.URL.Query(), stream.ClaimID, stream.hash, ip)
+		if err == nil {
+			flagged = false
+			if isDownload && !signed.Allows(signedurl.OpDownload) {
+				deny(c, audit.ReasonSignature, "download not allowed")
+				c.String(http.StatusForbidden, "downloads are not allowed by this link")
+				return
+			}
+		} else if !errors.Is(err, signedurl.ErrNotSigned) {
+			processStreamError(audit.ReasonSignature, c, uri, err)
 			return
 		}
 	}
-	if isDownload && abuseCount > 2 {
+	//don't allow downloads if flagged
+	if isDownload && flagged {
+		firewall.Escalations.Report(ip, firewall.SignalFlaggedReferrer)
+		deny(c, audit.ReasonFlagged, "download")
+		c.String(http.StatusForbidden, "downloads are currently disabled")
+		return
+	}
+
+	limit := firewall.RateLimiter.Allow(firewall.Request{IP: ip, ClaimID: stream.ClaimID, Download: isDownload})
+	limit.SetHeaders(c.Writer.Header())
+	if !limit.Allowed {
+		Logger.Warnf("IP %s exceeded %s rate limit: %s - %s", ip, limit.Limit, stream.ClaimID, stream.Claim.Name)
+		reportRateLimited(ip, limit)
+		deny(c, audit.ReasonRateLimited, limit.Limit)
 		c.String(http.StatusTooManyRequests, "Try again later")
 		return
 	}
@@ -252,18 +222,28 @@ func (h *RequestHandler) Handle(c *gin.Context) {
 		return
 	}
 	if flagged && !isSpeech {
+		firewall.Escalations.Report(ip, firewall.SignalFlaggedReferrer)
+		deny(c, audit.ReasonFlagged, decision.Rule)
 		c.String(http.StatusUnauthorized, "this content cannot be accessed at the moment")
 		return
 	}
 
-	if !isDownload && fitForTranscoder(c, stream) && h.player.tclient != nil {
-		tcPath := h.player.tclient.GetPlaybackPath(c.Param("claim_id"), stream.hash)
-		if tcPath != "" {
-			metrics.StreamsDelivered.WithLabelValues(metrics.StreamTranscoded).Inc()
-			c.Redirect(
-				http.StatusPermanentRedirect,
-				getPlaylistURL(c.Request.URL.Path, c.Request.URL.Query(), tcPath, stream),
-			)
+	var download *quota.Download
+	if isDownload && c.Request.Method == http.MethodGet && h.player.options.downloadQuota != nil {
+		download = newDownload(c, ip, stream)
+		if err := h.player.options.downloadQuota.Admit(*download); err != nil {
+			processStreamError("quota", c, uri, err)
+			return
+		}
+	}
+
+	if formats != nil {
+		h.addAlternateLinks(c, stream)
+		if h.serveNegotiated(c, stream, formats, ip, isDownload) {
+			return
+		}
+	} else if !isDownload && fitForTranscoder(c, stream) && h.player.tclient != nil {
+		if h.redirectToPlaylist(c, stream, ip) {
 			return
 		}
 	}
@@ -295,6 +275,13 @@ func (h *RequestHandler) Handle(c *gin.Context) {
 	case http.MethodGet:
 		addBreadcrumb(c.Request, "player", fmt.Sprintf("play %v", uri))
 		err = h.player.Play(stream, c)
+		firewall.RateLimiter.RecordBytes(ip, int64(c.Writer.Size()))
+		if !isDownload && strings.HasPrefix(stream.ContentType, "video/") {
+			transcode.RecordServed(false, int64(c.Writer.Size()))
+		}
+		if download != nil {
+			h.player.options.downloadQuota.Record(*download, int64(c.Writer.Size()))
+		}
 		if err != nil {
 			processStreamError("playback", c, uri, err)
 			return
@@ -302,38 +289,329 @@ func (h *RequestHandler) Handle(c *gin.Context) {
 	}
 }
 
+// HandleTranscodedFragment serves playlists and segments of transcoded streams. Requests carrying a valid
+// rendition signature skip resolving the stream, unsigned ones go through the same checks as original streams.
+// Checks that don't need the stream resolved are run for every request.
 func (h *RequestHandler) HandleTranscodedFragment(c *gin.Context) {
 	uri := c.Param("claim_id")
+	sdHash := c.Param("sd_hash")
+	fragment := c.Param("fragment")
 	addExtraResponseHeaders(c)
 	metrics.StreamsRunning.WithLabelValues(metrics.StreamTranscoded).Inc()
 	defer metrics.StreamsRunning.WithLabelValues(metrics.StreamTranscoded).Dec()
+	ip := c.ClientIP()
+	defer auditDenial(c, ip)
+
+	if ban, banned := firewall.FindBan(ip); banned {
+		deny(c, audit.ReasonBanned, ban.Reason)
+		c.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+	if rejectPatterns(c, firewall.PatternInput{Path: c.Request.URL.Path, URI: c.Request.URL.String(), SDHash: sdHash}) {
+		return
+	}
+	if iapi.IsBlocked(uri) {
+		deny(c, audit.ReasonBlockedContent, "")
+		c.String(http.StatusForbidden, "this content cannot be accessed")
+		return
+	}
+
+	signed, err := h.player.verifyHLS(c.Request.URL.Query(), uri, sdHash, ip)
+	if err != nil {
+		processStreamError(audit.ReasonSignature, c, uri, err)
+		return
+	}
+	session := hlssession.Key{Client: ip, ClaimID: uri, SdHash: sdHash, Credentials: hlsCredentials(c)}
+	sessions := h.player.hlsSessions
+	// Viewers that passed all checks recently don't have to go through them again.
+	var channelID string
+	authorized := signed != nil
+	if authorized {
+		channelID = signed.ChannelID
+	} else if sessions != nil {
+		channelID, authorized = sessions.Allowed(session)
+	}
+	claimID := uri
+	if authorized {
+		if !h.recheckFragment(c, uri, channelID, ip) {
+			return
+		}
+	} else {
+		stream, ok := h.authorizeFragment(c, uri, sdHash, ip)
+		if !ok {
+			return
+		}
+		claimID = stream.ClaimID
+		channelID = streamChannelID(stream)
+	}
+	limit := firewall.RateLimiter.Allow(firewall.Request{IP: ip, ClaimID: claimID})
+	limit.SetHeaders(c.Writer.Header())
+	if !limit.Allowed {
+		reportRateLimited(ip, limit)
+		deny(c, audit.ReasonRateLimited, limit.Limit)
+		c.String(http.StatusTooManyRequests, "Try again later")
+		return
+	}
+	if !authorized {
+		if err := h.player.VerifyAccess(c.MustGet(ctxStream).(*Stream), c); err != nil {
+			processStreamError("access", c, uri, err)
+			return
+		}
+		if sessions != nil {
+			sessions.Allow(session, channelID)
+		}
+	}
+
+	var size int64
+	sig, err := h.player.signHLS(uri, sdHash, channelID, ip)
+	if err != nil {
+		Logger.Warnf("cannot sign playlist for %v: %v", ip, err)
+	}
+	w := &ttfbWriter{ResponseWriter: c.Writer, start: time.Now()}
+	c.Writer = w
+	if isPlaylist(fragment) && sig != nil {
+		size, err = h.servePlaylist(c, uri, sdHash, fragment, sig)
+	} else {
+		size, err = h.player.tclient.PlayFragment(uri, sdHash, fragment, c.Writer, c.Request)
+	}
+	if err != nil {
+		processStreamError("transcoder", c, uri, err, "sd_hash", sdHash, "fragment", fragment)
+		return
+	}
+	var prefetched bool
+	if sessions != nil {
+		prefetched = sessions.Played(uri, sdHash, fragment)
+	}
+	if c.Request.Method == http.MethodGet {
+		result := fragmentCacheResult(c.Writer.Header(), prefetched)
+		metrics.TcFragmentCache.WithLabelValues(result).Inc()
+		if !w.firstByte.IsZero() {
+			metrics.TcFragmentTTFB.WithLabelValues(result).Observe(w.firstByte.Sub(w.start).Seconds())
+		}
+	}
+	firewall.RateLimiter.RecordBytes(ip, size)
+	metrics.TcOutBytes.Add(float64(size))
+	transcode.RecordServed(true, size)
+}
+
+// fragmentCacheResult tells if a fragment was served from the local transcoder cache, as reported by its x-cache header.
+func fragmentCacheResult(h http.Header, prefetched bool) string {
+	switch {
+	case prefetched:
+		return hlssession.ResultPrefetched
+	case strings.EqualFold(h.Get("x-cache"), "HIT"):
+		return hlssession.ResultHit
+	default:
+		return hlssession.ResultMiss
+	}
+}
+
+// ttfbWriter notes when the first byte of the response body is written.
+type ttfbWriter struct {
+	gin.ResponseWriter
+	start, firstByte time.Time
+}
+
+func (w *ttfbWriter) Write(b []byte) (int, error) {
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *ttfbWriter) WriteString(s string) (int, error) {
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+	return w.ResponseWriter.WriteString(s)
+}
 
+// recheckFragment repeats the checks of a fragment request authorized by a signature or an earlier request
+// that can be run without resolving the stream, so blocks, pattern rules and region policies take effect
+// before the authorization expires. The response is written if the fragment cannot be served.
+func (h *RequestHandler) recheckFragment(c *gin.Context, uri, channelID, ip string) bool {
+	if channelID != "" && firewall.IsStreamBlocked(uri, &channelID) {
+		deny(c, audit.ReasonBlockedContent, "")
+		c.String(http.StatusForbidden, "this content cannot be accessed")
+		return false
+	}
+	var err error
+	if stream, ok := h.player.cachedStream(uri); ok {
+		if rejectPatterns(c, streamPatternInput(c, stream)) {
+			return false
+		}
+		err = h.player.VerifyRegion(stream, ip)
+	} else {
+		// Policies matching claim tags can only be applied once the stream is resolved again.
+		_, err = h.player.verifyContentRegion(geo.Content{ClaimID: uri, ChannelID: channelID}, ip)
+	}
+	if err != nil {
+		processStreamError("geo", c, uri, err)
+		return false
+	}
+	return true
+}
+
+// streamChannelID returns the ID of the channel that signed the stream claim, if any.
+func streamChannelID(s *Stream) string {
+	if s.Claim.SigningChannel == nil {
+		return ""
+	}
+	return s.Claim.SigningChannel.ClaimID
+}
+
+// authorizeFragment resolves the stream a fragment belongs to and checks if it can be served to the client.
+// The response is written if it cannot.
+func (h *RequestHandler) authorizeFragment(c *gin.Context, uri, sdHash, ip string) (*Stream, bool) {
 	stream, err := h.player.ResolveStream(uri)
 	addBreadcrumb(c.Request, "sdk", fmt.Sprintf("resolve %v", uri))
 	if err != nil {
 		processStreamError("resolve", c, uri, err)
-		return
+		return nil, false
 	}
 	hasValidChannel := stream.Claim.SigningChannel != nil && stream.Claim.SigningChannel.ClaimID != ""
 	var channelClaimId *string
 	if hasValidChannel {
 		channelClaimId = &stream.Claim.SigningChannel.ClaimID
 	}
+	c.Set(ctxStream, stream)
 	if firewall.IsStreamBlocked(uri, channelClaimId) {
+		deny(c, audit.ReasonBlockedContent, "")
 		c.String(http.StatusForbidden, "this content cannot be accessed")
-		return
+		return nil, false
 	}
-	err = h.player.VerifyAccess(stream, c)
-	if err != nil {
-		processStreamError("access", c, uri, err)
-		return
+	if rejectPatterns(c, streamPatternInput(c, stream)) {
+		return nil, false
+	}
+	// Signatures are bound to the sd hash, so it must not be possible to obtain one for a stream the claim doesn't have.
+	if h.player.options.urlSigner != nil && stream.hash != sdHash {
+		processStreamError("resolve", c, uri, fmt.Errorf("%w: sd hash %v does not belong to it", ErrClaimNotFound, sdHash))
+		return nil, false
 	}
-	size, err := h.player.tclient.PlayFragment(uri, c.Param("sd_hash"), c.Param("fragment"), c.Writer, c.Request)
+	if err := h.player.VerifyRegion(stream, ip); err != nil {
+		processStreamError("geo", c, uri, err)
+		return nil, false
+	}
+	return stream, true
+}
+
+// redirectToPlaylist redirects to the master playlist of the transcoded stream, reporting whether it has one.
+// Until the transcoder cache is restored, the original stream is served instead.
+func (h *RequestHandler) redirectToPlaylist(c *gin.Context, stream *Stream, ip string) bool {
+	if h.player.restoringTranscoderCache() {
+		metrics.TcRestoreFallbacks.Inc()
+		return false
+	}
+	tcPath := h.player.tclient.GetPlaybackPath(c.Param("claim_id"), stream.hash)
+	if tcPath == "" {
+		if h.player.options.transcodeTrigger != nil && playStart(c.Request) {
+			h.player.options.transcodeTrigger.RecordPlay(stream.URI(), stream.hash)
+		}
+		return false
+	}
+	sig, err := h.player.signHLS(c.Param("claim_id"), stream.hash, streamChannelID(stream), ip)
 	if err != nil {
-		processStreamError("transcoder", c, uri, err, "sd_hash", c.Param("sd_hash"), "fragment", c.Param("fragment"))
-		return
+		Logger.Warnf("cannot sign playlist for %v: %v", ip, err)
+	}
+	metrics.StreamsDelivered.WithLabelValues(metrics.StreamTranscoded).Inc()
+	c.Redirect(
+		http.StatusPermanentRedirect,
+		getPlaylistURL(c.Request.URL.Path, c.Request.URL.Query(), tcPath, stream, sig),
+	)
+	return true
+}
+
+// serveNegotiated responds with the first of formats available for the stream, reporting whether it did.
+// The original stream is left for the caller to serve, as it also is for HLS requests while
+// the transcoder cache is being restored.
+func (h *RequestHandler) serveNegotiated(c *gin.Context, stream *Stream, formats []string, ip string, isDownload bool) bool {
+	for _, f := range formats {
+		switch f {
+		case formatMP4:
+			return false
+		case formatHLS:
+			if isDownload || h.player.tclient == nil || !strings.HasPrefix(stream.ContentType, "video/") {
+				continue
+			}
+			if h.redirectToPlaylist(c, stream, ip) {
+				return true
+			}
+			// Renditions can't be looked up until the transcoder cache is restored,
+			// so the original stream stands in for them even for clients accepting HLS only.
+			if h.player.restoringTranscoderCache() {
+				return false
+			}
+		}
+	}
+	c.String(http.StatusNotAcceptable, "none of the requested formats (%v) is available", strings.Join(formats, ", "))
+	return true
+}
+
+// newDownload describes a download request for quota purposes. Whether it counts as a new file
+// is up to the quota, which counts each claim once a day.
+func newDownload(c *gin.Context, ip string, stream *Stream) *quota.Download {
+	d := &quota.Download{
+		IP:      ip,
+		Account: c.GetHeader(authTokenHeader),
+		ClaimID: stream.ClaimID,
+		Tags:    stream.Claim.Value.Tags,
+	}
+	if d.Account == "" {
+		d.Account = c.Query(paramAuthToken)
+	}
+	if stream.Claim.SigningChannel != nil {
+		d.ChannelID = stream.Claim.SigningChannel.ClaimID
+	}
+	return d
+}
+
+// playStart checks if the request starts playback from the beginning of the stream, as opposed to
+// seeks and buffering requests of a play already under way, so each play is only counted once.
+func playStart(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	rng := r.Header.Get("Range")
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
+
+// streamPatternInput collects request and claim fields pattern rules are matched against.
+func streamPatternInput(c *gin.Context, s *Stream) firewall.PatternInput {
+	in := firewall.PatternInput{Path: c.Request.URL.Path, URI: c.Request.URL.String(), ClaimName: s.Claim.Name, SDHash: s.hash}
+	if s.Claim.SigningChannel != nil {
+		in.ChannelName = s.Claim.SigningChannel.Name
+	}
+	return in
+}
+
+// rejectPatterns responds with the status of the first pattern rule matching in, reporting whether one did.
+func rejectPatterns(c *gin.Context, in firewall.PatternInput) bool {
+	rule, ok := firewall.MatchPatterns(in)
+	if !ok {
+		return false
+	}
+	Logger.Infof("request %v blocked by pattern rule %v: %v", c.Request.URL.Path, rule.Name, rule.Reason)
+	deny(c, audit.ReasonPattern, rule.Name)
+	c.String(rule.Status, "this content cannot be accessed")
+	return true
+}
+
+// reportRateLimited reports a request denied by the rate limiter to the escalation engine.
+func reportRateLimited(ip string, limit firewall.Decision) {
+	if limit.Limit == firewall.LimitDownloads {
+		firewall.Escalations.Report(ip, firewall.SignalDownloadAbuse)
+	} else {
+		firewall.Escalations.Report(ip, firewall.SignalRateLimited)
+	}
+}
+
+// reportClientError reports authentication failures to the escalation engine so storms of them lead to bans.
+// Other client errors such as 404s and 416s are common for legitimate players and are not reported.
+func reportClientError(c *gin.Context, ip string) {
+	status := c.Writer.Status()
+	if status == http.StatusUnauthorized || status == http.StatusForbidden {
+		firewall.Escalations.Report(ip, firewall.SignalClientError)
 	}
-	metrics.TcOutBytes.Add(float64(size))
 }
 
 func writeHeaders(c *gin.Context, s *Stream) {
@@ -341,7 +619,11 @@ func writeHeaders(c *gin.Context, s *Stream) {
 	c.Header("Content-Type", s.ContentType)
 	c.Header("Last-Modified", s.Timestamp().UTC().Format(http.TimeFormat))
 	if c.Request.Method != http.MethodHead {
-		c.Header("Cache-Control", "public, max-age=31536000")
+		if s.geoRestricted {
+			c.Header("Cache-Control", "private, max-age=31536000")
+		} else {
+			c.Header("Cache-Control", "public, max-age=31536000")
+		}
 	}
 
 	isDownload, _ := strconv.ParseBool(c.Query(paramDownload))
@@ -365,12 +647,45 @@ func processStreamError(errorType string, gctx *gin.Context, uri string, err err
 
 	Logger.Errorf("%s stream %v - %s error: %v", gctx.Request.Method, uri, errorType, err)
 
-	if errors.Is(err, ErrPaidStream) {
+	var scheduled *ScheduledReleaseError
+	if errors.As(err, &scheduled) {
+		// Viewers waiting for a premiere poll the stream, which must not count as a client error or a denial.
+		w.Header().Set("Retry-After", strconv.Itoa(scheduled.RetryAfter()))
+		w.Header().Set("Cache-Control", "no-store")
+		writeErrorResponse(w, http.StatusTooEarly, err.Error())
+	} else if errors.Is(err, quota.ErrQuotaExceeded) {
+		var exceeded *quota.ExceededError
+		if errors.As(err, &exceeded) {
+			w.Header().Set("Retry-After", strconv.Itoa(exceeded.RetryAfter()))
+		}
+		writeErrorResponse(w, http.StatusTooManyRequests, err.Error())
+	} else if errors.Is(err, quota.ErrDownloadDisabled) {
+		writeErrorResponse(w, http.StatusForbidden, err.Error())
+	} else if errors.Is(err, geo.ErrRestricted) {
+		w.Header().Set("Cache-Control", "private, no-store")
+		writeErrorResponse(w, http.StatusUnavailableForLegalReasons, err.Error())
+	} else if errors.Is(err, ErrPaidStream) {
 		writeErrorResponse(w, http.StatusPaymentRequired, err.Error())
 	} else if errors.Is(err, ErrClaimNotFound) {
 		writeErrorResponse(w, http.StatusNotFound, err.Error())
-	} else if errors.Is(err, ErrEdgeCredentialsMissing) {
+	} else if errors.Is(err, ErrEdgeCredentialsMissing) || errors.Is(err, ErrEdgeAuthenticationFailed) {
+		writeErrorResponse(w, http.StatusUnauthorized, err.Error())
+	} else if errors.Is(err, paid.ErrUnknownKeyID) || errors.Is(err, paid.ErrUnsupportedSigningMethod) {
 		writeErrorResponse(w, http.StatusUnauthorized, err.Error())
+	} else if errors.Is(err, paid.ErrEntitlementRequired) {
+		writeErrorResponse(w, http.StatusPaymentRequired, err.Error())
+	} else if errors.Is(err, paid.ErrRentalExpired) {
+		writeErrorResponse(w, http.StatusGone, err.Error())
+	} else if errors.Is(err, paid.ErrEntitlementMismatch) {
+		writeErrorResponse(w, http.StatusForbidden, err.Error())
+	} else if errors.Is(err, paid.ErrClientMismatch) || errors.Is(err, paid.ErrSessionMismatch) {
+		writeErrorResponse(w, http.StatusForbidden, err.Error())
+	} else if errors.Is(err, paid.ErrTooManyStreams) {
+		writeErrorResponse(w, http.StatusTooManyRequests, err.Error())
+	} else if errors.Is(err, signedurl.ErrExpired) {
+		writeErrorResponse(w, http.StatusGone, err.Error())
+	} else if errorType == audit.ReasonSignature {
+		writeErrorResponse(w, http.StatusForbidden, err.Error())
 	} else if strings.Contains(err.Error(), "blob not found") {
 		writeErrorResponse(w, http.StatusServiceUnavailable, err.Error())
 	} else if strings.Contains(err.Error(), "hash in response does not match") {
@@ -392,6 +707,56 @@ func processStreamError(errorType string, gctx *gin.Context, uri string, err err
 		logger.SendToSentry(err, req, "error_type", errorType)
 		writeErrorResponse(w, http.StatusInternalServerError, err.Error())
 	}
+	if isDenial(w.Status()) {
+		deny(gctx, errorType, err.Error())
+	}
+}
+
+// isDenial checks if status rejects the client, as opposed to missing content or failures.
+func isDenial(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusUnavailableForLegalReasons:
+		return true
+	}
+	return false
+}
+
+// deny notes why the request is rejected, the audit event is recorded by auditDenial once the response is written.
+func deny(c *gin.Context, reason, rule string) {
+	c.Set(ctxDenial, denial{reason: reason, rule: rule})
+}
+
+type denial struct {
+	reason, rule string
+}
+
+// auditDenial records an audit event for requests rejected with deny.
+func auditDenial(c *gin.Context, ip string) {
+	v, ok := c.Get(ctxDenial)
+	if !ok || c.Writer.Status() < http.StatusBadRequest {
+		return
+	}
+	d := v.(denial)
+	e := audit.Event{
+		IP:        ip,
+		ClaimID:   c.Param("claim_id"),
+		Reason:    d.reason,
+		Rule:      d.rule,
+		Endpoint:  c.FullPath(),
+		Path:      c.Request.URL.Path,
+		Method:    c.Request.Method,
+		Status:    c.Writer.Status(),
+		Referrer:  c.Request.Referer(),
+		UserAgent: c.Request.UserAgent(),
+	}
+	if v, ok := c.Get(ctxStream); ok {
+		s := v.(*Stream)
+		e.ClaimID, e.ClaimName = s.ClaimID, s.Claim.Name
+		if s.Claim.SigningChannel != nil {
+			e.ChannelID, e.Channel = s.Claim.SigningChannel.ClaimID, s.Claim.SigningChannel.Name
+		}
+	}
+	audit.Record(e)
 }
 
 func writeErrorResponse(w http.ResponseWriter, statusCode int, msg string) {
@@ -415,26 +780,39 @@ func addExtraResponseHeaders(c *gin.Context) {
 	c.Header("X-Powered-By", playerName)
 }
 
-func getPlaylistURL(fullPath string, query url.Values, tcPath string, stream *Stream) string {
+// getPlaylistURL returns the master playlist URL of a transcoded stream for the endpoint family of fullPath.
+// CDN hash parameters of the request are carried over and sig, if present, is added to the query.
+func getPlaylistURL(fullPath string, query url.Values, tcPath string, stream *Stream, sig url.Values) string {
+	var path, qs string
 	if strings.HasPrefix(fullPath, "/v5/streams/start/") {
-		qs := ""
+		path = fmt.Sprintf("/v5/streams/hls/%s", tcPath)
 		if query.Get(paramHashHLS) != "" {
-			qs = fmt.Sprintf("?ip=%s&hash=%s", query.Get(paramClientIP), query.Get(paramHashHLS))
+			qs = fmt.Sprintf("ip=%s&hash=%s", query.Get(paramClientIP), query.Get(paramHashHLS))
 		}
-		return fmt.Sprintf("/v5/streams/hls/%s%s", tcPath, qs)
 	} else if strings.HasPrefix(fullPath, "/v6/streams/") {
-		path := fmt.Sprintf("/v6/streams/%s", tcPath)
+		path = fmt.Sprintf("/v6/streams/%s", tcPath)
 		h := query.Get(paramHash77)
 		if h != "" {
 			path = "/" + h + path
 		}
-		return path
+	} else {
+		path = fmt.Sprintf("/api/v4/streams/tc/%s/%s", stream.URL, tcPath)
+	}
+	// The signature is appended so parameters CDNs validate keep their order and encoding.
+	if len(sig) > 0 {
+		if qs != "" {
+			qs += "&"
+		}
+		qs += sig.Encode()
+	}
+	if qs != "" {
+		path += "?" + qs
 	}
-	return fmt.Sprintf("/api/v4/streams/tc/%s/%s", stream.URL, tcPath)
+	return path
 }
 
 func fitForTranscoder(c *gin.Context, s *Stream) bool {
 	return (strings.HasPrefix(c.FullPath(), "/api/v4/") ||
-		((reV5StartEndpoint.MatchString(c.FullPath()) || reV6StartEndpoint.MatchString(c.FullPath())) && c.Request.Method == http.MethodHead)) &&
+		(reV5StartEndpoint.MatchString(c.FullPath()) && c.Request.Method == http.MethodHead)) &&
 		strings.HasPrefix(s.ContentType, "video/")
 }
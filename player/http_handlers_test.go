@@ -223,7 +223,7 @@ func TestHandleHeadStreamsV2(t *testing.T) {
 	body, _ = io.ReadAll(r.Body)
 	assert.Equal(t, http.StatusGone, r.StatusCode, string(body))
 
-	validToken, err := paid.CreateToken("iOS-13-AdobeXD/9cd2e93bfc752dd6560e43623f36d0c3504dbca6", "000", 120_000_000, paid.ExpTenSecPer100MB)
+	validToken, err := paid.CreateToken("iOS-13-AdobeXD/9cd2e93bfc752dd6560e43623f36d0c3504dbca6", "000", 120_000_000, paid.ExpTenSecPerMB)
 	require.NoError(t, err)
 
 	r = makeRequest(t, nil, http.MethodHead, "/api/v2/streams/paid/iOS-13-AdobeXD/9cd2e93bfc752dd6560e43623f36d0c3504dbca6/"+validToken, nil)
@@ -255,7 +255,7 @@ func TestHandleHeadStreamsV3(t *testing.T) {
 	body, _ = io.ReadAll(r.Body)
 	assert.Equal(t, http.StatusGone, r.StatusCode, string(body))
 
-	validToken, err := paid.CreateToken("iOS-13-AdobeXD/9cd2e93bfc752dd6560e43623f36d0c3504dbca6", "000", 120_000_000, paid.ExpTenSecPer100MB)
+	validToken, err := paid.CreateToken("iOS-13-AdobeXD/9cd2e93bfc752dd6560e43623f36d0c3504dbca6", "000", 120_000_000, paid.ExpTenSecPerMB)
 	require.NoError(t, err)
 
 	r = makeRequest(t, nil, http.MethodHead, "/api/v3/streams/paid/iOS-13-AdobeXD/9cd2e93bfc752dd6560e43623f36d0c3504dbca6/abcdef/"+validToken, nil)
@@ -277,13 +277,13 @@ func Test_getPlaylistURL(t *testing.T) {
 	t.Run("v4", func(t *testing.T) {
 		assert.Equal(t,
 			"/api/v4/streams/tc/lbryStreamURL/claimID/SDhash/master.m3u8",
-			getPlaylistURL("/api/v4/streams/free/lbryStreamURL/claimID/SDhash/", url.Values{}, tcURL, stream),
+			getPlaylistURL("/api/v4/streams/free/lbryStreamURL/claimID/SDhash/", url.Values{}, tcURL, stream, nil),
 		)
 	})
 	t.Run("v5", func(t *testing.T) {
 		assert.Equal(t,
 			"/v5/streams/hls/claimID/SDhash/master.m3u8",
-			getPlaylistURL("/v5/streams/start/claimID/SDhash/", url.Values{}, tcURL, stream),
+			getPlaylistURL("/v5/streams/start/claimID/SDhash/", url.Values{}, tcURL, stream, nil),
 		)
 	})
 	t.Run("v5 signed", func(t *testing.T) {
@@ -294,13 +294,23 @@ func Test_getPlaylistURL(t *testing.T) {
 		q.Add(paramClientIP, ip)
 		assert.Equal(t,
 			fmt.Sprintf("/v5/streams/hls/claimID/SDhash/master.m3u8?ip=%s&hash=%s", ip, h),
-			getPlaylistURL("/v5/streams/start/claimID/SDhash/", q, tcURL, stream),
+			getPlaylistURL("/v5/streams/start/claimID/SDhash/", q, tcURL, stream, nil),
+		)
+	})
+	t.Run("v5 signed with signature", func(t *testing.T) {
+		q := url.Values{}
+		q.Add(paramHashHLS, "a/b+c")
+		q.Add(paramClientIP, "192.0.2.1")
+		sig := url.Values{"exp": {"1700000000"}, "sig": {"abc"}}
+		assert.Equal(t,
+			"/v5/streams/hls/claimID/SDhash/master.m3u8?ip=192.0.2.1&hash=a/b+c&exp=1700000000&sig=abc",
+			getPlaylistURL("/v5/streams/start/claimID/SDhash/", q, tcURL, stream, sig),
 		)
 	})
 	t.Run("v6", func(t *testing.T) {
 		assert.Equal(t,
 			"/v6/streams/claimID/SDhash/master.m3u8",
-			getPlaylistURL("/v6/streams/claimID/SDhash/start", url.Values{}, tcURL, stream),
+			getPlaylistURL("/v6/streams/claimID/SDhash/start", url.Values{}, tcURL, stream, nil),
 		)
 	})
 	t.Run("v6 with hash", func(t *testing.T) {
@@ -309,7 +319,16 @@ func Test_getPlaylistURL(t *testing.T) {
 		q.Add(paramHash77, h)
 		assert.Equal(t,
 			"/abc,89898/v6/streams/claimID/SDhash/master.m3u8",
-			getPlaylistURL("/v6/streams/claimID/SDhash/start", q, tcURL, stream),
+			getPlaylistURL("/v6/streams/claimID/SDhash/start", q, tcURL, stream, nil),
+		)
+	})
+	t.Run("v6 with signature", func(t *testing.T) {
+		q := url.Values{}
+		q.Add(paramHash77, "abc,89898")
+		sig := url.Values{"exp": {"1700000000"}, "sig": {"abc"}}
+		assert.Equal(t,
+			"/abc,89898/v6/streams/claimID/SDhash/master.m3u8?exp=1700000000&sig=abc",
+			getPlaylistURL("/v6/streams/claimID/SDhash/start", q, tcURL, stream, sig),
 		)
 	})
 }
@@ -419,3 +438,24 @@ func Test_fitForTranscoder(t *testing.T) {
 	require.NoError(t, err)
 	assert.False(t, fitForTranscoder(c, s))
 }
+
+func TestPlayStart(t *testing.T) {
+	for rng, expected := range map[string]bool{
+		"":              true,
+		"bytes=0-":      true,
+		"bytes=0-1023":  true,
+		"bytes=1-":      false,
+		"bytes=50000-":  false,
+		"bytes=-500":    false,
+		"bytes=10-20":   false,
+		"bytes=0-1,5-9": true,
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "/v6/streams/x/y.mp4", nil)
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		assert.Equal(t, expected, playStart(r), rng)
+	}
+	r, _ := http.NewRequest(http.MethodHead, "/v6/streams/x/y.mp4", nil)
+	assert.False(t, playStart(r))
+}
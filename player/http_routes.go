@@ -41,7 +41,7 @@ func InstallPlayerRoutes(r *gin.Engine, p *Player) {
 	v6Router.HEAD("/:claim_id/:sd_hash", playerHandler.Handle)
 	v6Router.GET("/:claim_id/:sd_hash", playerHandler.Handle)
 
-	if p.TCVideoPath != "" {
+	if p.tclient != nil {
 		v4Router.GET("/tc/:claim_name/:claim_id/:sd_hash/:fragment", playerHandler.HandleTranscodedFragment)
 		v4Router.HEAD("/tc/:claim_name/:claim_id/:sd_hash/:fragment", playerHandler.HandleTranscodedFragment)
 
@@ -0,0 +1,118 @@
+package player
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Stream formats clients can ask for on v6 endpoints with the Accept header or the format parameter.
+const (
+	paramFormat = "format"
+
+	formatHLS  = "hls"
+	formatDASH = "dash"
+	// formatMP4 is the original stream served progressively, which is usually an MP4 file.
+	formatMP4 = "mp4"
+)
+
+var formatOrder = []string{formatHLS, formatMP4, formatDASH}
+
+// streamFormats returns the formats acceptable to the client in order of preference. An explicit format
+// parameter takes precedence over the Accept header. Without a preference, HEAD requests get the transcoded
+// version if available and GET requests the original stream, as v6 clients have always been served.
+func streamFormats(c *gin.Context) ([]string, error) {
+	defaults := []string{formatMP4}
+	if c.Request.Method == http.MethodHead {
+		defaults = []string{formatHLS, formatMP4}
+	}
+
+	if f := c.Query(paramFormat); f != "" {
+		f = strings.ToLower(f)
+		if slices.Contains(formatOrder, f) {
+			return []string{f}, nil
+		}
+		return nil, fmt.Errorf("unknown format %q, expected one of %v", f, strings.Join(formatOrder, ", "))
+	}
+
+	weights := map[string]float64{}
+	wildcard := 0.0
+	for _, part := range strings.Split(c.GetHeader("Accept"), ",") {
+		mt, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		f := mediaTypeFormat(mt)
+		switch {
+		case f == "":
+		case f == "*":
+			wildcard = max(wildcard, q)
+		default:
+			if w, ok := weights[f]; !ok || q > w {
+				weights[f] = q
+			}
+		}
+	}
+	// Clients not naming any of the formats, like most browsers, get the default behavior.
+	if len(weights) == 0 {
+		return defaults, nil
+	}
+	if wildcard > 0 {
+		for _, f := range defaults {
+			if _, ok := weights[f]; !ok {
+				weights[f] = wildcard
+			}
+		}
+	}
+
+	var formats []string
+	for _, f := range append(defaults, formatOrder...) {
+		if w, ok := weights[f]; ok && w > 0 && !slices.Contains(formats, f) {
+			formats = append(formats, f)
+		}
+	}
+	sort.SliceStable(formats, func(i, j int) bool { return weights[formats[i]] > weights[formats[j]] })
+	return formats, nil
+}
+
+// mediaTypeFormat maps a media range of the Accept header to a stream format, "*" is returned for */*.
+func mediaTypeFormat(mt string) string {
+	switch mt {
+	case "application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl":
+		return formatHLS
+	case "application/dash+xml":
+		return formatDASH
+	case "*/*":
+		return "*"
+	}
+	if strings.HasPrefix(mt, "video/") {
+		return formatMP4
+	}
+	return ""
+}
+
+// addAlternateLinks advertises representations of the stream available with the format parameter.
+func (h *RequestHandler) addAlternateLinks(c *gin.Context, s *Stream) {
+	link := func(format, contentType string) string {
+		q := c.Request.URL.Query()
+		q.Set(paramFormat, format)
+		return fmt.Sprintf(`<%s?%s>; rel="alternate"; type="%s"`, c.Request.URL.Path, q.Encode(), contentType)
+	}
+	links := []string{link(formatMP4, s.ContentType)}
+	if h.player.tclient != nil && strings.HasPrefix(s.ContentType, "video/") {
+		links = append(links, link(formatHLS, "application/vnd.apple.mpegurl"))
+	}
+	c.Header("Link", strings.Join(links, ", "))
+}
@@ -1,15 +1,27 @@
 package player
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"net/http"
 	"regexp"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/OdyseeTeam/player-server/internal/metrics"
+	"github.com/OdyseeTeam/player-server/pkg/admission"
+	"github.com/OdyseeTeam/player-server/pkg/catalog"
+	"github.com/OdyseeTeam/player-server/pkg/edgetoken"
+	"github.com/OdyseeTeam/player-server/pkg/geo"
+	"github.com/OdyseeTeam/player-server/pkg/hlssession"
 	"github.com/OdyseeTeam/player-server/pkg/logger"
 	"github.com/OdyseeTeam/player-server/pkg/paid"
+	"github.com/OdyseeTeam/player-server/pkg/quota"
+	"github.com/OdyseeTeam/player-server/pkg/signedurl"
+	"github.com/OdyseeTeam/player-server/pkg/transcode"
 	"github.com/prometheus/client_golang/prometheus"
 
 	tclient "github.com/OdyseeTeam/transcoder/client"
@@ -32,10 +44,18 @@ var (
 )
 
 type PlayerOptions struct {
-	edgeToken        string
+	edgeTokens       *edgetoken.Set
 	lbrynetAddress   string
 	downloadsEnabled bool
+	downloadQuota    *quota.Quota
 	prefetch         bool
+	catalog          *catalog.Catalog
+	admission        *admission.Gate
+	urlSigner        *signedurl.Keyring
+	hlsSignatureTTL  time.Duration
+	entitlements     bool
+	geo              *geo.Restrictor
+	transcodeTrigger *transcode.Trigger
 }
 
 // Player is an entry-point object to the new player package.
@@ -43,15 +63,34 @@ type Player struct {
 	lbrynetClient *ljsonrpc.Client
 	blobSource    *HotCache
 	resolveCache  gcache.Cache
-	tclient       *tclient.Client
+	tclient       Transcoder
 	TCVideoPath   string
+	hlsSessions   *hlssession.Cache
+	restore       cacheRestore
 
 	options PlayerOptions
 }
 
+// WithEdgeToken sets a single edge token granting access to all scopes.
 func WithEdgeToken(token string) func(options *PlayerOptions) {
 	return func(options *PlayerOptions) {
-		options.edgeToken = token
+		if token == "" {
+			return
+		}
+		tokens, err := edgetoken.NewSet(edgetoken.Legacy(token))
+		if err != nil {
+			// Protected content is not served without tokens, so this must not go unnoticed.
+			Logger.Errorf("invalid edge token, protected streams will be refused: %v", err)
+			return
+		}
+		options.edgeTokens = tokens
+	}
+}
+
+// WithEdgeTokens sets the edge token set used for verifying access to protected streams.
+func WithEdgeTokens(tokens *edgetoken.Set) func(options *PlayerOptions) {
+	return func(options *PlayerOptions) {
+		options.edgeTokens = tokens
 	}
 }
 
@@ -73,16 +112,78 @@ func WithPrefetch(enabled bool) func(options *PlayerOptions) {
 	}
 }
 
+// WithCatalog makes the player resolve streams from a local catalog instead of the SDK.
+func WithCatalog(c *catalog.Catalog) func(options *PlayerOptions) {
+	return func(options *PlayerOptions) {
+		options.catalog = c
+	}
+}
+
+// WithAdmissionGate sets the policy gate that requests are checked against before being served.
+func WithAdmissionGate(g *admission.Gate) func(options *PlayerOptions) {
+	return func(options *PlayerOptions) {
+		options.admission = g
+	}
+}
+
+// WithURLSigner enables verification of signed playback URLs. Requests with a valid signature
+// bypass admission flagging. The keyring also signs segment URLs in playlists of transcoded streams.
+func WithURLSigner(k *signedurl.Keyring) func(options *PlayerOptions) {
+	return func(options *PlayerOptions) {
+		options.urlSigner = k
+	}
+}
+
+// WithHLSSignatureTTL sets how long signed HLS playlist and segment URLs are valid for.
+func WithHLSSignatureTTL(ttl time.Duration) func(options *PlayerOptions) {
+	return func(options *PlayerOptions) {
+		options.hlsSignatureTTL = ttl
+	}
+}
+
+// WithEntitlements enables verifying rental and purchase entitlement tokens in the player itself,
+// so protected paid content can be served without a trusted edge in front.
+func WithEntitlements(enabled bool) func(options *PlayerOptions) {
+	return func(options *PlayerOptions) {
+		options.entitlements = enabled
+	}
+}
+
+// WithDownloadQuota enables daily download quotas per client IP and account.
+func WithDownloadQuota(q *quota.Quota) func(options *PlayerOptions) {
+	return func(options *PlayerOptions) {
+		options.downloadQuota = q
+	}
+}
+
+// WithTranscodeTrigger enables on-demand transcoding of popular streams that have no rendition yet.
+func WithTranscodeTrigger(t *transcode.Trigger) func(options *PlayerOptions) {
+	return func(options *PlayerOptions) {
+		options.transcodeTrigger = t
+	}
+}
+
+// WithGeoRestrictor enables country restrictions for claims and channels.
+func WithGeoRestrictor(r *geo.Restrictor) func(options *PlayerOptions) {
+	return func(options *PlayerOptions) {
+		options.geo = r
+	}
+}
+
 // NewPlayer initializes an instance with optional BlobStore.
 func NewPlayer(hotCache *HotCache, optionFuncs ...func(*PlayerOptions)) *Player {
 	options := &PlayerOptions{
 		lbrynetAddress:   defaultSdkAddress,
 		downloadsEnabled: true,
+		hlsSignatureTTL:  DefaultHLSSignatureTTL,
 	}
 
 	for _, optionFunc := range optionFuncs {
 		optionFunc(options)
 	}
+	if options.admission == nil {
+		options.admission = admission.NewGateWithPolicy(admission.DefaultPolicy())
+	}
 
 	lbrynetClient := ljsonrpc.NewClient(options.lbrynetAddress)
 	lbrynetClient.SetRPCTimeout(10 * time.Second)
@@ -94,11 +195,30 @@ func NewPlayer(hotCache *HotCache, optionFuncs ...func(*PlayerOptions)) *Player
 	}
 }
 
-func (p *Player) AddTranscoderClient(c *tclient.Client, path string) {
+// Transcoder provides HLS renditions of streams. It is implemented by the transcoder client.
+type Transcoder interface {
+	// GetPlaybackPath returns the master playlist path of the rendition, or an empty string if there's none.
+	GetPlaybackPath(lbryURL, sdHash string) string
+	// PlayFragment serves a playlist or a segment of the rendition.
+	PlayFragment(lbryURL, sdHash, fragmentName string, w http.ResponseWriter, r *http.Request) (int64, error)
+	// RestoreCache indexes renditions already on disk, returning their number of files.
+	RestoreCache() (int64, error)
+}
+
+var _ Transcoder = tclient.Client{}
+
+// AddTranscoderClient enables serving renditions from the transcoder, path is where they're cached.
+func (p *Player) AddTranscoderClient(c Transcoder, path string) {
 	p.tclient = c
 	p.TCVideoPath = path
 }
 
+// AddHLSSessions enables carrying access decisions over between fragment requests of the same viewer
+// and prefetching segments of transcoded streams being watched.
+func (p *Player) AddHLSSessions(s *hlssession.Cache) {
+	p.hlsSessions = s
+}
+
 // Play delivers requested URI onto the supplied http.ResponseWriter.
 func (p *Player) Play(s *Stream, c *gin.Context) error {
 	metrics.StreamsRunning.WithLabelValues(metrics.StreamOriginal).Inc()
@@ -114,6 +234,10 @@ func (p *Player) ResolveStream(claimId string) (*Stream, error) {
 		metrics.ResolveTimeMS.Observe(float64(time.Since(t).Milliseconds()))
 	}(start)
 
+	if p.options.catalog != nil {
+		return p.resolveFromCatalog(claimId)
+	}
+
 	var claim *ljsonrpc.Claim
 
 	cachedClaim, cErr := p.resolveCache.Get(claimId)
@@ -161,6 +285,66 @@ func (p *Player) ResolveStream(claimId string) (*Stream, error) {
 	return NewStream(p, claim), nil
 }
 
+// resolveFromCatalog builds a stream out of the local catalog entry, without calling the SDK.
+func (p *Player) resolveFromCatalog(uri string) (*Stream, error) {
+	e, ok := p.options.catalog.Lookup(uri)
+	if !ok {
+		metrics.ResolveFailures.With(prometheus.Labels{
+			metrics.ResolveSource: metrics.ResolveSourceCatalog,
+			metrics.ResolveKind:   metrics.ResolveFailureClaimNotFound,
+		}).Inc()
+		return nil, ErrClaimNotFound
+	}
+	claim, err := e.Claim()
+	if err != nil {
+		metrics.ResolveFailures.With(prometheus.Labels{
+			metrics.ResolveSource: metrics.ResolveSourceCatalog,
+			metrics.ResolveKind:   metrics.ResolveFailureGeneral,
+		}).Inc()
+		return nil, err
+	}
+	metrics.ResolveSuccesses.WithLabelValues(metrics.ResolveSourceCatalog).Inc()
+	return NewStream(p, claim), nil
+}
+
+// cachedStream returns the stream if it can be built without calling the SDK,
+// from the catalog or a claim still in the resolve cache.
+func (p *Player) cachedStream(claimID string) (*Stream, bool) {
+	var claim *ljsonrpc.Claim
+	if p.options.catalog != nil {
+		e, ok := p.options.catalog.Lookup(claimID)
+		if !ok {
+			return nil, false
+		}
+		c, err := e.Claim()
+		if err != nil {
+			return nil, false
+		}
+		claim = c
+	} else {
+		cached, err := p.resolveCache.GetIFPresent(claimID)
+		if err != nil {
+			return nil, false
+		}
+		claim = cached.(*ljsonrpc.Claim)
+	}
+	if claim.Value.GetStream().GetSource() == nil {
+		return nil, false
+	}
+	return NewStream(p, claim), true
+}
+
+// CheckResolver is a readiness check searching the SDK for a claim that doesn't exist,
+// which only succeeds if claims can be resolved. Streams from the catalog don't need the SDK.
+func (p *Player) CheckResolver(ctx context.Context) error {
+	if p.options.catalog != nil {
+		return nil
+	}
+	claimID := strings.Repeat("0", 40)
+	_, err := p.lbrynetClient.ClaimSearch(ljsonrpc.ClaimSearchArgs{ClaimID: &claimID, PageSize: 1, Page: 1})
+	return err
+}
+
 // resolve the claim
 func (p *Player) resolve(claimID string) (*ljsonrpc.Claim, error) {
 	generalFailureLabels := prometheus.Labels{
@@ -219,33 +403,29 @@ func (p *Player) resolve(claimID string) (*ljsonrpc.Claim, error) {
 
 // VerifyAccess checks if the stream is protected and the token supplied matched the stream
 func (p *Player) VerifyAccess(stream *Stream, ctx *gin.Context) error {
-	protectedMap := map[string]bool{
-		"c:members-only": true,
-		"c:rental":       true,
-		"c:purchase":     true,
-		"c:unlisted":     true,
-	}
-	protectedWithTimeMap := map[string]bool{
-		"c:scheduled:show": true,
-		"c:scheduled:hide": true,
-	}
-	for _, t := range stream.Claim.Value.Tags {
-		if protectedMap[t] ||
-			strings.HasPrefix(t, "purchase:") ||
-			strings.HasPrefix(t, "rental:") ||
-			(protectedWithTimeMap[t] && stream.Claim.Value.GetStream().ReleaseTime > time.Now().Unix()) {
-			th := ctx.Request.Header.Get(edgeTokenHeader)
-			if th == "" {
-				return ErrEdgeCredentialsMissing
-			}
-			if p.options.edgeToken == "" {
-				return ErrEdgeAuthenticationMisconfigured
-			}
-			if strings.TrimPrefix(th, edgeTokenPrefix) != p.options.edgeToken {
-				return ErrEdgeAuthenticationFailed
+	if scopes := protectedScopes(stream); len(scopes) > 0 {
+		th := ctx.Request.Header.Get(edgeTokenHeader)
+		if th == "" && slices.Contains(scopes, edgetoken.ScopeScheduled) {
+			return p.verifyScheduled(stream, ctx)
+		}
+		if th == "" && p.options.entitlements && paidOnly(scopes) {
+			if terms, ok := paid.ParseTerms(stream.Claim.Value.Tags); ok {
+				return p.verifyEntitlement(stream, terms, ctx)
 			}
-			return nil
 		}
+		if th == "" {
+			return ErrEdgeCredentialsMissing
+		}
+		if p.options.edgeTokens == nil {
+			return ErrEdgeAuthenticationMisconfigured
+		}
+		_, err := p.options.edgeTokens.Verify(strings.TrimPrefix(th, edgeTokenPrefix), scopes...)
+		if errors.Is(err, edgetoken.ErrNoTokens) {
+			return ErrEdgeAuthenticationMisconfigured
+		} else if err != nil {
+			return fmt.Errorf("%w: %v", ErrEdgeAuthenticationFailed, err)
+		}
+		return nil
 	}
 
 	token := ctx.Param("token")
@@ -257,12 +437,115 @@ func (p *Player) VerifyAccess(stream *Stream, ctx *gin.Context) error {
 	if token == "" {
 		return ErrPaidStream
 	}
-	if err := paid.VerifyStreamAccess(strings.Replace(stream.URI(), "#", "/", 1), token); err != nil {
+	client := paid.Client{IP: ctx.ClientIP(), SessionID: ctx.Query(paramSession)}
+	if err := paid.VerifyStreamAccess(strings.Replace(stream.URI(), "#", "/", 1), token, client); err != nil {
+		return err
+	}
+	return nil
+}
+
+// VerifyRegion checks if the stream can be played from the client's country.
+func (p *Player) VerifyRegion(stream *Stream, ip string) error {
+	if p.options.geo == nil {
+		return nil
+	}
+	c := geo.Content{ClaimID: stream.ClaimID, Tags: stream.Claim.Value.Tags}
+	if stream.Claim.SigningChannel != nil {
+		c.ChannelID = stream.Claim.SigningChannel.ClaimID
+	}
+	restricted, err := p.verifyContentRegion(c, ip)
+	if restricted {
+		stream.geoRestricted = true
+	}
+	return err
+}
+
+// verifyContentRegion checks if content can be served in the region of ip, reporting whether it is restricted at all.
+func (p *Player) verifyContentRegion(c geo.Content, ip string) (bool, error) {
+	if p.options.geo == nil || !p.options.geo.Restricted(c) {
+		return false, nil
+	}
+	return true, p.options.geo.Check(c, ip)
+}
+
+// verifyEntitlement checks the entitlement token supplied either as the paid token path parameter or a query parameter.
+func (p *Player) verifyEntitlement(stream *Stream, terms paid.Terms, ctx *gin.Context) error {
+	token := ctx.Param("token")
+	if token == "" {
+		token = ctx.Query(paramEntitlement)
+	}
+	err := paid.VerifyEntitlement(stream.ClaimID, terms, token)
+	if err != nil {
+		return err
+	}
+	Logger.WithField("uri", stream.URI()).Infof("%v entitlement verified", terms.Kind)
+	return nil
+}
+
+// verifyScheduled admits requests for unreleased streams only if they carry a creator preview token.
+func (p *Player) verifyScheduled(stream *Stream, ctx *gin.Context) error {
+	token := ctx.Query(paramEntitlement)
+	if token == "" {
+		return &ScheduledReleaseError{ReleaseTime: time.Unix(stream.Claim.Value.GetStream().ReleaseTime, 0)}
+	}
+	// Previews stand in for the entitlement of paid streams only, content restricted to members
+	// or unlisted still requires an edge token.
+	if !paidOnly(contentScopes(stream)) {
+		return ErrEdgeCredentialsMissing
+	}
+	if err := paid.VerifyPreview(stream.ClaimID, token); err != nil {
 		return err
 	}
+	Logger.WithField("uri", stream.URI()).Info("preview token verified")
 	return nil
 }
 
+// protectedScopes returns the edge token scopes required for the stream, none if the stream is not protected.
+// Scheduled streams are only protected until their release time, which is checked on every request
+// so cached claims become available as soon as they are released.
+func protectedScopes(stream *Stream) []edgetoken.Scope {
+	scopes := contentScopes(stream)
+	for _, t := range stream.Claim.Value.Tags {
+		if (t == "c:scheduled:show" || t == "c:scheduled:hide") && stream.Claim.Value.GetStream().ReleaseTime > time.Now().Unix() {
+			return append([]edgetoken.Scope{edgetoken.ScopeScheduled}, scopes...)
+		}
+	}
+	return scopes
+}
+
+// contentScopes returns all edge token scopes the stream is restricted to regardless of its release time.
+func contentScopes(stream *Stream) []edgetoken.Scope {
+	var scopes []edgetoken.Scope
+	add := func(s edgetoken.Scope) {
+		if !slices.Contains(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	for _, t := range stream.Claim.Value.Tags {
+		switch {
+		case t == "c:members-only":
+			add(edgetoken.ScopeMembersOnly)
+		case t == "c:rental" || strings.HasPrefix(t, "rental:") || strings.HasPrefix(t, "c:rental:"):
+			add(edgetoken.ScopeRental)
+		case t == "c:purchase" || strings.HasPrefix(t, "purchase:") || strings.HasPrefix(t, "c:purchase:"):
+			add(edgetoken.ScopePurchase)
+		case t == "c:unlisted":
+			add(edgetoken.ScopeUnlisted)
+		}
+	}
+	return scopes
+}
+
+// paidOnly checks if scopes restrict content to paying viewers only, which entitlements and previews stand in for.
+func paidOnly(scopes []edgetoken.Scope) bool {
+	for _, s := range scopes {
+		if s != edgetoken.ScopeRental && s != edgetoken.ScopePurchase {
+			return false
+		}
+	}
+	return true
+}
+
 func rev(b []byte) []byte {
 	r := make([]byte, len(b))
 	for left, right := 0, len(b)-1; left < right; left, right = left+1, right-1 {
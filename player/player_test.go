@@ -10,9 +10,18 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/mmdbtest"
+	"github.com/OdyseeTeam/player-server/pkg/audit"
+	"github.com/OdyseeTeam/player-server/pkg/edgetoken"
+	"github.com/OdyseeTeam/player-server/pkg/geo"
+	"github.com/OdyseeTeam/player-server/pkg/paid"
+	"github.com/OdyseeTeam/player-server/pkg/quota"
 
 	ljsonrpc "github.com/lbryio/lbry.go/v2/extras/jsonrpc"
 	"github.com/lbryio/reflector.go/store"
+	pb "github.com/lbryio/types/v2/go"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -304,3 +313,239 @@ func TestVerifyAccess(t *testing.T) {
 		})
 	}
 }
+
+func TestVerifyAccessScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tokens, err := edgetoken.NewSet(
+		edgetoken.Token{Name: "members", Secret: "members-secret-0001", Scopes: []edgetoken.Scope{edgetoken.ScopeMembersOnly}},
+		edgetoken.Token{Name: "unlisted", Secret: "unlisted-secret-001", Scopes: []edgetoken.Scope{edgetoken.ScopeUnlisted}},
+		edgetoken.Token{Name: "scheduled", Secret: "scheduled-secret-01", Scopes: []edgetoken.Scope{edgetoken.ScopeScheduled}},
+		edgetoken.Token{Name: "both", Secret: "both-secret-0000001", Scopes: []edgetoken.Scope{edgetoken.ScopeMembersOnly, edgetoken.ScopeUnlisted}},
+	)
+	require.NoError(t, err)
+	p := &Player{options: PlayerOptions{edgeTokens: tokens}}
+	newStream := func(releaseTime time.Time, tags ...string) *Stream {
+		return NewStream(p, &ljsonrpc.Claim{
+			ClaimID: "81b1749f773bad5b9b53d21508051560f2746cdc",
+			Name:    "restricted",
+			Value: pb.Claim{
+				Tags: tags,
+				Type: &pb.Claim_Stream{Stream: &pb.Stream{
+					ReleaseTime: releaseTime.Unix(),
+					Source:      &pb.Source{SdHash: []byte{1, 2, 3}},
+				}},
+			},
+		})
+	}
+	verify := func(s *Stream, secret string) error {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request, _ = http.NewRequest(http.MethodGet, "/v6/streams/x/y.mp4", nil)
+		ctx.Request.Header.Set(edgeTokenHeader, edgeTokenPrefix+secret)
+		return p.VerifyAccess(s, ctx)
+	}
+
+	// Tokens have to grant every scope content is restricted to, whatever the order of tags.
+	released := time.Now().Add(-time.Hour)
+	for _, tags := range [][]string{{"c:unlisted", "c:members-only"}, {"c:members-only", "c:unlisted"}} {
+		s := newStream(released, tags...)
+		assert.ErrorIs(t, verify(s, "members-secret-0001"), ErrEdgeAuthenticationFailed, tags)
+		assert.ErrorIs(t, verify(s, "unlisted-secret-001"), ErrEdgeAuthenticationFailed, tags)
+		assert.NoError(t, verify(s, "both-secret-0000001"), tags)
+	}
+
+	unreleased := newStream(time.Now().Add(time.Hour), "c:scheduled:hide", "c:members-only")
+	assert.ErrorIs(t, verify(unreleased, "scheduled-secret-01"), ErrEdgeAuthenticationFailed)
+	assert.ErrorIs(t, verify(unreleased, "members-secret-0001"), ErrEdgeAuthenticationFailed)
+	assert.NoError(t, verify(newStream(released, "c:scheduled:hide", "c:members-only"), "members-secret-0001"))
+}
+
+func TestVerifyAccessScheduled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	require.NoError(t, paid.GeneratePrivateKey())
+
+	p := &Player{}
+	newScheduled := func(releaseTime time.Time) *Stream {
+		return NewStream(p, &ljsonrpc.Claim{
+			ClaimID: "81b1749f773bad5b9b53d21508051560f2746cdc",
+			Name:    "scheduled",
+			Value: pb.Claim{
+				Tags: []string{"c:scheduled:show"},
+				Type: &pb.Claim_Stream{Stream: &pb.Stream{
+					ReleaseTime: releaseTime.Unix(),
+					Source:      &pb.Source{SdHash: []byte{1, 2, 3}},
+				}},
+			},
+		})
+	}
+	newContext := func(query string) *gin.Context {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request, _ = http.NewRequest(http.MethodGet, "/v6/streams/x/y.mp4"+query, nil)
+		return ctx
+	}
+
+	release := time.Now().Add(time.Hour)
+	s := newScheduled(release)
+	err := p.VerifyAccess(s, newContext(""))
+	require.ErrorIs(t, err, ErrScheduledRelease)
+	var scheduled *ScheduledReleaseError
+	require.ErrorAs(t, err, &scheduled)
+	assert.Equal(t, release.Unix(), scheduled.ReleaseTime.Unix())
+	assert.InDelta(t, 3600, scheduled.RetryAfter(), 2)
+
+	ctx := newContext("")
+	processStreamError("access", ctx, s.URI(), err)
+	assert.Equal(t, http.StatusTooEarly, ctx.Writer.Status())
+	assert.NotEmpty(t, ctx.Writer.Header().Get("Retry-After"))
+	_, denied := ctx.Get(ctxDenial)
+	assert.False(t, denied, "waiting for a release is not a denial")
+
+	preview, err := paid.CreateEntitlementToken("preview-1", s.ClaimID, paid.KindPreview, time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
+	assert.NoError(t, p.VerifyAccess(s, newContext("?entitlement="+preview)))
+
+	purchase, err := paid.CreateEntitlementToken("purchase-1", s.ClaimID, paid.KindPurchase, time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
+	assert.ErrorIs(t, p.VerifyAccess(s, newContext("?entitlement="+purchase)), paid.ErrEntitlementMismatch)
+
+	assert.NoError(t, p.VerifyAccess(newScheduled(time.Now().Add(-time.Second)), newContext("")))
+
+	// Previews don't open content restricted to members or unlisted.
+	for _, tag := range []string{"c:members-only", "c:unlisted"} {
+		s := newScheduled(release)
+		s.Claim.Value.Tags = append(s.Claim.Value.Tags, tag)
+		assert.ErrorIs(t, p.VerifyAccess(s, newContext("?entitlement="+preview)), ErrEdgeCredentialsMissing, tag)
+	}
+	s = newScheduled(release)
+	s.Claim.Value.Tags = append(s.Claim.Value.Tags, "c:rental")
+	assert.NoError(t, p.VerifyAccess(s, newContext("?entitlement="+preview)))
+}
+
+func TestVerifyRegion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dbPath := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	require.NoError(t, mmdbtest.Write(dbPath, "GeoLite2-Country", map[string]map[string]any{
+		"203.0.113.0/24":  {"country": map[string]any{"iso_code": "US"}},
+		"198.51.100.0/24": {"country": map[string]any{"iso_code": "DE"}},
+	}))
+	r, err := geo.NewRestrictor(dbPath, "")
+	require.NoError(t, err)
+	defer r.Shutdown()
+
+	p := &Player{}
+	WithGeoRestrictor(r)(&p.options)
+	newStream := func(tags ...string) *Stream {
+		return NewStream(p, &ljsonrpc.Claim{
+			ClaimID: "81b1749f773bad5b9b53d21508051560f2746cdc",
+			Name:    "geo",
+			Value: pb.Claim{
+				Tags: tags,
+				Type: &pb.Claim_Stream{Stream: &pb.Stream{Source: &pb.Source{SdHash: []byte{1, 2, 3}}}},
+			},
+		})
+	}
+
+	s := newStream("geo:allow:us")
+	assert.NoError(t, p.VerifyRegion(s, "203.0.113.1"))
+	assert.True(t, s.geoRestricted)
+
+	err = p.VerifyRegion(s, "198.51.100.1")
+	require.ErrorIs(t, err, geo.ErrRestricted)
+	rec := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(rec)
+	ctx.Request, _ = http.NewRequest(http.MethodGet, "/v6/streams/x/y.mp4", nil)
+	processStreamError("geo", ctx, s.URI(), err)
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, rec.Code)
+	assert.Contains(t, rec.Body.String(), "restricted by the publisher")
+
+	s = newStream("gaming")
+	assert.NoError(t, p.VerifyRegion(s, "198.51.100.1"))
+	assert.False(t, s.geoRestricted)
+}
+
+func TestDownloadQuota(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	q, err := quota.New(quota.Opts{})
+	require.NoError(t, err)
+	p := &Player{}
+	WithDownloadQuota(q)(&p.options)
+	s := NewStream(p, &ljsonrpc.Claim{
+		ClaimID: "81b1749f773bad5b9b53d21508051560f2746cdc",
+		Name:    "quota",
+		Value: pb.Claim{
+			Tags: []string{"download:disabled"},
+			Type: &pb.Claim_Stream{Stream: &pb.Stream{Source: &pb.Source{SdHash: []byte{1, 2, 3}}}},
+		},
+		SigningChannel: &ljsonrpc.Claim{ClaimID: "b1e1a3f9d1e4c2a5b6c7d8e9f0a1b2c3d4e5f6a7"},
+	})
+
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request, _ = http.NewRequest(http.MethodGet, "/v6/streams/x/y.mp4?download=true&auth_token=abc", nil)
+	ctx.Request.Header.Set("Range", "bytes=0-")
+	d := newDownload(ctx, "192.0.2.1", s)
+	assert.Equal(t, "abc", d.Account)
+	assert.Equal(t, "b1e1a3f9d1e4c2a5b6c7d8e9f0a1b2c3d4e5f6a7", d.ChannelID)
+
+	ctx.Request.Header.Set("Range", "bytes=1000-")
+	ctx.Request.Header.Set(authTokenHeader, "def")
+	d = newDownload(ctx, "192.0.2.1", s)
+	assert.Equal(t, "def", d.Account)
+
+	err = q.Admit(*d)
+	rec := httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(rec)
+	ctx.Request, _ = http.NewRequest(http.MethodGet, "/v6/streams/x/y.mp4?download=true", nil)
+	processStreamError("quota", ctx, s.URI(), err)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(rec)
+	ctx.Request, _ = http.NewRequest(http.MethodGet, "/v6/streams/x/y.mp4?download=true", nil)
+	processStreamError("quota", ctx, s.URI(), &quota.ExceededError{Scope: quota.ScopeIP, Limit: "files", Reset: time.Now().Add(time.Hour)})
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+}
+
+func TestAuditDenial(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := audit.NewFileSink(path, 0, 0)
+	require.NoError(t, err)
+	audit.Default = audit.New(audit.Opts{}, sink)
+	defer func() { audit.Default = nil }()
+
+	s := NewStream(&Player{}, &ljsonrpc.Claim{
+		ClaimID: "81b1749f773bad5b9b53d21508051560f2746cdc",
+		Name:    "audited",
+		Value: pb.Claim{
+			Type: &pb.Claim_Stream{Stream: &pb.Stream{Source: &pb.Source{SdHash: []byte{1, 2, 3}}}},
+		},
+		SigningChannel: &ljsonrpc.Claim{ClaimID: "b1e1a3f9d1e4c2a5b6c7d8e9f0a1b2c3d4e5f6a7", Name: "@channel"},
+	})
+
+	// Not found is not a denial.
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request, _ = http.NewRequest(http.MethodGet, "/v6/streams/x/y.mp4", nil)
+	processStreamError("resolve", ctx, "x", ErrClaimNotFound)
+	auditDenial(ctx, "192.0.2.1")
+
+	ctx, _ = gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request, _ = http.NewRequest(http.MethodGet, "/v6/streams/x/y.mp4", nil)
+	ctx.Request.Header.Set("Referer", "https://example.com/")
+	ctx.Set(ctxStream, s)
+	processStreamError("geo", ctx, s.URI(), geo.ErrRestricted)
+	auditDenial(ctx, "192.0.2.1")
+
+	audit.Default.Shutdown()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var e audit.Event
+	require.NoError(t, json.Unmarshal(b, &e))
+	assert.Equal(t, "192.0.2.1", e.IP)
+	assert.Equal(t, "geo", e.Reason)
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, e.Status)
+	assert.Equal(t, "81b1749f773bad5b9b53d21508051560f2746cdc", e.ClaimID)
+	assert.Equal(t, "audited", e.ClaimName)
+	assert.Equal(t, "@channel", e.Channel)
+	assert.Equal(t, "https://example.com/", e.Referrer)
+	assert.Equal(t, "/v6/streams/x/y.mp4", e.Path)
+}
@@ -0,0 +1,123 @@
+package player
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OdyseeTeam/player-server/internal/metrics"
+)
+
+// States of the transcoder cache restore.
+const (
+	RestoreNone      = "none"
+	RestoreRunning   = "restoring"
+	RestoreCompleted = "restored"
+	RestoreFailed    = "failed"
+)
+
+// restoreProgressInterval is how often restore progress metrics are updated.
+var restoreProgressInterval = time.Second
+
+// RestoreStatus describes the transcoder cache restore.
+type RestoreStatus struct {
+	State      string     `json:"state"`
+	Items      int64      `json:"items"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+type cacheRestore struct {
+	mu     sync.Mutex
+	status RestoreStatus
+}
+
+// RestoreTranscoderCache indexes renditions already on disk in the background. Until it's done new viewers
+// get original streams instead of being redirected to renditions, which would mostly be retrieved from
+// the remote server again. Fragments are still served, retrieved from the remote server if not indexed yet.
+// progress, if set, returns the number of items restored so far. Calls made while a restore is running are ignored.
+func (p *Player) RestoreTranscoderCache(progress func() int64) {
+	now := time.Now()
+	r := &p.restore
+	r.mu.Lock()
+	if r.status.State == RestoreRunning {
+		r.mu.Unlock()
+		Logger.Warn("transcoder cache restore is already running")
+		return
+	}
+	r.status = RestoreStatus{State: RestoreRunning, StartedAt: &now}
+	done := make(chan struct{})
+	r.mu.Unlock()
+	metrics.TcRestoreRunning.Set(1)
+
+	go func() {
+		if progress == nil {
+			return
+		}
+		t := time.NewTicker(restoreProgressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				n := progress()
+				r.mu.Lock()
+				if r.status.State == RestoreRunning {
+					r.status.Items = n
+					metrics.TcRestoreItems.Set(float64(n))
+					metrics.TcRestoreSeconds.Set(time.Since(now).Seconds())
+				}
+				r.mu.Unlock()
+			}
+		}
+	}()
+
+	go func() {
+		n, err := p.tclient.RestoreCache()
+		finished := time.Now()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.status.FinishedAt = &finished
+		if err != nil {
+			Logger.Errorf("failed to restore transcoder cache: %v", err)
+			r.status.State = RestoreFailed
+			r.status.Error = err.Error()
+		} else {
+			Logger.Infof("restored %v items into transcoder cache in %v", n, finished.Sub(now))
+			r.status.State = RestoreCompleted
+			r.status.Items = n
+			metrics.TcRestoreItems.Set(float64(n))
+		}
+		metrics.TcRestoreRunning.Set(0)
+		metrics.TcRestoreSeconds.Set(finished.Sub(now).Seconds())
+		close(done)
+	}()
+}
+
+// TranscoderCacheRestore returns the state of the transcoder cache restore.
+func (p *Player) TranscoderCacheRestore() RestoreStatus {
+	p.restore.mu.Lock()
+	defer p.restore.mu.Unlock()
+	s := p.restore.status
+	if s.State == "" {
+		s.State = RestoreNone
+	}
+	return s
+}
+
+// restoringTranscoderCache checks if the transcoder cache restore is still running.
+func (p *Player) restoringTranscoderCache() bool {
+	return p.TranscoderCacheRestore().State == RestoreRunning
+}
+
+// CheckTranscoderCache is a readiness check failing while the transcoder cache restore is running.
+func (p *Player) CheckTranscoderCache(ctx context.Context) error {
+	s := p.TranscoderCacheRestore()
+	if s.State == RestoreRunning {
+		return fmt.Errorf("restoring transcoder cache, %v items restored so far", s.Items)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package player
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreTranscoderCache(t *testing.T) {
+	restoreProgressInterval = time.Millisecond
+	e := newHLSEnv(t)
+	e.tc.RestoreGate = make(chan struct{})
+	start := fmt.Sprintf("/v6/streams/%v/%v.mp4", hlsClaimID, hlsSdHash[:6])
+
+	assert.Equal(t, RestoreNone, e.player.TranscoderCacheRestore().State)
+	assert.NoError(t, e.player.CheckTranscoderCache(context.Background()))
+
+	e.player.RestoreTranscoderCache(func() int64 { return 2 })
+	require.Eventually(t, func() bool {
+		return e.player.TranscoderCacheRestore().Items == 2
+	}, time.Second, time.Millisecond)
+	s := e.player.TranscoderCacheRestore()
+	assert.Equal(t, RestoreRunning, s.State)
+	assert.NotNil(t, s.StartedAt)
+	assert.EqualError(t, e.player.CheckTranscoderCache(context.Background()), "restoring transcoder cache, 2 items restored so far")
+
+	// A restore already running is not started again.
+	e.player.RestoreTranscoderCache(func() int64 { return 5 })
+	assert.Equal(t, s.StartedAt, e.player.TranscoderCacheRestore().StartedAt)
+
+	// Renditions are not offered while restoring, fragments are still served.
+	stream, err := e.player.ResolveStream(hlsClaimID)
+	require.NoError(t, err)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodHead, start, nil)
+	assert.False(t, NewRequestHandler(e.player).serveNegotiated(c, stream, []string{formatHLS, formatMP4}, "192.0.2.1", false))
+	// Clients asking for HLS only get the original stream rather than a 406.
+	assert.False(t, NewRequestHandler(e.player).serveNegotiated(c, stream, []string{formatHLS}, "192.0.2.1", false))
+	assert.NotEqual(t, http.StatusNotAcceptable, c.Writer.Status())
+	rec := e.request(t, http.MethodGet, fmt.Sprintf("/v6/streams/%v/%v/v0_s000000.ts", hlsClaimID, hlsSdHash))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	close(e.tc.RestoreGate)
+	require.Eventually(t, func() bool {
+		return e.player.TranscoderCacheRestore().State == RestoreCompleted
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, e.player.CheckTranscoderCache(context.Background()))
+	s = e.player.TranscoderCacheRestore()
+	n, _ := e.tc.RestoreCache()
+	assert.Equal(t, n, s.Items)
+	assert.NotNil(t, s.FinishedAt)
+
+	rec = e.request(t, http.MethodHead, start)
+	assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+}
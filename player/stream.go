@@ -32,6 +32,8 @@ type Stream struct {
 	resolvedStream *pb.Stream
 	sdBlob         *stream.SDBlob
 	seekOffset     int64
+	// geoRestricted streams must not be cached by shared caches as access depends on client location.
+	geoRestricted bool
 
 	currentChunkHash string
 	currentChunk     *ReadableChunk